@@ -0,0 +1,377 @@
+// Package eval measures how well each hash type tells the transformed copies of an image from
+// unrelated images, so that the hamming threshold of each type can be chosen from evidence.
+package eval
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"math/bits"
+	"sort"
+	"testing/fstest"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+)
+
+// Images are the names of the image files of FS.
+type Images struct {
+	FS    fs.FS
+	Names []string
+}
+
+// Evaluation hashes reference images and their transformed copies, which should match them,
+// and negative images with their transformed copies, which should not.
+type Evaluation struct {
+	HashTypes  []hash.Type
+	Transforms []Transform
+	// Fraction is the minimum fraction of matching segments of the segment hash, as given by
+	// --segment-fraction.
+	Fraction float64
+	// HashSize is the side of the grid of bits of DHashExt and PHashExt, as given by
+	// --hash-size, or hash.DefaultExtHashSize if 0.
+	HashSize int
+	// OnImage, if set, is called after each image is hashed, with the error that made it be
+	// left out of the evaluation.
+	OnImage func(name string, err error)
+}
+
+// Result holds the distances of a hash type between each reference and its transformed copies,
+// by transform, and between each reference and every negative image and copy. A distance of -1
+// means that an image has no hash of the type, such as a PDQ of low quality.
+type Result struct {
+	HashType hash.Type
+	// Bits is the size of the hash, the greatest distance.
+	Bits      int
+	Positives map[string][]int
+	Negatives []int
+}
+
+// sample holds the hashes of an image and of its transformed copies.
+type sample struct {
+	original *media.Media
+	copies   []*media.Media
+}
+
+// Run evaluates every hash type of the references against their copies and the negatives.
+func (e *Evaluation) Run(references, negatives Images) ([]*Result, error) {
+	refs := e.hashImages(references)
+	if len(refs) == 0 {
+		return nil, errors.New("no reference image could be hashed")
+	}
+	negs := e.hashImages(negatives)
+	if len(negs) == 0 {
+		return nil, errors.New("no negative image could be hashed")
+	}
+
+	var results []*Result
+	for _, hashType := range e.HashTypes {
+		if !hashType.IsPerceptual() {
+			continue
+		}
+
+		r := &Result{HashType: hashType, Bits: hashBits(hashType, e.hashSize()), Positives: make(map[string][]int)}
+		for _, ref := range refs {
+			for i, t := range e.Transforms {
+				d := Distance(hashType, ref.original, ref.copies[i], e.Fraction)
+				r.Positives[t.Name] = append(r.Positives[t.Name], d)
+			}
+			for _, neg := range negs {
+				r.Negatives = append(r.Negatives, Distance(hashType, ref.original, neg.original, e.Fraction))
+				for _, c := range neg.copies {
+					r.Negatives = append(r.Negatives, Distance(hashType, ref.original, c, e.Fraction))
+				}
+			}
+		}
+		results = append(results, r)
+	}
+
+	return results, nil
+}
+
+// hashImages hashes the images and their transformed copies, leaving out the files that are not
+// images.
+func (e *Evaluation) hashImages(images Images) []*sample {
+	var samples []*sample
+	for _, name := range images.Names {
+		s, err := e.hashImage(images.FS, name)
+		if e.OnImage != nil {
+			e.OnImage(name, err)
+		}
+		if err == nil {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+func (e *Evaluation) hashImage(fsys fs.FS, name string) (*sample, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Eval::hashImage(%s) | Error: %v", name, err)
+	}
+
+	// the EXIF orientation is ignored, as the copies are made of the image as stored.
+	original, err := e.hashData(name, data)
+	if err != nil {
+		return nil, err
+	}
+	s := &sample{original: original}
+
+	for _, t := range e.Transforms {
+		timg, err := t.Apply(img)
+		if err != nil {
+			return nil, fmt.Errorf("Eval::hashImage(%s) | Error: %s: %v", name, t.Name, err)
+		}
+
+		var buf bytes.Buffer
+		enc := png.Encoder{CompressionLevel: png.BestSpeed}
+		if err = enc.Encode(&buf, timg); err != nil {
+			return nil, fmt.Errorf("Eval::hashImage(%s) | Error: %s: %v", name, t.Name, err)
+		}
+
+		c, err := e.hashData(name+"."+t.Name+".png", buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		s.copies = append(s.copies, c)
+	}
+
+	return s, nil
+}
+
+// hashData computes the hashes of the image as the search does.
+func (e *Evaluation) hashData(name string, data []byte) (*media.Media, error) {
+	fsys := fstest.MapFS{name: &fstest.MapFile{Data: data}}
+	m, err := media.NewMedia(fsys, name, e.HashTypes, media.WithOrientation(false), media.WithHashSize(e.hashSize()))
+	if err != nil {
+		return nil, err
+	}
+	if m.Type() != "image" {
+		return nil, fmt.Errorf("Eval::hashData(%s) | Error: not an image", name)
+	}
+	return m, nil
+}
+
+// Distance returns the hamming distance of the hashes of the type of two media, or -1 if either
+// has none. The distance of the segment hashes is the least hamming distance of their segments
+// at which the fraction of the segments match, which is the threshold that a search needs to
+// find one from the other.
+func Distance(hashType hash.Type, l, r *media.Media, fraction float64) int {
+	switch {
+	case hashType == hash.SegmentHash:
+		lh, rh := l.SegmentHash(), r.SegmentHash()
+		if len(lh) == 0 || len(rh) == 0 {
+			return -1
+		}
+		n := len(lh)
+		if len(rh) < n {
+			n = len(rh)
+		}
+		for d := 0; d <= 64; d++ {
+			if matched, _ := hash.SegmentMatches(lh, rh, d); float64(matched) >= fraction*float64(n) {
+				return d
+			}
+		}
+		return 64
+	case hashType.IsExtended():
+		lh, rh := l.ExtHash(hashType), r.ExtHash(hashType)
+		if len(lh) == 0 || len(rh) == 0 {
+			return -1
+		}
+		d, err := hash.ExtDistance(lh, rh)
+		if err != nil {
+			return -1
+		}
+		return d
+	default:
+		if !l.Has(hashType) || !r.Has(hashType) {
+			return -1
+		}
+		return bits.OnesCount64(l.PerceptualHash(hashType) ^ r.PerceptualHash(hashType))
+	}
+}
+
+func (e *Evaluation) hashSize() int {
+	if e.HashSize == 0 {
+		return hash.DefaultExtHashSize
+	}
+	return e.HashSize
+}
+
+// hashBits returns the number of bits of the perceptual hash type, whose extended hashes have
+// a grid of the side size.
+func hashBits(hashType hash.Type, size int) int {
+	if hashType.IsExtended() && hashType != hash.SegmentHash {
+		return 64 * hashType.Words(size)
+	}
+	return 64
+}
+
+// Point is the confusion matrix of a hash type at a threshold. The copies of a reference within
+// the threshold are true positives, the negatives within the threshold false positives, and
+// the pairs with an image without a hash are never within the threshold.
+type Point struct {
+	Threshold      int
+	TP, FP, FN, TN int
+}
+
+// Precision returns the fraction of the pairs within the threshold that are copies, which is 1
+// when there is none.
+func (p Point) Precision() float64 {
+	if p.TP+p.FP == 0 {
+		return 1
+	}
+	return float64(p.TP) / float64(p.TP+p.FP)
+}
+
+// Recall returns the fraction of the copies within the threshold, the true positive rate.
+func (p Point) Recall() float64 {
+	if p.TP+p.FN == 0 {
+		return 0
+	}
+	return float64(p.TP) / float64(p.TP+p.FN)
+}
+
+// FPR returns the fraction of the negatives within the threshold, the false positive rate.
+func (p Point) FPR() float64 {
+	if p.FP+p.TN == 0 {
+		return 0
+	}
+	return float64(p.FP) / float64(p.FP+p.TN)
+}
+
+// F1 returns the harmonic mean of the precision and the recall.
+func (p Point) F1() float64 {
+	if p.TP == 0 {
+		return 0
+	}
+	return 2 * float64(p.TP) / float64(2*p.TP+p.FP+p.FN)
+}
+
+// Histogram returns the number of distances of each value from 0 to bits and the number of
+// missing distances.
+func Histogram(distances []int, bits int) ([]int, int) {
+	hist := make([]int, bits+1)
+	missing := 0
+	for _, d := range distances {
+		if d < 0 || d > bits {
+			missing++
+			continue
+		}
+		hist[d]++
+	}
+	return hist, missing
+}
+
+// positives returns the distances of the copies of every transform.
+func (r *Result) positives() []int {
+	var all []int
+	for _, distances := range r.Positives {
+		all = append(all, distances...)
+	}
+	return all
+}
+
+// ROC returns the points of every threshold from 0 to the bits of the hash.
+func (r *Result) ROC() []Point {
+	positives := r.positives()
+	pos, _ := Histogram(positives, r.Bits)
+	neg, _ := Histogram(r.Negatives, r.Bits)
+	totalPos := len(positives)
+	totalNeg := len(r.Negatives)
+
+	points := make([]Point, 0, r.Bits+1)
+	tp, fp := 0, 0
+	for d := 0; d <= r.Bits; d++ {
+		tp += pos[d]
+		fp += neg[d]
+		points = append(points, Point{
+			Threshold: d,
+			TP:        tp,
+			FP:        fp,
+			FN:        totalPos - tp,
+			TN:        totalNeg - fp,
+		})
+	}
+	return points
+}
+
+// Recall returns the fraction of the copies of the transform within the threshold.
+func (r *Result) Recall(transform string, threshold int) float64 {
+	distances := r.Positives[transform]
+	if len(distances) == 0 {
+		return 0
+	}
+	n := 0
+	for _, d := range distances {
+		if d >= 0 && d <= threshold {
+			n++
+		}
+	}
+	return float64(n) / float64(len(distances))
+}
+
+// Best returns the point of the highest F1, the lowest threshold on a tie.
+func Best(points []Point) Point {
+	var best Point
+	for i, p := range points {
+		if i == 0 || p.F1() > best.F1() {
+			best = p
+		}
+	}
+	return best
+}
+
+// AUC returns the area under the ROC curve of the points, from (0, 0) to (1, 1).
+func AUC(points []Point) float64 {
+	area := 0.0
+	x, y := 0.0, 0.0
+	for _, p := range points {
+		area += (p.FPR() - x) * (p.Recall() + y) / 2
+		x, y = p.FPR(), p.Recall()
+	}
+	return area + (1-x)*(1+y)/2
+}
+
+// Summary describes a distribution of distances.
+type Summary struct {
+	N, Missing            int
+	Min, Median, P95, Max int
+	Mean                  float64
+}
+
+// Summarize returns the summary of the distances, leaving out the missing ones.
+func Summarize(distances []int) Summary {
+	var s Summary
+	var valid []int
+	for _, d := range distances {
+		if d < 0 {
+			s.Missing++
+			continue
+		}
+		valid = append(valid, d)
+	}
+	s.N = len(valid)
+	if s.N == 0 {
+		return s
+	}
+
+	sort.Ints(valid)
+	total := 0
+	for _, d := range valid {
+		total += d
+	}
+	s.Min, s.Max = valid[0], valid[s.N-1]
+	s.Median = valid[s.N/2]
+	s.P95 = valid[(s.N*95+99)/100-1]
+	s.Mean = float64(total) / float64(s.N)
+	return s
+}
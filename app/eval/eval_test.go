@@ -0,0 +1,158 @@
+package eval
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math"
+	"testing"
+	"testing/fstest"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+	"github.com/tsmweb/chasam/internal/testimage"
+)
+
+func TestTransforms(t *testing.T) {
+	img := testimage.Waves(160, 120, 1)
+	sizes := map[string]image.Point{
+		"jpeg-50":       {160, 120},
+		"resize-50":     {80, 60},
+		"crop-10":       {128, 96},
+		"border-10":     {192, 144},
+		"brightness-40": {160, 120},
+		"rotate-5":      {160, 120},
+		"watermark":     {160, 120},
+	}
+
+	for _, tr := range Transforms() {
+		out, err := tr.Apply(img)
+		if err != nil {
+			t.Fatalf("%s: %v", tr.Name, err)
+		}
+		if got := out.Bounds().Size(); got != sizes[tr.Name] {
+			t.Errorf("%s: got size %v, want %v", tr.Name, got, sizes[tr.Name])
+		}
+	}
+
+	transforms, err := ParseTransforms("jpeg, rotate-5,watermark")
+	if err != nil || len(transforms) != 3 || transforms[0].Name != "jpeg-50" || transforms[1].Name != "rotate-5" {
+		t.Errorf("got %v (%v)", transforms, err)
+	}
+	if _, err = ParseTransforms("blur"); err == nil {
+		t.Error("expected an error for an unknown transform")
+	}
+}
+
+func TestROC(t *testing.T) {
+	r := &Result{
+		HashType:  hash.DHash,
+		Bits:      64,
+		Positives: map[string][]int{"jpeg-50": {0, 1, 2}, "crop-10": {5, -1}},
+		Negatives: []int{3, 10, 20, 30, -1},
+	}
+
+	points := r.ROC()
+	if len(points) != 65 {
+		t.Fatalf("got %d points", len(points))
+	}
+	p := points[5]
+	if p.TP != 4 || p.FN != 1 || p.FP != 1 || p.TN != 4 {
+		t.Errorf("got %+v at the threshold 5", p)
+	}
+	if p.Precision() != 0.8 || p.Recall() != 0.8 || p.FPR() != 0.2 || p.F1() != 0.8 {
+		t.Errorf("got precision %f, recall %f, fpr %f, f1 %f", p.Precision(), p.Recall(), p.FPR(), p.F1())
+	}
+	if best := Best(points); best.Threshold != 5 {
+		t.Errorf("got the best threshold %d, want 5", best.Threshold)
+	}
+	if got := r.Recall("crop-10", 5); got != 0.5 {
+		t.Errorf("got recall %f for crop-10, want 0.5", got)
+	}
+
+	// the pairs without a hash are reached only at the end of the curve, at (1, 1).
+	if auc := AUC(points); math.Abs(auc-0.78) > 1e-9 {
+		t.Errorf("got AUC %f, want 0.78", auc)
+	}
+
+	s := Summarize(r.Negatives)
+	if s.N != 4 || s.Missing != 1 || s.Min != 3 || s.Median != 20 || s.P95 != 30 || s.Max != 30 || s.Mean != 15.75 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestRun(t *testing.T) {
+	fsys := fstest.MapFS{}
+	for i, name := range []string{"a.png", "b.png", "c.png"} {
+		fsys[name] = &fstest.MapFile{Data: testimage.Encode(t, testimage.Shapes(i), "png")}
+	}
+	fsys["notes.txt"] = &fstest.MapFile{Data: []byte("not an image")}
+
+	transforms, _ := ParseTransforms("jpeg,resize,brightness")
+	var skipped []string
+	e := &Evaluation{
+		HashTypes:  []hash.Type{hash.SHA1, hash.DHash, hash.PDQ},
+		Transforms: transforms,
+		Fraction:   0.5,
+		OnImage: func(name string, err error) {
+			if err != nil {
+				skipped = append(skipped, name)
+			}
+		},
+	}
+
+	results, err := e.Run(Images{fsys, []string{"a.png", "b.png", "notes.txt"}}, Images{fsys, []string{"c.png"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0] != "notes.txt" {
+		t.Errorf("got skipped %v", skipped)
+	}
+
+	// the cryptographic hashes are not evaluated.
+	if len(results) != 2 || results[0].HashType != hash.DHash || results[1].HashType != hash.PDQ {
+		t.Fatalf("got %d results", len(results))
+	}
+	for _, r := range results {
+		if len(r.Negatives) != 2*(1+len(transforms)) {
+			t.Errorf("%s: got %d negatives", r.HashType, len(r.Negatives))
+		}
+		for _, tr := range transforms {
+			if len(r.Positives[tr.Name]) != 2 {
+				t.Errorf("%s: got %d positives of %s", r.HashType, len(r.Positives[tr.Name]), tr.Name)
+			}
+		}
+		if auc := AUC(r.ROC()); auc < 0.9 {
+			t.Errorf("%s: got AUC %f", r.HashType, auc)
+		}
+	}
+	if results[1].Bits != 256 {
+		t.Errorf("got %d bits for PDQ", results[1].Bits)
+	}
+
+	if _, err = e.Run(Images{fsys, []string{"notes.txt"}}, Images{fsys, []string{"c.png"}}); err == nil {
+		t.Error("expected an error without references")
+	}
+}
+
+func TestDistance(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 96, 64))); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{"plain.png": &fstest.MapFile{Data: buf.Bytes()}}
+	m, err := media.NewMedia(fsys, "plain.png", []hash.Type{hash.DHash, hash.PDQ})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a d-hash of 0 is at distance 0 of itself, a missing hash at -1.
+	if d := Distance(hash.DHash, m, m, 0.5); d != 0 {
+		t.Errorf("got d-hash distance %d, want 0", d)
+	}
+	for _, hashType := range []hash.Type{hash.PDQ, hash.PHash} {
+		if d := Distance(hashType, m, m, 0.5); d != -1 {
+			t.Errorf("got %s distance %d, want -1", hashType, d)
+		}
+	}
+}
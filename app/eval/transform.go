@@ -0,0 +1,186 @@
+package eval
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// Transform is a synthetic change of an image after which a search should still find it, such
+// as the recompression or the resizing of a shared photo.
+type Transform struct {
+	Name  string
+	Apply func(img image.Image) (image.Image, error)
+}
+
+// Transforms returns every synthetic transform.
+func Transforms() []Transform {
+	return []Transform{
+		{"jpeg-50", recompress(50)},
+		{"resize-50", scale(0.5)},
+		{"crop-10", crop(0.1)},
+		{"border-10", border(0.1)},
+		{"brightness-40", brightness(40)},
+		{"rotate-5", rotate(5)},
+		{"watermark", watermark},
+	}
+}
+
+// ParseTransforms returns the transforms of a comma-separated list of names, which may leave
+// out the parameter: jpeg, resize-50...
+func ParseTransforms(names string) ([]Transform, error) {
+	var transforms []Transform
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		found := false
+		for _, t := range Transforms() {
+			if name == t.Name || strings.HasPrefix(t.Name, name+"-") {
+				transforms = append(transforms, t)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+	}
+	return transforms, nil
+}
+
+// recompress encodes the image as a JPEG of the quality.
+func recompress(quality int) func(image.Image) (image.Image, error) {
+	return func(img image.Image) (image.Image, error) {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+		return jpeg.Decode(&buf)
+	}
+}
+
+// scale resizes the image by the factor.
+func scale(factor float64) func(image.Image) (image.Image, error) {
+	return func(img image.Image) (image.Image, error) {
+		b := img.Bounds()
+		w := uint(math.Max(1, math.Round(float64(b.Dx())*factor)))
+		h := uint(math.Max(1, math.Round(float64(b.Dy())*factor)))
+		return resize.Resize(w, h, img, resize.Bilinear), nil
+	}
+}
+
+// crop cuts the fraction of the width and of the height from each side of the image.
+func crop(fraction float64) func(image.Image) (image.Image, error) {
+	return func(img image.Image) (image.Image, error) {
+		b := img.Bounds()
+		dx := int(float64(b.Dx()) * fraction)
+		dy := int(float64(b.Dy()) * fraction)
+		r := image.Rect(b.Min.X+dx, b.Min.Y+dy, b.Max.X-dx, b.Max.Y-dy)
+
+		dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+		draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+		return dst, nil
+	}
+}
+
+// border adds a black border of the fraction of the width and of the height to each side of the
+// image.
+func border(fraction float64) func(image.Image) (image.Image, error) {
+	return func(img image.Image) (image.Image, error) {
+		b := img.Bounds()
+		dx := int(float64(b.Dx()) * fraction)
+		dy := int(float64(b.Dy()) * fraction)
+
+		dst := image.NewRGBA(image.Rect(0, 0, b.Dx()+2*dx, b.Dy()+2*dy))
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+		draw.Draw(dst, image.Rect(dx, dy, dx+b.Dx(), dy+b.Dy()), img, b.Min, draw.Src)
+		return dst, nil
+	}
+}
+
+// brightness adds delta to each color channel of the image.
+func brightness(delta int) func(image.Image) (image.Image, error) {
+	return func(img image.Image) (image.Image, error) {
+		dst := toRGBA(img)
+		for i := 0; i < len(dst.Pix); i += 4 {
+			for c := 0; c < 3; c++ {
+				v := int(dst.Pix[i+c]) + delta
+				if v < 0 {
+					v = 0
+				} else if v > 255 {
+					v = 255
+				}
+				dst.Pix[i+c] = uint8(v)
+			}
+		}
+		return dst, nil
+	}
+}
+
+// rotate turns the image by degrees around its center, keeping its size and filling the corners
+// with black.
+func rotate(degrees float64) func(image.Image) (image.Image, error) {
+	return func(img image.Image) (image.Image, error) {
+		src := toRGBA(img)
+		b := src.Bounds()
+		dst := image.NewRGBA(b)
+
+		sin, cos := math.Sincos(degrees * math.Pi / 180)
+		cx, cy := float64(b.Dx())/2, float64(b.Dy())/2
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				// the pixel of the source that lands on (x, y).
+				fx, fy := float64(x)+0.5-cx, float64(y)+0.5-cy
+				sx := int(math.Floor(cos*fx + sin*fy + cx))
+				sy := int(math.Floor(-sin*fx + cos*fy + cy))
+				if sx < 0 || sy < 0 || sx >= b.Dx() || sy >= b.Dy() {
+					continue
+				}
+				i, j := dst.PixOffset(x, y), src.PixOffset(sx, sy)
+				copy(dst.Pix[i:i+4], src.Pix[j:j+4])
+			}
+		}
+		return dst, nil
+	}
+}
+
+// watermark blends a striped white band, as the text of a watermark, over the bottom of the
+// image.
+func watermark(img image.Image) (image.Image, error) {
+	dst := toRGBA(img)
+	b := dst.Bounds()
+	band := image.Rect(b.Dx()/5, b.Dy()*3/4, b.Dx()*4/5, b.Dy()*7/8)
+	stripe := band.Dy()/4 + 1
+
+	for y := band.Min.Y; y < band.Max.Y; y++ {
+		for x := band.Min.X; x < band.Max.X; x++ {
+			alpha := 128
+			if (x-band.Min.X)/stripe%2 == 1 {
+				alpha = 200
+			}
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				dst.Pix[i+c] = uint8((int(dst.Pix[i+c])*(255-alpha) + 255*alpha) / 255)
+			}
+		}
+	}
+	return dst, nil
+}
+
+// toRGBA returns a copy of the image as an RGBA starting at (0, 0).
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
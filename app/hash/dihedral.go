@@ -0,0 +1,90 @@
+package hash
+
+import (
+	"errors"
+	"image"
+
+	"github.com/tsmweb/chasam/common/mediautil"
+)
+
+// Dihedral is one of the 8 transforms of the square, the rotations by multiples of 90° and the
+// mirrors, used to hash the flipped and rotated copies of an image.
+type Dihedral int
+
+const (
+	Identity   Dihedral = iota
+	Rotate90            // clockwise
+	Rotate180           // upside down
+	Rotate270           // clockwise
+	FlipH               // mirrored left to right
+	FlipV               // mirrored top to bottom
+	Transpose           // mirrored across the main diagonal
+	Transverse          // mirrored across the anti-diagonal
+)
+
+// Dihedrals returns the transforms other than Identity.
+func Dihedrals() []Dihedral {
+	return []Dihedral{Rotate90, Rotate180, Rotate270, FlipH, FlipV, Transpose, Transverse}
+}
+
+func (d Dihedral) String() string {
+	switch d {
+	case Identity:
+		return "identity"
+	case Rotate90:
+		return "rotate-90"
+	case Rotate180:
+		return "rotate-180"
+	case Rotate270:
+		return "rotate-270"
+	case FlipH:
+		return "flip-h"
+	case FlipV:
+		return "flip-v"
+	case Transpose:
+		return "transpose"
+	case Transverse:
+		return "transverse"
+	default:
+		return ""
+	}
+}
+
+// orientations maps each transform to the EXIF orientation that displays the stored image
+// transformed by it.
+var orientations = map[Dihedral]int{
+	Rotate90:   6,
+	Rotate180:  3,
+	Rotate270:  8,
+	FlipH:      2,
+	FlipV:      4,
+	Transpose:  5,
+	Transverse: 7,
+}
+
+// Apply returns img transformed by d.
+func (d Dihedral) Apply(img image.Image) image.Image {
+	return mediautil.Orient(img, orientations[d])
+}
+
+// PerceptualHash computes the perceptual hash of hashType of img.
+func PerceptualHash(hashType Type, img image.Image) (uint64, error) {
+	switch hashType {
+	case AHash:
+		return AverageHash(img)
+	case DHash:
+		return DifferenceHash(img)
+	case DHashV:
+		return DifferenceHashVertical(img)
+	case PHash:
+		return PerceptionHash(img)
+	case DomiHash:
+		return DifferenceDomiHash(img)
+	case ChHash:
+		return PerceptionChHash(img)
+	case WHash:
+		return WaveletHash(img)
+	default:
+		return 0, errors.New("not a perceptual hash")
+	}
+}
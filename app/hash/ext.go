@@ -0,0 +1,86 @@
+package hash
+
+import (
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/nfnt/resize"
+	"github.com/tsmweb/chasam/app/hash/transform"
+)
+
+// DefaultExtHashSize is the side of the grid of bits of DHashExt and PHashExt, whose hashes
+// have size*size bits, unless another size is given.
+const DefaultExtHashSize = 16
+
+// CheckExtHashSize returns an error unless size is a valid side of the grid of bits of
+// DHashExt and PHashExt, a power of two from 8 to 32.
+func CheckExtHashSize(size int) error {
+	if size < 8 || size > 32 || size&(size-1) != 0 {
+		return fmt.Errorf("invalid hash size %d, it must be 8, 16 or 32", size)
+	}
+	return nil
+}
+
+// ExtDifferenceHash is the DifferenceHash of size*size bits, the first word holding the first
+// bits. A size of 8 gives the one word of DifferenceHash.
+func ExtDifferenceHash(img image.Image, size int) ([]uint64, error) {
+	if img == nil {
+		return nil, errors.New("image cannot be nil")
+	}
+
+	w, h := size+1, size
+	resized := resize.Resize(uint(w), uint(h), img, resize.Bilinear)
+	pixels := transform.ConvertToGrayArray(resized)
+	hashs := make([]uint64, (size*size+63)/64)
+	idx := 0
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			if pixels[y][x] < pixels[y][x+1] {
+				hashs[idx/64] |= 1 << uint(64-idx%64-1)
+			}
+			idx++
+		}
+	}
+
+	return hashs, nil
+}
+
+// ExtPerceptionHash is the PerceptionHash of size*size bits, taken from the lowest frequencies
+// of the DCT of the image resized to 4*size, the first word holding the first bits. A size of 8
+// gives the one word of PerceptionHash. The size must be a power of two.
+func ExtPerceptionHash(img image.Image, size int) ([]uint64, error) {
+	if img == nil {
+		return nil, errors.New("image cannot be nil")
+	}
+	if size <= 0 || size&(size-1) != 0 {
+		return nil, fmt.Errorf("invalid hash size %d", size)
+	}
+
+	w, h := 4*size, 4*size
+	resized := resize.Resize(uint(w), uint(h), img, resize.Bilinear)
+	pixels := transform.ConvertToGrayArray(resized)
+	dct := transform.DCT2D(pixels, w, h)
+
+	// the average of the lowest frequencies, excluding the DC coefficient.
+	sum := 0.0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			sum += dct[y][x]
+		}
+	}
+	sum -= dct[0][0]
+	avg := sum / float64(size*size-1)
+
+	hashs := make([]uint64, (size*size+63)/64)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if idx := y*size + x; dct[y][x] > avg {
+				hashs[idx/64] |= 1 << uint(64-idx%64-1)
+			}
+		}
+	}
+
+	return hashs, nil
+}
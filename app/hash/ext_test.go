@@ -0,0 +1,57 @@
+package hash
+
+import (
+	"image"
+	"testing"
+
+	"github.com/nfnt/resize"
+	"github.com/tsmweb/chasam/internal/testimage"
+)
+
+func TestExtHash(t *testing.T) {
+	img := testimage.Waves(400, 300, 2)
+
+	// a size of 8 gives the 64-bit hashes.
+	dHash, _ := DifferenceHash(img)
+	pHash, _ := PerceptionHash(img)
+	if h, err := ExtDifferenceHash(img, 8); err != nil || len(h) != 1 || h[0] != dHash {
+		t.Errorf("ExtDifferenceHash(8) = %x (%v), want %x", h, err, dHash)
+	}
+	if h, err := ExtPerceptionHash(img, 8); err != nil || len(h) != 1 || h[0] != pHash {
+		t.Errorf("ExtPerceptionHash(8) = %x (%v), want %x", h, err, pHash)
+	}
+
+	// a resized copy stays close to the original, another image does not.
+	resized := resize.Resize(300, 225, img, resize.Bilinear)
+	other := testimage.Waves(400, 300, 0)
+	hashFuncs := map[string]func(image.Image, int) ([]uint64, error){
+		"ExtDifferenceHash": ExtDifferenceHash,
+		"ExtPerceptionHash": ExtPerceptionHash,
+	}
+	for name, fn := range hashFuncs {
+		for _, size := range []int{16, 32} {
+			h, err := fn(img, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(h) != size*size/64 {
+				t.Fatalf("%s(%d): got %d words", name, size, len(h))
+			}
+
+			hResized, _ := fn(resized, size)
+			hOther, _ := fn(other, size)
+			near, _ := ExtDistance(h, hResized)
+			far, _ := ExtDistance(h, hOther)
+			if near > size*size/16 || far <= size*size/8 {
+				t.Errorf("%s(%d): resized copy at %d bits, other image at %d bits", name, size, near, far)
+			}
+		}
+	}
+
+	if err := CheckExtHashSize(12); err == nil {
+		t.Error("expected an error for a size that is not a power of two")
+	}
+	if err := CheckExtHashSize(32); err != nil || DHashExt.Words(32) != 16 {
+		t.Errorf("got %d words for a size of 32 (%v)", DHashExt.Words(32), err)
+	}
+}
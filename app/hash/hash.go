@@ -2,6 +2,7 @@ package hash
 
 import (
 	"bufio"
+	"crypto/md5"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
@@ -10,13 +11,17 @@ import (
 	"image"
 	"io"
 	"math/bits"
-	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/nfnt/resize"
 	"github.com/tsmweb/chasam/app/hash/transform"
 	"github.com/tsmweb/chasam/pkg/ed2k"
 )
 
+// Type identifies a hash algorithm. The values are persisted by the hash databases, so new
+// types must be appended to the end of the list.
 type Type int
 
 const (
@@ -29,8 +34,169 @@ const (
 	WHash
 	DomiHash
 	ChHash
+	MD5
+	SegmentHash
+	PDQ
+	DHashExt
+	PHashExt
 )
 
+// Types returns every hash type.
+func Types() []Type {
+	return []Type{SHA1, ED2K, MD5, AHash, DHash, DHashV, PHash, WHash, DomiHash, ChHash, SegmentHash, PDQ, DHashExt, PHashExt}
+}
+
+// ParseType returns the hash type named name, either as returned by String or as written in
+// the command line (d-hash, p-hash...). The comparison is case-insensitive.
+func ParseType(name string) (Type, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, t := range Types() {
+		if name == strings.ToLower(t.String()) || name == t.Name() {
+			return t, nil
+		}
+	}
+	return -1, fmt.Errorf("unknown hash type %q", name)
+}
+
+// DefaultDistance returns the hamming distance up to which two perceptual hashes of the type
+// are taken for the same image, unless another one is given. It is lower for the hashes that
+// collide more often, such as PHash, and higher for the ones that vary more, such as DomiHash,
+// and grows with the bits of the extended hashes, whose grid has the side size.
+func (t Type) DefaultDistance(size int) int {
+	switch t {
+	case AHash, PHash, ChHash:
+		return 8
+	case DHash, DHashV, WHash, SegmentHash:
+		return 10
+	case DomiHash:
+		return 14
+	case PDQ:
+		return 31
+	case DHashExt:
+		return 10 * size * size / 64
+	case PHashExt:
+		return 8 * size * size / 64
+	default:
+		return 0
+	}
+}
+
+// ParseDistances returns the hamming distance of each perceptual type set by spec, a list of
+// type:distance pairs such as "d-hash:8,p-hash:12", separated by commas or new lines. A
+// distance without a type applies to every type not listed, and the text after a # is a
+// comment. The types left out get their DefaultDistance for the extended hashes of size.
+func ParseDistances(spec string, size int) (map[Type]int, error) {
+	distances := make(map[Type]int)
+	all := -1
+
+	for _, line := range strings.Split(spec, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		for _, item := range strings.Split(line, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+
+			name, value, found := strings.Cut(item, ":")
+			if !found {
+				name, value, found = strings.Cut(item, "=")
+			}
+			if !found {
+				name, value = "", item
+			}
+			distance, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || distance < 0 {
+				return nil, fmt.Errorf("invalid hamming distance %q", item)
+			}
+
+			if name == "" {
+				all = distance
+				continue
+			}
+			t, err := ParseType(name)
+			if err != nil {
+				return nil, err
+			}
+			distances[t] = distance
+		}
+	}
+
+	for _, t := range Types() {
+		if _, ok := distances[t]; ok || !t.IsPerceptual() {
+			continue
+		}
+		if all >= 0 {
+			distances[t] = all
+		} else {
+			distances[t] = t.DefaultDistance(size)
+		}
+	}
+	return distances, nil
+}
+
+// IsPerceptual reports whether the hash is computed from the image content instead of the
+// file bytes.
+func (t Type) IsPerceptual() bool {
+	return t != SHA1 && t != ED2K && t != MD5
+}
+
+// IsExtended reports whether the perceptual hash is made of several 64-bit words, handled as
+// a []uint64 instead of an uint64.
+func (t Type) IsExtended() bool {
+	return t == SegmentHash || t == PDQ || t == DHashExt || t == PHashExt
+}
+
+// Words returns the number of 64-bit words of the extended hash whose grid has the side size,
+// or 0 if it varies from an image to another.
+func (t Type) Words(size int) int {
+	switch t {
+	case PDQ:
+		return PDQWords
+	case DHashExt, PHashExt:
+		return (size*size + 63) / 64
+	default:
+		return 0
+	}
+}
+
+// Name returns the name of the hash type as written in the command line.
+func (t Type) Name() string {
+	switch t {
+	case SHA1:
+		return "sha1"
+	case ED2K:
+		return "ed2k"
+	case MD5:
+		return "md5"
+	case AHash:
+		return "a-hash"
+	case DHash:
+		return "d-hash"
+	case DHashV:
+		return "d-hash-v"
+	case PHash:
+		return "p-hash"
+	case WHash:
+		return "w-hash"
+	case DomiHash:
+		return "domi-hash"
+	case ChHash:
+		return "ch-hash"
+	case SegmentHash:
+		return "segment-hash"
+	case PDQ:
+		return "pdq"
+	case DHashExt:
+		return "d-hash-ext"
+	case PHashExt:
+		return "p-hash-ext"
+	default:
+		return ""
+	}
+}
+
 func (t Type) String() string {
 	switch t {
 	case SHA1:
@@ -51,12 +217,22 @@ func (t Type) String() string {
 		return "DomiHash"
 	case ChHash:
 		return "ChHash"
+	case MD5:
+		return "MD5"
+	case SegmentHash:
+		return "SegmentHash"
+	case PDQ:
+		return "PDQ"
+	case DHashExt:
+		return "DHashExt"
+	case PHashExt:
+		return "PHashExt"
 	default:
 		return ""
 	}
 }
 
-func Sha1Hash(f *os.File) (string, error) {
+func Sha1Hash(f io.ReadSeeker) (string, error) {
 	if err := seekStart(f); err != nil {
 		return "", err
 	}
@@ -76,7 +252,7 @@ func Sha1Hash(f *os.File) (string, error) {
 	return h, nil
 }
 
-func Ed2kHash(f *os.File) (string, error) {
+func Ed2kHash(f io.ReadSeeker) (string, error) {
 	if err := seekStart(f); err != nil {
 		return "", err
 	}
@@ -96,7 +272,27 @@ func Ed2kHash(f *os.File) (string, error) {
 	return h, nil
 }
 
-func seekStart(f *os.File) error {
+func Md5Hash(f io.ReadSeeker) (string, error) {
+	if err := seekStart(f); err != nil {
+		return "", err
+	}
+
+	rd := bufio.NewReader(f)
+	sh := md5.New()
+	_, err := rd.WriteTo(sh)
+	if err != nil {
+		return "", err
+	}
+	h := fmt.Sprintf("%x", sh.Sum(nil))
+
+	if err = seekStart(f); err != nil {
+		return "", err
+	}
+
+	return h, nil
+}
+
+func seekStart(f io.Seeker) error {
 	_, err := f.Seek(0, io.SeekStart)
 	return err
 }
@@ -228,8 +424,57 @@ func PerceptionHash(img image.Image) (uint64, error) {
 	return hash, nil
 }
 
+// WaveletHash function returns a hash computation of wavelet hash.
+// Implementation follows
+// https://github.com/JohannesBuchner/imagehash (whash, haar mode)
 func WaveletHash(img image.Image) (uint64, error) {
-	return 0, nil
+	if img == nil {
+		return 0, errors.New("image cannot be nil")
+	}
+
+	// the image is scaled to 64x64 (2^6), so a 8x8 (2^3) low-pass band is left after three
+	// levels of decomposition.
+	size, maxLevel, level := 64, 6, 3
+	resized := resize.Resize(uint(size), uint(size), img, resize.Bilinear)
+	pixels := transform.ConvertToGrayArray(resized)
+
+	for y := range pixels {
+		for x := range pixels[y] {
+			pixels[y][x] /= 255
+		}
+	}
+
+	// remove the lowest frequency, which only holds the overall brightness of the image.
+	coeffs := transform.HaarWavelet2D(pixels, size, maxLevel)
+	coeffs[0][0] = 0
+	pixels = transform.InverseHaarWavelet2D(coeffs, size, maxLevel)
+
+	coeffs = transform.HaarWavelet2D(pixels, size, maxLevel-level)
+
+	// calculate the median of the low-pass band.
+	w, h := 8, 8
+	flatLL := [64]float64{} // 8x8
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			flatLL[h*y+x] = coeffs[y][x]
+		}
+	}
+
+	sorted := flatLL
+	sort.Float64s(sorted[:])
+	median := (sorted[31] + sorted[32]) / 2
+
+	// extract the hash.
+	var hash uint64
+
+	for idx, p := range flatLL {
+		if p > median {
+			hash |= 1 << uint(64-idx-1)
+		}
+	}
+
+	return hash, nil
 }
 
 func DifferenceDomiHash(img image.Image) (uint64, error) {
@@ -309,6 +554,11 @@ func FormatToHex(hash uint64) string {
 	return fmt.Sprintf("%016x", hash)
 }
 
+// ParseHex returns the hash formatted by FormatToHex.
+func ParseHex(s string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimSpace(s), 16, 64)
+}
+
 func ExtFormatToHex(hashs []uint64) string {
 	var hexBytes []byte
 
@@ -321,6 +571,24 @@ func ExtFormatToHex(hashs []uint64) string {
 	return hex.EncodeToString(hexBytes)
 }
 
+// ParseExtHex returns the hash formatted by ExtFormatToHex.
+func ParseExtHex(s string) ([]uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || len(s)%16 != 0 {
+		return nil, errors.New("invalid extended hash length")
+	}
+
+	hashs := make([]uint64, 0, len(s)/16)
+	for i := 0; i < len(s); i += 16 {
+		h, err := strconv.ParseUint(s[i:i+16], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		hashs = append(hashs, h)
+	}
+	return hashs, nil
+}
+
 func Distance(lHash, rHash uint64) (int, error) {
 	hamming := lHash ^ rHash
 	return bits.OnesCount64(hamming), nil
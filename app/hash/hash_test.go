@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/tsmweb/chasam/common/mediautil"
+	"github.com/tsmweb/chasam/internal/testimage"
 )
 
 func TestSha1Hash(t *testing.T) {
@@ -38,6 +39,26 @@ func TestEd2kHash(t *testing.T) {
 	t.Log(h)
 }
 
+func TestMd5Hash(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err = f.WriteString("The quick brown fox jumps over the lazy dog"); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := Md5Hash(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != "9e107d9d372bb6826bd81d3542a419d6" {
+		t.Errorf("unexpected md5 %s", h)
+	}
+}
+
 func TestAverageHash(t *testing.T) {
 	img, err := loadImage("../../test/img.jpg")
 	if err != nil {
@@ -117,16 +138,42 @@ func TestPerceptionChHash(t *testing.T) {
 }
 
 func TestWaveletHash(t *testing.T) {
-	img, err := loadImage("../../test/img.jpg")
+	hash, err := WaveletHash(testimage.Gradient(128, 96, 0))
 	if err != nil {
 		t.Fatal(err)
 	}
+	if hash == 0 {
+		t.Fatal("expected a non-zero hash")
+	}
+	t.Logf("WaveletHash: %v\n", hash)
+}
 
-	hash, err := WaveletHash(img)
+func TestWaveletHashSimilarity(t *testing.T) {
+	img := testimage.Gradient(128, 96, 0)
+
+	hash1, err := WaveletHash(img)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("WaveletHash: %v\n", hash)
+	if hash1 == 0 {
+		t.Fatal("expected a non-zero hash")
+	}
+
+	hash2, err := WaveletHash(testimage.Gradient(128, 96, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dist, _ := Distance(hash1, hash2); dist > 4 {
+		t.Errorf("brightened image: expected distance <= 4, got %d", dist)
+	}
+
+	hash3, err := WaveletHash(testimage.Invert(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dist, _ := Distance(hash1, hash3); dist < 32 {
+		t.Errorf("inverted image: expected distance >= 32, got %d", dist)
+	}
 }
 
 func BenchmarkAverageHash(b *testing.B) {
@@ -203,3 +250,35 @@ func loadImage(uri string) (image.Image, error) {
 	}
 	return img, nil
 }
+
+func TestParseDistances(t *testing.T) {
+	distances, err := ParseDistances("d-hash:8, PHash:12\n# a comment\nw-hash = 6 # another one\n", DefaultExtHashSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[Type]int{DHash: 8, PHash: 12, WHash: 6, DomiHash: DomiHash.DefaultDistance(DefaultExtHashSize), PDQ: 31}
+	for hashType, distance := range want {
+		if distances[hashType] != distance {
+			t.Errorf("%s: got %d, want %d", hashType, distances[hashType], distance)
+		}
+	}
+	if _, ok := distances[SHA1]; ok {
+		t.Error("expected no distance for SHA1")
+	}
+
+	// a distance without a type applies to the types not listed.
+	if distances, err = ParseDistances("10,p-hash:4", DefaultExtHashSize); err != nil || distances[PHash] != 4 || distances[PDQ] != 10 {
+		t.Errorf("got %v (%v)", distances, err)
+	}
+
+	// the default distance of the extended hashes grows with their size.
+	if distances, err = ParseDistances("", 32); err != nil || distances[DHashExt] != 160 || distances[DHash] != 10 {
+		t.Errorf("got %v (%v) for a size of 32", distances, err)
+	}
+
+	for _, spec := range []string{"d-hash:x", "e-hash:4", "d-hash:-1"} {
+		if _, err = ParseDistances(spec, DefaultExtHashSize); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
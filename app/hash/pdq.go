@@ -0,0 +1,189 @@
+package hash
+
+import (
+	"errors"
+	"image"
+	"math"
+	"sort"
+)
+
+const (
+	// pdqSize is the side of the decimated image whose DCT is taken.
+	pdqSize = 64
+	// pdqDCTSize is the side of the block of the DCT coefficients that make up the hash.
+	pdqDCTSize = 16
+	// PDQWords is the number of 64-bit words of a PDQ hash.
+	PDQWords = 4
+)
+
+// PDQMinQuality is the quality under which the PDQ hash of an image, too plain to be told apart
+// from others, is not used.
+var PDQMinQuality = 50
+
+// pdqDCT is the 16x64 matrix of the DCT-II, without its DC row.
+var pdqDCT = func() [pdqDCTSize][pdqSize]float32 {
+	var d [pdqDCTSize][pdqSize]float32
+	scale := math.Sqrt(2.0 / pdqSize)
+	for i := 0; i < pdqDCTSize; i++ {
+		for j := 0; j < pdqSize; j++ {
+			d[i][j] = float32(scale * math.Cos(math.Pi/2/pdqSize*float64(i+1)*float64(2*j+1)))
+		}
+	}
+	return d
+}()
+
+// PDQHash returns the 256-bit PDQ hash of the image, in PDQWords words whose first one holds
+// the highest bits, so that ExtFormatToHex gives its usual hexadecimal form, and its quality
+// from 0 to 100. Implementation follows the reference of Facebook's ThreatExchange: the
+// luminance is blurred by a Jarosz filter, decimated to 64x64, and each bit tells whether a
+// coefficient of the 16x16 lowest frequencies of its DCT is above their median.
+func PDQHash(img image.Image) ([]uint64, int, error) {
+	if img == nil {
+		return nil, 0, errors.New("image cannot be nil")
+	}
+	b := img.Bounds()
+	rows, cols := b.Dy(), b.Dx()
+	if rows == 0 || cols == 0 {
+		return nil, 0, errors.New("image cannot be empty")
+	}
+
+	luma := make([]float32, rows*cols)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			luma[y*cols+x] = 0.299*float32(r>>8) + 0.587*float32(g>>8) + 0.114*float32(bl>>8)
+		}
+	}
+
+	jaroszFilter(luma, rows, cols, jaroszWindowSize(cols), jaroszWindowSize(rows))
+
+	var small [pdqSize][pdqSize]float32
+	for i := 0; i < pdqSize; i++ {
+		ini := int((float64(i) + 0.5) * float64(rows) / pdqSize)
+		for j := 0; j < pdqSize; j++ {
+			inj := int((float64(j) + 0.5) * float64(cols) / pdqSize)
+			small[i][j] = luma[ini*cols+inj]
+		}
+	}
+
+	quality := pdqQuality(&small)
+
+	// the DCT of the 64x64 block, D * A * Dt, restricted to 16x16.
+	var tmp [pdqDCTSize][pdqSize]float32
+	for i := 0; i < pdqDCTSize; i++ {
+		for j := 0; j < pdqSize; j++ {
+			var sum float32
+			for k := 0; k < pdqSize; k++ {
+				sum += pdqDCT[i][k] * small[k][j]
+			}
+			tmp[i][j] = sum
+		}
+	}
+	coefs := make([]float32, 0, pdqDCTSize*pdqDCTSize)
+	for i := 0; i < pdqDCTSize; i++ {
+		for j := 0; j < pdqDCTSize; j++ {
+			var sum float32
+			for k := 0; k < pdqSize; k++ {
+				sum += tmp[i][k] * pdqDCT[j][k]
+			}
+			coefs = append(coefs, sum)
+		}
+	}
+
+	sorted := append([]float32(nil), coefs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[(len(sorted)+1)/2-1]
+
+	hashs := make([]uint64, PDQWords)
+	for k, c := range coefs {
+		if c > median {
+			hashs[PDQWords-1-k/64] |= 1 << (k % 64)
+		}
+	}
+	return hashs, quality, nil
+}
+
+// pdqQuality sums the gradients of the decimated image, so that a plain image scores 0.
+func pdqQuality(small *[pdqSize][pdqSize]float32) int {
+	abs := func(d int) int {
+		if d < 0 {
+			return -d
+		}
+		return d
+	}
+
+	sum := 0
+	for i := 0; i < pdqSize-1; i++ {
+		for j := 0; j < pdqSize; j++ {
+			sum += abs(int((small[i][j] - small[i+1][j]) * 100 / 255))
+		}
+	}
+	for i := 0; i < pdqSize; i++ {
+		for j := 0; j < pdqSize-1; j++ {
+			sum += abs(int((small[i][j] - small[i][j+1]) * 100 / 255))
+		}
+	}
+
+	quality := sum / 90
+	if quality > 100 {
+		quality = 100
+	}
+	return quality
+}
+
+// jaroszWindowSize returns the window of the box filter along a dimension of the image, so that
+// it is decimated to pdqSize without aliasing.
+func jaroszWindowSize(dimension int) int {
+	return (dimension + 2*pdqSize - 1) / (2 * pdqSize)
+}
+
+// jaroszFilter blurs the image in place by two passes of a box filter along the rows and the
+// columns, which approximates a tent filter.
+func jaroszFilter(pixels []float32, rows, cols, rowWindow, colWindow int) {
+	tmp := make([]float32, len(pixels))
+	for rep := 0; rep < 2; rep++ {
+		for i := 0; i < rows; i++ {
+			box1D(pixels[i*cols:], tmp[i*cols:], cols, 1, rowWindow)
+		}
+		for j := 0; j < cols; j++ {
+			box1D(tmp[j:], pixels[j:], rows, cols, colWindow)
+		}
+	}
+}
+
+// box1D writes to out the mean of the window of in centred on each of its n values, which are
+// stride apart. The window is cut at the ends.
+func box1D(in, out []float32, n, stride, window int) {
+	half := (window + 2) / 2
+	var sum float32
+	size := 0
+	li, ri, oi := 0, 0, 0
+
+	for i := 0; i < half-1; i++ {
+		sum += in[ri]
+		size++
+		ri += stride
+	}
+	for i := 0; i < window-half+1; i++ {
+		sum += in[ri]
+		size++
+		out[oi] = sum / float32(size)
+		ri += stride
+		oi += stride
+	}
+	for i := 0; i < n-window; i++ {
+		sum += in[ri]
+		sum -= in[li]
+		out[oi] = sum / float32(size)
+		li += stride
+		ri += stride
+		oi += stride
+	}
+	for i := 0; i < half-1; i++ {
+		sum -= in[li]
+		size--
+		out[oi] = sum / float32(size)
+		li += stride
+		oi += stride
+	}
+}
@@ -0,0 +1,93 @@
+package hash
+
+import (
+	"bufio"
+	"image"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nfnt/resize"
+	"github.com/tsmweb/chasam/internal/testimage"
+)
+
+func TestPDQHash(t *testing.T) {
+	h, quality, err := PDQHash(testimage.Waves(400, 300, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != PDQWords {
+		t.Fatalf("got %d words, want %d", len(h), PDQWords)
+	}
+	ones := 0
+	for _, w := range h {
+		ones += bits.OnesCount64(w)
+	}
+	// a bit is set for each coefficient above the median.
+	if ones != 128 {
+		t.Errorf("got %d bits set, want 128", ones)
+	}
+	if quality < PDQMinQuality {
+		t.Errorf("got quality %d for a textured image", quality)
+	}
+
+	// a resized copy is close, another image is not.
+	resized, _, _ := PDQHash(resize.Resize(300, 225, testimage.Waves(400, 300, 0), resize.Bilinear))
+	if d, _ := ExtDistance(h, resized); d > 31 {
+		t.Errorf("resized copy at distance %d", d)
+	}
+	other, _, _ := PDQHash(testimage.Waves(400, 300, 1))
+	if d, _ := ExtDistance(h, other); d <= 31 {
+		t.Errorf("other image at distance %d", d)
+	}
+
+	plain := image.NewGray(image.Rect(0, 0, 100, 100))
+	if _, quality, err = PDQHash(plain); err != nil || quality != 0 {
+		t.Errorf("got quality %d (%v) for a plain image", quality, err)
+	}
+}
+
+// TestPDQHashVectors checks the hashes of the test images of testdata/pdq against expected.txt,
+// one "hash,quality,filename" per line. The file was written by testdata/pdq/generate.py, a
+// transcription of the reference implementation of ThreatExchange, not by ThreatExchange
+// itself, and the hashes must match it exactly.
+func TestPDQHashVectors(t *testing.T) {
+	f, err := os.Open("testdata/pdq/expected.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Split(strings.TrimSpace(sc.Text()), ",")
+		if len(fields) != 3 {
+			continue
+		}
+		wantQuality, _ := strconv.Atoi(fields[1])
+
+		img, err := loadImage(filepath.Join("testdata/pdq", filepath.Base(fields[2])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, quality, err := PDQHash(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, err := ParseExtHex(fields[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d, _ := ExtDistance(h, want); d != 0 || quality != wantQuality {
+			t.Errorf("%s: got %s quality %d, want %s quality %d", fields[2], ExtFormatToHex(h), quality,
+				fields[0], wantQuality)
+		}
+	}
+	if err = sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,230 @@
+package hash
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/nfnt/resize"
+	"github.com/tsmweb/chasam/app/hash/transform"
+)
+
+const (
+	// segmentationSize is the side of the grayscale image that is segmented.
+	segmentationSize = 300
+	// segmentThreshold splits the pixels in bright and dark segments.
+	segmentThreshold = 128
+	// minSegmentSize is the number of pixels of the smallest segment hashed.
+	minSegmentSize = 500
+	// minSegmentDeviation is the standard deviation of the gray levels under which a segment is
+	// flat, and its hash, made of noise, is left out.
+	minSegmentDeviation = 4
+	// MaxSegments is the number of segments hashed, the largest first.
+	MaxSegments = 16
+)
+
+// CropResistantHash segments the image in bright and dark regions and returns the difference hash
+// of the bounding box of each region, the largest first. A crop or a border only changes the
+// regions on the edges, so the other regions still match. Flat regions and plain gradients are
+// left out, so the result may be empty. Implementation follows
+// Steinebach et al., "Efficient Cropping-Resistant Robust Image Hashing" (2014), as done by
+// the crop_resistant_hash of the imagehash library.
+func CropResistantHash(img image.Image) ([]uint64, error) {
+	if img == nil {
+		return nil, errors.New("image cannot be nil")
+	}
+
+	resized := resize.Resize(segmentationSize, segmentationSize, img, resize.Bilinear)
+	gray := transform.ConvertToGrayArray(resized)
+	pixels := medianFilter(boxBlur(boxBlur(gray)))
+
+	segments := findSegments(pixels)
+	if len(segments) == 0 {
+		segments = []segment{{maxX: segmentationSize - 1, maxY: segmentationSize - 1}}
+	}
+
+	b := img.Bounds()
+	scaleX := float64(b.Dx()) / segmentationSize
+	scaleY := float64(b.Dy()) / segmentationSize
+
+	hashes := make([]uint64, 0, len(segments))
+	for _, s := range segments {
+		if deviation(gray, s) < minSegmentDeviation {
+			continue
+		}
+
+		box := image.Rect(
+			b.Min.X+int(float64(s.minX)*scaleX),
+			b.Min.Y+int(float64(s.minY)*scaleY),
+			b.Min.X+int(float64(s.maxX+1)*scaleX),
+			b.Min.Y+int(float64(s.maxY+1)*scaleY),
+		).Intersect(b)
+		if box.Empty() {
+			continue
+		}
+
+		crop := image.NewRGBA(image.Rect(0, 0, box.Dx(), box.Dy()))
+		draw.Draw(crop, crop.Bounds(), img, box.Min, draw.Src)
+		h, err := DifferenceHash(crop)
+		if err != nil {
+			return nil, err
+		}
+		// the hash of a plain gradient is made of identical bits and matches any other.
+		if h == 0 || h == math.MaxUint64 {
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
+// SegmentMatches returns the number of segments of lHash that are within distance of a segment
+// of rHash, and the mean distance of these segments.
+func SegmentMatches(lHash, rHash []uint64, distance int) (int, int) {
+	matches, total := 0, 0
+	for _, l := range lHash {
+		best := -1
+		for _, r := range rHash {
+			if d := bits.OnesCount64(l ^ r); d <= distance && (best < 0 || d < best) {
+				best = d
+			}
+		}
+		if best >= 0 {
+			matches++
+			total += best
+		}
+	}
+	if matches == 0 {
+		return 0, 0
+	}
+	return matches, (total + matches/2) / matches
+}
+
+// segment is the bounding box and the number of pixels of a connected region.
+type segment struct {
+	minX, minY, maxX, maxY int
+	size                   int
+}
+
+// findSegments returns the 4-connected regions of pixels on the same side of segmentThreshold
+// that have at least minSegmentSize pixels, the largest first and up to MaxSegments.
+func findSegments(pixels [][]float64) []segment {
+	h, w := len(pixels), len(pixels[0])
+	visited := make([]bool, w*h)
+	stack := make([]int, 0, w*h)
+
+	var segments []segment
+	for start := range visited {
+		if visited[start] {
+			continue
+		}
+		bright := pixels[start/w][start%w] > segmentThreshold
+
+		s := segment{minX: w, minY: h, maxX: -1, maxY: -1}
+		visited[start] = true
+		stack = append(stack[:0], start)
+		for len(stack) > 0 {
+			p := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			x, y := p%w, p/w
+			s.size++
+			if x < s.minX {
+				s.minX = x
+			}
+			if x > s.maxX {
+				s.maxX = x
+			}
+			if y < s.minY {
+				s.minY = y
+			}
+			if y > s.maxY {
+				s.maxY = y
+			}
+
+			for _, n := range [4][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				nx, ny := n[0], n[1]
+				if nx < 0 || ny < 0 || nx >= w || ny >= h {
+					continue
+				}
+				q := ny*w + nx
+				if !visited[q] && (pixels[ny][nx] > segmentThreshold) == bright {
+					visited[q] = true
+					stack = append(stack, q)
+				}
+			}
+		}
+
+		if s.size >= minSegmentSize {
+			segments = append(segments, s)
+		}
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].size > segments[j].size })
+	if len(segments) > MaxSegments {
+		segments = segments[:MaxSegments]
+	}
+	return segments
+}
+
+// deviation returns the standard deviation of the gray levels in the bounding box of s.
+func deviation(gray [][]float64, s segment) float64 {
+	var sum, sumSq, n float64
+	for y := s.minY; y <= s.maxY; y++ {
+		for x := s.minX; x <= s.maxX; x++ {
+			sum += gray[y][x]
+			sumSq += gray[y][x] * gray[y][x]
+			n++
+		}
+	}
+	mean := sum / n
+	return math.Sqrt(math.Max(sumSq/n-mean*mean, 0))
+}
+
+// boxBlur averages each pixel with its 3x3 neighbourhood.
+func boxBlur(pixels [][]float64) [][]float64 {
+	h, w := len(pixels), len(pixels[0])
+	out := make([][]float64, h)
+	for y := range out {
+		out[y] = make([]float64, w)
+		for x := range out[y] {
+			sum, n := 0.0, 0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if yy, xx := y+dy, x+dx; yy >= 0 && xx >= 0 && yy < h && xx < w {
+						sum += pixels[yy][xx]
+						n++
+					}
+				}
+			}
+			out[y][x] = sum / float64(n)
+		}
+	}
+	return out
+}
+
+// medianFilter replaces each pixel by the median of its 3x3 neighbourhood.
+func medianFilter(pixels [][]float64) [][]float64 {
+	h, w := len(pixels), len(pixels[0])
+	out := make([][]float64, h)
+	window := make([]float64, 0, 9)
+	for y := range out {
+		out[y] = make([]float64, w)
+		for x := range out[y] {
+			window = window[:0]
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if yy, xx := y+dy, x+dx; yy >= 0 && xx >= 0 && yy < h && xx < w {
+						window = append(window, pixels[yy][xx])
+					}
+				}
+			}
+			sort.Float64s(window)
+			out[y][x] = window[len(window)/2]
+		}
+	}
+	return out
+}
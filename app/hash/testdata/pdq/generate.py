@@ -0,0 +1,209 @@
+#!/usr/bin/env python3
+"""Writes the PDQ test images of this directory and expected.txt, their hashes and qualities.
+
+The hashes are computed by a transcription of pdqhashing.cpp, the reference implementation of
+Facebook's ThreatExchange, which rounds every operation to single precision as the reference
+does, independently of the Go implementation. Only the standard library is used. The output of
+the pdq-photo-hasher of ThreatExchange for these images, one "hash,quality,filename" per line,
+can replace expected.txt.
+
+	python3 generate.py
+"""
+
+import math
+import struct
+import zlib
+
+_f = struct.Struct("f")
+
+
+def f32(x):
+    """Rounds x to single precision."""
+    return _f.unpack(_f.pack(x))[0]
+
+
+# images ---------------------------------------------------------------------------------------
+
+def lcg(seed):
+    state = seed
+    while True:
+        state = (state * 1103515245 + 12345) % (1 << 31)
+        yield state >> 16
+
+
+def clamp(v):
+    return max(0, min(255, int(v)))
+
+
+def gradient(x, y, w, h):
+    return (clamp(255 * x / w), clamp(255 * y / h), clamp(255 * (x + y) / (w + h)))
+
+
+def texture(x, y, w, h):
+    v = 128 + 60 * math.sin(x / 17 + y / 23) + 60 * math.cos(y / 11 - x / 31)
+    return (clamp(v), clamp(255 - v), clamp(v / 2))
+
+
+def checker(x, y, w, h):
+    if (x // 20 + y // 20) % 2:
+        return (200, 40, 40)
+    return (30, 60, 220)
+
+
+def rings(x, y, w, h):
+    r = math.hypot(x - w / 3, y - h / 2)
+    v = 128 + 120 * math.sin(r / 6)
+    return (clamp(v), clamp(v * 0.8), clamp(255 - v))
+
+
+def stripes(x, y, w, h):
+    v = 255 if (y // 24) % 2 else 0
+    return (v, clamp(v * 0.5 + x), clamp(255 - v))
+
+
+def faint(x, y, w, h):
+    v = 120 + 8 * x / w
+    return (clamp(v), clamp(v), clamp(v))
+
+
+def make_noise(w, h):
+    rnd = lcg(42)
+    pixels = [[(next(rnd) % 256, next(rnd) % 256, next(rnd) % 256) for _ in range(w)] for _ in range(h)]
+    return lambda x, y, w, h: pixels[y][x]
+
+
+IMAGES = [
+    ("gradient.png", 256, 256, gradient),
+    ("texture.png", 400, 300, texture),
+    ("checker.png", 320, 240, checker),
+    ("rings.png", 257, 193, rings),
+    ("noise.png", 200, 150, make_noise(200, 150)),
+    ("stripes.png", 120, 360, stripes),
+    ("faint.png", 160, 120, faint),
+]
+
+
+def render(w, h, fn):
+    return [[fn(x, y, w, h) for x in range(w)] for y in range(h)]
+
+
+def write_png(path, pixels):
+    h, w = len(pixels), len(pixels[0])
+    raw = b"".join(b"\x00" + bytes(c for p in row for c in p) for row in pixels)
+
+    def chunk(kind, data):
+        body = kind + data
+        return struct.pack(">I", len(data)) + body + struct.pack(">I", zlib.crc32(body))
+
+    with open(path, "wb") as f:
+        f.write(b"\x89PNG\r\n\x1a\n")
+        f.write(chunk(b"IHDR", struct.pack(">IIBBBBB", w, h, 8, 2, 0, 0, 0)))
+        f.write(chunk(b"IDAT", zlib.compress(raw, 9)))
+        f.write(chunk(b"IEND", b""))
+
+
+# PDQ ------------------------------------------------------------------------------------------
+
+def luma(pixels):
+    return [f32(f32(f32(f32(0.299) * r) + f32(f32(0.587) * g)) + f32(f32(0.114) * b))
+            for row in pixels for (r, g, b) in row]
+
+
+def window_size(old, new=64):
+    return (old + 2 * new - 1) // (2 * new)
+
+
+def box1d(inv, outv, start, n, stride, window):
+    half = (window + 2) // 2
+    s, size = 0.0, 0
+    li = ri = oi = start
+    for _ in range(half - 1):
+        s = f32(s + inv[ri]); size += 1; ri += stride
+    for _ in range(window - half + 1):
+        s = f32(s + inv[ri]); size += 1
+        outv[oi] = f32(s / size); ri += stride; oi += stride
+    for _ in range(n - window):
+        s = f32(f32(s + inv[ri]) - inv[li])
+        outv[oi] = f32(s / size); li += stride; ri += stride; oi += stride
+    for _ in range(half - 1):
+        s = f32(s - inv[li]); size -= 1
+        outv[oi] = f32(s / size); li += stride; oi += stride
+
+
+def jarosz(buf, rows, cols):
+    row_window, col_window = window_size(cols), window_size(rows)
+    tmp = [0.0] * len(buf)
+    for _ in range(2):
+        for i in range(rows):
+            box1d(buf, tmp, i * cols, cols, 1, row_window)
+        for j in range(cols):
+            box1d(tmp, buf, j, rows, cols, col_window)
+
+
+def decimate(buf, rows, cols):
+    return [[buf[int((i + 0.5) * rows / 64) * cols + int((j + 0.5) * cols / 64)] for j in range(64)]
+            for i in range(64)]
+
+
+def quality(a):
+    total = 0
+    for i in range(63):
+        for j in range(64):
+            total += abs(int(f32(f32(f32(a[i][j] - a[i + 1][j]) * 100) / 255)))
+    for i in range(64):
+        for j in range(63):
+            total += abs(int(f32(f32(f32(a[i][j] - a[i][j + 1]) * 100) / 255)))
+    return min(total // 90, 100)
+
+
+DCT = [[f32(math.sqrt(2 / 64) * math.cos(math.pi / 2 / 64 * (i + 1) * (2 * j + 1))) for j in range(64)]
+       for i in range(16)]
+
+
+def dct16(a):
+    tmp = []
+    for i in range(16):
+        row = []
+        for j in range(64):
+            s = 0.0
+            for k in range(64):
+                s = f32(s + f32(DCT[i][k] * a[k][j]))
+            row.append(s)
+        tmp.append(row)
+    coefs = []
+    for i in range(16):
+        for j in range(16):
+            s = 0.0
+            for k in range(64):
+                s = f32(s + f32(tmp[i][k] * DCT[j][k]))
+            coefs.append(s)
+    return coefs
+
+
+def pdq(pixels):
+    rows, cols = len(pixels), len(pixels[0])
+    buf = luma(pixels)
+    jarosz(buf, rows, cols)
+    small = decimate(buf, rows, cols)
+    coefs = dct16(small)
+    median = sorted(coefs)[127]
+
+    # bit k is coefficient k; the hexadecimal form starts from bit 255, as in Hash256::format.
+    value = 0
+    for k, c in enumerate(coefs):
+        if c > median:
+            value |= 1 << k
+    return "%064x" % value, quality(small)
+
+
+def main():
+    with open("expected.txt", "w") as out:
+        for name, w, h, fn in IMAGES:
+            pixels = render(w, h, fn)
+            write_png(name, pixels)
+            digest, q = pdq(pixels)
+            out.write("%s,%d,%s\n" % (digest, q, name))
+
+
+if __name__ == "__main__":
+    main()
@@ -222,3 +222,94 @@ func DCT2D(input [][]float64, w int, h int) [][]float64 {
 	wg.Wait()
 	return output
 }
+
+// HaarWavelet2D function returns a result of the 2D Haar discrete wavelet transform applied
+// level times over a square input whose side is a power of two. At each level the current
+// low-pass (LL) quadrant, in the top-left corner, is decomposed again.
+func HaarWavelet2D(input [][]float64, size int, level int) [][]float64 {
+	output := make([][]float64, size)
+	for i := range output {
+		output[i] = make([]float64, size)
+		copy(output[i], input[i])
+	}
+
+	temp := make([]float64, size)
+	for n := size; level > 0 && n > 1; n, level = n/2, level-1 {
+		// rows.
+		for y := 0; y < n; y++ {
+			haar1D(output[y][:n], temp)
+		}
+
+		// columns.
+		col := make([]float64, n)
+		for x := 0; x < n; x++ {
+			for y := 0; y < n; y++ {
+				col[y] = output[y][x]
+			}
+			haar1D(col, temp)
+			for y := 0; y < n; y++ {
+				output[y][x] = col[y]
+			}
+		}
+	}
+
+	return output
+}
+
+// InverseHaarWavelet2D function reverses HaarWavelet2D for the same size and level.
+func InverseHaarWavelet2D(input [][]float64, size int, level int) [][]float64 {
+	output := make([][]float64, size)
+	for i := range output {
+		output[i] = make([]float64, size)
+		copy(output[i], input[i])
+	}
+
+	n := size
+	for l := 0; l < level && n > 1; l++ {
+		n /= 2
+	}
+
+	temp := make([]float64, size)
+	for n *= 2; level > 0 && n <= size; n, level = n*2, level-1 {
+		// columns.
+		col := make([]float64, n)
+		for x := 0; x < n; x++ {
+			for y := 0; y < n; y++ {
+				col[y] = output[y][x]
+			}
+			inverseHaar1D(col, temp)
+			for y := 0; y < n; y++ {
+				output[y][x] = col[y]
+			}
+		}
+
+		// rows.
+		for y := 0; y < n; y++ {
+			inverseHaar1D(output[y][:n], temp)
+		}
+	}
+
+	return output
+}
+
+// haar1D applies one level of the orthonormal Haar transform, leaving the averages in the
+// first half of input and the details in the second half.
+func haar1D(input, temp []float64) {
+	half := len(input) / 2
+	for i := 0; i < half; i++ {
+		a, b := input[2*i], input[2*i+1]
+		temp[i] = (a + b) / math.Sqrt2
+		temp[half+i] = (a - b) / math.Sqrt2
+	}
+	copy(input, temp[:len(input)])
+}
+
+func inverseHaar1D(input, temp []float64) {
+	half := len(input) / 2
+	for i := 0; i < half; i++ {
+		s, d := input[i], input[half+i]
+		temp[2*i] = (s + d) / math.Sqrt2
+		temp[2*i+1] = (s - d) / math.Sqrt2
+	}
+	copy(input, temp[:len(input)])
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/nfnt/resize"
 	"image"
 	"image/jpeg"
+	"math"
 	"os"
 	"testing"
 )
@@ -28,6 +29,28 @@ func TestConvertToGrayArray(t *testing.T) {
 	}
 }
 
+func TestHaarWavelet2D(t *testing.T) {
+	size := 8
+	input := make([][]float64, size)
+	for y := range input {
+		input[y] = make([]float64, size)
+		for x := range input[y] {
+			input[y][x] = float64((x*7 + y*13) % 17)
+		}
+	}
+
+	coeffs := HaarWavelet2D(input, size, 3)
+	output := InverseHaarWavelet2D(coeffs, size, 3)
+
+	for y := range input {
+		for x := range input[y] {
+			if math.Abs(input[y][x]-output[y][x]) > 1e-9 {
+				t.Fatalf("pixel (%d,%d): expected %v, got %v", x, y, input[y][x], output[y][x])
+			}
+		}
+	}
+}
+
 func loadImage(t *testing.T, uri string) image.Image {
 	t.Helper()
 
@@ -0,0 +1,8 @@
+package media
+
+// Allowlist holds the SHA1 of known-good files, such as the NSRL RDS, which are skipped by the
+// search before any image decoding.
+type Allowlist interface {
+	Contains(sha1 string) bool
+	Len() int
+}
@@ -0,0 +1,263 @@
+package media
+
+import (
+	"strings"
+	"time"
+
+	"github.com/tsmweb/chasam/app/hash"
+)
+
+// Cache stores the hashes computed by NewMedia, so that a file whose size and modification
+// time did not change since a previous search is neither read nor decoded again.
+type Cache interface {
+	// Get returns the entry of path, if it was stored with the same size and modification time.
+	Get(path string, size int64, modifiedAt time.Time) (*CacheEntry, bool)
+	Put(path string, size int64, modifiedAt time.Time, entry *CacheEntry)
+	// Close saves the entries stored since the cache was opened.
+	Close() error
+}
+
+// CacheEntry holds the content type and the hashes of a file, the settings its perceptual
+// hashes were computed with and the quality of its PDQ hash.
+//
+// Variants holds the perceptual hashes of each dihedral transform of an image and Thumbnail
+// the entry of its EXIF thumbnail, with an empty content type for an image without one. Both
+// are nil until they are computed.
+type CacheEntry struct {
+	ContentType string
+	Settings    Settings
+	Hashes      map[hash.Type]string
+	PHashes     map[hash.Type]uint64
+	ExtHashes   map[hash.Type][]uint64
+	PDQQuality  int
+	Variants    map[hash.Dihedral]map[hash.Type]uint64
+	Thumbnail   *CacheEntry
+}
+
+func NewCacheEntry(contentType string) *CacheEntry {
+	return &CacheEntry{
+		ContentType: contentType,
+		Hashes:      make(map[hash.Type]string),
+		PHashes:     make(map[hash.Type]uint64),
+		ExtHashes:   make(map[hash.Type][]uint64),
+	}
+}
+
+// Copy returns a copy of the entry, to which hashes can be added without changing it.
+func (e *CacheEntry) Copy() *CacheEntry {
+	entry := NewCacheEntry(e.ContentType)
+	entry.Settings = e.Settings
+	entry.PDQQuality = e.PDQQuality
+	for hashType, h := range e.Hashes {
+		entry.Hashes[hashType] = h
+	}
+	for hashType, h := range e.PHashes {
+		entry.PHashes[hashType] = h
+	}
+	for hashType, h := range e.ExtHashes {
+		entry.ExtHashes[hashType] = h
+	}
+	if e.Variants != nil {
+		entry.Variants = make(map[hash.Dihedral]map[hash.Type]uint64, len(e.Variants))
+		for d, hashes := range e.Variants {
+			entry.Variants[d] = make(map[hash.Type]uint64, len(hashes))
+			for hashType, h := range hashes {
+				entry.Variants[d][hashType] = h
+			}
+		}
+	}
+	if e.Thumbnail != nil {
+		entry.Thumbnail = e.Thumbnail.Copy()
+	}
+	return entry
+}
+
+// DropPerceptual removes the perceptual hashes of the entry, keeping the cryptographic ones,
+// which do not depend on the settings. The thumbnail is always hashed with the default
+// settings, so it is kept.
+func (e *CacheEntry) DropPerceptual() {
+	e.PHashes = make(map[hash.Type]uint64)
+	e.ExtHashes = make(map[hash.Type][]uint64)
+	e.Variants = nil
+}
+
+// Contains reports whether the entry holds the hash of hashType.
+func (e *CacheEntry) Contains(hashType hash.Type) bool {
+	if hashType.IsExtended() {
+		// a hash of another size than the settings of the entry is computed again.
+		h, ok := e.ExtHashes[hashType]
+		words := hashType.Words(e.Settings.HashSize)
+		return ok && (len(h) == 0 || words == 0 || len(h) == words)
+	}
+	if hashType.IsPerceptual() {
+		_, ok := e.PHashes[hashType]
+		return ok
+	}
+	_, ok := e.Hashes[hashType]
+	return ok
+}
+
+// containsVariants reports whether the entry holds the hashes of hashTypes of every dihedral
+// variant.
+func (e *CacheEntry) containsVariants(hashTypes []hash.Type) bool {
+	if e.Variants == nil {
+		return false
+	}
+	for _, d := range hash.Dihedrals() {
+		hashes, ok := e.Variants[d]
+		if !ok {
+			return false
+		}
+		for _, h := range variantTypes(hashTypes) {
+			if _, ok = hashes[h]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// containsThumbnail reports whether the entry tells the hashes of hashTypes of the thumbnail,
+// or that the image has none.
+func (e *CacheEntry) containsThumbnail(hashTypes []hash.Type) bool {
+	if e.Thumbnail == nil {
+		return false
+	}
+	if e.Thumbnail.ContentType == "" {
+		return true
+	}
+	for _, h := range variantTypes(hashTypes) {
+		if !e.Thumbnail.Contains(h) {
+			return false
+		}
+	}
+	return true
+}
+
+// restore copies the hashes of the entry to the media.
+func (m *Media) restore(entry *CacheEntry) {
+	for hashType, h := range entry.Hashes {
+		switch hashType {
+		case hash.SHA1:
+			m.sha1 = h
+		case hash.ED2K:
+			m.ed2k = h
+		case hash.MD5:
+			m.md5 = h
+		}
+	}
+
+	for hashType, h := range entry.PHashes {
+		m.setPerceptualHash(hashType, h)
+	}
+
+	for hashType, h := range entry.ExtHashes {
+		switch hashType {
+		case hash.SegmentHash:
+			m.segmentHash = h
+		case hash.PDQ:
+			m.pdq = h
+			m.pdqQuality = entry.PDQQuality
+		case hash.DHashExt:
+			m.dHashExt = h
+		case hash.PHashExt:
+			m.pHashExt = h
+		}
+	}
+}
+
+// store copies the hashes of hashTypes from the media to the entry.
+func (m *Media) store(entry *CacheEntry, hashTypes []hash.Type) {
+	for _, hashType := range hashTypes {
+		switch hashType {
+		case hash.SHA1:
+			entry.Hashes[hashType] = m.sha1
+		case hash.ED2K:
+			entry.Hashes[hashType] = m.ed2k
+		case hash.MD5:
+			entry.Hashes[hashType] = m.md5
+		case hash.AHash:
+			entry.PHashes[hashType] = m.aHash
+		case hash.DHash:
+			entry.PHashes[hashType] = m.dHash
+		case hash.DHashV:
+			entry.PHashes[hashType] = m.dHashV
+		case hash.PHash:
+			entry.PHashes[hashType] = m.pHash
+		case hash.DomiHash:
+			entry.PHashes[hashType] = m.domiHash
+		case hash.ChHash:
+			entry.PHashes[hashType] = m.chHash
+		case hash.WHash:
+			entry.PHashes[hashType] = m.wHash
+		case hash.SegmentHash:
+			entry.ExtHashes[hashType] = m.segmentHash
+		case hash.PDQ:
+			entry.ExtHashes[hashType] = m.pdq
+			entry.PDQQuality = m.pdqQuality
+		case hash.DHashExt:
+			entry.ExtHashes[hashType] = m.dHashExt
+		case hash.PHashExt:
+			entry.ExtHashes[hashType] = m.pHashExt
+		}
+	}
+}
+
+// restoreVariants sets the variants of the media from the hashes of hashTypes of the entry.
+func (m *Media) restoreVariants(entry *CacheEntry, hashTypes []hash.Type) {
+	for _, d := range hash.Dihedrals() {
+		v := m.newVariant()
+		for _, h := range variantTypes(hashTypes) {
+			v.setPerceptualHash(h, entry.Variants[d][h])
+		}
+		m.variants = append(m.variants, Variant{Transform: d, Media: v})
+	}
+}
+
+// storeVariants copies the hashes of the variants of the media to the entry.
+func (m *Media) storeVariants(entry *CacheEntry) {
+	if entry.Variants == nil {
+		entry.Variants = make(map[hash.Dihedral]map[hash.Type]uint64)
+	}
+	for _, v := range m.variants {
+		hashes, ok := entry.Variants[v.Transform]
+		if !ok {
+			hashes = make(map[hash.Type]uint64)
+			entry.Variants[v.Transform] = hashes
+		}
+		for h := range v.hasHash {
+			hashes[h] = v.PerceptualHash(h)
+		}
+	}
+}
+
+// restoreThumbnail sets the thumbnail of the media from the entry, if the image has one.
+func (m *Media) restoreThumbnail(entry *CacheEntry, hashTypes []hash.Type) {
+	if entry.Thumbnail.ContentType == "" {
+		return
+	}
+	thumb := &Media{name: m.name, path: m.path, modifiedAt: m.modifiedAt,
+		contentType: entry.Thumbnail.ContentType, open: m.openThumbnail}
+	thumb.mediaType = strings.Split(thumb.contentType, "/")[0]
+	for _, h := range variantTypes(hashTypes) {
+		thumb.setPerceptualHash(h, entry.Thumbnail.PHashes[h])
+	}
+	m.thumbnail = thumb
+}
+
+// storeThumbnail copies the hashes of the thumbnail of the media to the entry, with an empty
+// content type if the image has none.
+func (m *Media) storeThumbnail(entry *CacheEntry) {
+	if m.thumbnail == nil {
+		entry.Thumbnail = NewCacheEntry("")
+		return
+	}
+	thumb := NewCacheEntry(m.thumbnail.contentType)
+	if entry.Thumbnail != nil && entry.Thumbnail.ContentType == thumb.ContentType {
+		thumb = entry.Thumbnail
+	}
+	for h := range m.thumbnail.hasHash {
+		thumb.PHashes[h] = m.thumbnail.PerceptualHash(h)
+	}
+	entry.Thumbnail = thumb
+}
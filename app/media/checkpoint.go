@@ -0,0 +1,25 @@
+package media
+
+import "time"
+
+// Checkpoint records the files handled by a search, so that an interrupted search can be
+// resumed without handling them again.
+type Checkpoint interface {
+	// Done reports whether path was handled by a previous search.
+	Done(path string) bool
+	// MarkDone records that path was handled. For a matched file it is called after OnMatch.
+	MarkDone(path string)
+	// Save persists the files marked so far. It is called by the match stage, so it never runs
+	// concurrently with OnMatch.
+	Save() error
+}
+
+// WithCheckpoint makes the Search skip the files already done in the checkpoint, mark the files
+// it handles and save the checkpoint every interval and when it finishes. Files that could not be
+// handled are not marked, so they are retried by a resumed search.
+func WithCheckpoint(checkpoint Checkpoint, interval time.Duration) Option {
+	return func(o *options) {
+		o.checkpoint = checkpoint
+		o.checkpointInterval = interval
+	}
+}
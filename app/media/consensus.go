@@ -0,0 +1,213 @@
+package media
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tsmweb/chasam/app/hash"
+)
+
+// Policy decides from the hash types that matched a reference whether the media is taken for
+// the same image.
+type Policy int
+
+const (
+	// PolicyAny takes a reference matched by any hash type.
+	PolicyAny Policy = iota
+	// PolicyMajority takes a reference matched by more than half of the hash types.
+	PolicyMajority
+	// PolicyAll takes a reference matched by every hash type.
+	PolicyAll
+	// PolicyWeighted takes a reference whose score reaches the minimum score.
+	PolicyWeighted
+)
+
+var policyNames = []string{"any", "majority", "all", "weighted"}
+
+// ParsePolicy returns the policy named name: any, majority, all or weighted.
+func ParsePolicy(name string) (Policy, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, n := range policyNames {
+		if name == n {
+			return Policy(i), nil
+		}
+	}
+	return -1, fmt.Errorf("unknown policy %q", name)
+}
+
+func (p Policy) String() string {
+	if p < 0 || int(p) >= len(policyNames) {
+		return "unknown"
+	}
+	return policyNames[p]
+}
+
+// ParseWeights parses the weights of the hash types in the score, given as a list such as
+// d-hash:2,p-hash:1.5. The types left out weigh 1.
+func ParseWeights(spec string) (map[hash.Type]float64, error) {
+	weights := make(map[hash.Type]float64)
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(item, ":")
+		if !found {
+			name, value, found = strings.Cut(item, "=")
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid weight %q", item)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight %q", item)
+		}
+
+		t, err := hash.ParseType(name)
+		if err != nil {
+			return nil, err
+		}
+		weights[t] = weight
+	}
+	return weights, nil
+}
+
+// Consensus combines the matches of the hash types of a media into a score per reference, from
+// 0 to 1. A hash type scores 1 at distance 0 down to 1/(threshold+1) at its threshold, and 0 if
+// it did not match the reference; the score is the weighted mean of every hash type evaluated.
+type Consensus struct {
+	Policy   Policy
+	MinScore float64
+	Weights  map[hash.Type]float64
+}
+
+// Ballot collects the matches of each hash type evaluated for a media.
+type Ballot struct {
+	evaluated []hash.Type
+	votes     map[candidate]map[hash.Type]Match
+}
+
+// candidate is a reference voted for, identified by its name and category.
+type candidate struct {
+	name     string
+	category string
+}
+
+func NewBallot() *Ballot {
+	return &Ballot{votes: make(map[candidate]map[hash.Type]Match)}
+}
+
+// Evaluate counts the hash type in the score, whether it matches a reference or not.
+func (b *Ballot) Evaluate(hashType hash.Type) {
+	for _, t := range b.evaluated {
+		if t == hashType {
+			return
+		}
+	}
+	b.evaluated = append(b.evaluated, hashType)
+}
+
+// Vote adds the match of the hash type. A reference matched more than once by the same type,
+// such as by the variants of the media, keeps the closest match.
+func (b *Ballot) Vote(hashType hash.Type, match Match) {
+	c := candidate{match.Name, match.Category}
+	votes, ok := b.votes[c]
+	if !ok {
+		votes = make(map[hash.Type]Match)
+		b.votes[c] = votes
+	}
+	if v, ok := votes[hashType]; !ok || similarity(match) > similarity(v) {
+		votes[hashType] = match
+	}
+}
+
+// Count returns the references taken by the policy, highest score first. The hash type,
+// distance and threshold of each match are those of its closest hash type.
+func (c *Consensus) Count(b *Ballot) []Match {
+	var matches []Match
+
+	for ref, votes := range b.votes {
+		var total, score float64
+		for _, t := range b.evaluated {
+			w := c.weight(t)
+			total += w
+			if v, ok := votes[t]; ok {
+				score += w * similarity(v)
+			}
+		}
+		if total > 0 {
+			score /= total
+		}
+
+		n := 0
+		for _, t := range b.evaluated {
+			if _, ok := votes[t]; ok {
+				n++
+			}
+		}
+		switch c.Policy {
+		case PolicyMajority:
+			if 2*n <= len(b.evaluated) {
+				continue
+			}
+		case PolicyAll:
+			if n < len(b.evaluated) {
+				continue
+			}
+		case PolicyWeighted:
+			if score < c.MinScore {
+				continue
+			}
+		}
+
+		match := Match{
+			Name:      ref.name,
+			Category:  ref.category,
+			Distances: make(map[hash.Type]int, len(votes)),
+			Score:     score,
+		}
+		best := -1.0
+		for _, t := range b.evaluated {
+			v, ok := votes[t]
+			if !ok {
+				continue
+			}
+			match.Distances[t] = v.Distance
+			if s := similarity(v); s > best {
+				best = s
+				match.HashType, match.Distance, match.Threshold = v.HashType, v.Distance, v.Threshold
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		matches = append(matches, match)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		if matches[i].Name != matches[j].Name {
+			return matches[i].Name < matches[j].Name
+		}
+		return matches[i].Category < matches[j].Category
+	})
+	return matches
+}
+
+func (c *Consensus) weight(hashType hash.Type) float64 {
+	if w, ok := c.Weights[hashType]; ok {
+		return w
+	}
+	return 1
+}
+
+// similarity normalizes the distance of the match by its threshold.
+func similarity(match Match) float64 {
+	return 1 - float64(match.Distance)/float64(match.Threshold+1)
+}
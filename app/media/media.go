@@ -1,10 +1,12 @@
 package media
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"image"
-	"os"
+	"io"
+	"io/fs"
 	"path/filepath"
 	"strings"
 	"time"
@@ -13,10 +15,28 @@ import (
 	"github.com/tsmweb/chasam/common/mediautil"
 )
 
+// ErrAllowlisted is returned by NewMedia for the files in the allowlist.
+var ErrAllowlisted = errors.New("file in the allowlist")
+
 type Match struct {
-	Name     string
+	Name string
+	// Category is the category the reference set assigns to the file, if any.
+	Category string
 	HashType string
 	Distance int
+	// Threshold is the hamming distance up to which the hashes were taken for the same image.
+	Threshold int
+	// Distances holds the distance of each hash type that matched the reference, and Score the
+	// confidence of the Consensus of the hash types, from 0 to 1.
+	Distances map[hash.Type]int
+	Score     float64
+}
+
+// Variant holds the perceptual hashes of the image transformed by one of the dihedral
+// transforms.
+type Variant struct {
+	Transform hash.Dihedral
+	*Media
 }
 
 // Media represents the information of a media and its hash.
@@ -28,6 +48,7 @@ type Media struct {
 	modifiedAt  time.Time
 	ed2k        string
 	sha1        string
+	md5         string
 	aHash       uint64
 	dHash       uint64
 	dHashV      uint64
@@ -35,88 +56,222 @@ type Media struct {
 	domiHash    uint64
 	chHash      uint64
 	wHash       uint64
+	hasHash     map[hash.Type]bool
+	segmentHash []uint64
+	pdq         []uint64
+	pdqQuality  int
+	dHashExt    []uint64
+	pHashExt    []uint64
 	match       []Match
+	thumbnail   *Media
+	variants    []Variant
+	open        func() (io.ReadCloser, error)
 }
 
-// NewMedia creates and returns a new Media instance.
-func NewMedia(path string, hashTypes []hash.Type) (*Media, error) {
-	file, err := os.Open(path)
+// NewMedia creates and returns a new Media instance of the file name of fsys, such as
+// os.DirFS(dir) or an fstest.MapFS. The name is also the path of the media.
+func NewMedia(fsys fs.FS, name string, hashTypes []hash.Type, opts ...Option) (*Media, error) {
+	return newMediaFromFS(fsys, name, name, hashTypes, newOptions(opts))
+}
+
+// newMediaFromFS creates the Media of the file name of fsys, reported as path.
+func newMediaFromFS(fsys fs.FS, name string, path string, hashTypes []hash.Type, o *options) (*Media, error) {
+	file, err := fsys.Open(name)
 	if err != nil {
 		return nil, fmt.Errorf("Media::NewMedia(%s) | Error: %v", path, err)
 	}
 	defer file.Close()
 
-	// checks if it is valid media.
-	contentType, err := mediautil.GetContentType(file)
+	// get file information.
+	info, err := file.Stat()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Media::NewMedia(%s) | Error: %v", path, err)
 	}
 
-	// get file information.
-	info, err := file.Stat()
+	rs, err := readSeeker(file)
 	if err != nil {
 		return nil, fmt.Errorf("Media::NewMedia(%s) | Error: %v", path, err)
 	}
 
-	_, name := filepath.Split(info.Name())
+	open := func() (io.ReadCloser, error) {
+		return fsys.Open(name)
+	}
+
+	return newMedia(rs, path, info.Size(), info.ModTime(), open, hashTypes, o)
+}
+
+// readSeeker returns the file itself if it can seek, as the files of os.DirFS do, or a reader of
+// its content read to memory.
+func readSeeker(file fs.File) (io.ReadSeeker, error) {
+	if rs, ok := file.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// newMediaFromMemory creates the Media of a content held in memory, such as an archive member
+// whose virtual path is path.
+func newMediaFromMemory(data []byte, path string, modifiedAt time.Time, hashTypes []hash.Type,
+	o *options) (*Media, error) {
+	open := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	return newMedia(bytes.NewReader(data), path, int64(len(data)), modifiedAt, open, hashTypes, o)
+}
+
+// newMedia computes the hashes of the content read from file. The size and the modification time
+// identify the content in the cache and open reads it again after the hashes are computed.
+func newMedia(file io.ReadSeeker, path string, size int64, modifiedAt time.Time,
+	open func() (io.ReadCloser, error), hashTypes []hash.Type, o *options) (*Media, error) {
+	var err error
+	var cached *CacheEntry
+	if o.cache != nil {
+		cached, _ = o.cache.Get(path, size, modifiedAt)
+	}
+
+	var contentType mediautil.ContentType
+	if cached != nil {
+		contentType = mediautil.ContentType(cached.ContentType)
+	} else {
+		// checks if it is valid media.
+		contentType, err = mediautil.GetContentType(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, name := filepath.Split(path)
 
 	m := new(Media)
 	m.path = path
 	m.name = name
-	m.modifiedAt = info.ModTime()
+	m.modifiedAt = modifiedAt
+	m.open = open
 	m.mediaType = strings.Split(contentType.String(), "/")[0]
 	m.contentType = contentType.String()
 
-	var img image.Image
-	getImg := func() image.Image {
-		if img == nil {
-			img, err = mediautil.Decode(file, mediautil.ContentType(m.contentType))
-			if err != nil {
-				return nil
-			}
+	// computed holds the hash types that are not in the cache. The perceptual hashes computed
+	// with other settings are computed again.
+	var computed []hash.Type
+	if cached != nil {
+		if cached.Settings != o.settings() {
+			cached.DropPerceptual()
+			cached.Settings = o.settings()
 		}
-		return img
+		m.restore(cached)
+	} else {
+		cached = NewCacheEntry(m.contentType)
+		cached.Settings = o.settings()
 	}
 
-	for _, h := range hashTypes {
-		switch h {
-		case hash.SHA1:
+	if o.allowlist != nil {
+		if !cached.Contains(hash.SHA1) {
 			if err = m.setSHA1(file); err != nil {
 				return nil, err
 			}
-		case hash.ED2K:
-			if err = m.setED2K(file); err != nil {
-				return nil, err
+			computed = append(computed, hash.SHA1)
+		}
+		if o.allowlist.Contains(m.sha1) {
+			return nil, ErrAllowlisted
+		}
+	}
+
+	// the image is decoded once, by the first hash that needs it.
+	var decoded image.Image
+	var decodeErr error
+	getImg := func() (image.Image, error) {
+		if decoded == nil && decodeErr == nil {
+			if decoded, decodeErr = m.decode(file, o); decodeErr != nil {
+				decodeErr = fmt.Errorf("Media::decode(%s) | Error: %v", path, decodeErr)
 			}
-		case hash.AHash:
-			if err = m.setAHash(getImg()); err != nil {
+		}
+		return decoded, decodeErr
+	}
+
+	for _, h := range hashTypes {
+		if cached.Contains(h) || (h == hash.SHA1 && m.sha1 != "") {
+			continue
+		}
+		computed = append(computed, h)
+
+		var img image.Image
+		if h.IsPerceptual() {
+			if img, err = getImg(); err != nil {
 				return nil, err
 			}
+		}
+
+		switch h {
+		case hash.SHA1:
+			err = m.setSHA1(file)
+		case hash.ED2K:
+			err = m.setED2K(file)
+		case hash.MD5:
+			err = m.setMD5(file)
+		case hash.AHash:
+			err = m.setAHash(img)
 		case hash.DHash:
-			if err = m.setDHash(getImg()); err != nil {
-				return nil, err
-			}
+			err = m.setDHash(img)
 		case hash.DHashV:
-			if err = m.setDHashV(getImg()); err != nil {
-				return nil, err
-			}
+			err = m.setDHashV(img)
 		case hash.PHash:
-			if err = m.setPHash(getImg()); err != nil {
-				return nil, err
-			}
+			err = m.setPHash(img)
 		case hash.DomiHash:
-			if err = m.setDomiHash(getImg()); err != nil {
-				return nil, err
-			}
+			err = m.setDomiHash(img)
 		case hash.ChHash:
-			if err = m.setChHash(getImg()); err != nil {
-				return nil, err
-			}
+			err = m.setChHash(img)
+		case hash.WHash:
+			err = m.setWHash(img)
+		case hash.SegmentHash:
+			err = m.setSegmentHash(img)
+		case hash.PDQ:
+			err = m.setPDQ(img)
+		case hash.DHashExt:
+			err = m.setDHashExt(img, o.extHashSize())
+		case hash.PHashExt:
+			err = m.setPHashExt(img, o.extHashSize())
 		default:
-			return nil, errors.New("hash not found")
+			err = errors.New("hash not found")
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
 
+	// the variants and the thumbnail are stored in the cache as well, so that a search with
+	// them does not decode the files again either.
+	changed := len(computed) > 0
+	if o.dihedral && m.mediaType == "image" {
+		if cached.containsVariants(hashTypes) {
+			m.restoreVariants(cached, hashTypes)
+		} else if img, err := getImg(); err == nil {
+			m.setVariants(img, hashTypes)
+			m.storeVariants(cached)
+			changed = true
+		}
+	}
+
+	if o.thumbnail && contentType == mediautil.ImageJPEG {
+		if cached.containsThumbnail(hashTypes) {
+			m.restoreThumbnail(cached, hashTypes)
+		} else {
+			m.setThumbnail(file, hashTypes)
+			m.storeThumbnail(cached)
+			changed = true
+		}
+	}
+
+	if o.cache != nil && changed {
+		m.store(cached, computed)
+		o.cache.Put(path, size, modifiedAt, cached)
+	}
+
 	return m, nil
 }
 
@@ -148,6 +303,10 @@ func (m *Media) ED2K() string {
 	return m.ed2k
 }
 
+func (m *Media) MD5() string {
+	return m.md5
+}
+
 func (m *Media) AHash() uint64 {
 	return m.aHash
 }
@@ -173,10 +332,223 @@ func (m *Media) ChHash() uint64 {
 }
 
 func (m *Media) WHash() uint64 {
-	return 0
+	return m.wHash
+}
+
+// SegmentHash returns the difference hashes of the segments of the image, the largest first.
+func (m *Media) SegmentHash() []uint64 {
+	return m.segmentHash
+}
+
+// PDQ returns the 256-bit PDQ hash, empty if the quality of the image is under
+// hash.PDQMinQuality.
+func (m *Media) PDQ() []uint64 {
+	return m.pdq
+}
+
+// PDQQuality returns the quality of the PDQ hash, from 0 for a plain image to 100, also for an
+// image whose hash was left out, or 0 if the PDQ hash was not computed.
+func (m *Media) PDQQuality() int {
+	return m.pdqQuality
 }
 
-func (m *Media) setSHA1(f *os.File) error {
+// DHashExt returns the difference hash of size*size bits, the size given by WithHashSize.
+func (m *Media) DHashExt() []uint64 {
+	return m.dHashExt
+}
+
+// PHashExt returns the perception hash of size*size bits, the size given by WithHashSize.
+func (m *Media) PHashExt() []uint64 {
+	return m.pHashExt
+}
+
+// ExtHash returns the extended hash of hashType, or nil if it was not computed.
+func (m *Media) ExtHash(hashType hash.Type) []uint64 {
+	switch hashType {
+	case hash.SegmentHash:
+		return m.segmentHash
+	case hash.PDQ:
+		return m.pdq
+	case hash.DHashExt:
+		return m.dHashExt
+	case hash.PHashExt:
+		return m.pHashExt
+	default:
+		return nil
+	}
+}
+
+// Thumbnail returns the media of the EXIF thumbnail, holding its perceptual hashes, or nil if
+// the image has none or it was not requested with WithThumbnail.
+func (m *Media) Thumbnail() *Media {
+	return m.thumbnail
+}
+
+// Variants returns the perceptual hashes of the rotated and mirrored image, if they were
+// requested with WithDihedral.
+func (m *Media) Variants() []Variant {
+	return m.variants
+}
+
+// Has reports whether the media has the hash of hashType. A perceptual hash of 0, such as the
+// d-hash of a plain image, is a hash; an extended hash left out, such as a PDQ of low quality,
+// is not.
+func (m *Media) Has(hashType hash.Type) bool {
+	switch {
+	case hashType == hash.SHA1:
+		return m.sha1 != ""
+	case hashType == hash.ED2K:
+		return m.ed2k != ""
+	case hashType == hash.MD5:
+		return m.md5 != ""
+	case hashType.IsExtended():
+		return len(m.ExtHash(hashType)) > 0
+	default:
+		return m.hasHash[hashType]
+	}
+}
+
+// PerceptualHash returns the perceptual hash of hashType, or 0 if it was not computed, which
+// Has tells from a hash of 0.
+func (m *Media) PerceptualHash(hashType hash.Type) uint64 {
+	switch hashType {
+	case hash.AHash:
+		return m.aHash
+	case hash.DHash:
+		return m.dHash
+	case hash.DHashV:
+		return m.dHashV
+	case hash.PHash:
+		return m.pHash
+	case hash.DomiHash:
+		return m.domiHash
+	case hash.ChHash:
+		return m.chHash
+	case hash.WHash:
+		return m.wHash
+	default:
+		return 0
+	}
+}
+
+// setVariants computes the perceptual hashes of img transformed by each dihedral transform.
+func (m *Media) setVariants(img image.Image, hashTypes []hash.Type) {
+	for _, d := range hash.Dihedrals() {
+		v := m.newVariant()
+		transformed := d.Apply(img)
+
+		for _, h := range variantTypes(hashTypes) {
+			value, err := hash.PerceptualHash(h, transformed)
+			if err != nil {
+				continue
+			}
+			v.setPerceptualHash(h, value)
+		}
+		m.variants = append(m.variants, Variant{Transform: d, Media: v})
+	}
+}
+
+// newVariant returns a media of the same file, whose hashes are set by the caller.
+func (m *Media) newVariant() *Media {
+	return &Media{name: m.name, path: m.path, mediaType: m.mediaType, contentType: m.contentType,
+		modifiedAt: m.modifiedAt, open: m.open}
+}
+
+// variantTypes returns the hash types of hashTypes computed for the variants and the thumbnail,
+// the perceptual hashes of 64 bits.
+func variantTypes(hashTypes []hash.Type) []hash.Type {
+	var types []hash.Type
+	for _, h := range hashTypes {
+		if h.IsPerceptual() && !h.IsExtended() {
+			types = append(types, h)
+		}
+	}
+	return types
+}
+
+// setPerceptualHash sets the perceptual hash of hashType.
+func (m *Media) setPerceptualHash(hashType hash.Type, value uint64) {
+	if m.hasHash == nil {
+		m.hasHash = make(map[hash.Type]bool)
+	}
+	m.hasHash[hashType] = true
+
+	switch hashType {
+	case hash.AHash:
+		m.aHash = value
+	case hash.DHash:
+		m.dHash = value
+	case hash.DHashV:
+		m.dHashV = value
+	case hash.PHash:
+		m.pHash = value
+	case hash.DomiHash:
+		m.domiHash = value
+	case hash.ChHash:
+		m.chHash = value
+	case hash.WHash:
+		m.wHash = value
+	}
+}
+
+// decode decodes the image read from f, turned upright by its EXIF orientation unless it was
+// disabled with WithOrientation.
+func (m *Media) decode(f io.ReadSeeker, o *options) (image.Image, error) {
+	contentType := mediautil.ContentType(m.contentType)
+
+	orientation := 1
+	if !o.ignoreOrientation && (contentType == mediautil.ImageJPEG || contentType == mediautil.ImageTIFF) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		orientation, _ = mediautil.ExtractOrientation(f)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	img, err := mediautil.Decode(f, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return mediautil.Orient(img, orientation), nil
+}
+
+// setThumbnail computes the perceptual hashes of the EXIF thumbnail. An image without a
+// thumbnail, or whose thumbnail cannot be decoded, is left without it.
+func (m *Media) setThumbnail(f io.ReadSeeker, hashTypes []hash.Type) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	data, err := mediautil.ExtractThumbnail(f)
+	if err != nil || len(data) == 0 {
+		return
+	}
+
+	thumb, err := newMediaFromMemory(data, m.path, m.modifiedAt, variantTypes(hashTypes), new(options))
+	if err != nil {
+		return
+	}
+	m.thumbnail = thumb
+}
+
+// openThumbnail reads the EXIF thumbnail of the media, the content of a thumbnail restored
+// from the cache.
+func (m *Media) openThumbnail() (io.ReadCloser, error) {
+	f, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := mediautil.ExtractThumbnail(f)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *Media) setSHA1(f io.ReadSeeker) error {
 	h, err := hash.Sha1Hash(f)
 	if err != nil {
 		return fmt.Errorf("Media::setSHA1(%s) | Error: %v", m.path, err)
@@ -185,7 +557,7 @@ func (m *Media) setSHA1(f *os.File) error {
 	return nil
 }
 
-func (m *Media) setED2K(f *os.File) error {
+func (m *Media) setED2K(f io.ReadSeeker) error {
 	h, err := hash.Ed2kHash(f)
 	if err != nil {
 		return fmt.Errorf("Media::setED2K(%s) | Error: %v", m.path, err)
@@ -194,12 +566,21 @@ func (m *Media) setED2K(f *os.File) error {
 	return nil
 }
 
+func (m *Media) setMD5(f io.ReadSeeker) error {
+	h, err := hash.Md5Hash(f)
+	if err != nil {
+		return fmt.Errorf("Media::setMD5(%s) | Error: %v", m.path, err)
+	}
+	m.md5 = h
+	return nil
+}
+
 func (m *Media) setAHash(img image.Image) error {
 	h, err := hash.AverageHash(img)
 	if err != nil {
 		return fmt.Errorf("Media::setAHash(%s) | Error: %v", m.path, err)
 	}
-	m.aHash = h
+	m.setPerceptualHash(hash.AHash, h)
 	return nil
 }
 
@@ -208,7 +589,7 @@ func (m *Media) setDHash(img image.Image) error {
 	if err != nil {
 		return fmt.Errorf("Media::setDHash(%s) | Error: %v", m.path, err)
 	}
-	m.dHash = h
+	m.setPerceptualHash(hash.DHash, h)
 	return nil
 }
 
@@ -217,7 +598,7 @@ func (m *Media) setDHashV(img image.Image) error {
 	if err != nil {
 		return fmt.Errorf("Media::setDHashV(%s) | Error: %v", m.path, err)
 	}
-	m.dHashV = h
+	m.setPerceptualHash(hash.DHashV, h)
 	return nil
 }
 
@@ -226,7 +607,7 @@ func (m *Media) setPHash(img image.Image) error {
 	if err != nil {
 		return fmt.Errorf("Media::setPHash(%s) | Error: %v", m.path, err)
 	}
-	m.pHash = h
+	m.setPerceptualHash(hash.PHash, h)
 	return nil
 }
 
@@ -235,7 +616,7 @@ func (m *Media) setDomiHash(img image.Image) error {
 	if err != nil {
 		return fmt.Errorf("Media::setDomiHash(%s) | Error: %v", m.path, err)
 	}
-	m.domiHash = h
+	m.setPerceptualHash(hash.DomiHash, h)
 	return nil
 }
 
@@ -244,24 +625,85 @@ func (m *Media) setChHash(img image.Image) error {
 	if err != nil {
 		return fmt.Errorf("Media::setChHash(%s) | Error: %v", m.path, err)
 	}
-	m.chHash = h
+	m.setPerceptualHash(hash.ChHash, h)
+	return nil
+}
+
+func (m *Media) setWHash(img image.Image) error {
+	h, err := hash.WaveletHash(img)
+	if err != nil {
+		return fmt.Errorf("Media::setWHash(%s) | Error: %v", m.path, err)
+	}
+	m.setPerceptualHash(hash.WHash, h)
+	return nil
+}
+
+func (m *Media) setSegmentHash(img image.Image) error {
+	h, err := hash.CropResistantHash(img)
+	if err != nil {
+		return fmt.Errorf("Media::setSegmentHash(%s) | Error: %v", m.path, err)
+	}
+	m.segmentHash = h
+	return nil
+}
+
+func (m *Media) setPDQ(img image.Image) error {
+	h, quality, err := hash.PDQHash(img)
+	if err != nil {
+		return fmt.Errorf("Media::setPDQ(%s) | Error: %v", m.path, err)
+	}
+	if quality < hash.PDQMinQuality {
+		h = []uint64{}
+	}
+	m.pdq = h
+	m.pdqQuality = quality
+	return nil
+}
+
+func (m *Media) setDHashExt(img image.Image, size int) error {
+	h, err := hash.ExtDifferenceHash(img, size)
+	if err != nil {
+		return fmt.Errorf("Media::setDHashExt(%s) | Error: %v", m.path, err)
+	}
+	m.dHashExt = h
 	return nil
 }
 
-func (m *Media) AddMatch(name string, hashType string, distance int) {
+func (m *Media) setPHashExt(img image.Image, size int) error {
+	h, err := hash.ExtPerceptionHash(img, size)
+	if err != nil {
+		return fmt.Errorf("Media::setPHashExt(%s) | Error: %v", m.path, err)
+	}
+	m.pHashExt = h
+	return nil
+}
+
+func (m *Media) AddMatch(name string, hashType string, distance int, threshold int) {
 	m.match = append(m.match, Match{
-		Name:     name,
-		HashType: hashType,
-		Distance: distance,
+		Name:      name,
+		HashType:  hashType,
+		Distance:  distance,
+		Threshold: threshold,
 	})
 }
 
+// AddMatches adds the matches taken by a Consensus.
+func (m *Media) AddMatches(matches ...Match) {
+	m.match = append(m.match, matches...)
+}
+
 func (m *Media) Match() []Match {
 	return m.match
 }
 
+// Open returns a reader of the media content, which is read from the archive member held in
+// memory or from the file system of the media.
+func (m *Media) Open() (io.ReadCloser, error) {
+	return m.open()
+}
+
 func (m *Media) getImage() (image.Image, error) {
-	f, err := os.Open(m.path)
+	f, err := m.Open()
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,156 @@
+package media
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsmweb/chasam/app/hash"
+)
+
+// Option configures NewMedia and the Search, which passes its options to NewMedia.
+type Option func(*options)
+
+type options struct {
+	allowlist Allowlist
+	cache     Cache
+
+	checkpoint         Checkpoint
+	checkpointInterval time.Duration
+
+	archiveDepth int
+	thumbnail    bool
+	dihedral     bool
+
+	ignoreOrientation bool
+	hashSize          int
+}
+
+// Settings are the options of NewMedia that change the perceptual hashes. The hashes of a cache
+// or of a hash database are only compared to the ones computed with the same settings.
+type Settings struct {
+	// Orientation tells whether the EXIF orientation is applied before the perceptual hashes.
+	Orientation bool
+	// HashSize is the side of the grid of bits of DHashExt and PHashExt.
+	HashSize int
+}
+
+// SettingsOf returns the settings of opts.
+func SettingsOf(opts ...Option) Settings {
+	return newOptions(opts).settings()
+}
+
+func (o *options) settings() Settings {
+	return Settings{Orientation: !o.ignoreOrientation, HashSize: o.extHashSize()}
+}
+
+// extHashSize returns the size given by WithHashSize or hash.DefaultExtHashSize.
+func (o *options) extHashSize() int {
+	if o.hashSize == 0 {
+		return hash.DefaultExtHashSize
+	}
+	return o.hashSize
+}
+
+func (s Settings) String() string {
+	return fmt.Sprintf("orientation=%t, hash-size=%d", s.Orientation, s.HashSize)
+}
+
+// ParseSettings parses the settings formatted by String, such as the ones recorded in a hash set.
+func ParseSettings(s string) (Settings, error) {
+	var settings Settings
+	seen := make(map[string]bool)
+
+	for _, field := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		var err error
+		switch {
+		case seen[key]:
+			err = fmt.Errorf("repeated setting %q", key)
+		case key == "orientation":
+			settings.Orientation, err = strconv.ParseBool(value)
+		case key == "hash-size":
+			settings.HashSize, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown setting %q", key)
+		}
+		if err != nil {
+			return Settings{}, fmt.Errorf("invalid settings %q: %v", s, err)
+		}
+		seen[key] = true
+	}
+	if len(seen) != 2 {
+		return Settings{}, fmt.Errorf("invalid settings %q: expected orientation and hash-size", s)
+	}
+	return settings, nil
+}
+
+func newOptions(opts []Option) *options {
+	o := new(options)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithAllowlist makes NewMedia return ErrAllowlisted for the files whose SHA1 is in the
+// allowlist, before the image is decoded.
+func WithAllowlist(allowlist Allowlist) Option {
+	return func(o *options) {
+		o.allowlist = allowlist
+	}
+}
+
+// WithCache makes NewMedia take the hashes of unchanged files from the cache and store the
+// hashes it computes.
+func WithCache(cache Cache) Option {
+	return func(o *options) {
+		o.cache = cache
+	}
+}
+
+// WithArchiveDepth makes the Search hash the members of the zip, tar, tar.gz and gz archives it
+// finds, descending into up to depth levels of nested archives. Members are named by a virtual
+// path such as evidence.zip!/dir/img.jpg.
+func WithArchiveDepth(depth int) Option {
+	return func(o *options) {
+		o.archiveDepth = depth
+	}
+}
+
+// WithThumbnail makes NewMedia also compute the perceptual hashes of the JPEG thumbnail stored
+// in the EXIF of the image, returned by Media.Thumbnail.
+func WithThumbnail() Option {
+	return func(o *options) {
+		o.thumbnail = true
+	}
+}
+
+// WithOrientation enables or disables the EXIF orientation applied to the images before their
+// perceptual hashes are computed, so that a rotated photo hashes as the upright one. It is
+// enabled by default. The perceptual hashes of the cache computed under the other setting are
+// computed again.
+func WithOrientation(enabled bool) Option {
+	return func(o *options) {
+		o.ignoreOrientation = !enabled
+	}
+}
+
+// WithDihedral makes NewMedia also compute the perceptual hashes of the image rotated by 90°,
+// 180° and 270° and mirrored, returned by Media.Variants, so that a flipped or rotated copy
+// matches the reference.
+func WithDihedral() Option {
+	return func(o *options) {
+		o.dihedral = true
+	}
+}
+
+// WithHashSize sets the side of the grid of bits of DHashExt and PHashExt, whose hashes have
+// size*size bits, which must be valid for hash.CheckExtHashSize. It is hash.DefaultExtHashSize
+// by default.
+func WithHashSize(size int) Option {
+	return func(o *options) {
+		o.hashSize = size
+	}
+}
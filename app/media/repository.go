@@ -5,6 +5,22 @@ import "github.com/tsmweb/chasam/app/hash"
 type Repository interface {
 	AppendHash(hashType hash.Type, hashValue string, fileName string)
 	FindByHash(hashType hash.Type, hashValue string) string
+	// FindAllByHash returns every reference with the cryptographic hash, ordered by file name.
+	FindAllByHash(hashType hash.Type, hashValue string) []Match
 	AppendPerceptualHash(hashType hash.Type, hashValue uint64, fileName string)
+	// FindByPerceptualHash returns the distance and the file name of the closest hash within
+	// distance, or -1 when there is none.
 	FindByPerceptualHash(hashType hash.Type, hashValue uint64, distance int) (int, string)
+	// FindAllByPerceptualHash returns up to limit matches within distance, closest first and
+	// ties ordered by file name. A limit <= 0 returns every match.
+	FindAllByPerceptualHash(hashType hash.Type, hashValue uint64, distance int, limit int) []Match
+	AppendExtHash(hashType hash.Type, hashValue []uint64, fileName string)
+	// FindAllByExtHash returns up to limit matches of the extended hash within distance, closest
+	// first and ties ordered by file name. A limit <= 0 returns every match.
+	FindAllByExtHash(hashType hash.Type, hashValue []uint64, distance int, limit int) []Match
+	AppendSegmentHash(hashValue []uint64, fileName string)
+	// FindAllBySegmentHash returns up to limit references of which at least fraction of the
+	// segments, of the query or of the reference whichever has fewer, are within distance of a
+	// segment of the other. The distance of a match is the mean distance of its segments.
+	FindAllBySegmentHash(hashValue []uint64, distance int, fraction float64, limit int) []Match
 }
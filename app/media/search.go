@@ -1,173 +1,393 @@
 package media
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tsmweb/chasam/app/hash"
 	"github.com/tsmweb/chasam/common/mediautil"
+	"github.com/tsmweb/chasam/pkg/archive"
 )
 
 type OnError func(ctx context.Context, err error)
 type OnSearch func(ctx context.Context, m *Media) (bool, error)
 type OnMatch func(ctx context.Context, m *Media)
 
+// Stats counts the files found by the search. Every file is counted exactly once, as processed,
+// skipped or errored. The members of an archive are counted as files, while the archive itself
+// is only counted in Archives, unless it could not be read.
+type Stats struct {
+	Processed   int // hashed and searched in the reference set
+	Matched     int // processed files that matched
+	Skipped     int // not a supported media, in the allowlist or done in the checkpoint
+	Allowlisted int // skipped files that are in the allowlist
+	Resumed     int // skipped files that were done in the checkpoint
+	Errored     int // could not be read, hashed or searched
+	Archives    int // archives walked
+}
+
+// Files returns the number of files found by the search.
+func (st Stats) Files() int {
+	return st.Processed + st.Skipped + st.Errored
+}
+
+// Search walks a directory tree and runs every file through a pipeline of stages connected by
+// bounded channels:
+//
+//	walk -> hash (poolSize workers) -> lookup (poolSize workers) -> match (1 worker)
+//
+// The hash stage creates the Media, the lookup stage calls OnSearch and the match stage calls
+// OnMatch and OnError, so OnMatch and OnError are never called concurrently.
 type Search struct {
 	ctx       context.Context
+	fsys      fs.FS
 	root      string
 	hashTypes []hash.Type
-
-	semaphoreCh chan struct{}
-	errorCh     chan error
-	mediaCh     chan *Media
-	matchCh     chan *Media
+	poolSize  int
+
+	checkpoint         Checkpoint
+	checkpointInterval time.Duration
+	archiveDepth       int
+	options            *options
+
+	processed   int64
+	matched     int64
+	skipped     int64
+	allowlisted int64
+	resumed     int64
+	errored     int64
+	archives    int64
+
+	nameCh  chan string
+	mediaCh chan *Media
+	matchCh chan *Media
+	errorCh chan error
 
 	onError  OnError
 	onSearch OnSearch
 	onMatch  OnMatch
 }
 
+// NewSearch creates a search of every file of fsys, such as os.DirFS(root), an archive or a disk
+// image. The paths of the files are reported joined to root.
 func NewSearch(
 	ctx context.Context,
+	fsys fs.FS,
 	root string,
 	hashTypes []hash.Type,
 	onError OnError,
 	onSearch OnSearch,
 	onMatch OnMatch,
 	poolSize int,
+	opts ...Option,
 ) *Search {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+
+	o := newOptions(opts)
+	if o.checkpointInterval <= 0 {
+		o.checkpointInterval = time.Minute
+	}
+
 	searchMedia := &Search{
-		ctx:         ctx,
-		root:        root,
-		hashTypes:   hashTypes,
-		semaphoreCh: make(chan struct{}, poolSize),
-		errorCh:     make(chan error),
-		mediaCh:     make(chan *Media),
-		matchCh:     make(chan *Media),
-		onError:     onError,
-		onSearch:    onSearch,
-		onMatch:     onMatch,
+		ctx:       ctx,
+		fsys:      fsys,
+		root:      root,
+		hashTypes: hashTypes,
+		poolSize:  poolSize,
+
+		checkpoint:         o.checkpoint,
+		checkpointInterval: o.checkpointInterval,
+		archiveDepth:       o.archiveDepth,
+		options:            o,
+
+		nameCh:   make(chan string, poolSize),
+		mediaCh:  make(chan *Media, poolSize),
+		matchCh:  make(chan *Media, poolSize),
+		errorCh:  make(chan error, poolSize),
+		onError:  onError,
+		onSearch: onSearch,
+		onMatch:  onMatch,
 	}
 
 	return searchMedia
 }
 
-func (s *Search) Run() {
-	var wg sync.WaitGroup
+// Run searches the file system and returns when every file found was handled or, if the
+// context is canceled, when the files already found were handled.
+func (s *Search) Run() Stats {
+	var matchWg sync.WaitGroup
+	matchWg.Add(1)
+	go s.handleMatches(&matchWg)
+
+	lookupWg := s.startWorkers(s.handleLookup)
+	hashWg := s.startWorkers(s.handleHash)
 
-	wg.Add(1)
-	go s.processMedia(&wg)
+	s.walkRoot()
+	close(s.nameCh)
 
-	s.walkRoot(s.root)
+	hashWg.Wait()
+	close(s.mediaCh)
+	lookupWg.Wait()
+	close(s.matchCh)
+	close(s.errorCh)
+	matchWg.Wait()
 
-	wg.Wait()
+	return s.Stats()
 }
 
-func (s *Search) processMedia(wg *sync.WaitGroup) {
-	defer wg.Done()
+// Stats returns the number of files handled so far.
+func (s *Search) Stats() Stats {
+	return Stats{
+		Processed:   int(atomic.LoadInt64(&s.processed)),
+		Matched:     int(atomic.LoadInt64(&s.matched)),
+		Skipped:     int(atomic.LoadInt64(&s.skipped)),
+		Allowlisted: int(atomic.LoadInt64(&s.allowlisted)),
+		Resumed:     int(atomic.LoadInt64(&s.resumed)),
+		Errored:     int(atomic.LoadInt64(&s.errored)),
+		Archives:    int(atomic.LoadInt64(&s.archives)),
+	}
+}
 
-	wg.Add(1)
-	go func(wg *sync.WaitGroup) {
-		defer wg.Done()
-		var wgi sync.WaitGroup
+func (s *Search) startWorkers(worker func()) *sync.WaitGroup {
+	wg := new(sync.WaitGroup)
+	for i := 0; i < s.poolSize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker()
+		}()
+	}
+	return wg
+}
 
-		for m := range s.mediaCh {
-			wgi.Add(1)
-			go s.handleSearch(m, &wgi)
+// walkRoot sends the name of every regular file to the hash stage.
+func (s *Search) walkRoot() {
+	err := fs.WalkDir(s.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == "." {
+				return err
+			}
+			// an unreadable entry is reported and the walk goes on.
+			s.fail(err)
+			return nil
 		}
 
-		wgi.Wait()
-		close(s.matchCh)
-	}(wg)
-
-	wg.Add(1)
-	go func(wg *sync.WaitGroup) {
-		defer wg.Done()
-		var wgi sync.WaitGroup
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			atomic.AddInt64(&s.skipped, 1)
+			return nil
+		}
+		if s.checkpoint != nil && s.checkpoint.Done(s.pathOf(name)) {
+			atomic.AddInt64(&s.resumed, 1)
+			atomic.AddInt64(&s.skipped, 1)
+			return nil
+		}
 
-		for m := range s.matchCh {
-			wgi.Add(1)
-			go s.handleMatch(m, &wgi)
+		select {
+		case s.nameCh <- name:
+			return nil
+		case <-s.ctx.Done():
+			return s.ctx.Err()
 		}
+	})
 
-		wgi.Wait()
-		close(s.errorCh)
-	}(wg)
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		s.errorCh <- fmt.Errorf("Search::walkRoot(%s) | Error: %v", s.root, err)
+	}
+}
 
-	for err := range s.errorCh {
-		wg.Add(1)
-		go s.handleError(err, wg)
+// pathOf returns the path of the file name of fsys, which identifies it in the reports, the
+// cache and the checkpoint.
+func (s *Search) pathOf(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *Search) handleHash() {
+	for name := range s.nameCh {
+		path := s.pathOf(name)
+		m, err := newMediaFromFS(s.fsys, name, path, s.hashTypes, s.options)
+		if errors.Is(err, mediautil.ErrUnsupportedMediaType) && s.archiveDepth > 0 {
+			ok, archiveErr := s.handleArchive(name, path)
+			if ok {
+				continue
+			}
+			if archiveErr != nil {
+				err = archiveErr
+			}
+		}
+		s.dispatch(path, m, err)
 	}
 }
 
-func (s *Search) walkRoot(root string) {
-	var wg sync.WaitGroup
+// dispatch sends the media to the lookup stage or counts why it was not created.
+func (s *Search) dispatch(path string, m *Media, err error) {
+	switch {
+	case err == nil:
+		s.mediaCh <- m
+	case errors.Is(err, ErrAllowlisted):
+		atomic.AddInt64(&s.allowlisted, 1)
+		atomic.AddInt64(&s.skipped, 1)
+		s.markDone(path)
+	case errors.Is(err, mediautil.ErrUnsupportedMediaType):
+		atomic.AddInt64(&s.skipped, 1)
+		s.markDone(path)
+	default:
+		s.fail(err)
+	}
+}
 
-	filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
+// handleArchive hashes the members of the archive name, returning false if it is not an
+// archive. The members are hashed from memory and the ones that are not media are not read.
+func (s *Search) handleArchive(name, path string) (bool, error) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return false, nil
+	}
+	defer f.Close()
+
+	header := make([]byte, archive.HeaderSize)
+	n, _ := io.ReadFull(f, header)
+	if archive.Detect(header[:n]) == archive.None {
+		return false, nil
+	}
+
+	ra, size, err := readerAt(f, header[:n])
+	if err != nil {
+		return false, fmt.Errorf("Search::handleArchive(%s) | Error: %v", path, err)
+	}
+
+	err = archive.Walk(path, ra, size, s.archiveDepth, func(member *archive.Member) error {
+		if err := s.ctx.Err(); err != nil {
 			return err
 		}
-
-		if info.IsDir() {
+		if s.checkpoint != nil && s.checkpoint.Done(member.Path) {
+			atomic.AddInt64(&s.resumed, 1)
+			atomic.AddInt64(&s.skipped, 1)
 			return nil
 		}
 
-		select {
-		case s.semaphoreCh <- struct{}{}: // acquire token
-		case <-s.ctx.Done():
-			return filepath.SkipDir
+		if _, err := mediautil.ParseContentType(member.Header); err != nil {
+			s.dispatch(member.Path, nil, err)
+			return nil
 		}
 
-		wg.Add(1)
-		go s.handleMedia(path, &wg)
+		data, err := member.ReadAll()
+		if err != nil {
+			s.fail(err)
+			return nil
+		}
 
+		m, err := newMediaFromMemory(data, member.Path, member.ModTime, s.hashTypes, s.options)
+		s.dispatch(member.Path, m, err)
 		return nil
 	})
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		return false, fmt.Errorf("Search::handleArchive(%s) | Error: %v", path, err)
+	}
 
-	wg.Wait()
-	close(s.mediaCh)
+	atomic.AddInt64(&s.archives, 1)
+	return true, nil
 }
 
-func (s *Search) handleMedia(path string, wg *sync.WaitGroup) {
-	defer wg.Done()
+// readerAt returns the file itself if it can read at an offset, as the files of os.DirFS do, or
+// a reader of its content read to memory, which starts by the header already read.
+func readerAt(file fs.File, header []byte) (io.ReaderAt, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if ra, ok := file.(io.ReaderAt); ok {
+		return ra, info.Size(), nil
+	}
 
-	m, err := NewMedia(path, s.hashTypes)
+	data, err := io.ReadAll(io.MultiReader(bytes.NewReader(header), file))
 	if err != nil {
-		if !errors.Is(err, mediautil.ErrUnsupportedMediaType) {
-			s.errorCh <- err
+		return nil, 0, err
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+func (s *Search) handleLookup() {
+	for m := range s.mediaCh {
+		ok, err := s.onSearch(s.ctx, m)
+		switch {
+		case err != nil:
+			s.fail(err)
+		case ok:
+			s.matchCh <- m
+		default:
+			atomic.AddInt64(&s.processed, 1)
+			s.markDone(m.Path())
 		}
-	} else {
-		s.mediaCh <- m
 	}
 }
 
-func (s *Search) handleSearch(m *Media, wg *sync.WaitGroup) {
+// handleMatches is the match stage, which calls OnMatch for the matches and OnError for the
+// errors of every stage until both channels are closed, and saves the checkpoint.
+func (s *Search) handleMatches(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	ok, err := s.onSearch(s.ctx, m)
-	if err != nil {
-		s.errorCh <- err
+	var tick <-chan time.Time
+	if s.checkpoint != nil {
+		ticker := time.NewTicker(s.checkpointInterval)
+		defer ticker.Stop()
+		tick = ticker.C
 	}
-	if ok {
-		s.matchCh <- m
-	} else {
-		<-s.semaphoreCh // release token
+
+	matchCh, errorCh := s.matchCh, s.errorCh
+	for matchCh != nil || errorCh != nil {
+		select {
+		case m, ok := <-matchCh:
+			if !ok {
+				matchCh = nil
+				continue
+			}
+			s.onMatch(s.ctx, m)
+			atomic.AddInt64(&s.matched, 1)
+			atomic.AddInt64(&s.processed, 1)
+			s.markDone(m.Path())
+		case err, ok := <-errorCh:
+			if !ok {
+				errorCh = nil
+				continue
+			}
+			s.onError(s.ctx, err)
+		case <-tick:
+			s.saveCheckpoint()
+		}
 	}
+	s.saveCheckpoint()
 }
 
-func (s *Search) handleMatch(m *Media, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	s.onMatch(s.ctx, m)
-	<-s.semaphoreCh // release token
+func (s *Search) markDone(path string) {
+	if s.checkpoint != nil {
+		s.checkpoint.MarkDone(path)
+	}
 }
 
-func (s *Search) handleError(err error, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (s *Search) saveCheckpoint() {
+	if s.checkpoint == nil {
+		return
+	}
+	if err := s.checkpoint.Save(); err != nil {
+		s.onError(s.ctx, err)
+	}
+}
 
-	s.onError(s.ctx, err)
-	<-s.semaphoreCh // release token
+// fail counts a file that could not be handled and reports the error.
+func (s *Search) fail(err error) {
+	atomic.AddInt64(&s.errored, 1)
+	s.errorCh <- err
 }
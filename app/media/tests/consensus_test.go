@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"math"
+	"testing"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+)
+
+func TestConsensus(t *testing.T) {
+	// a.jpg is matched by DHash and PHash, b.jpg by AHash and c.jpg by all of them; DHashV is
+	// evaluated but matches nothing.
+	ballot := media.NewBallot()
+	for _, hashType := range []hash.Type{hash.AHash, hash.DHash, hash.DHashV, hash.PHash} {
+		ballot.Evaluate(hashType)
+	}
+	ballot.Vote(hash.DHash, media.Match{Name: "a.jpg", HashType: "DHash", Distance: 5, Threshold: 9})
+	ballot.Vote(hash.DHash, media.Match{Name: "a.jpg", HashType: "DHash(rotate-90)", Distance: 0, Threshold: 9})
+	ballot.Vote(hash.PHash, media.Match{Name: "a.jpg", HashType: "PHash", Distance: 2, Threshold: 9})
+	ballot.Vote(hash.AHash, media.Match{Name: "b.jpg", HashType: "AHash", Distance: 0, Threshold: 9})
+	for _, hashType := range []hash.Type{hash.AHash, hash.DHash, hash.DHashV, hash.PHash} {
+		ballot.Vote(hashType, media.Match{Name: "c.jpg", HashType: hashType.String(), Distance: 0, Threshold: 9})
+	}
+
+	tests := []struct {
+		consensus media.Consensus
+		want      []string
+	}{
+		{media.Consensus{Policy: media.PolicyAny}, []string{"c.jpg", "a.jpg", "b.jpg"}},
+		{media.Consensus{Policy: media.PolicyMajority}, []string{"c.jpg"}},
+		{media.Consensus{Policy: media.PolicyAll}, []string{"c.jpg"}},
+		{media.Consensus{Policy: media.PolicyWeighted, MinScore: 0.4}, []string{"c.jpg", "a.jpg"}},
+		{media.Consensus{
+			Policy:   media.PolicyWeighted,
+			MinScore: 0.4,
+			Weights:  map[hash.Type]float64{hash.AHash: 4},
+		}, []string{"c.jpg", "b.jpg"}},
+	}
+
+	for _, tt := range tests {
+		matches := tt.consensus.Count(ballot)
+		var names []string
+		for _, m := range matches {
+			names = append(names, m.Name)
+		}
+		if len(names) != len(tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.consensus.Policy, names, tt.want)
+			continue
+		}
+		for i := range names {
+			if names[i] != tt.want[i] {
+				t.Errorf("%v: got %v, want %v", tt.consensus.Policy, names, tt.want)
+				break
+			}
+		}
+	}
+
+	// a.jpg keeps the closest match of each hash type: (1 + 0.8) / 4.
+	matches := (&media.Consensus{Policy: media.PolicyAny}).Count(ballot)
+	a := matches[1]
+	if a.HashType != "DHash(rotate-90)" || a.Distance != 0 || a.Threshold != 9 {
+		t.Errorf("got %s at %d/%d, want DHash(rotate-90) at 0/9", a.HashType, a.Distance, a.Threshold)
+	}
+	if len(a.Distances) != 2 || a.Distances[hash.DHash] != 0 || a.Distances[hash.PHash] != 2 {
+		t.Errorf("got distances %v", a.Distances)
+	}
+	if math.Abs(a.Score-0.45) > 1e-9 {
+		t.Errorf("got score %f, want 0.45", a.Score)
+	}
+	if matches[0].Score != 1 {
+		t.Errorf("got score %f for c.jpg, want 1", matches[0].Score)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, name := range []string{"any", "majority", "all", "Weighted"} {
+		p, err := media.ParsePolicy(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p2, _ := media.ParsePolicy(p.String()); p2 != p {
+			t.Errorf("%s: got %v after a round trip", name, p2)
+		}
+	}
+	if _, err := media.ParsePolicy("most"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+
+	weights, err := media.ParseWeights("d-hash:2, p-hash=0.5")
+	if err != nil || weights[hash.DHash] != 2 || weights[hash.PHash] != 0.5 || len(weights) != 2 {
+		t.Errorf("got %v (%v)", weights, err)
+	}
+	for _, spec := range []string{"d-hash", "d-hash:-1", "x:1"} {
+		if _, err := media.ParseWeights(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+	"github.com/tsmweb/chasam/common/mediautil"
+	"github.com/tsmweb/chasam/internal/testimage"
+)
+
+type allowlistStub map[string]bool
+
+func (a allowlistStub) Contains(sha1 string) bool { return a[sha1] }
+func (a allowlistStub) Len() int                  { return len(a) }
+
+func TestNewMediaAllowlist(t *testing.T) {
+	dir := t.TempDir()
+	testimage.Write(t, filepath.Join(dir, "img.png"), testimage.Pattern(0))
+	fsys, path := os.DirFS(dir), "img.png"
+
+	m, err := media.NewMedia(fsys, path, []hash.Type{hash.SHA1, hash.DHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = media.NewMedia(fsys, path, []hash.Type{hash.DHash}, media.WithAllowlist(allowlistStub{m.SHA1(): true}))
+	if !errors.Is(err, media.ErrAllowlisted) {
+		t.Fatalf("expected ErrAllowlisted, got %v", err)
+	}
+
+	other, err := media.NewMedia(fsys, path, []hash.Type{hash.SHA1, hash.DHash}, media.WithAllowlist(allowlistStub{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.SHA1() != m.SHA1() || other.DHash() != m.DHash() {
+		t.Fatalf("expected the same hashes, got %s/%x and %s/%x", m.SHA1(), m.DHash(), other.SHA1(), other.DHash())
+	}
+}
+
+// withExif inserts in the JPEG data an EXIF APP1 segment holding the orientation, if not 0, and
+// the thumbnail, if not nil.
+func withExif(data []byte, orientation uint16, thumb []byte) []byte {
+	le := binary.LittleEndian
+	tiff := []byte{'I', 'I', 0x2a, 0, 8, 0, 0, 0}
+
+	entry := func(tag, typ uint16, value uint32) []byte {
+		e := make([]byte, 12)
+		le.PutUint16(e[0:], tag)
+		le.PutUint16(e[2:], typ)
+		le.PutUint32(e[4:], 1)
+		le.PutUint32(e[8:], value)
+		return e
+	}
+
+	var ifd0 [][]byte
+	if orientation != 0 {
+		ifd0 = append(ifd0, entry(0x0112, 3, uint32(orientation)))
+	}
+	ifd1Offset := 8 + 2 + 12*len(ifd0) + 4
+	tiff = le.AppendUint16(tiff, uint16(len(ifd0)))
+	for _, e := range ifd0 {
+		tiff = append(tiff, e...)
+	}
+	if thumb == nil {
+		tiff = le.AppendUint32(tiff, 0)
+	} else {
+		tiff = le.AppendUint32(tiff, uint32(ifd1Offset))
+		thumbOffset := ifd1Offset + 2 + 2*12 + 4
+		tiff = le.AppendUint16(tiff, 2)
+		tiff = append(tiff, entry(0x0201, 4, uint32(thumbOffset))...)
+		tiff = append(tiff, entry(0x0202, 4, uint32(len(thumb)))...)
+		tiff = le.AppendUint32(tiff, 0)
+		tiff = append(tiff, thumb...)
+	}
+
+	app1 := []byte{0xff, 0xe1, 0, 0}
+	app1 = append(app1, "Exif\x00\x00"...)
+	app1 = append(app1, tiff...)
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(app1)-2))
+
+	out := append([]byte(nil), data[:2]...)
+	out = append(out, app1...)
+	return append(out, data[2:]...)
+}
+
+func TestNewMediaThumbnail(t *testing.T) {
+	thumb := testimage.Encode(t, testimage.Pattern(3), "jpeg")
+	fsys := fstest.MapFS{
+		"edited.jpg": &fstest.MapFile{Data: withExif(testimage.Encode(t, testimage.Pattern(1), "jpeg"), 0, thumb)},
+		"plain.jpg":  &fstest.MapFile{Data: testimage.Encode(t, testimage.Pattern(1), "jpeg")},
+		"thumb.jpg":  &fstest.MapFile{Data: thumb},
+	}
+	hashTypes := []hash.Type{hash.SHA1, hash.DHash, hash.PHash}
+
+	want, err := media.NewMedia(fsys, "thumb.jpg", hashTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := media.NewMedia(fsys, "edited.jpg", hashTypes, media.WithThumbnail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := m.Thumbnail()
+	if got == nil {
+		t.Fatal("expected the thumbnail of the EXIF")
+	}
+	if got.DHash() != want.DHash() || got.PHash() != want.PHash() || got.SHA1() != "" {
+		t.Fatalf("expected the perceptual hashes of the thumbnail %x/%x, got %x/%x",
+			want.DHash(), want.PHash(), got.DHash(), got.PHash())
+	}
+	if m.DHash() == got.DHash() {
+		t.Fatal("expected the hash of the image to differ from the one of the thumbnail")
+	}
+
+	if m, err = media.NewMedia(fsys, "edited.jpg", hashTypes); err != nil || m.Thumbnail() != nil {
+		t.Fatalf("expected no thumbnail without the option, got %v", err)
+	}
+	if m, err = media.NewMedia(fsys, "plain.jpg", hashTypes, media.WithThumbnail()); err != nil || m.Thumbnail() != nil {
+		t.Fatalf("expected no thumbnail without EXIF, got %v", err)
+	}
+}
+
+func TestNewMediaOrientation(t *testing.T) {
+	upright := testimage.Pattern(1)
+	fsys := fstest.MapFS{"upright.jpg": &fstest.MapFile{Data: testimage.Encode(t, upright, "jpeg")}}
+
+	// the camera stores the photo rotated and the orientation that turns it upright.
+	for _, orientation := range []uint16{3, 6, 8} {
+		inverse := orientation
+		if orientation != 3 {
+			inverse = 14 - orientation
+		}
+		stored := testimage.Encode(t, mediautil.Orient(upright, int(inverse)), "jpeg")
+		fsys[fmt.Sprintf("rotated-%d.jpg", orientation)] = &fstest.MapFile{Data: withExif(stored, orientation, nil)}
+	}
+
+	hashTypes := []hash.Type{hash.DHash, hash.PHash}
+	want, err := media.NewMedia(fsys, "upright.jpg", hashTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, orientation := range []uint16{3, 6, 8} {
+		name := fmt.Sprintf("rotated-%d.jpg", orientation)
+		m, err := media.NewMedia(fsys, name, hashTypes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := bits.OnesCount64(m.DHash() ^ want.DHash()); d > 4 {
+			t.Errorf("%s: d-hash distance %d to the upright photo", name, d)
+		}
+		if d := bits.OnesCount64(m.PHash() ^ want.PHash()); d > 4 {
+			t.Errorf("%s: p-hash distance %d to the upright photo", name, d)
+		}
+
+		m, err = media.NewMedia(fsys, name, hashTypes, media.WithOrientation(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := bits.OnesCount64(m.DHash() ^ want.DHash()); d <= 10 {
+			t.Errorf("%s: d-hash distance %d without the orientation, want the rotated photo", name, d)
+		}
+	}
+
+	// the perceptual hashes cached with the other setting are computed again.
+	cache := &cacheStub{entries: make(map[string]*media.CacheEntry)}
+	name := "rotated-6.jpg"
+	oriented, err := media.NewMedia(fsys, name, hashTypes, media.WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := media.NewMedia(fsys, name, hashTypes, media.WithCache(cache), media.WithOrientation(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.DHash() == oriented.DHash() {
+		t.Error("the d-hash of the oriented photo was taken from the cache")
+	}
+	if e := cache.entries[name]; e.Settings.Orientation || e.PHashes[hash.DHash] != m.DHash() {
+		t.Errorf("expected the hashes without the orientation in the cache, got %+v", e)
+	}
+}
+
+func TestNewMediaDihedral(t *testing.T) {
+	reference := testimage.Pattern(2)
+	fsys := fstest.MapFS{"reference.png": &fstest.MapFile{Data: testimage.Encode(t, reference, "png")}}
+	for _, d := range hash.Dihedrals() {
+		fsys[d.String()+".png"] = &fstest.MapFile{Data: testimage.Encode(t, d.Apply(reference), "png")}
+	}
+
+	hashTypes := []hash.Type{hash.SHA1, hash.DHash, hash.PHash}
+	want, err := media.NewMedia(fsys, "reference.png", hashTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the variant that undoes the transform of the copy has the hashes of the reference.
+	inverse := map[hash.Dihedral]hash.Dihedral{hash.Rotate90: hash.Rotate270, hash.Rotate270: hash.Rotate90}
+	for _, d := range hash.Dihedrals() {
+		m, err := media.NewMedia(fsys, d.String()+".png", hashTypes, media.WithDihedral())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Variants()) != 7 {
+			t.Fatalf("%s: got %d variants, want 7", d, len(m.Variants()))
+		}
+
+		undo, ok := inverse[d]
+		if !ok {
+			undo = d
+		}
+		var matched []hash.Dihedral
+		for _, v := range m.Variants() {
+			if v.DHash() == want.DHash() && v.PHash() == want.PHash() {
+				matched = append(matched, v.Transform)
+			}
+		}
+		if len(matched) != 1 || matched[0] != undo {
+			t.Errorf("%s: matched by %v, want %s", d, matched, undo)
+		}
+	}
+
+	if m, err := media.NewMedia(fsys, "reference.png", hashTypes); err != nil || m.Variants() != nil {
+		t.Fatalf("expected no variants without the option, got %v", err)
+	}
+}
+
+func TestNewMediaPDQ(t *testing.T) {
+	plain := image.NewGray(image.Rect(0, 0, 96, 64))
+	fsys := fstest.MapFS{
+		"img.png":   &fstest.MapFile{Data: testimage.Encode(t, testimage.Pattern(1), "png")},
+		"img.jpg":   &fstest.MapFile{Data: testimage.Encode(t, testimage.Pattern(1), "jpeg")},
+		"plain.png": &fstest.MapFile{Data: testimage.Encode(t, plain, "png")},
+	}
+
+	hashTypes := []hash.Type{hash.PDQ}
+	original, err := media.NewMedia(fsys, "img.png", hashTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := media.NewMedia(fsys, "img.jpg", hashTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(original.PDQ()) != hash.PDQWords || original.PDQQuality() < hash.PDQMinQuality {
+		t.Fatalf("got PDQ %x of quality %d", original.PDQ(), original.PDQQuality())
+	}
+	if d, err := hash.ExtDistance(original.PDQ(), copied.PDQ()); err != nil || d > 31 {
+		t.Errorf("JPEG copy at distance %d (%v)", d, err)
+	}
+
+	// the hash of an image of low quality is left out.
+	m, err := media.NewMedia(fsys, "plain.png", hashTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.PDQ()) != 0 || m.PDQQuality() != 0 {
+		t.Errorf("expected no PDQ for a plain image, got %x of quality %d", m.PDQ(), m.PDQQuality())
+	}
+
+	// the quality is kept in the cache with the hash.
+	cache := &cacheStub{entries: make(map[string]*media.CacheEntry)}
+	for i := 0; i < 2; i++ {
+		m, err = media.NewMedia(fsys, "img.png", hashTypes, media.WithCache(cache))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.PDQQuality() != original.PDQQuality() {
+			t.Errorf("got quality %d, want %d", m.PDQQuality(), original.PDQQuality())
+		}
+	}
+}
+
+func TestNewMediaHas(t *testing.T) {
+	plain := image.NewGray(image.Rect(0, 0, 96, 64))
+	fsys := fstest.MapFS{"plain.png": &fstest.MapFile{Data: testimage.Encode(t, plain, "png")}}
+	cache := &cacheStub{entries: make(map[string]*media.CacheEntry)}
+
+	// the d-hash of a plain image is 0, while its PDQ of low quality is left out.
+	hashTypes := []hash.Type{hash.SHA1, hash.DHash, hash.PDQ}
+	for i := 0; i < 2; i++ {
+		m, err := media.NewMedia(fsys, "plain.png", hashTypes, media.WithCache(cache))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !m.Has(hash.SHA1) || !m.Has(hash.DHash) || m.DHash() != 0 || m.Has(hash.PDQ) || m.Has(hash.PHash) {
+			t.Errorf("got sha1 %t, d-hash %t (%x), pdq %t, p-hash %t", m.Has(hash.SHA1), m.Has(hash.DHash),
+				m.DHash(), m.Has(hash.PDQ), m.Has(hash.PHash))
+		}
+	}
+}
+
+func TestNewMediaFS(t *testing.T) {
+	data := testimage.Encode(t, testimage.Pattern(2), "png")
+	fsys := fstest.MapFS{
+		"dir/img.png": &fstest.MapFile{Data: data, ModTime: time.Unix(1700000000, 0)},
+	}
+
+	m, err := media.NewMedia(fsys, "dir/img.png", []hash.Type{hash.SHA1, hash.MD5, hash.PHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Path() != "dir/img.png" || m.Name() != "img.png" || m.ContentType() != "image/png" {
+		t.Fatalf("unexpected media %s %s %s", m.Path(), m.Name(), m.ContentType())
+	}
+	if m.SHA1() != fmt.Sprintf("%x", sha1.Sum(data)) || m.MD5() != fmt.Sprintf("%x", md5.Sum(data)) {
+		t.Fatalf("unexpected hashes %s %s", m.SHA1(), m.MD5())
+	}
+
+	r, err := m.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if content, _ := io.ReadAll(r); !bytes.Equal(content, data) {
+		t.Fatal("unexpected content")
+	}
+}
+
+type cacheStub struct {
+	entries map[string]*media.CacheEntry
+}
+
+func (c *cacheStub) Get(path string, _ int64, _ time.Time) (*media.CacheEntry, bool) {
+	e, ok := c.entries[path]
+	return e, ok
+}
+
+func (c *cacheStub) Put(path string, _ int64, _ time.Time, entry *media.CacheEntry) {
+	c.entries[path] = entry
+}
+
+func (c *cacheStub) Close() error { return nil }
+
+func TestNewMediaCache(t *testing.T) {
+	dir := t.TempDir()
+	testimage.Write(t, filepath.Join(dir, "img.png"), testimage.Pattern(1))
+	fsys, path := os.DirFS(dir), "img.png"
+
+	cache := &cacheStub{entries: make(map[string]*media.CacheEntry)}
+
+	m, err := media.NewMedia(fsys, path, []hash.Type{hash.SHA1, hash.DHash}, media.WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := cache.entries[path]
+	if entry == nil || entry.Hashes[hash.SHA1] != m.SHA1() || entry.PHashes[hash.DHash] != m.DHash() {
+		t.Fatalf("expected the hashes of the media in the cache, got %+v", entry)
+	}
+
+	// a cached hash is not computed again, so the file is not decoded.
+	fake := "fake.png"
+	if err = os.WriteFile(filepath.Join(dir, fake), []byte("not an image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cache.entries[fake] = &media.CacheEntry{
+		ContentType: "image/png",
+		Settings:    media.SettingsOf(),
+		Hashes:      map[hash.Type]string{hash.SHA1: m.SHA1()},
+		PHashes:     map[hash.Type]uint64{hash.DHash: m.DHash()},
+	}
+
+	cached, err := media.NewMedia(fsys, fake, []hash.Type{hash.SHA1, hash.DHash}, media.WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.SHA1() != m.SHA1() || cached.DHash() != m.DHash() || cached.Type() != "image" {
+		t.Fatalf("expected the cached hashes, got %s/%x", cached.SHA1(), cached.DHash())
+	}
+
+	// hash types missing from the entry are computed and added to it.
+	cached, err = media.NewMedia(fsys, path, []hash.Type{hash.SHA1, hash.DHash, hash.PHash}, media.WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.entries[path].PHashes[hash.PHash] != cached.PHash() || cached.PHash() == 0 {
+		t.Fatalf("expected the p-hash to be cached, got %+v", cache.entries[path])
+	}
+}
+
+func TestNewMediaCacheVariants(t *testing.T) {
+	data := withExif(testimage.Encode(t, testimage.Pattern(1), "jpeg"), 0, testimage.Encode(t, testimage.Pattern(3), "jpeg"))
+	fsys := fstest.MapFS{"img.jpg": &fstest.MapFile{Data: data}}
+	cache := &cacheStub{entries: make(map[string]*media.CacheEntry)}
+	hashTypes := []hash.Type{hash.SHA1, hash.DHash, hash.PHash}
+	opts := []media.Option{media.WithCache(cache), media.WithDihedral(), media.WithThumbnail()}
+
+	m, err := media.NewMedia(fsys, "img.jpg", hashTypes, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Variants()) != len(hash.Dihedrals()) || m.Thumbnail() == nil {
+		t.Fatalf("expected the variants and the thumbnail, got %d variants", len(m.Variants()))
+	}
+
+	// the variants and the thumbnail are cached, so the file is not decoded again.
+	fsys["img.jpg"] = &fstest.MapFile{Data: []byte("not an image")}
+	cached, err := media.NewMedia(fsys, "img.jpg", hashTypes, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached.Variants()) != len(m.Variants()) || cached.Thumbnail() == nil {
+		t.Fatalf("expected the cached variants and thumbnail, got %d variants", len(cached.Variants()))
+	}
+	for i, v := range cached.Variants() {
+		want := m.Variants()[i]
+		if v.Transform != want.Transform || v.DHash() != want.DHash() || v.PHash() != want.PHash() {
+			t.Fatalf("expected the %s variant %x/%x, got %x/%x", want.Transform, want.DHash(), want.PHash(), v.DHash(), v.PHash())
+		}
+	}
+	if got, want := cached.Thumbnail(), m.Thumbnail(); got.DHash() != want.DHash() || got.PHash() != want.PHash() {
+		t.Fatalf("expected the cached thumbnail %x/%x, got %x/%x", want.DHash(), want.PHash(), got.DHash(), got.PHash())
+	}
+
+	// an image without a thumbnail is cached as such.
+	fsys["plain.jpg"] = &fstest.MapFile{Data: testimage.Encode(t, testimage.Pattern(1), "jpeg")}
+	if _, err = media.NewMedia(fsys, "plain.jpg", hashTypes, opts...); err != nil {
+		t.Fatal(err)
+	}
+	if e := cache.entries["plain.jpg"]; e.Thumbnail == nil || e.Thumbnail.ContentType != "" {
+		t.Fatalf("expected an entry without a thumbnail, got %+v", e.Thumbnail)
+	}
+}
+
+func TestNewMediaDecodeError(t *testing.T) {
+	fsys := fstest.MapFS{"broken.png": &fstest.MapFile{Data: testimage.Encode(t, testimage.Pattern(1), "png")[:64]}}
+
+	_, err := media.NewMedia(fsys, "broken.png", []hash.Type{hash.DHash})
+	if err == nil || !strings.Contains(err.Error(), "Media::decode(broken.png)") {
+		t.Fatalf("expected the decode error, got %v", err)
+	}
+}
+
+func TestNewMediaExtHashSize(t *testing.T) {
+	fsys := fstest.MapFS{"img.png": &fstest.MapFile{Data: testimage.Encode(t, testimage.Pattern(1), "png")}}
+	cache := &cacheStub{entries: make(map[string]*media.CacheEntry)}
+	hashTypes := []hash.Type{hash.DHashExt, hash.PHashExt}
+
+	m, err := media.NewMedia(fsys, "img.png", hashTypes, media.WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.DHashExt()) != 4 || len(m.PHashExt()) != 4 {
+		t.Fatalf("expected 256-bit hashes, got %x and %x", m.DHashExt(), m.PHashExt())
+	}
+	if got := cache.entries["img.png"].ExtHashes[hash.DHashExt]; fmt.Sprint(got) != fmt.Sprint(m.DHashExt()) {
+		t.Fatalf("expected the d-hash-ext to be cached, got %x", got)
+	}
+
+	// the hashes cached with another size are computed again.
+	m, err = media.NewMedia(fsys, "img.png", hashTypes, media.WithCache(cache), media.WithHashSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dHash, _ := hash.DifferenceHash(testimage.Pattern(1))
+	if len(m.DHashExt()) != 1 || m.DHashExt()[0] != dHash || len(m.PHashExt()) != 1 {
+		t.Fatalf("expected 64-bit hashes, got %x and %x", m.DHashExt(), m.PHashExt())
+	}
+	if e := cache.entries["img.png"]; e.Settings.HashSize != 8 || len(e.ExtHashes[hash.PHashExt]) != 1 {
+		t.Fatalf("expected the 64-bit hashes in the cache, got %+v", e)
+	}
+}
+
+func TestParseSettings(t *testing.T) {
+	want := media.Settings{Orientation: false, HashSize: 32}
+	if got, err := media.ParseSettings(want.String()); err != nil || got != want {
+		t.Fatalf("expected %s, got %s (%v)", want, got, err)
+	}
+
+	for _, s := range []string{"", "orientation=true", "orientation=yes, hash-size=16",
+		"orientation=true, hash-size=16, dihedral=true", "hash-size=16, hash-size=8"} {
+		if _, err := media.ParseSettings(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
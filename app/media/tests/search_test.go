@@ -1,23 +1,45 @@
 package tests
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/tsmweb/chasam/app/hash"
 	"github.com/tsmweb/chasam/app/media"
 	"github.com/tsmweb/chasam/infra/repository"
+	"github.com/tsmweb/chasam/internal/testimage"
+	"io"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 var (
-	repo media.Repository
+	repo    media.Repository
+	matches map[string][]media.Match
 )
 
 func TestSearch(t *testing.T) {
-	source := "/home/martins/Downloads/images/search"
-	target := "/home/martins/Downloads/images/benchmark"
+	source := fstest.MapFS{
+		"ref-0.png": {Data: testimage.Encode(t, testimage.Pattern(0), "png")},
+		"ref-1.png": {Data: testimage.Encode(t, testimage.Pattern(1), "png")},
+		"ref-2.png": {Data: testimage.Encode(t, testimage.Pattern(2), "png")},
+	}
+	target := fstest.MapFS{
+		"a/copy.png":      {Data: source["ref-0.png"].Data},
+		"b/recoded.jpg":   {Data: testimage.Encode(t, testimage.Pattern(1), "jpeg")},
+		"c/unrelated.png": {Data: testimage.Encode(t, testimage.Checker(), "png")},
+		"c/notes.txt":     {Data: []byte("notes")},
+	}
 	hashTypes := []hash.Type{
 		hash.SHA1,
 		hash.ED2K,
@@ -27,21 +49,36 @@ func TestSearch(t *testing.T) {
 		hash.PHash,
 	}
 
-	_repo, err := repository.NewMediaRepositoryMem(source, hashTypes)
+	_repo, err := repository.NewMediaRepositoryFS(source, hashTypes)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	repo = _repo
+	matches = make(map[string][]media.Match)
 
 	s := media.NewSearch(
 		context.Background(),
 		target,
+		"evidence",
 		hashTypes,
 		onError,
 		onSearch,
 		onMatch,
 		runtime.NumCPU())
-	s.Run()
+	stats := runSearch(t, s)
+
+	if stats.Processed != 3 || stats.Matched != 2 || stats.Skipped != 1 || stats.Errored != 0 {
+		t.Fatalf("unexpected stats %+v %v", stats, matches)
+	}
+
+	copyMatch := matches[filepath.Join("evidence", "a", "copy.png")]
+	if len(copyMatch) != 1 || copyMatch[0].Name != "ref-0.png" || copyMatch[0].HashType != hash.SHA1.String() {
+		t.Fatalf("expected a SHA1 match of ref-0.png, got %v", matches)
+	}
+	recodedMatch := matches[filepath.Join("evidence", "b", "recoded.jpg")]
+	if len(recodedMatch) != 1 || recodedMatch[0].Name != "ref-1.png" {
+		t.Fatalf("expected a perceptual match of ref-1.png, got %v", matches)
+	}
 }
 
 func onSearch(_ context.Context, m *media.Media) (bool, error) {
@@ -50,52 +87,352 @@ func onSearch(_ context.Context, m *media.Media) (bool, error) {
 	}
 
 	if src := repo.FindByHash(hash.SHA1, m.SHA1()); src != "-1" {
-		m.AddMatch(src, hash.SHA1.String(), 0)
+		m.AddMatch(src, hash.SHA1.String(), 0, 0)
 		return true, nil
 	}
 
 	if src := repo.FindByHash(hash.ED2K, m.ED2K()); src != "-1" {
-		m.AddMatch(src, hash.ED2K.String(), 0)
+		m.AddMatch(src, hash.ED2K.String(), 0, 0)
 		return true, nil
 	}
 
 	hamming := 1
 
 	if dist, src := repo.FindByPerceptualHash(hash.AHash, m.AHash(), hamming); dist != -1 {
-		m.AddMatch(src, hash.AHash.String(), dist)
+		m.AddMatch(src, hash.AHash.String(), dist, hamming)
 		return true, nil
 	}
 
 	if dist, src := repo.FindByPerceptualHash(hash.DHash, m.DHash(), hamming); dist != -1 {
-		m.AddMatch(src, hash.DHash.String(), dist)
+		m.AddMatch(src, hash.DHash.String(), dist, hamming)
 		return true, nil
 	}
 
 	if dist, src := repo.FindByPerceptualHash(hash.DHashV, m.DHashV(), hamming); dist != -1 {
-		m.AddMatch(src, hash.DHashV.String(), dist)
+		m.AddMatch(src, hash.DHashV.String(), dist, hamming)
 		return true, nil
 	}
 
 	if dist, src := repo.FindByPerceptualHash(hash.PHash, m.PHash(), hamming); dist != -1 {
-		m.AddMatch(src, hash.PHash.String(), dist)
+		m.AddMatch(src, hash.PHash.String(), dist, hamming)
 		return true, nil
 	}
 	return false, nil
 }
 
 func onMatch(_ context.Context, m *media.Media) {
-	fmt.Printf("Name: %s\n", m.Name())
-	fmt.Printf("Path: %s\n", m.Path())
-	fmt.Printf("Type: %s\n", m.Type())
-	fmt.Printf("SHA1: %s\n", m.SHA1())
-	fmt.Printf("ED2K: %s\n", m.ED2K())
-	fmt.Printf("Ahash: %s\n", hash.FormatToHex(m.AHash()))
-	fmt.Printf("Dhash: %s\n", hash.FormatToHex(m.DHash()))
-	fmt.Printf("DhashV: %s\n", hash.FormatToHex(m.DHashV()))
-	fmt.Printf("Phash: %s\n", hash.FormatToHex(m.PHash()))
-	fmt.Printf("Match: %v\n\n", m.Match())
+	matches[m.Path()] = m.Match()
 }
 
 func onError(_ context.Context, err error) {
 	fmt.Fprintln(os.Stderr, err.Error())
 }
+
+// runSearch runs s and fails the test if it does not return in time.
+func runSearch(t *testing.T, s *media.Search) media.Stats {
+	t.Helper()
+
+	done := make(chan media.Stats, 1)
+	go func() { done <- s.Run() }()
+
+	select {
+	case stats := <-done:
+		return stats
+	case <-time.After(30 * time.Second):
+		t.Fatal("search did not finish")
+		return media.Stats{}
+	}
+}
+
+func TestSearchNonMediaFiles(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 3; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%d", i))
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 40; j++ {
+			name := filepath.Join(dir, fmt.Sprintf("file%d.txt", j))
+			if err := os.WriteFile(name, []byte("not a media file\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, poolSize := range []int{1, 4} {
+		s := media.NewSearch(
+			context.Background(),
+			os.DirFS(root),
+			root,
+			[]hash.Type{hash.SHA1, hash.DHash},
+			func(context.Context, error) {},
+			func(context.Context, *media.Media) (bool, error) { return false, nil },
+			func(context.Context, *media.Media) {},
+			poolSize)
+
+		stats := runSearch(t, s)
+		if stats.Skipped != 120 || stats.Files() != 120 {
+			t.Fatalf("poolSize %d: expected 120 skipped files, got %+v", poolSize, stats)
+		}
+	}
+}
+
+func TestSearchStats(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 6; i++ {
+		testimage.Write(t, filepath.Join(root, fmt.Sprintf("img%d.png", i)), testimage.Pattern(i))
+	}
+	for i := 0; i < 5; i++ {
+		name := filepath.Join(root, fmt.Sprintf("notes%d.txt", i))
+		if err := os.WriteFile(name, []byte("notes"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a truncated PNG is detected as an image but cannot be decoded.
+	broken := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...)
+	if err := os.WriteFile(filepath.Join(root, "broken.png"), broken, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	allowed, err := media.NewMedia(os.DirFS(root), "img0.png", []hash.Type{hash.SHA1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var matched, errored []string
+
+	s := media.NewSearch(
+		context.Background(),
+		os.DirFS(root),
+		root,
+		[]hash.Type{hash.SHA1, hash.DHash},
+		func(_ context.Context, err error) {
+			mu.Lock()
+			errored = append(errored, err.Error())
+			mu.Unlock()
+		},
+		func(_ context.Context, m *media.Media) (bool, error) {
+			switch m.Name() {
+			case "img1.png":
+				return false, errors.New("lookup failed")
+			case "img2.png", "img3.png":
+				return true, nil
+			}
+			return false, nil
+		},
+		func(_ context.Context, m *media.Media) {
+			mu.Lock()
+			matched = append(matched, m.Name())
+			mu.Unlock()
+		},
+		2,
+		media.WithAllowlist(allowlistStub{allowed.SHA1(): true}))
+
+	stats := runSearch(t, s)
+
+	expected := media.Stats{Processed: 4, Matched: 2, Skipped: 6, Allowlisted: 1, Errored: 2}
+	if stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+	if stats.Files() != 12 {
+		t.Fatalf("expected 12 files, got %d", stats.Files())
+	}
+	if len(matched) != 2 || len(errored) != 2 {
+		t.Fatalf("expected 2 matches and 2 errors, got %v and %v", matched, errored)
+	}
+}
+
+type checkpointStub struct {
+	mu     sync.Mutex
+	done   map[string]bool
+	marked []string
+	saves  int
+}
+
+func (c *checkpointStub) Done(path string) bool { return c.done[path] }
+
+func (c *checkpointStub) MarkDone(path string) {
+	c.mu.Lock()
+	c.marked = append(c.marked, path)
+	c.mu.Unlock()
+}
+
+func (c *checkpointStub) Save() error {
+	c.mu.Lock()
+	c.saves++
+	c.mu.Unlock()
+	return nil
+}
+
+func TestSearchCallbacksSerialized(t *testing.T) {
+	fsys := fstest.MapFS{}
+	for i := 0; i < 16; i++ {
+		fsys[fmt.Sprintf("img%d.png", i)] = &fstest.MapFile{Data: testimage.Encode(t, testimage.Pattern(i%4), "png")}
+	}
+
+	// OnMatch and OnError are slow, so they would overlap if called from different goroutines.
+	var inside, overlaps, calls int32
+	callback := func() {
+		if atomic.AddInt32(&inside, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&calls, 1)
+		atomic.AddInt32(&inside, -1)
+	}
+
+	s := media.NewSearch(
+		context.Background(),
+		fsys,
+		"root",
+		[]hash.Type{hash.SHA1},
+		func(context.Context, error) { callback() },
+		func(_ context.Context, m *media.Media) (bool, error) {
+			var n int
+			fmt.Sscanf(m.Name(), "img%d.png", &n)
+			if n%2 == 0 {
+				return false, errors.New("lookup failed")
+			}
+			return true, nil
+		},
+		func(context.Context, *media.Media) { callback() },
+		4)
+
+	runSearch(t, s)
+	if calls != 16 || overlaps != 0 {
+		t.Fatalf("expected 16 calls without overlap, got %d calls and %d overlaps", calls, overlaps)
+	}
+}
+
+func TestSearchCheckpoint(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 4; i++ {
+		testimage.Write(t, filepath.Join(root, fmt.Sprintf("img%d.png", i)), testimage.Pattern(i))
+	}
+	if err := os.WriteFile(filepath.Join(root, "notes.txt"), []byte("notes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint := &checkpointStub{done: map[string]bool{filepath.Join(root, "img0.png"): true}}
+	var searched []string
+
+	s := media.NewSearch(
+		context.Background(),
+		os.DirFS(root),
+		root,
+		[]hash.Type{hash.DHash},
+		func(context.Context, error) {},
+		func(_ context.Context, m *media.Media) (bool, error) {
+			switch m.Name() {
+			case "img1.png":
+				return false, errors.New("lookup failed")
+			case "img2.png":
+				return true, nil
+			}
+			return false, nil
+		},
+		func(_ context.Context, m *media.Media) {
+			searched = append(searched, m.Name())
+		},
+		2,
+		media.WithCheckpoint(checkpoint, time.Hour))
+
+	stats := runSearch(t, s)
+
+	if stats.Resumed != 1 || stats.Skipped != 2 || stats.Errored != 1 || stats.Processed != 2 {
+		t.Fatalf("unexpected stats %+v %v", stats, matches)
+	}
+
+	// the file done before and the errored file are not marked.
+	sort.Strings(checkpoint.marked)
+	expected := []string{
+		filepath.Join(root, "img2.png"),
+		filepath.Join(root, "img3.png"),
+		filepath.Join(root, "notes.txt"),
+	}
+	if fmt.Sprint(checkpoint.marked) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v marked, got %v", expected, checkpoint.marked)
+	}
+	if checkpoint.saves != 1 {
+		t.Fatalf("expected the checkpoint to be saved once, got %d", checkpoint.saves)
+	}
+	if len(searched) != 1 {
+		t.Fatalf("expected 1 match, got %v", searched)
+	}
+}
+
+func TestSearchArchives(t *testing.T) {
+	root := t.TempDir()
+	img := filepath.Join(t.TempDir(), "img.png")
+	testimage.Write(t, img, testimage.Pattern(3))
+	data, err := os.ReadFile(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// evidence.zip holds an image, a text file and a tar holding the same image.
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	tw.WriteHeader(&tar.Header{Name: "nested/img.png", Mode: 0o644, Size: int64(len(data))})
+	tw.Write(data)
+	tw.Close()
+
+	f, err := os.Create(filepath.Join(root, "evidence.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, content := range map[string][]byte{
+		"dir/img.png":   data,
+		"dir/notes.txt": []byte("notes"),
+		"inner.tar":     tarBuf.Bytes(),
+	} {
+		w, _ := zw.Create(name)
+		w.Write(content)
+	}
+	zw.Close()
+	f.Close()
+
+	for _, tt := range []struct {
+		depth   int
+		matches []string
+		stats   media.Stats
+	}{
+		{0, nil, media.Stats{Skipped: 1}},
+		{1, []string{"evidence.zip!/dir/img.png"}, media.Stats{Processed: 1, Matched: 1, Skipped: 2, Archives: 1}},
+		{2, []string{"evidence.zip!/dir/img.png", "evidence.zip!/inner.tar!/nested/img.png"},
+			media.Stats{Processed: 2, Matched: 2, Skipped: 1, Archives: 1}},
+	} {
+		var matches []string
+		s := media.NewSearch(
+			context.Background(),
+			os.DirFS(root),
+			root,
+			[]hash.Type{hash.SHA1},
+			func(_ context.Context, err error) { t.Error(err) },
+			func(context.Context, *media.Media) (bool, error) { return true, nil },
+			func(_ context.Context, m *media.Media) {
+				rel, _ := filepath.Rel(root, m.Path())
+				matches = append(matches, filepath.ToSlash(rel))
+
+				r, err := m.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				content, _ := io.ReadAll(r)
+				r.Close()
+				if !bytes.Equal(content, data) || m.Name() != "img.png" || m.Type() != "image" {
+					t.Errorf("unexpected member %s", m.Path())
+				}
+			},
+			1,
+			media.WithArchiveDepth(tt.depth))
+
+		stats := runSearch(t, s)
+		sort.Strings(matches)
+		if fmt.Sprint(matches) != fmt.Sprint(tt.matches) || stats != tt.stats {
+			t.Fatalf("depth %d: expected %v %+v, got %v %+v", tt.depth, tt.matches, tt.stats, matches, stats)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+The checkpoint is a text journal appended while the search runs:
+
+	chasam-checkpoint 1
+	target "<target directory>"
+	csv "<match CSV>"
+	done "<path>"     a file handled by the search
+	saved <offset>    the match CSV was flushed up to offset
+
+A file is only done if a saved line follows it, since its CSV rows may not have been flushed
+yet. When the search is resumed, the CSV is truncated to the last saved offset, which drops any
+row of the files that are going to be handled again.
+*/
+
+const checkpointVersion = "chasam-checkpoint 1"
+
+var errInvalidCheckpoint = errors.New("invalid checkpoint")
+
+type checkpointFile struct {
+	path   string
+	target string
+	csv    string
+
+	// flushCSV flushes the match CSV and returns its size.
+	flushCSV func() (int64, error)
+
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	done   map[string]struct{}
+	offset int64
+}
+
+// newCheckpoint starts the journal of a search of target whose matches are written to csv.
+func newCheckpoint(path, target, csv string) (*checkpointFile, error) {
+	c := &checkpointFile{
+		path:   path,
+		target: target,
+		csv:    csv,
+		done:   make(map[string]struct{}),
+	}
+
+	if err := c.rewrite(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// resumeCheckpoint loads the journal of an interrupted search of target. The files done and
+// the CSV offset are the ones of the last saved line.
+func resumeCheckpoint(path, target string) (*checkpointFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &checkpointFile{
+		path: path,
+		done: make(map[string]struct{}),
+	}
+	var pending []string
+
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			// a line without a newline was interrupted while being written.
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		if n == 1 {
+			if line != checkpointVersion {
+				return nil, fmt.Errorf("%s: %w", path, errInvalidCheckpoint)
+			}
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "target", "csv", "done":
+			value, err = strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, errInvalidCheckpoint)
+			}
+			switch key {
+			case "target":
+				c.target = value
+			case "csv":
+				c.csv = value
+			default:
+				pending = append(pending, value)
+			}
+		case "saved":
+			c.offset, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, errInvalidCheckpoint)
+			}
+			for _, p := range pending {
+				c.done[p] = struct{}{}
+			}
+			pending = pending[:0]
+		default:
+			return nil, fmt.Errorf("%s:%d: %w", path, n, errInvalidCheckpoint)
+		}
+	}
+
+	if c.csv == "" || c.target == "" {
+		return nil, fmt.Errorf("%s: %w", path, errInvalidCheckpoint)
+	}
+	if c.target != target {
+		return nil, fmt.Errorf("the checkpoint %s belongs to the search of %s", path, c.target)
+	}
+
+	// the journal is rewritten without the lines that were not saved.
+	if err = c.rewrite(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// rewrite replaces the journal by the header, the files done and the offset saved so far, and
+// keeps it open for appending.
+func (c *checkpointFile) rewrite() error {
+	tmpPath := c.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, checkpointVersion)
+	fmt.Fprintf(w, "target %s\n", strconv.Quote(c.target))
+	fmt.Fprintf(w, "csv %s\n", strconv.Quote(c.csv))
+	if len(c.done) > 0 {
+		for p := range c.done {
+			fmt.Fprintf(w, "done %s\n", strconv.Quote(p))
+		}
+		fmt.Fprintf(w, "saved %d\n", c.offset)
+	}
+
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, c.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	c.f = f
+	c.w = w
+	return nil
+}
+
+func (c *checkpointFile) Done(path string) bool {
+	_, ok := c.done[path]
+	return ok
+}
+
+func (c *checkpointFile) MarkDone(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(c.w, "done %s\n", strconv.Quote(path))
+}
+
+// Save flushes the match CSV and records its size after the files marked so far.
+func (c *checkpointFile) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offset, err := c.flushCSV()
+	if err != nil {
+		return fmt.Errorf("checkpoint: %v", err)
+	}
+
+	fmt.Fprintf(c.w, "saved %d\n", offset)
+	if err = c.w.Flush(); err == nil {
+		err = c.f.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("checkpoint: %v", err)
+	}
+	return nil
+}
+
+// Close closes the journal and, if the search was completed, removes it.
+func (c *checkpointFile) Close(completed bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.f.Close()
+	if completed {
+		return os.Remove(c.path)
+	}
+	return err
+}
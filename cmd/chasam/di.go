@@ -7,16 +7,20 @@ import (
 )
 
 type Provider struct {
-	mediaRepositoryMem media.Repository
+	mediaRepositoryMem  media.Repository
+	mediaRepositoryFile media.Repository
+	mediaRepositoryList media.Repository
+	allowlist           media.Allowlist
+	hashCache           media.Cache
 }
 
 func CreateProvider() *Provider {
 	return &Provider{}
 }
 
-func (p *Provider) MediaRepositoryMem(dir string, hashTypes []hash.Type) (media.Repository, error) {
+func (p *Provider) MediaRepositoryMem(dir string, hashTypes []hash.Type, opts ...media.Option) (media.Repository, error) {
 	if p.mediaRepositoryMem == nil {
-		repo, err := repository.NewMediaRepositoryMem(dir, hashTypes)
+		repo, err := repository.NewMediaRepositoryMem(dir, hashTypes, opts...)
 		if err != nil {
 			return nil, err
 		}
@@ -24,3 +28,48 @@ func (p *Provider) MediaRepositoryMem(dir string, hashTypes []hash.Type) (media.
 	}
 	return p.mediaRepositoryMem, nil
 }
+
+func (p *Provider) MediaRepositoryFile(dbPath string, source string, hashTypes []hash.Type,
+	opts ...media.Option) (media.Repository, error) {
+	if p.mediaRepositoryFile == nil {
+		repo, err := repository.NewMediaRepositoryFile(dbPath, source, hashTypes, opts...)
+		if err != nil {
+			return nil, err
+		}
+		p.mediaRepositoryFile = repo
+	}
+	return p.mediaRepositoryFile, nil
+}
+
+func (p *Provider) MediaRepositoryHashSet(path string, opts ...media.Option) (media.Repository, error) {
+	if p.mediaRepositoryList == nil {
+		repo, err := repository.NewMediaRepositoryHashSet(path, opts...)
+		if err != nil {
+			return nil, err
+		}
+		p.mediaRepositoryList = repo
+	}
+	return p.mediaRepositoryList, nil
+}
+
+func (p *Provider) Allowlist(path string) (media.Allowlist, error) {
+	if p.allowlist == nil {
+		allowlist, err := repository.NewAllowlistMem(path)
+		if err != nil {
+			return nil, err
+		}
+		p.allowlist = allowlist
+	}
+	return p.allowlist, nil
+}
+
+func (p *Provider) HashCache(path string) (media.Cache, error) {
+	if p.hashCache == nil {
+		cache, err := repository.NewHashCacheFile(path)
+		if err != nil {
+			return nil, err
+		}
+		p.hashCache = cache
+	}
+	return p.hashCache, nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/tsmweb/chasam/app/eval"
+	"github.com/tsmweb/chasam/app/hash"
+)
+
+// runEval measures the distances of every perceptual hash type between the images of a source
+// directory and their synthetic transformed copies, and between them and unrelated images, and
+// writes the precision/recall and ROC tables from which the --hamming thresholds can be chosen.
+// It returns the exit code.
+func runEval(args []string) int {
+	var perceptualTypes []string
+	for _, t := range hash.Types() {
+		if t.IsPerceptual() {
+			perceptualTypes = append(perceptualTypes, t.Name())
+		}
+	}
+	var allTransforms []string
+	for _, t := range eval.Transforms() {
+		allTransforms = append(allTransforms, t.Name)
+	}
+
+	flags := flag.NewFlagSet("eval", flag.ExitOnError)
+	evalSource := flags.String("source", "", "--source=images/benign")
+	evalNegatives := flags.String("negatives", "", "--negatives=images/other")
+	evalHoldout := flags.Float64("holdout", 0.2, "--holdout=0.2")
+	evalHash := flags.String("hash", strings.Join(perceptualTypes, ","), "--hash=d-hash,p-hash")
+	evalTransform := flags.String("transform", strings.Join(allTransforms, ","), "--transform=jpeg,resize")
+	evalSize := flags.Int("hash-size", 16, "--hash-size=16")
+	evalFraction := flags.Float64("segment-fraction", 0.5, "--segment-fraction=0.5")
+	evalOutput := flags.String("output", "", "--output=eval.csv")
+	flags.Usage = printEvalHelper
+	flags.Parse(args)
+
+	if *evalSource == "" {
+		printEvalHelper()
+		return 0
+	}
+
+	if err := hash.CheckExtHashSize(*evalSize); err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
+		return 1
+	}
+
+	hashTypes, _ := makeHashTypes(*evalHash)
+	if len(hashTypes) == 0 {
+		fmt.Fprintf(os.Stderr, "[!] Error: nenhum tipo de hash válido em `%s`\n", *evalHash)
+		return 1
+	}
+
+	transforms, err := eval.ParseTransforms(*evalTransform)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
+		return 1
+	}
+
+	references, negatives, err := makeEvalImages(*evalSource, *evalNegatives, *evalHoldout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
+		return 1
+	}
+
+	color.Printf("[>] Imagens de referência: <green>%d</>, imagens negativas: <green>%d</>, transformações: <green>%d</>\n",
+		len(references.Names), len(negatives.Names), len(transforms))
+
+	count := 0
+	e := &eval.Evaluation{
+		HashTypes:  hashTypes,
+		Transforms: transforms,
+		Fraction:   *evalFraction,
+		HashSize:   *evalSize,
+		OnImage: func(name string, err error) {
+			count++
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[!] Imagem ignorada `%s`. Error: %v\n", name, err.Error())
+			}
+			fmt.Printf("\r[*] Imagens processadas: %d", count)
+		},
+	}
+	results, err := e.Run(references, negatives)
+	fmt.Println()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
+		return 1
+	}
+
+	name := *evalOutput
+	if name == "" {
+		name = fmt.Sprintf("eval_%s.csv", time.Now().Format("2006-01-02"))
+	}
+	distName := strings.TrimSuffix(name, ".csv") + "_dist.csv"
+
+	if err = writeEvalFile(name, func(w *csv.Writer) { writeROC(w, results, transforms) }); err == nil {
+		err = writeEvalFile(distName, func(w *csv.Writer) { writeDistribution(w, results, transforms) })
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
+		return 1
+	}
+
+	printEvalSummary(results, transforms, *evalSize)
+	color.Printf("[>] Tabela de precisão/recall e ROC: <green>%s</>\n", name)
+	color.Printf("[>] Distribuição das distâncias: <green>%s</>\n", distName)
+	return 0
+}
+
+// makeEvalImages lists the images of the source directory and of the negatives directory or,
+// without one, holds out the fraction of the source images as negatives, spread over the
+// images sorted by name.
+func makeEvalImages(source, negatives string, holdout float64) (eval.Images, eval.Images, error) {
+	refs := eval.Images{FS: os.DirFS(source)}
+	names, err := listFiles(refs.FS)
+	if err != nil {
+		return refs, eval.Images{}, err
+	}
+
+	if negatives != "" {
+		negs := eval.Images{FS: os.DirFS(negatives)}
+		negs.Names, err = listFiles(negs.FS)
+		refs.Names = names
+		return refs, negs, err
+	}
+
+	if holdout <= 0 || holdout >= 1 {
+		return refs, eval.Images{}, fmt.Errorf("invalid holdout %v, it must be between 0 and 1", holdout)
+	}
+	k := int(math.Round(float64(len(names)) * holdout))
+	if k == 0 {
+		k = 1
+	}
+	negs := eval.Images{FS: refs.FS}
+	for i, name := range names {
+		if (i+1)*k/len(names) > i*k/len(names) {
+			negs.Names = append(negs.Names, name)
+		} else {
+			refs.Names = append(refs.Names, name)
+		}
+	}
+	if len(refs.Names) == 0 || len(negs.Names) == 0 {
+		return refs, negs, fmt.Errorf("not enough images in `%s` to hold out negatives", source)
+	}
+	return refs, negs, nil
+}
+
+// listFiles returns the names of the files of the root directory of fsys, sorted.
+func listFiles(fsys fs.FS) ([]string, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func writeEvalFile(name string, write func(w *csv.Writer)) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	write(w)
+	w.Flush()
+	err = w.Error()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeROC writes a row for each hash type and threshold, with the recall of each transform.
+func writeROC(w *csv.Writer, results []*eval.Result, transforms []eval.Transform) {
+	header := []string{"TIPO DO HASH", "LIMIAR", "VP", "FP", "FN", "VN", "PRECISAO", "RECALL", "TFP", "F1"}
+	for _, t := range transforms {
+		header = append(header, "RECALL "+t.Name)
+	}
+	w.Write(header)
+
+	for _, r := range results {
+		for _, p := range r.ROC() {
+			row := []string{
+				r.HashType.String(),
+				strconv.Itoa(p.Threshold),
+				strconv.Itoa(p.TP),
+				strconv.Itoa(p.FP),
+				strconv.Itoa(p.FN),
+				strconv.Itoa(p.TN),
+				formatRate(p.Precision()),
+				formatRate(p.Recall()),
+				formatRate(p.FPR()),
+				formatRate(p.F1()),
+			}
+			for _, t := range transforms {
+				row = append(row, formatRate(r.Recall(t.Name, p.Threshold)))
+			}
+			w.Write(row)
+		}
+	}
+}
+
+// writeDistribution writes the histogram of the distances of each hash type, for the copies of
+// each transform and for the negatives.
+func writeDistribution(w *csv.Writer, results []*eval.Result, transforms []eval.Transform) {
+	w.Write([]string{"TIPO DO HASH", "PARES", "DISTANCIA", "QUANTIDADE"})
+
+	for _, r := range results {
+		series := []string{}
+		for _, t := range transforms {
+			series = append(series, t.Name)
+		}
+		series = append(series, "negativos")
+
+		for _, s := range series {
+			distances := r.Negatives
+			if s != "negativos" {
+				distances = r.Positives[s]
+			}
+			hist, missing := eval.Histogram(distances, r.Bits)
+			for d, n := range hist {
+				if n > 0 {
+					w.Write([]string{r.HashType.String(), s, strconv.Itoa(d), strconv.Itoa(n)})
+				}
+			}
+			if missing > 0 {
+				w.Write([]string{r.HashType.String(), s, "sem hash", strconv.Itoa(missing)})
+			}
+		}
+	}
+}
+
+func formatRate(v float64) string {
+	return strconv.FormatFloat(v, 'f', 4, 64)
+}
+
+// printEvalSummary prints, for each hash type, the distances of the copies of each transform
+// and of the negatives, the AUC and the threshold of the highest F1.
+func printEvalSummary(results []*eval.Result, transforms []eval.Transform, hashSize int) {
+	for _, r := range results {
+		points := r.ROC()
+		best := eval.Best(points)
+
+		color.Printf("\n<yellow>%s</> (%d bits): AUC <green>%.4f</>, limiar de maior F1 <green>%d</> "+
+			"(precisão %.4f, recall %.4f, TFP %.4f), limiar padrão %d\n",
+			r.HashType.String(), r.Bits, eval.AUC(points), best.Threshold,
+			best.Precision(), best.Recall(), best.FPR(), r.HashType.DefaultDistance(hashSize))
+		fmt.Printf("\t%-16s %8s %8s %8s %8s %8s %8s\n", "pares", "n", "mín", "mediana", "p95", "máx", "sem hash")
+
+		for _, t := range transforms {
+			printEvalRow(t.Name, eval.Summarize(r.Positives[t.Name]))
+		}
+		printEvalRow("negativos", eval.Summarize(r.Negatives))
+	}
+}
+
+func printEvalRow(name string, s eval.Summary) {
+	fmt.Printf("\t%-16s %8d %8d %8d %8d %8d %8d\n", name, s.N, s.Min, s.Median, s.P95, s.Max, s.Missing)
+}
+
+func printEvalHelper() {
+	fmt.Println("Uso: chasam eval --source=images/benign --negatives=images/other --hash=d-hash,p-hash --output=eval.csv")
+	fmt.Println("Gera cópias transformadas das imagens de origem e mede a distância de cada tipo de hash perceptivo " +
+		"entre as imagens e suas cópias e entre elas e imagens sem relação, para escolher o --hamming de cada " +
+		"tipo de hash a partir de evidências.")
+
+	fmt.Printf("\nArgumentos.\n")
+	fmt.Printf(templateHelperStr, "--source", "diretório com as imagens de referência (imagens benignas)")
+	fmt.Printf(templateHelperStr, "--negatives", "diretório com imagens sem relação com as de referência "+
+		"(padrão: uma fração das imagens de --source é separada como negativas)")
+	fmt.Printf(templateHelperStr, "--holdout", "fração das imagens de --source separada como negativas "+
+		"quando --negatives não é informado (0.2 por padrão)")
+	fmt.Printf(templateHelperStr, "--hash", "tipos de hash perceptivo separados por vírgula (padrão: todos)")
+	fmt.Printf(templateHelperStr, "--transform", "transformações separadas por vírgula (padrão: todas)")
+	fmt.Printf(templateHelperStr, "\tjpeg-50", "recompressão JPEG com qualidade 50")
+	fmt.Printf(templateHelperStr, "\tresize-50", "redimensionamento para a metade do tamanho")
+	fmt.Printf(templateHelperStr, "\tcrop-10", "recorte de 10% de cada lado")
+	fmt.Printf(templateHelperStr, "\tborder-10", "borda preta de 10% em cada lado")
+	fmt.Printf(templateHelperStr, "\tbrightness-40", "aumento de 40 no brilho de cada canal de cor")
+	fmt.Printf(templateHelperStr, "\trotate-5", "rotação de 5° em torno do centro")
+	fmt.Printf(templateHelperStr, "\twatermark", "faixa branca semitransparente sobre a parte de baixo da imagem")
+	fmt.Printf(templateHelperStr, "--hash-size", "lado da grade de bits do d-hash-ext e do p-hash-ext: 8, 16 ou 32")
+	fmt.Printf(templateHelperStr, "--segment-fraction", "fração mínima dos segmentos que devem corresponder "+
+		"para o segment-hash (0.5 por padrão)")
+	fmt.Printf(templateHelperStr, "--output", "tabela de precisão/recall e ROC por limiar "+
+		"(padrão: eval_<data>.csv); a distribuição das distâncias é gravada em <output>_dist.csv")
+}
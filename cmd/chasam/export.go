@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+	"github.com/tsmweb/chasam/infra/repository"
+)
+
+// runExport hashes the images of a source directory and writes them as a hash set file, which
+// can be shared and used as --source without the images. It returns the exit code.
+func runExport(args []string) int {
+	var allTypes []string
+	for _, t := range hash.Types() {
+		allTypes = append(allTypes, t.Name())
+	}
+
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	exportSource := fs.String("source", "", "--source=image/source")
+	exportHash := fs.String("hash", strings.Join(allTypes, ","), "--hash=sha1,md5,d-hash,p-hash")
+	exportFormat := fs.String("format", "csv", "--format=csv|ndjson|vics")
+	exportOutput := fs.String("output", "", "--output=hashset.csv")
+	exportSize := fs.Int("hash-size", 16, "--hash-size=16")
+	exportOrient := fs.Bool("orientation", true, "--orientation=false")
+	fs.Usage = printExportHelper
+	fs.Parse(args)
+
+	if *exportSource == "" {
+		printExportHelper()
+		return 0
+	}
+
+	format, err := repository.ParseHashSetFormat(*exportFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
+		return 1
+	}
+
+	if err = hash.CheckExtHashSize(*exportSize); err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
+		return 1
+	}
+
+	hashTypes, _ := makeHashTypes(*exportHash)
+	if len(hashTypes) == 0 {
+		fmt.Fprintf(os.Stderr, "[!] Error: nenhum tipo de hash válido em `%s`\n", *exportHash)
+		return 1
+	}
+
+	name := *exportOutput
+	if name == "" {
+		ext := string(format)
+		if format == repository.HashSetVICS {
+			ext = "json"
+		}
+		name = fmt.Sprintf("hashset_%s.%s", time.Now().Format("2006-01-02"), ext)
+	}
+
+	out, err := os.Create(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
+		return 1
+	}
+
+	err = repository.ExportHashSet(*exportSource, hashTypes, format, out,
+		media.WithOrientation(*exportOrient), media.WithHashSize(*exportSize))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+		fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
+		return 1
+	}
+
+	color.Printf("[>] Conjunto de hashs exportado: <green>%s</>\n", name)
+	return 0
+}
+
+func printExportHelper() {
+	fmt.Println("Uso: chasam export --source=images/source --hash=sha1,d-hash,p-hash --format=csv --output=hashset.csv")
+	fmt.Println("Calcula os hashs das imagens de origem e grava um conjunto de hashs, que pode ser " +
+		"compartilhado e usado como --source sem as imagens.")
+
+	fmt.Printf("\nArgumentos.\n")
+	fmt.Printf(templateHelperStr, "--source", "diretório de origem com as imagens a serem exportadas")
+	fmt.Printf(templateHelperStr, "--hash", "tipos de hash separados por vírgula (padrão: todos)")
+	fmt.Printf(templateHelperStr, "--format", "formato do conjunto de hashs")
+	fmt.Printf(templateHelperStr, "\tcsv", "uma coluna por tipo de hash")
+	fmt.Printf(templateHelperStr, "\tndjson", "um objeto JSON por linha")
+	fmt.Printf(templateHelperStr, "\tvics", "VICS JSON do Project VIC")
+	fmt.Printf(templateHelperStr, "--output", "arquivo de saída (padrão: hashset_<data>.<formato>)")
+	fmt.Printf(templateHelperStr, "--hash-size", "lado da grade de bits do d-hash-ext e do p-hash-ext: 8, 16 ou 32")
+	fmt.Printf(templateHelperStr, "--orientation", "aplica a orientação do EXIF antes dos hashs perceptivos "+
+		"(ativada por padrão; o --hash-size e a --orientation são gravados no conjunto com hashs perceptivos, "+
+		"que é recusado por uma pesquisa com outros valores)")
+}
@@ -7,9 +7,11 @@ package main
 import (
 	"context"
 	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -21,30 +23,60 @@ import (
 	"github.com/gookit/color"
 	"github.com/tsmweb/chasam/app/hash"
 	"github.com/tsmweb/chasam/app/media"
+	"github.com/tsmweb/chasam/pkg/carve"
+	"github.com/tsmweb/chasam/pkg/disk"
+	"github.com/tsmweb/chasam/pkg/disk/vfs"
+	"github.com/tsmweb/chasam/pkg/ewf"
 	"github.com/tsmweb/chasam/pkg/progressbar"
 )
 
 var (
-	cpu      = flag.Int("cpu", runtime.NumCPU(), "--cpu=4")
-	source   = flag.String("source", "", "--source=image/source")
-	target   = flag.String("target", "", "--target=image/target")
-	hashType = flag.String("hash", "d-hash", "--hash=sha1,ed2k,a-hash,d-hash,d-hash-v,p-hash,domi-hash,ch-hash")
-	hamming  = flag.Int("hamming", 10, "--hamming=10")
-
-	_hashMap      map[hash.Type]bool
-	_hashArray    []hash.Type
-	provider      = CreateProvider()
-	_repository   media.Repository
-	countFileCh   = make(chan struct{})
-	countMatchCh  = make(chan struct{})
-	extractFileCh = make(chan string)
+	cpu       = flag.Int("cpu", runtime.NumCPU(), "--cpu=4")
+	source    = flag.String("source", "", "--source=image/source")
+	db        = flag.String("db", "", "--db=reference.db")
+	target    = flag.String("target", "", "--target=image/target")
+	allowlist = flag.String("allowlist", "", "--allowlist=NSRLFile.txt")
+	cache     = flag.String("cache", "", "--cache=target.cache")
+	resume    = flag.Bool("resume", false, "--resume")
+	depth     = flag.Int("archive-depth", 0, "--archive-depth=3")
+	verify    = flag.Bool("verify", false, "--verify")
+	carving   = flag.Bool("carve", false, "--carve")
+	thumbnail = flag.Bool("thumbnail", false, "--thumbnail")
+	orient    = flag.Bool("orientation", true, "--orientation=false")
+	dihedral  = flag.Bool("dihedral", false, "--dihedral")
+	hashType  = flag.String("hash", "d-hash", "--hash=sha1,ed2k,md5,a-hash,d-hash,d-hash-v,p-hash,w-hash,domi-hash,ch-hash,segment-hash,pdq,d-hash-ext,p-hash-ext")
+	hamming   = flag.String("hamming", "", "--hamming=d-hash:8,p-hash:12")
+	hashSize  = flag.Int("hash-size", 16, "--hash-size=16")
+	fraction  = flag.Float64("segment-fraction", 0.5, "--segment-fraction=0.5")
+	top       = flag.Int("top", 0, "--top=1")
+	policy    = flag.String("policy", "any", "--policy=any|majority|all|weighted")
+	weights   = flag.String("weights", "", "--weights=d-hash:2,p-hash:1")
+	minScore  = flag.Float64("min-score", 0.5, "--min-score=0.5")
+
+	_hashMap     map[hash.Type]bool
+	_hashArray   []hash.Type
+	provider     = CreateProvider()
+	_repository  media.Repository
+	_distances   map[hash.Type]int
+	_consensus   *media.Consensus
+	countFileCh  = make(chan struct{})
+	countMatchCh = make(chan struct{})
+	_checkpoint  *checkpointFile
 
 	_extractionFolderPath = "extracted"
+	_checkpointPath       = "chasam.checkpoint"
 
 	_csv *csv.Writer
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(runExport(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "eval" {
+		os.Exit(runEval(os.Args[2:]))
+	}
+
 	flag.Parse()
 
 	ctx, cancelFunc := signal.NotifyContext(context.Background(), os.Interrupt)
@@ -59,30 +91,56 @@ func main() {
 	//	cancelFun()
 	//}()
 
-	if *source == "" || *target == "" {
+	if (*source == "" && *db == "") || *target == "" {
 		printHelper()
 		os.Exit(0)
 	}
 
+	if err := hash.CheckExtHashSize(*hashSize); err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
+		os.Exit(1)
+	}
+
+	distances, err := makeDistances(*hamming)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
+		os.Exit(1)
+	}
+	_distances = distances
+
+	consensus, err := makeConsensus()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
+		os.Exit(1)
+	}
+	_consensus = consensus
+	_hashArray, _hashMap = makeHashTypes(*hashType)
+
 	if err := createExtractionFolder(); err != nil {
 		fmt.Fprintf(os.Stderr, "[!] Falha ao criar a pasta de extração. Error: %v", err.Error())
 		os.Exit(1)
 	}
 
-	csvName := fmt.Sprintf(
-		"match_%s.csv",
-		time.Now().Format("2006-01-02"),
-	)
-	csvFile, err := os.Create(csvName)
+	csvFile, err := openMatchFile()
 	if err != nil {
-		fmt.Printf("[!] Error: %v\n", err.Error())
+		fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
+		os.Exit(1)
 	}
 	_csv = csv.NewWriter(csvFile)
 	defer func() {
 		_csv.Flush()
 		csvFile.Close()
 	}()
-	_csv.Write([]string{"ORIGEM", "ALVO", "ALVO PATH", "TIPO DO HASH", "HAMMING"})
+	if info, err := csvFile.Stat(); err == nil && info.Size() == 0 {
+		_csv.Write(matchHeader())
+	}
+	_checkpoint.flushCSV = func() (int64, error) {
+		_csv.Flush()
+		if err := _csv.Error(); err != nil {
+			return 0, err
+		}
+		return csvFile.Seek(0, io.SeekCurrent)
+	}
 
 	printBanner()
 
@@ -99,6 +157,7 @@ func main() {
 		bar.Finish()
 	}()
 
+	var stats media.Stats
 	countMatch := 0
 	go func() {
 		for range countMatchCh {
@@ -107,32 +166,83 @@ func main() {
 		}
 	}()
 
-	go func() {
-		for path := range extractFileCh {
-			if err := extractFile(path); err != nil {
-				fmt.Fprintf(os.Stderr, "[!] Falha ao extrair o arquivo `%s`. Error: %v\n",
-					path, err.Error())
-			}
-		}
-	}()
-
 	start := time.Now()
 
-	if err := runMediaSearch(ctx); err != nil {
+	if err := runMediaSearch(ctx, &stats); err != nil {
 		fmt.Printf("[!] Error: %v\n", err.Error())
 	}
 
+	completed := ctx.Err() == nil
+	if err := _checkpoint.Close(completed); err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Falha ao fechar o checkpoint. Error: %v\n", err.Error())
+	}
+
 	elapsed := time.Since(start)
 	time.Sleep(time.Millisecond * 500)
 
 	color.Printf("\n[>] Pesquisa concluída em: <green>%s</>\n", elapsed)
 	color.Printf("[>] Total de arquivos analisados: <green>%d</>\n", countFile)
+	color.Printf("[>] Total de arquivos ignorados: <green>%d</>\n", stats.Skipped)
+	if *resume {
+		color.Printf("[>] Total de arquivos analisados antes da interrupção: <green>%d</>\n", stats.Resumed)
+	}
+	if *allowlist != "" {
+		color.Printf("[>] Total de arquivos ignorados (allowlist): <green>%d</>\n", stats.Allowlisted)
+	}
+	color.Printf("[>] Total de arquivos com erro: <green>%d</>\n", stats.Errored)
+	if stats.Archives > 0 {
+		color.Printf("[>] Total de arquivos compactados abertos: <green>%d</>\n", stats.Archives)
+	}
 	color.Printf("[>] Total de match: <green>%d</>\n", countMatch)
 	color.Printf("[>] Arquivo de match: <green>%s</>\n", csvFile.Name())
+	if !completed {
+		color.Printf("[>] Pesquisa interrompida, para continuar execute novamente com <green>--resume</>\n")
+	}
 
 	//panic(fmt.Errorf("%s", "error goroutines"))
 }
 
+// openMatchFile creates the match CSV of a new search and its checkpoint or, with --resume, opens
+// the CSV of the interrupted search truncated to the last checkpoint.
+func openMatchFile() (*os.File, error) {
+	if !*resume {
+		csvName := fmt.Sprintf(
+			"match_%s.csv",
+			time.Now().Format("2006-01-02"),
+		)
+		csvFile, err := os.Create(csvName)
+		if err != nil {
+			return nil, err
+		}
+
+		_checkpoint, err = newCheckpoint(_checkpointPath, *target, csvName)
+		if err != nil {
+			csvFile.Close()
+			return nil, err
+		}
+		return csvFile, nil
+	}
+
+	checkpoint, err := resumeCheckpoint(_checkpointPath, *target)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao retomar a pesquisa: %v", err)
+	}
+	_checkpoint = checkpoint
+
+	csvFile, err := os.OpenFile(checkpoint.csv, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err = csvFile.Truncate(checkpoint.offset); err == nil {
+		_, err = csvFile.Seek(checkpoint.offset, io.SeekStart)
+	}
+	if err != nil {
+		csvFile.Close()
+		return nil, err
+	}
+	return csvFile, nil
+}
+
 func createExtractionFolder() error {
 	_, err := os.Stat(_extractionFolderPath)
 	if os.IsNotExist(err) {
@@ -145,74 +255,203 @@ func createExtractionFolder() error {
 	return nil
 }
 
-func runMediaSearch(ctx context.Context) error {
+func runMediaSearch(ctx context.Context, stats *media.Stats) error {
 	root := *target
 	poolSize := *cpu
-	_hashArray, _hashMap = makeHashTypes()
 
-	repo, err := provider.MediaRepositoryMem(*source, _hashArray)
+	repo, err := makeRepository()
 	if err != nil {
 		return err
 	}
 	_repository = repo
 
+	var opts []media.Option
+	if *allowlist != "" {
+		al, err := provider.Allowlist(*allowlist)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, media.WithAllowlist(al))
+	}
+
+	var hashCache media.Cache
+	if *cache != "" {
+		hashCache, err = provider.HashCache(*cache)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, media.WithCache(hashCache))
+	}
+	opts = append(opts, media.WithCheckpoint(_checkpoint, 30*time.Second))
+	opts = append(opts, media.WithArchiveDepth(*depth))
+	if *thumbnail {
+		opts = append(opts, media.WithThumbnail())
+	}
+	opts = append(opts, hashOptions()...)
+	if *dihedral {
+		opts = append(opts, media.WithDihedral())
+	}
+
+	fsys, root, closeTarget, err := openTarget(root)
+	if err != nil {
+		return err
+	}
+	defer closeTarget()
+
 	s := media.NewSearch(
 		ctx,
+		fsys,
 		root,
 		_hashArray,
 		onError,
 		onSearch,
 		onMatch,
 		poolSize,
+		opts...,
 	)
-	s.Run()
+	*stats = s.Run()
+
+	if hashCache != nil {
+		if err = hashCache.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "[!] Falha ao salvar o cache de hashs `%s`. Error: %v\n", *cache, err.Error())
+		}
+	}
 
 	close(countFileCh)
-	close(extractFileCh)
 	close(countMatchCh)
 	return nil
 }
 
-func makeHashTypes() ([]hash.Type, map[hash.Type]bool) {
+// openTarget opens the --target directory or, if it is a file, the file systems of the disk
+// image (dd or E01) it holds, whose files are reported as image.dd!/p1/dir/img.jpg. With --carve
+// the files carved from the image outside the files of its file systems are added as
+// image.dd!/$Carved/<offset>.jpg, and a file without a supported file system is only carved.
+func openTarget(target string) (fs.FS, string, func(), error) {
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if info.IsDir() {
+		return os.DirFS(target), target, func() {}, nil
+	}
+
+	f, err := os.Open(target)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	header := make([]byte, 8)
+	n, _ := io.ReadFull(f, header)
+
+	var image io.ReaderAt = f
+	size := info.Size()
+	closeImage := func() { f.Close() }
+
+	if ewf.IsEWF(header[:n]) {
+		f.Close()
+		e, err := ewf.Open(target)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("falha ao abrir a imagem E01 `%s`: %v", target, err)
+		}
+		if *verify {
+			fmt.Println("[*] Verificando o MD5 da imagem E01...")
+			if err = e.Verify(); err != nil {
+				e.Close()
+				return nil, "", nil, fmt.Errorf("falha na verificação da imagem E01 `%s`: %v", target, err)
+			}
+		}
+		image, size, closeImage = e, e.Size(), func() { e.Close() }
+	}
+
+	fsys, err := disk.Open(image, size)
+	if *carving && errors.Is(err, disk.ErrUnsupported) {
+		fsys, err = vfs.New(vfs.NewDir(".", time.Time{}, false)), nil
+	}
+	if err != nil {
+		closeImage()
+		return nil, "", nil, fmt.Errorf("falha ao abrir a imagem de disco `%s`: %v", target, err)
+	}
+
+	if *carving {
+		fmt.Println("[*] Recuperando arquivos por carving...")
+		carved, err := carve.NewDir(image, size, fsys.Allocated())
+		if err != nil {
+			closeImage()
+			return nil, "", nil, fmt.Errorf("falha no carving de `%s`: %v", target, err)
+		}
+		fsys.Root().Add(carved)
+	}
+	return fsys, target + "!", closeImage, nil
+}
+
+// makeRepository loads the reference hashes from the --db database, built from --source when
+// needed, from a hash set file given as --source (plain list, CSV, HashKeeper or VICS JSON) or
+// by hashing the images of the --source directory.
+func makeRepository() (media.Repository, error) {
+	if *db != "" {
+		return provider.MediaRepositoryFile(*db, *source, _hashArray, hashOptions()...)
+	}
+
+	info, err := os.Stat(*source)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return provider.MediaRepositoryHashSet(*source, hashOptions()...)
+	}
+
+	return provider.MediaRepositoryMem(*source, _hashArray, hashOptions()...)
+}
+
+// hashOptions returns the options of NewMedia that change the perceptual hashes, with which
+// the references and the targets are hashed alike.
+func hashOptions() []media.Option {
+	return []media.Option{media.WithOrientation(*orient), media.WithHashSize(*hashSize)}
+}
+
+func makeHashTypes(types string) ([]hash.Type, map[hash.Type]bool) {
 	hashMap := make(map[hash.Type]bool)
 	var hashArray []hash.Type
-	hTypes := strings.Split(*hashType, ",")
+	hTypes := strings.Split(types, ",")
 
 	for _, ht := range hTypes {
-		switch strings.ToLower(ht) {
-		case "sha1":
-			hashArray = append(hashArray, hash.SHA1)
-			hashMap[hash.SHA1] = true
-		case "ed2k":
-			hashArray = append(hashArray, hash.ED2K)
-			hashMap[hash.ED2K] = true
-		case "a-hash":
-			hashArray = append(hashArray, hash.AHash)
-			hashMap[hash.AHash] = true
-		case "d-hash":
-			hashArray = append(hashArray, hash.DHash)
-			hashMap[hash.DHash] = true
-		case "d-hash-v":
-			hashArray = append(hashArray, hash.DHashV)
-			hashMap[hash.DHashV] = true
-		case "p-hash":
-			hashArray = append(hashArray, hash.PHash)
-			hashMap[hash.PHash] = true
-		case "domi-hash":
-			hashArray = append(hashArray, hash.DomiHash)
-			hashMap[hash.DomiHash] = true
-		case "ch-hash":
-			hashArray = append(hashArray, hash.ChHash)
-			hashMap[hash.ChHash] = true
-		case "w-hash":
-			hashArray = append(hashArray, hash.WHash)
-			hashMap[hash.WHash] = true
+		t, err := hash.ParseType(ht)
+		if err != nil || hashMap[t] {
+			continue
 		}
+		hashArray = append(hashArray, t)
+		hashMap[t] = true
 	}
 
 	return hashArray, hashMap
 }
 
+// makeDistances returns the hamming distance of each hash type set by --hamming, which is either
+// a list such as d-hash:8,p-hash:12 or the path of a file holding one.
+func makeDistances(value string) (map[hash.Type]int, error) {
+	if info, err := os.Stat(value); err == nil && info.Mode().IsRegular() {
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+		value = string(data)
+	}
+	return hash.ParseDistances(value, *hashSize)
+}
+
+// makeConsensus returns the consensus of the hash types set by --policy, --weights and
+// --min-score.
+func makeConsensus() (*media.Consensus, error) {
+	p, err := media.ParsePolicy(*policy)
+	if err != nil {
+		return nil, err
+	}
+	w, err := media.ParseWeights(*weights)
+	if err != nil {
+		return nil, err
+	}
+	return &media.Consensus{Policy: p, MinScore: *minScore, Weights: w}, nil
+}
+
 func onError(_ context.Context, err error) {
 	fmt.Fprintf(os.Stderr, "[!] Error: %v\n", err.Error())
 }
@@ -224,76 +463,141 @@ func onSearch(_ context.Context, m *media.Media) (bool, error) {
 
 	countFileCh <- struct{}{}
 
-	if _, ok := _hashMap[hash.SHA1]; ok {
-		if src := _repository.FindByHash(hash.SHA1, m.SHA1()); src != "-1" {
-			m.AddMatch(src, hash.SHA1.String(), 0)
-			return true, nil
-		}
+	// an identical file needs no consensus.
+	if _, ok := _hashMap[hash.SHA1]; ok && addCryptoMatch(m, hash.SHA1, m.SHA1()) {
+		return true, nil
 	}
 
-	if _, ok := _hashMap[hash.ED2K]; ok {
-		if src := _repository.FindByHash(hash.ED2K, m.ED2K()); src != "-1" {
-			m.AddMatch(src, hash.ED2K.String(), 0)
-			return true, nil
-		}
+	if _, ok := _hashMap[hash.ED2K]; ok && addCryptoMatch(m, hash.ED2K, m.ED2K()) {
+		return true, nil
 	}
 
-	if _, ok := _hashMap[hash.AHash]; ok {
-		if dist, src := _repository.FindByPerceptualHash(hash.AHash, m.AHash(), *hamming); dist != -1 {
-			m.AddMatch(src, hash.AHash.String(), dist)
-			return true, nil
-		}
+	if _, ok := _hashMap[hash.MD5]; ok && addCryptoMatch(m, hash.MD5, m.MD5()) {
+		return true, nil
 	}
 
-	if _, ok := _hashMap[hash.DHash]; ok {
-		if dist, src := _repository.FindByPerceptualHash(hash.DHash, m.DHash(), *hamming); dist != -1 {
-			m.AddMatch(src, hash.DHash.String(), dist)
-			return true, nil
+	ballot := media.NewBallot()
+	for _, hashType := range _hashArray {
+		switch {
+		case !hashType.IsPerceptual():
+		case hashType == hash.SegmentHash:
+			voteSegment(ballot, m.SegmentHash())
+		case hashType.IsExtended():
+			voteExt(ballot, hashType, m.ExtHash(hashType))
+		default:
+			votePerceptual(ballot, hashType, m, "")
 		}
 	}
 
-	if _, ok := _hashMap[hash.DHashV]; ok {
-		if dist, src := _repository.FindByPerceptualHash(hash.DHashV, m.DHashV(), *hamming); dist != -1 {
-			m.AddMatch(src, hash.DHashV.String(), dist)
-			return true, nil
+	for _, v := range m.Variants() {
+		for _, hashType := range _hashArray {
+			if hashType.IsPerceptual() && !hashType.IsExtended() {
+				votePerceptual(ballot, hashType, v.Media, v.Transform.String())
+			}
 		}
 	}
 
-	if _, ok := _hashMap[hash.PHash]; ok {
-		if dist, src := _repository.FindByPerceptualHash(hash.PHash, m.PHash(), *hamming); dist != -1 {
-			m.AddMatch(src, hash.PHash.String(), dist)
-			return true, nil
+	if thumb := m.Thumbnail(); thumb != nil {
+		for _, hashType := range _hashArray {
+			if hashType.IsPerceptual() && !hashType.IsExtended() {
+				votePerceptual(ballot, hashType, thumb, "thumbnail")
+			}
 		}
 	}
 
-	if _, ok := _hashMap[hash.DomiHash]; ok {
-		if dist, src := _repository.FindByPerceptualHash(hash.DomiHash, m.DomiHash(), *hamming); dist != -1 {
-			m.AddMatch(src, hash.DomiHash.String(), dist)
-			return true, nil
-		}
+	matches := topMatches(_consensus.Count(ballot))
+	m.AddMatches(matches...)
+	return len(matches) > 0, nil
+}
+
+// topMatches keeps the first --top matches of a file, which are sorted from the best one.
+func topMatches(matches []media.Match) []media.Match {
+	if *top > 0 && len(matches) > *top {
+		return matches[:*top]
 	}
+	return matches
+}
 
-	if _, ok := _hashMap[hash.ChHash]; ok {
-		if dist, src := _repository.FindByPerceptualHash(hash.ChHash, m.ChHash(), *hamming); dist != -1 {
-			m.AddMatch(src, hash.ChHash.String(), dist)
-			return true, nil
+// addCryptoMatch adds to the media the references of the same file, with a score of 1, and
+// reports whether there was any.
+func addCryptoMatch(m *media.Media, hashType hash.Type, hashValue string) bool {
+	matches := topMatches(_repository.FindAllByHash(hashType, hashValue))
+	for i := range matches {
+		matches[i].Score = 1
+	}
+	m.AddMatches(matches...)
+	return len(matches) > 0
+}
+
+// votePerceptual adds to the ballot every reference within the hamming distance of the hash of
+// m. The hash of a variant of the media, such as its EXIF thumbnail or its rotated copy, votes
+// for its hash type but is reported under the name of the variant: DHash(thumbnail),
+// DHash(rotate-90)... The hash type of the media itself is evaluated only when it has a hash.
+func votePerceptual(b *media.Ballot, hashType hash.Type, m *media.Media, variant string) {
+	if !m.Has(hashType) {
+		return
+	}
+	if variant == "" {
+		b.Evaluate(hashType)
+	}
+
+	distance := _distances[hashType]
+	hashValue := m.PerceptualHash(hashType)
+	for _, match := range _repository.FindAllByPerceptualHash(hashType, hashValue, distance, 0) {
+		if variant != "" {
+			match.HashType += "(" + variant + ")"
 		}
+		match.Threshold = distance
+		b.Vote(hashType, match)
+	}
+}
+
+// voteExt adds to the ballot every reference whose extended hash is within the hamming distance.
+func voteExt(b *media.Ballot, hashType hash.Type, hashValue []uint64) {
+	if len(hashValue) == 0 {
+		return
 	}
+	b.Evaluate(hashType)
 
-	return false, nil
+	distance := _distances[hashType]
+	for _, match := range _repository.FindAllByExtHash(hashType, hashValue, distance, 0) {
+		match.Threshold = distance
+		b.Vote(hashType, match)
+	}
+}
+
+// voteSegment adds to the ballot every reference of which at least the --segment-fraction of the
+// segments are within the hamming distance.
+func voteSegment(b *media.Ballot, hashValue []uint64) {
+	if len(hashValue) == 0 {
+		return
+	}
+	b.Evaluate(hash.SegmentHash)
+
+	distance := _distances[hash.SegmentHash]
+	for _, match := range _repository.FindAllBySegmentHash(hashValue, distance, *fraction, 0) {
+		match.Threshold = distance
+		b.Vote(hash.SegmentHash, match)
+	}
 }
 
 func onMatch(_ context.Context, m *media.Media) {
 	for _, match := range m.Match() {
-		printMatch(match.Name, m.Name(), m.Path(), match.HashType, match.Distance)
+		printMatch(match, m)
 	}
 
-	extractFileCh <- m.Path()
+	// the file is extracted before the match is marked done in the checkpoint.
+	if err := extractFile(m); err != nil {
+		fmt.Fprintf(os.Stderr, "[!] Falha ao extrair o arquivo `%s`. Error: %v\n",
+			m.Path(), err.Error())
+	}
 	countMatchCh <- struct{}{}
 }
 
-func extractFile(path string) error {
-	dirname, filename := filepath.Split(path)
+// extractFile copies the media to the extraction folder, under its path. The members of an
+// archive are placed under a folder named after the archive, such as evidence.zip!/dir/img.jpg.
+func extractFile(m *media.Media) error {
+	dirname, filename := filepath.Split(m.Path())
 
 	if dirname != "" {
 		aux := strings.Split(dirname, ":")
@@ -302,7 +606,7 @@ func extractFile(path string) error {
 		}
 	}
 
-	src, err := os.Open(path)
+	src, err := m.Open()
 	if err != nil {
 		return err
 	}
@@ -328,14 +632,47 @@ func extractFile(path string) error {
 	return nil
 }
 
-func printMatch(sourceName, targetName, targetPath, hashType string, distHamming int) {
-	_csv.Write([]string{
-		sourceName,
-		targetName,
-		targetPath,
-		hashType,
-		strconv.Itoa(distHamming),
-	})
+// matchHeader returns the header of the match CSV, with a column of distances for each perceptual
+// hash type of the search.
+func matchHeader() []string {
+	header := []string{"ORIGEM", "CATEGORIA", "ALVO", "ALVO PATH", "TIPO DO HASH", "HAMMING", "LIMIAR"}
+	for _, hashType := range _hashArray {
+		if hashType.IsPerceptual() {
+			header = append(header, strings.ToUpper(hashType.String()))
+		}
+	}
+	header = append(header, "SCORE")
+	if _hashMap[hash.PDQ] {
+		header = append(header, "QUALIDADE PDQ")
+	}
+	return header
+}
+
+func printMatch(match media.Match, m *media.Media) {
+	row := []string{
+		match.Name,
+		match.Category,
+		m.Name(),
+		m.Path(),
+		match.HashType,
+		strconv.Itoa(match.Distance),
+		strconv.Itoa(match.Threshold),
+	}
+	for _, hashType := range _hashArray {
+		if !hashType.IsPerceptual() {
+			continue
+		}
+		if d, ok := match.Distances[hashType]; ok {
+			row = append(row, strconv.Itoa(d))
+		} else {
+			row = append(row, "")
+		}
+	}
+	row = append(row, strconv.FormatFloat(match.Score, 'f', 3, 64))
+	if _hashMap[hash.PDQ] {
+		row = append(row, strconv.Itoa(m.PDQQuality()))
+	}
+	_csv.Write(row)
 }
 
 func printBanner() {
@@ -353,15 +690,32 @@ const templateHelperStr = "\t%-10s \t\t %s\n"
 func printHelper() {
 	fmt.Println("Uso: chasam --source=images/source --target=images/target --hash=d-hash,d-hash-v --hamming=10")
 	fmt.Println("Realiza uma pesquisa de imagens através da comparação de hashs.")
+	fmt.Println("Para exportar os hashs das imagens de origem: chasam export --help")
+	fmt.Println("Para avaliar os limiares de cada tipo de hash: chasam eval --help")
 
 	fmt.Printf("\nArgumentos.\n")
 	fmt.Printf(templateHelperStr, "--cpu", "definir o número de núcleos da cpu para o processamento dos hashs")
-	fmt.Printf(templateHelperStr, "--hamming", "distância limite entre dois hashs perceptivos")
+	fmt.Printf(templateHelperStr, "--hamming", "distância limite entre dois hashs perceptivos, por tipo de hash "+
+		"(d-hash:8,p-hash:12; um número sem tipo vale para os demais tipos; ou um arquivo com um tipo:distância por linha). "+
+		"Padrão: a-hash, p-hash e ch-hash 8, d-hash, d-hash-v, w-hash e segment-hash 10, domi-hash 14, pdq 31, "+
+		"d-hash-ext e p-hash-ext proporcional ao --hash-size")
+	fmt.Printf(templateHelperStr, "--policy", "política de consenso entre os hashs perceptivos, que são todos avaliados "+
+		"e combinados em um score de 0 a 1 registrado no arquivo de match com a distância de cada tipo de hash "+
+		"(um hash criptográfico igual dispensa o consenso)")
+	fmt.Printf(templateHelperStr, "\tany", "basta um tipo de hash dentro da distância (padrão)")
+	fmt.Printf(templateHelperStr, "\tmajority", "mais da metade dos tipos de hash dentro da distância")
+	fmt.Printf(templateHelperStr, "\tall", "todos os tipos de hash dentro da distância")
+	fmt.Printf(templateHelperStr, "\tweighted", "score ponderado pelos pesos de --weights de pelo menos --min-score")
+	fmt.Printf(templateHelperStr, "--weights", "peso de cada tipo de hash no score (d-hash:2,p-hash:1; os demais pesam 1)")
+	fmt.Printf(templateHelperStr, "--min-score", "score mínimo da política weighted (0.5 por padrão)")
+	fmt.Printf(templateHelperStr, "--top", "número máximo de correspondências por arquivo, da de maior score à de menor, "+
+		"aplicado após o consenso (0 registra todas)")
 	fmt.Printf(templateHelperStr, "--hash", "tipo do hash "+
 		"(pode ser informado mais de um tipo separados por vírgula)")
 
 	fmt.Printf(templateHelperStr, "\tsha1", "função hash criptográfica de 160 bits")
 	fmt.Printf(templateHelperStr, "\ted2k", "hash usado em compartilhamento de arquivos eDonkey")
+	fmt.Printf(templateHelperStr, "\tmd5", "função hash criptográfica de 128 bits")
 
 	fmt.Printf(templateHelperStr, "\ta-hash", "hash médio "+
 		"(calculado pela média de todos os valores de cinza da imagem)")
@@ -379,9 +733,66 @@ func printHelper() {
 
 	fmt.Printf(templateHelperStr, "\tch-hash", "hash perceptivo (converte a imagem em treshold e calcula aplicando uma transformada discreta de cosseno)")
 
-	// fmt.Printf(templateHelperStr, "\tw-hash", "wavelet hash (calcula aplicando uma transformada wavelet bidimensional)")
+	fmt.Printf(templateHelperStr, "\tw-hash", "wavelet hash (calcula aplicando uma transformada wavelet bidimensional)")
+
+	fmt.Printf(templateHelperStr, "\tsegment-hash", "hash resistente a recortes "+
+		"(segmenta a imagem em regiões claras e escuras e calcula o hash de diferença de cada uma)")
+
+	fmt.Printf(templateHelperStr, "\tpdq", "hash perceptivo de 256 bits do Facebook, usado no compartilhamento entre plataformas "+
+		"(imagens de qualidade inferior a 50 não são comparadas; a distância usual é 31)")
+
+	fmt.Printf(templateHelperStr, "\td-hash-ext", "hash de diferença estendido, com o número de bits definido por --hash-size")
+
+	fmt.Printf(templateHelperStr, "\tp-hash-ext", "hash perceptivo estendido, com o número de bits definido por --hash-size")
+
+	fmt.Printf(templateHelperStr, "--hash-size", "lado da grade de bits do d-hash-ext e do p-hash-ext: 8, 16 ou 32 "+
+		"(16 por padrão, 256 bits; uma lista de hashs com hashs estendidos de outro tamanho é recusada)")
+
+	fmt.Printf(templateHelperStr, "--segment-fraction", "fração mínima dos segmentos que devem corresponder "+
+		"para o segment-hash (0.5 por padrão)")
+
+	fmt.Printf(templateHelperStr, "--source", "diretório de origem com as imagens/vídeos a serem pesquisados "+
+		"(ou uma lista de hashs: um hash por linha, com o prefixo md5: ou ed2k: nos hashs de 32 dígitos "+
+		"a menos que a lista se chame *.md5 ou *.ed2k, CSV com colunas sha1, ed2k, md5, d-hash, p-hash..., "+
+		"HashKeeper ou VICS JSON do Project VIC; o formato é detectado automaticamente)")
+
+	fmt.Printf(templateHelperStr, "--db", "base de hashs das imagens de origem "+
+		"(criada a partir do --source quando não existir, com todos os tipos de hash das imagens de um diretório "+
+		"ou com os hashs e categorias de uma lista de hashs, e reutilizada nas próximas pesquisas; "+
+		"uma base sem algum tipo de --hash ou calculada com outro --hash-size ou --orientation é recalculada "+
+		"a partir do --source ou recusada)")
+
+	fmt.Printf(templateHelperStr, "--allowlist", "lista de arquivos conhecidos a serem ignorados antes da decodificação "+
+		"(NSRL RDS NSRLFile.txt ou um SHA1 por linha)")
+
+	fmt.Printf(templateHelperStr, "--cache", "arquivo de cache com os hashs dos arquivos alvo "+
+		"(arquivos com o mesmo tamanho e data de modificação não são lidos novamente nas próximas pesquisas)")
+
+	fmt.Printf(templateHelperStr, "--archive-depth", "número de níveis de arquivos compactados (zip, tar, tar.gz, gz) "+
+		"a serem abertos, incluindo os aninhados (padrão 0: os arquivos compactados não são abertos)")
+
+	fmt.Printf(templateHelperStr, "--resume", "retoma uma pesquisa interrompida a partir do último checkpoint "+
+		"(os arquivos já analisados são ignorados e o arquivo de match é reaproveitado)")
+
+	fmt.Printf(templateHelperStr, "--target", "diretório alvo onde será realizada a pesquisa por imagens/vídeos "+
+		"(ou uma imagem de disco dd com partições MBR/GPT e sistemas de arquivos FAT, exFAT, NTFS ou ext2/3/4, "+
+		"incluindo os arquivos apagados ainda recuperáveis; aceita também aquisições EnCase E01, "+
+		"com os segmentos E02, E03... na mesma pasta)")
+
+	fmt.Printf(templateHelperStr, "--orientation", "aplica a orientação do EXIF antes dos hashs perceptivos, para que "+
+		"uma foto rotacionada corresponda à original (ativada por padrão, --orientation=false desativa nas imagens de "+
+		"referência e nos arquivos alvo; um --db calculado com outra configuração é recalculado a partir do --source "+
+		"ou recusado)")
+
+	fmt.Printf(templateHelperStr, "--dihedral", "compara também as cópias da imagem rotacionadas em 90°, 180° e 270° "+
+		"e espelhadas, reportando a transformação encontrada, como DHash(rotate-90) ou DHash(flip-h)")
+
+	fmt.Printf(templateHelperStr, "--thumbnail", "calcula também os hashs perceptivos da miniatura JPEG do EXIF, "+
+		"que costuma manter a foto original de imagens editadas ou recortadas (reportado como DHash(thumbnail))")
 
-	fmt.Printf(templateHelperStr, "--source", "diretório de origem com as imagens/vídeos a serem pesquisados")
+	fmt.Printf(templateHelperStr, "--carve", "recupera por carving as imagens JPEG, PNG, GIF e BMP do espaço da imagem de disco "+
+		"fora dos arquivos alocados, ou de um arquivo bruto, reportadas pelo deslocamento em bytes, "+
+		"como imagem.dd!/$Carved/1048576.jpg")
 
-	fmt.Printf(templateHelperStr, "--target", "diretório alvo onde será realizada a pesquisa por imagens/vídeos")
+	fmt.Printf(templateHelperStr, "--verify", "confere o MD5 registrado na aquisição E01 antes da pesquisa")
 }
@@ -2,7 +2,7 @@ package mediautil
 
 import (
 	"github.com/rwcarlsen/goexif/exif"
-	"os"
+	"io"
 )
 
 var exifTags = []exif.FieldName{
@@ -21,7 +21,7 @@ var exifTags = []exif.FieldName{
 	exif.DateTimeOriginal,
 }
 
-func ExtractExif(file *os.File) (map[string]string, error) {
+func ExtractExif(file io.Reader) (map[string]string, error) {
 	x, err := exif.Decode(file)
 	if err != nil {
 		return nil, err
@@ -36,3 +36,35 @@ func ExtractExif(file *os.File) (map[string]string, error) {
 
 	return tagMap, nil
 }
+
+// ExtractThumbnail returns the JPEG thumbnail stored in the EXIF of file, or nil if it has none.
+func ExtractThumbnail(file io.Reader) ([]byte, error) {
+	x, err := exif.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	thumb, err := x.JpegThumbnail()
+	if err != nil {
+		return nil, nil
+	}
+	return thumb, nil
+}
+
+// ExtractOrientation returns the EXIF orientation of file, from 1 to 8, or 1 if it has none.
+func ExtractOrientation(file io.Reader) (int, error) {
+	x, err := exif.Decode(file)
+	if err != nil {
+		return 1, err
+	}
+
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1, nil
+	}
+	orientation, err := tag.Int(0)
+	if err != nil || orientation < 1 || orientation > 8 {
+		return 1, nil
+	}
+	return orientation, nil
+}
@@ -12,7 +12,6 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
-	"os"
 )
 
 type ContentType string
@@ -42,16 +41,23 @@ const (
 
 var ErrUnsupportedMediaType = errors.New("unsupported media type")
 
-func GetContentType(out *os.File) (contentType ContentType, err error) {
+func GetContentType(out io.ReadSeeker) (contentType ContentType, err error) {
 	fileHeader := make([]byte, 512)
 
-	if _, err = out.Read(fileHeader); err != nil {
+	n, err := out.Read(fileHeader)
+	if err != nil {
 		return
 	}
 	if _, err = out.Seek(0, io.SeekStart); err != nil {
 		return
 	}
 
+	return ParseContentType(fileHeader[:n])
+}
+
+// ParseContentType returns the supported media type of the content whose first bytes, up to 512,
+// are fileHeader.
+func ParseContentType(fileHeader []byte) (contentType ContentType, err error) {
 	_contentType := DetectContentType(fileHeader)
 
 	switch _contentType {
@@ -111,7 +117,7 @@ func Encode(w io.Writer, m image.Image, t ContentType) (err error) {
 	return
 }
 
-func Decode(f *os.File, t ContentType) (img image.Image, err error) {
+func Decode(f io.Reader, t ContentType) (img image.Image, err error) {
 	switch t {
 	case ImageGIF:
 		img, err = gif.Decode(f)
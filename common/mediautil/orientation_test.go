@@ -0,0 +1,46 @@
+package mediautil
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestOrient(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(y*3 + x), A: 255})
+		}
+	}
+	at := func(m image.Image, x, y int) uint8 {
+		r, _, _, _ := m.At(x, y).RGBA()
+		return uint8(r >> 8)
+	}
+
+	// the top left pixel of the stored image is displayed at the corner of each orientation.
+	corners := map[int][2]int{1: {0, 0}, 2: {2, 0}, 3: {2, 1}, 4: {0, 1}, 5: {0, 0}, 6: {1, 0}, 7: {1, 2}, 8: {0, 2}}
+	for orientation, corner := range corners {
+		oriented := Orient(img, orientation)
+		if got := at(oriented, corner[0], corner[1]); got != 0 {
+			t.Errorf("orientation %d: got %d at %v, want the top left pixel", orientation, got, corner)
+		}
+		if b := oriented.Bounds(); orientation >= 5 && (b.Dx() != 2 || b.Dy() != 3) {
+			t.Errorf("orientation %d: got bounds %v", orientation, b)
+		}
+
+		// orienting back by the inverse orientation gives the stored image.
+		inverse := orientation
+		if orientation == 6 || orientation == 8 {
+			inverse = 14 - orientation
+		}
+		back := Orient(oriented, inverse)
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 3; x++ {
+				if at(back, x, y) != at(img, x, y) {
+					t.Fatalf("orientation %d: the inverse %d does not restore the image", orientation, inverse)
+				}
+			}
+		}
+	}
+}
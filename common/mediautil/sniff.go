@@ -33,6 +33,18 @@ func DetectContentType(data []byte) string {
 	return "application/octet-stream" // fallback
 }
 
+// Signatures returns the prefixes of the data of the MIME type ct, such as "image/jpeg", from
+// the table used by DetectContentType.
+func Signatures(ct string) [][]byte {
+	var sigs [][]byte
+	for _, sig := range sniffSignatures {
+		if e, ok := sig.(*exactSig); ok && e.ct == ct {
+			sigs = append(sigs, e.sig)
+		}
+	}
+	return sigs
+}
+
 // isWS reports whether the provided byte is a whitespace byte (0xWS).
 func isWS(b byte) bool {
 	switch b {
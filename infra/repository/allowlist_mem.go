@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tsmweb/chasam/app/media"
+)
+
+type allowlistMem struct {
+	sha1 map[[20]byte]struct{}
+}
+
+func (a *allowlistMem) Contains(sha1 string) bool {
+	key, ok := parseSHA1(sha1)
+	if !ok {
+		return false
+	}
+	_, ok = a.sha1[key]
+	return ok
+}
+
+func (a *allowlistMem) Len() int {
+	return len(a.sha1)
+}
+
+func (a *allowlistMem) add(sha1 string) bool {
+	key, ok := parseSHA1(sha1)
+	if ok {
+		a.sha1[key] = struct{}{}
+	}
+	return ok
+}
+
+// NewAllowlistMem loads the SHA1 values of an NSRL RDS file (NSRLFile.txt, whose header holds
+// a "SHA-1" column) or of a plain list with one SHA1 per line, optionally followed by the file
+// name as written by sha1sum.
+func NewAllowlistMem(path string) (media.Allowlist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	allowlist := &allowlistMem{
+		sha1: make(map[[20]byte]struct{}),
+	}
+
+	br := bufio.NewReaderSize(f, 64*1024)
+	first, err := br.Peek(4096)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, err
+	}
+
+	if isRDSHeader(first) {
+		err = readRDS(br, allowlist)
+	} else {
+		err = readSHA1List(br, allowlist)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return allowlist, nil
+}
+
+func isRDSHeader(data []byte) bool {
+	line := string(data)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.Contains(strings.ToLower(line), `"sha-1"`)
+}
+
+func readRDS(r io.Reader, allowlist *allowlistMem) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+
+	col := -1
+	for i, column := range header {
+		if strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")), "sha-1") {
+			col = i
+		}
+	}
+	if col < 0 {
+		return errors.New("SHA-1 column not found")
+	}
+
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if v := field(row, col); !allowlist.add(v) {
+			line, _ := cr.FieldPos(col)
+			return fmt.Errorf("line %d: invalid SHA-1 %q", line, v)
+		}
+	}
+}
+
+func readSHA1List(r io.Reader, allowlist *allowlistMem) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(strings.TrimPrefix(sc.Text(), "\ufeff"))
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		if v := strings.Fields(text)[0]; !allowlist.add(v) {
+			return fmt.Errorf("line %d: invalid SHA-1 %q", line, v)
+		}
+	}
+
+	return sc.Err()
+}
+
+func parseSHA1(s string) ([20]byte, bool) {
+	var key [20]byte
+	if len(s) != hex.EncodedLen(len(key)) {
+		return key, false
+	}
+	if _, err := hex.Decode(key[:], []byte(s)); err != nil {
+		return key, false
+	}
+	return key, true
+}
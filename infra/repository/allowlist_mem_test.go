@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"testing"
+)
+
+func TestNewAllowlistMemRDS(t *testing.T) {
+	path := writeList(t, "NSRLFile.txt", `"SHA-1","MD5","CRC32","FileName","FileSize","ProductCode","OpSystemCode","SpecialCode"`+"\r\n"+
+		`"2FD4E1C67A2D28FCED849EE1BB76E7391B93EB12","9E107D9D372BB6826BD81D3542A419D6","414FA339","fox.txt",43,1,"358",""`+"\r\n"+
+		`"DA39A3EE5E6B4B0D3255BFEF95601890AFD80709","D41D8CD98F00B204E9800998ECF8427E","00000000","empty, file",0,1,"358",""`+"\r\n")
+
+	allowlist, err := NewAllowlistMem(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if allowlist.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", allowlist.Len())
+	}
+	if !allowlist.Contains("2fd4e1c67a2d28fced849ee1bb76e7391b93eb12") {
+		t.Error("expected fox.txt in the allowlist")
+	}
+	if !allowlist.Contains("DA39A3EE5E6B4B0D3255BFEF95601890AFD80709") {
+		t.Error("expected the empty file in the allowlist")
+	}
+	if allowlist.Contains("0000000000000000000000000000000000000000") || allowlist.Contains("xyz") {
+		t.Error("unexpected entry in the allowlist")
+	}
+}
+
+func TestNewAllowlistMemPlain(t *testing.T) {
+	path := writeList(t, "allowlist.txt", "# icons\n"+
+		"2fd4e1c67a2d28fced849ee1bb76e7391b93eb12  fox.txt\n"+
+		"\n"+
+		"da39a3ee5e6b4b0d3255bfef95601890afd80709\n")
+
+	allowlist, err := NewAllowlistMem(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if allowlist.Len() != 2 || !allowlist.Contains("da39a3ee5e6b4b0d3255bfef95601890afd80709") {
+		t.Fatalf("unexpected allowlist with %d entries", allowlist.Len())
+	}
+
+	if _, err = NewAllowlistMem(writeList(t, "bad.txt", "9e107d9d372bb6826bd81d3542a419d6\n")); err == nil {
+		t.Error("expected error for a MD5 list")
+	}
+}
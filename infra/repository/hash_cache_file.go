@@ -0,0 +1,220 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+)
+
+/*
+The hash cache is a binary file holding the hashes of the searched files, written with the
+same encoding as the hash database:
+
+	header:
+		magic    [8]byte   "CHASAMHC"
+		version  uint16    big endian, 1
+		count    uvarint   number of entries
+	entry (count times):
+		path     uvarint length + UTF-8 bytes
+		size     uvarint   file size in bytes
+		mtime    varint    modification time in Unix nanoseconds
+		type     uvarint length + content type
+		settings as in the hash database header, for the perceptual hashes of the entry
+		hashes   as in a hash database record
+		quality  uvarint   quality of the PDQ hash, 0 without it
+		variants uvarint   number of dihedral variants, 0 if they were not computed, followed
+		                   by the transform (uvarint) and the hashes of each one
+		thumb    uvarint   0 if the thumbnail was not computed, otherwise 1 followed by its
+		                   content type, empty for an image without one, and its hashes
+	trailer:
+		crc32    uint32    big endian, IEEE checksum of every preceding byte
+*/
+
+const (
+	cacheMagic   = "CHASAMHC"
+	cacheVersion = 1
+)
+
+type cacheEntry struct {
+	size       int64
+	modifiedAt int64
+	entry      *media.CacheEntry
+}
+
+type hashCacheFile struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	dirty   bool
+}
+
+// NewHashCacheFile opens the hash cache stored in path, which is created by Close if it does
+// not exist. A corrupted cache is an error, so that it is not silently overwritten.
+func NewHashCacheFile(path string) (media.Cache, error) {
+	c := &hashCacheFile{
+		path:    path,
+		entries: make(map[string]*cacheEntry),
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err = c.decode(f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c *hashCacheFile) Get(path string, size int64, modifiedAt time.Time) (*media.CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[path]
+	if !ok || e.size != size || e.modifiedAt != modifiedAt.UnixNano() {
+		return nil, false
+	}
+
+	// the caller may add hashes to the entry, so it gets a copy.
+	return e.entry.Copy(), true
+}
+
+func (c *hashCacheFile) Put(path string, size int64, modifiedAt time.Time, entry *media.CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[path] = &cacheEntry{
+		size:       size,
+		modifiedAt: modifiedAt.UnixNano(),
+		entry:      entry,
+	}
+	c.dirty = true
+}
+
+func (c *hashCacheFile) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+	if err := writeFileAtomic(c.path, c.encode); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+func (c *hashCacheFile) encode(w io.Writer) error {
+	paths := make([]string, 0, len(c.entries))
+	for path := range c.entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	bw := newBinaryWriter(w, cacheMagic, cacheVersion)
+	bw.putUvarint(uint64(len(paths)))
+
+	for _, path := range paths {
+		e := c.entries[path]
+		bw.putString(path)
+		bw.putUvarint(uint64(e.size))
+		bw.putVarint(e.modifiedAt)
+		bw.putString(e.entry.ContentType)
+		bw.putSettings(e.entry.Settings)
+		bw.putHashes(e.entry.Hashes, e.entry.PHashes, e.entry.ExtHashes)
+		bw.putUvarint(uint64(e.entry.PDQQuality))
+		putVariants(bw, e.entry.Variants)
+		putThumbnail(bw, e.entry.Thumbnail)
+	}
+
+	return bw.close()
+}
+
+func (c *hashCacheFile) decode(r io.Reader) error {
+	br, err := newBinaryReader(r, cacheMagic, cacheVersion)
+	if err != nil {
+		return err
+	}
+
+	count := br.getUvarint()
+	for i := uint64(0); i < count && br.err == nil; i++ {
+		path := br.getString()
+		e := &cacheEntry{
+			size:       int64(br.getUvarint()),
+			modifiedAt: br.getVarint(),
+		}
+		e.entry = media.NewCacheEntry(br.getString())
+		e.entry.Settings = br.getSettings()
+		br.getHashes(e.entry.Hashes, e.entry.PHashes, e.entry.ExtHashes)
+		e.entry.PDQQuality = int(br.getUvarint())
+		e.entry.Variants = getVariants(br)
+		e.entry.Thumbnail = getThumbnail(br)
+		c.entries[path] = e
+	}
+
+	return br.close()
+}
+
+func putVariants(bw *binaryWriter, variants map[hash.Dihedral]map[hash.Type]uint64) {
+	transforms := make([]int, 0, len(variants))
+	for d := range variants {
+		transforms = append(transforms, int(d))
+	}
+	sort.Ints(transforms)
+
+	bw.putUvarint(uint64(len(transforms)))
+	for _, d := range transforms {
+		bw.putUvarint(uint64(d))
+		bw.putHashes(nil, variants[hash.Dihedral(d)], nil)
+	}
+}
+
+func getVariants(br *binaryReader) map[hash.Dihedral]map[hash.Type]uint64 {
+	n := br.getUvarint()
+	if br.err == nil && n > uint64(len(hash.Dihedrals())) {
+		br.err = ErrInvalidDatabase
+	}
+	if n == 0 || br.err != nil {
+		return nil
+	}
+
+	variants := make(map[hash.Dihedral]map[hash.Type]uint64, n)
+	for ; n > 0 && br.err == nil; n-- {
+		d := hash.Dihedral(br.getUvarint())
+		variants[d] = make(map[hash.Type]uint64)
+		br.getHashes(make(map[hash.Type]string), variants[d], make(map[hash.Type][]uint64))
+	}
+	return variants
+}
+
+func putThumbnail(bw *binaryWriter, thumb *media.CacheEntry) {
+	if thumb == nil {
+		bw.putUvarint(0)
+		return
+	}
+	bw.putUvarint(1)
+	bw.putString(thumb.ContentType)
+	bw.putHashes(nil, thumb.PHashes, nil)
+}
+
+func getThumbnail(br *binaryReader) *media.CacheEntry {
+	if br.getUvarint() == 0 || br.err != nil {
+		return nil
+	}
+	thumb := media.NewCacheEntry(br.getString())
+	br.getHashes(thumb.Hashes, thumb.PHashes, thumb.ExtHashes)
+	return thumb
+}
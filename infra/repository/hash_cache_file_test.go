@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+)
+
+func TestHashCacheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.cache")
+	modifiedAt := time.Date(2023, 5, 1, 10, 30, 0, 123456789, time.UTC)
+
+	cache, err := NewHashCacheFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := media.NewCacheEntry("image/jpeg")
+	entry.Hashes[hash.SHA1] = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	entry.PHashes[hash.DHash] = 0x0f0f0f0f0f0f0f0f
+	entry.ExtHashes[hash.PDQ] = []uint64{1, 2, 3, 4}
+	entry.PDQQuality = 87
+	entry.Settings = media.Settings{Orientation: true, HashSize: 16}
+	entry.Variants = map[hash.Dihedral]map[hash.Type]uint64{hash.Rotate90: {hash.DHash: 0xf0f0f0f0f0f0f0f0}}
+	entry.Thumbnail = media.NewCacheEntry("image/jpeg")
+	entry.Thumbnail.PHashes[hash.DHash] = 0x00ff00ff00ff00ff
+	cache.Put("/evidence/img.jpg", 1234, modifiedAt, entry)
+	cache.Put("/evidence/other.png", 10, modifiedAt, media.NewCacheEntry("image/png"))
+
+	if err = cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = NewHashCacheFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := cache.Get("/evidence/img.jpg", 1234, modifiedAt)
+	if !ok {
+		t.Fatal("entry not found")
+	}
+	if got.ContentType != "image/jpeg" || got.Settings != entry.Settings || got.Hashes[hash.SHA1] != entry.Hashes[hash.SHA1] ||
+		got.PHashes[hash.DHash] != entry.PHashes[hash.DHash] || len(got.ExtHashes[hash.PDQ]) != 4 || got.PDQQuality != 87 {
+		t.Fatalf("expected %+v, got %+v", entry, got)
+	}
+	if got.Variants[hash.Rotate90][hash.DHash] != 0xf0f0f0f0f0f0f0f0 || got.Thumbnail == nil ||
+		got.Thumbnail.ContentType != "image/jpeg" || got.Thumbnail.PHashes[hash.DHash] != 0x00ff00ff00ff00ff {
+		t.Fatalf("expected the variants and the thumbnail of %+v, got %+v", entry, got)
+	}
+	if other, _ := cache.Get("/evidence/other.png", 10, modifiedAt); other.Variants != nil || other.Thumbnail != nil {
+		t.Fatalf("expected no variants nor thumbnail, got %+v", other)
+	}
+
+	if _, ok = cache.Get("/evidence/img.jpg", 1235, modifiedAt); ok {
+		t.Fatal("entry found for a different size")
+	}
+	if _, ok = cache.Get("/evidence/img.jpg", 1234, modifiedAt.Add(time.Second)); ok {
+		t.Fatal("entry found for a different modification time")
+	}
+	if _, ok = cache.Get("/evidence/missing.jpg", 1234, modifiedAt); ok {
+		t.Fatal("entry found for an unknown path")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0x01
+	if err = os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewHashCacheFile(path); !errors.Is(err, ErrInvalidDatabase) {
+		t.Fatalf("expected ErrInvalidDatabase, got %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package repository
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+)
+
+// vicsMetadata is the OData context written at the top of a VICS export.
+const vicsMetadata = "http://github.com/ICMEC/ProjectVic/DataModels/1.3.xml#Media"
+
+// ParseHashSetFormat returns the export format named name: csv, ndjson or vics.
+func ParseHashSetFormat(name string) (HashSetFormat, error) {
+	switch f := HashSetFormat(strings.ToLower(strings.TrimSpace(name))); f {
+	case HashSetCSV, HashSetNDJSON, HashSetVICS:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown export format %q", name)
+	}
+}
+
+// ExportHashSet computes the hashTypes of the files in dir and writes them to w as a hash set
+// in the given format, which NewMediaRepositoryHashSet can load without the images.
+// Perceptual hashes are formatted by hash.FormatToHex and the extended ones by
+// hash.ExtFormatToHex. The hashes are computed with opts, whose settings are recorded in the
+// set if it holds perceptual hashes, so that it is only loaded by a search with the same ones.
+func ExportHashSet(dir string, hashTypes []hash.Type, format HashSetFormat, w io.Writer, opts ...media.Option) error {
+	records, err := readMediaDir(dir, hashTypes, opts...)
+	if err != nil {
+		return err
+	}
+
+	var settings *media.Settings
+	for _, hashType := range hashTypes {
+		if hashType.IsPerceptual() {
+			s := media.SettingsOf(opts...)
+			settings = &s
+			break
+		}
+	}
+
+	return writeHashSet(w, format, hashTypes, records, settings)
+}
+
+// writeHashSet writes the records in the format, recording the settings unless they are nil.
+func writeHashSet(w io.Writer, format HashSetFormat, hashTypes []hash.Type, records []*record,
+	settings *media.Settings) error {
+	sort.Slice(records, func(i, j int) bool { return records[i].name < records[j].name })
+
+	switch format {
+	case HashSetCSV:
+		return writeCSVList(w, hashTypes, records, settings)
+	case HashSetNDJSON:
+		return writeNDJSONList(w, hashTypes, records, settings)
+	case HashSetVICS:
+		return writeVICS(w, hashTypes, records, settings)
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// hashValue returns the hash of the record formatted as text, or an empty string if the record
+// does not have it.
+func (rec *record) hashValue(hashType hash.Type) string {
+	if !hashType.IsPerceptual() {
+		return rec.hashes[hashType]
+	}
+	if hashType.IsExtended() {
+		if h, ok := rec.extHashes[hashType]; ok {
+			return hash.ExtFormatToHex(h)
+		}
+		return ""
+	}
+	if h, ok := rec.pHashes[hashType]; ok {
+		return hash.FormatToHex(h)
+	}
+	return ""
+}
+
+// setHash parses the hash of hashType formatted as text by hashValue and adds it to the record.
+func (rec *record) setHash(hashType hash.Type, value string) error {
+	switch {
+	case !hashType.IsPerceptual():
+		rec.hashes[hashType] = strings.ToLower(strings.TrimSpace(value))
+	case hashType.IsExtended():
+		h, err := hash.ParseExtHex(value)
+		if err != nil {
+			return err
+		}
+		rec.extHashes[hashType] = h
+	default:
+		h, err := hash.ParseHex(value)
+		if err != nil {
+			return err
+		}
+		rec.pHashes[hashType] = h
+	}
+	return nil
+}
+
+func writeCSVList(w io.Writer, hashTypes []hash.Type, records []*record, settings *media.Settings) error {
+	if settings != nil {
+		if _, err := fmt.Fprintf(w, "# %s: %s\n", settingsKey, settings); err != nil {
+			return err
+		}
+	}
+
+	cw := csv.NewWriter(w)
+
+	header := []string{"name"}
+	for _, hashType := range hashTypes {
+		header = append(header, hashType.Name())
+	}
+	cw.Write(header)
+
+	for _, rec := range records {
+		row := []string{rec.name}
+		for _, hashType := range hashTypes {
+			row = append(row, rec.hashValue(hashType))
+		}
+		cw.Write(row)
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeNDJSONList(w io.Writer, hashTypes []hash.Type, records []*record, settings *media.Settings) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	if settings != nil {
+		if err := enc.Encode(map[string]string{settingsKey: settings.String()}); err != nil {
+			return err
+		}
+	}
+
+	for _, rec := range records {
+		obj := map[string]string{"name": rec.name}
+		if rec.category != "" {
+			obj["category"] = rec.category
+		}
+		for _, hashType := range hashTypes {
+			if v := rec.hashValue(hashType); v != "" {
+				obj[hashType.Name()] = v
+			}
+		}
+
+		if err := enc.Encode(obj); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+func writeVICS(w io.Writer, hashTypes []hash.Type, records []*record, settings *media.Settings) error {
+	doc := struct {
+		Metadata string      `json:"odata.metadata"`
+		Settings string      `json:"chasam.settings,omitempty"`
+		Value    []vicsMedia `json:"value"`
+	}{
+		Metadata: vicsMetadata,
+		Value:    make([]vicsMedia, 0, len(records)),
+	}
+	if settings != nil {
+		doc.Settings = settings.String()
+	}
+
+	for i, rec := range records {
+		vm := vicsMedia{
+			MediaID: i + 1,
+			Name:    rec.name,
+			SHA1:    rec.hashes[hash.SHA1],
+			MD5:     rec.hashes[hash.MD5],
+		}
+		if rec.category != "" {
+			vm.Category = vicsCategory(rec.category)
+		}
+
+		for _, hashType := range hashTypes {
+			if hashType == hash.SHA1 || hashType == hash.MD5 {
+				continue
+			}
+			if v := rec.hashValue(hashType); v != "" {
+				vm.AlternativeHashes = append(vm.AlternativeHashes, vicsHash{
+					HashName:  hashType.String(),
+					HashValue: v,
+				})
+			}
+		}
+
+		doc.Value = append(doc.Value, vm)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// vicsCategory returns the category as the integer of the VICS categories, or as is if it is
+// not a number, such as the text categories of a CSV set.
+func vicsCategory(category string) interface{} {
+	if n, err := strconv.Atoi(category); err == nil {
+		return n
+	}
+	return category
+}
@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+	"github.com/tsmweb/chasam/internal/testimage"
+)
+
+func TestExportHashSetRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 3; i++ {
+		testimage.Write(t, filepath.Join(dir, "img-"+string(rune('a'+i))+".png"), testimage.Pattern(i))
+	}
+
+	hashTypes := []hash.Type{hash.SHA1, hash.ED2K, hash.MD5, hash.DHash, hash.PHash, hash.WHash, hash.SegmentHash, hash.PDQ,
+		hash.DHashExt, hash.PHashExt}
+	source, err := readMediaDir(dir, hashTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []HashSetFormat{HashSetCSV, HashSetNDJSON, HashSetVICS} {
+		path := filepath.Join(t.TempDir(), "hashset."+string(format))
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ExportHashSet(dir, hashTypes, format, f); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		if detected, _ := detectFile(t, path); detected != format {
+			t.Errorf("%s: detected as %s", format, detected)
+		}
+
+		repo, err := NewMediaRepositoryHashSet(path)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		for _, rec := range source {
+			for hashType, h := range rec.hashes {
+				if src := repo.FindByHash(hashType, h); src != rec.name {
+					t.Errorf("%s: %s of %s: got %s", format, hashType, rec.name, src)
+				}
+			}
+			for hashType, h := range rec.pHashes {
+				matches := repo.FindAllByPerceptualHash(hashType, h, 0, 0)
+				found := false
+				for _, m := range matches {
+					found = found || m.Name == rec.name
+				}
+				if !found {
+					t.Errorf("%s: %s of %s: got %v", format, hashType, rec.name, matches)
+				}
+			}
+			for hashType, h := range rec.extHashes {
+				var matches []media.Match
+				if hashType == hash.SegmentHash {
+					matches = repo.FindAllBySegmentHash(h, 0, 1, 0)
+				} else {
+					matches = repo.FindAllByExtHash(hashType, h, 0, 0)
+				}
+				if len(matches) == 0 || matches[0].Name != rec.name {
+					t.Errorf("%s: %s of %s: got %v", format, hashType, rec.name, matches)
+				}
+			}
+		}
+	}
+}
+
+func TestExportHashSetSettings(t *testing.T) {
+	dir := t.TempDir()
+	testimage.Write(t, filepath.Join(dir, "img.png"), testimage.Pattern(1))
+
+	unoriented := media.WithOrientation(false)
+	for _, format := range []HashSetFormat{HashSetCSV, HashSetNDJSON, HashSetVICS} {
+		for _, hashTypes := range [][]hash.Type{{hash.SHA1, hash.DHash}, {hash.SHA1}} {
+			path := filepath.Join(t.TempDir(), "hashset."+string(format))
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ExportHashSet(dir, hashTypes, format, f, unoriented); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			if _, err = NewMediaRepositoryHashSet(path, unoriented); err != nil {
+				t.Fatalf("%s %v: %v", format, hashTypes, err)
+			}
+
+			// the settings are only recorded, and checked, with perceptual hashes.
+			_, err = NewMediaRepositoryHashSet(path)
+			if perceptual := len(hashTypes) > 1; perceptual != errors.Is(err, ErrHashSetSettings) {
+				t.Errorf("%s %v: got %v", format, hashTypes, err)
+			}
+		}
+	}
+}
+
+func TestParseHashSetFormat(t *testing.T) {
+	if f, err := ParseHashSetFormat(" NDJSON "); err != nil || f != HashSetNDJSON {
+		t.Errorf("expected ndjson, got %s (%v)", f, err)
+	}
+	if _, err := ParseHashSetFormat("hashkeeper"); err == nil {
+		t.Error("expected error for hashkeeper")
+	}
+}
+
+func detectFile(t *testing.T, path string) (HashSetFormat, error) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	return detectHashListFormat(f)
+}
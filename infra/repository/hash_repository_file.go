@@ -0,0 +1,478 @@
+package repository
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+)
+
+/*
+The hash database is a binary file holding the hashes of a reference set, so the reference
+images only have to be decoded once, or a hash set parsed once. Integers are unsigned varints (encoding/binary) unless
+stated otherwise and the hash types are the numeric values of hash.Type.
+
+	header:
+		magic    [8]byte   "CHASAMDB"
+		version  uint16    big endian, 1
+		settings uvarint   flags of the settings of the perceptual hashes: 1 if the EXIF
+		                   orientation was applied
+		size     uvarint   side of the grid of bits of d-hash-ext and p-hash-ext
+		ntypes   uvarint   number of hash types computed for the records
+		ntypes times:
+			type   uvarint
+		count    uvarint   number of records
+	record (count times):
+		name     uvarint length + UTF-8 bytes
+		category uvarint length + UTF-8 bytes, empty if the reference set has none
+		nhash    uvarint   number of cryptographic hashes
+		nhash times:
+			type   uvarint
+			value  uvarint length + hexadecimal string
+		nphash   uvarint   number of perceptual hashes
+		nphash times:
+			type   uvarint
+			words  uvarint   number of 64-bit words, 1 unless the type is extended
+			value  words x uint64 big endian
+	trailer:
+		crc32    uint32    big endian, IEEE checksum of every preceding byte
+*/
+
+const (
+	dbMagic   = "CHASAMDB"
+	dbVersion = 1
+
+	// limits that keep a corrupted database from allocating huge buffers.
+	dbMaxString = 1 << 16
+	dbMaxWords  = 64
+	dbMaxTypes  = 256
+)
+
+var (
+	ErrInvalidDatabase = errors.New("invalid hash database")
+	// ErrDatabaseSettings is returned for a hash database whose perceptual hashes were computed
+	// with other settings than the search or without one of its hash types.
+	ErrDatabaseSettings = errors.New("hash database computed with other settings")
+)
+
+// NewMediaRepositoryFile loads the hash database stored in dbPath, which must hold the
+// hashTypes searched, its perceptual hashes computed with the settings of opts. If the database
+// does not exist or does not match, it is built from source and saved to dbPath: from a
+// directory, by computing every hash type of its files with opts, or from a hash set file read
+// by NewMediaRepositoryHashSet, keeping its hashes and categories. Without source, a database
+// that does not match is an error.
+func NewMediaRepositoryFile(dbPath string, source string, hashTypes []hash.Type, opts ...media.Option) (media.Repository, error) {
+	settings := media.SettingsOf(opts...)
+	records, err := readDatabase(dbPath, settings, hashTypes)
+	if errors.Is(err, os.ErrNotExist) || (errors.Is(err, ErrDatabaseSettings) && source != "") {
+		if source == "" {
+			return nil, err
+		}
+
+		var sourceTypes []hash.Type
+		records, sourceTypes, err = readSource(source, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeDatabase(dbPath, records, settings, sourceTypes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	repository := newMediaRepositoryMem()
+	for _, rec := range records {
+		repository.appendRecord(rec)
+	}
+
+	return repository, nil
+}
+
+// readSource returns the records of the reference set in source and the hash types computed for
+// them: every hash type for the files of a directory, the ones present in a hash set.
+func readSource(source string, opts ...media.Option) ([]*record, []hash.Type, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		records, err := readMediaDir(source, hash.Types(), opts...)
+		return records, hash.Types(), err
+	}
+
+	records, err := readHashSet(source, media.SettingsOf(opts...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	present := make(map[hash.Type]bool)
+	for _, rec := range records {
+		for hashType := range rec.hashes {
+			present[hashType] = true
+		}
+		for hashType := range rec.pHashes {
+			present[hashType] = true
+		}
+		for hashType := range rec.extHashes {
+			present[hashType] = true
+		}
+	}
+	return records, sortedTypes(present), nil
+}
+
+// readDatabase reads the records of the database, which must have the settings and hold the
+// hashTypes.
+func readDatabase(dbPath string, settings media.Settings, hashTypes []hash.Type) ([]*record, error) {
+	f, err := os.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, header, err := decodeRecords(f)
+	if err == nil {
+		err = header.check(settings, hashTypes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dbPath, err)
+	}
+	return records, nil
+}
+
+func writeDatabase(dbPath string, records []*record, settings media.Settings, hashTypes []hash.Type) error {
+	return writeFileAtomic(dbPath, func(w io.Writer) error {
+		return encodeRecords(w, records, &dbHeader{settings: settings, hashTypes: hashTypes})
+	})
+}
+
+// dbHeader holds the settings of the perceptual hashes of a database and the hash types
+// computed for its records.
+type dbHeader struct {
+	settings  media.Settings
+	hashTypes []hash.Type
+}
+
+// check returns ErrDatabaseSettings unless the database has the settings and holds the
+// hashTypes.
+func (h *dbHeader) check(settings media.Settings, hashTypes []hash.Type) error {
+	if h.settings != settings {
+		return fmt.Errorf("%w: built with %s, searched with %s", ErrDatabaseSettings, h.settings, settings)
+	}
+
+	present := make(map[hash.Type]bool, len(h.hashTypes))
+	for _, t := range h.hashTypes {
+		present[t] = true
+	}
+	for _, t := range hashTypes {
+		if !present[t] {
+			return fmt.Errorf("%w: built without the %s hashes", ErrDatabaseSettings, t)
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic saves the output of encode to a temporary file which replaces path when
+// complete, so an interrupted write never leaves a truncated file behind.
+func writeFileAtomic(path string, encode func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = tmp.Chmod(0o644); err == nil {
+		err = encode(tmp)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func encodeRecords(w io.Writer, records []*record, header *dbHeader) error {
+	bw := newBinaryWriter(w, dbMagic, dbVersion)
+	bw.putSettings(header.settings)
+	bw.putUvarint(uint64(len(header.hashTypes)))
+	for _, hashType := range header.hashTypes {
+		bw.putUvarint(uint64(hashType))
+	}
+	bw.putUvarint(uint64(len(records)))
+
+	for _, rec := range records {
+		bw.putString(rec.name)
+		bw.putString(rec.category)
+		bw.putHashes(rec.hashes, rec.pHashes, rec.extHashes)
+	}
+
+	return bw.close()
+}
+
+// decodeRecords returns the records and the header of the database.
+func decodeRecords(r io.Reader) ([]*record, *dbHeader, error) {
+	br, err := newBinaryReader(r, dbMagic, dbVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := &dbHeader{settings: br.getSettings()}
+	header.hashTypes = br.getTypes()
+
+	count := br.getUvarint()
+	var records []*record
+
+	for i := uint64(0); i < count && br.err == nil; i++ {
+		rec := newRecord(br.getString())
+		rec.category = br.getString()
+		br.getHashes(rec.hashes, rec.pHashes, rec.extHashes)
+		records = append(records, rec)
+	}
+
+	if err = br.close(); err != nil {
+		return nil, nil, err
+	}
+	return records, header, nil
+}
+
+// binaryWriter writes the header, the fields and the trailer of the binary files described
+// above, computing the checksum of everything it writes.
+type binaryWriter struct {
+	w   io.Writer
+	bw  *bufio.Writer
+	sum hash32
+	buf [binary.MaxVarintLen64]byte
+}
+
+type hash32 interface {
+	io.Writer
+	Sum32() uint32
+}
+
+func newBinaryWriter(w io.Writer, magic string, version uint16) *binaryWriter {
+	sum := crc32.NewIEEE()
+	bw := &binaryWriter{w: w, bw: bufio.NewWriter(io.MultiWriter(w, sum)), sum: sum}
+
+	bw.bw.WriteString(magic)
+	binary.Write(bw.bw, binary.BigEndian, version)
+	return bw
+}
+
+func (w *binaryWriter) putUvarint(v uint64) {
+	n := binary.PutUvarint(w.buf[:], v)
+	w.bw.Write(w.buf[:n])
+}
+
+func (w *binaryWriter) putVarint(v int64) {
+	n := binary.PutVarint(w.buf[:], v)
+	w.bw.Write(w.buf[:n])
+}
+
+func (w *binaryWriter) putString(s string) {
+	w.putUvarint(uint64(len(s)))
+	w.bw.WriteString(s)
+}
+
+// settingsOrientation is the flag of the settings set when the EXIF orientation is applied.
+const settingsOrientation = 1
+
+// putSettings writes the flags of the settings followed by the hash size.
+func (w *binaryWriter) putSettings(settings media.Settings) {
+	var flags uint64
+	if settings.Orientation {
+		flags |= settingsOrientation
+	}
+	w.putUvarint(flags)
+	w.putUvarint(uint64(settings.HashSize))
+}
+
+func (w *binaryWriter) putHashes(hashes map[hash.Type]string, pHashes map[hash.Type]uint64,
+	extHashes map[hash.Type][]uint64) {
+	w.putUvarint(uint64(len(hashes)))
+	for _, hashType := range sortedTypes(hashes) {
+		w.putUvarint(uint64(hashType))
+		w.putString(hashes[hashType])
+	}
+
+	w.putUvarint(uint64(len(pHashes) + len(extHashes)))
+	for _, hashType := range sortedTypes(pHashes) {
+		w.putUvarint(uint64(hashType))
+		w.putUvarint(1)
+		binary.Write(w.bw, binary.BigEndian, pHashes[hashType])
+	}
+	for _, hashType := range sortedTypes(extHashes) {
+		w.putUvarint(uint64(hashType))
+		w.putUvarint(uint64(len(extHashes[hashType])))
+		binary.Write(w.bw, binary.BigEndian, extHashes[hashType])
+	}
+}
+
+// close flushes the fields and writes the checksum trailer.
+func (w *binaryWriter) close() error {
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	return binary.Write(w.w, binary.BigEndian, w.sum.Sum32())
+}
+
+// binaryReader reads the files written by binaryWriter. The first error is kept in err and
+// makes every following read return a zero value.
+type binaryReader struct {
+	br  *bufio.Reader
+	tr  *teeByteReader
+	sum hash32
+	err error
+}
+
+// newBinaryReader reads the header of a file of the magic, written by this version.
+func newBinaryReader(r io.Reader, magic string, version uint16) (*binaryReader, error) {
+	sum := crc32.NewIEEE()
+	br := bufio.NewReader(r)
+	rd := &binaryReader{br: br, tr: &teeByteReader{r: br, w: sum}, sum: sum}
+
+	header := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(rd.tr, header); err != nil {
+		return nil, ErrInvalidDatabase
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, ErrInvalidDatabase
+	}
+	if v := binary.BigEndian.Uint16(header[len(magic):]); v != version {
+		return nil, fmt.Errorf("unsupported %s version %d", magic, v)
+	}
+
+	return rd, nil
+}
+
+func (r *binaryReader) getUvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	var v uint64
+	v, r.err = binary.ReadUvarint(r.tr)
+	return v
+}
+
+func (r *binaryReader) getVarint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	var v int64
+	v, r.err = binary.ReadVarint(r.tr)
+	return v
+}
+
+func (r *binaryReader) getString() string {
+	n := r.getUvarint()
+	if r.err == nil && n > dbMaxString {
+		r.err = ErrInvalidDatabase
+	}
+	if r.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	_, r.err = io.ReadFull(r.tr, b)
+	return string(b)
+}
+
+// getSettings reads the settings written by putSettings.
+func (r *binaryReader) getSettings() media.Settings {
+	flags := r.getUvarint()
+	size := r.getUvarint()
+	return media.Settings{Orientation: flags&settingsOrientation != 0, HashSize: int(size)}
+}
+
+func (r *binaryReader) getTypes() []hash.Type {
+	n := r.getUvarint()
+	if r.err == nil && n > dbMaxTypes {
+		r.err = ErrInvalidDatabase
+	}
+	var types []hash.Type
+	for ; n > 0 && r.err == nil; n-- {
+		types = append(types, hash.Type(r.getUvarint()))
+	}
+	return types
+}
+
+func (r *binaryReader) getHashes(hashes map[hash.Type]string, pHashes map[hash.Type]uint64,
+	extHashes map[hash.Type][]uint64) {
+	for n := r.getUvarint(); n > 0 && r.err == nil; n-- {
+		hashType := hash.Type(r.getUvarint())
+		hashes[hashType] = r.getString()
+	}
+
+	for n := r.getUvarint(); n > 0 && r.err == nil; n-- {
+		hashType := hash.Type(r.getUvarint())
+		nwords := r.getUvarint()
+		if r.err == nil && nwords > dbMaxWords {
+			r.err = ErrInvalidDatabase
+		}
+		if r.err != nil {
+			return
+		}
+		words := make([]uint64, nwords)
+		r.err = binary.Read(r.tr, binary.BigEndian, words)
+		switch {
+		case r.err != nil:
+		case hashType.IsExtended():
+			extHashes[hashType] = words
+		case len(words) == 1:
+			pHashes[hashType] = words[0]
+		}
+	}
+}
+
+// close checks the trailer against the checksum of every byte read.
+func (r *binaryReader) close() error {
+	if r.err != nil {
+		return ErrInvalidDatabase
+	}
+
+	var checksum uint32
+	expected := r.sum.Sum32()
+	if err := binary.Read(r.br, binary.BigEndian, &checksum); err != nil || checksum != expected {
+		return ErrInvalidDatabase
+	}
+	return nil
+}
+
+// teeByteReader writes to w every byte read from r.
+type teeByteReader struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+func (t *teeByteReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.w.Write(p[:n])
+	return n, err
+}
+
+func (t *teeByteReader) ReadByte() (byte, error) {
+	b, err := t.r.ReadByte()
+	if err == nil {
+		t.w.Write([]byte{b})
+	}
+	return b, err
+}
+
+func sortedTypes[V any](m map[hash.Type]V) []hash.Type {
+	types := make([]hash.Type, 0, len(m))
+	for t := range m {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
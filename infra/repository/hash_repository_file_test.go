@@ -0,0 +1,177 @@
+package repository
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+	"github.com/tsmweb/chasam/internal/testimage"
+)
+
+func TestEncodeDecodeRecords(t *testing.T) {
+	rec := newRecord("img.jpg")
+	rec.category = "1"
+	rec.hashes[hash.SHA1] = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	rec.hashes[hash.ED2K] = "31d6cfe0d16ae931b73c59d7e0c089c0"
+	rec.pHashes[hash.DHash] = 0x0f0f0f0f0f0f0f0f
+	rec.pHashes[hash.WHash] = 0xffff0000ffff0000
+	rec.extHashes[hash.SegmentHash] = []uint64{0x0123456789abcdef, 0xfedcba9876543210}
+
+	var buf bytes.Buffer
+	header := &dbHeader{
+		settings:  media.Settings{Orientation: true, HashSize: 16},
+		hashTypes: []hash.Type{hash.SHA1, hash.ED2K, hash.DHash, hash.WHash, hash.SegmentHash},
+	}
+	if err := encodeRecords(&buf, []*record{rec, newRecord("empty.png")}, header); err != nil {
+		t.Fatal(err)
+	}
+
+	records, got, err := decodeRecords(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.settings != header.settings ||
+		fmt.Sprint(got.hashTypes) != fmt.Sprint(header.hashTypes) {
+		t.Fatalf("expected the header %v %v, got %v %v", header.settings, header.hashTypes,
+			got.settings, got.hashTypes)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if fmt.Sprint(records[0]) != fmt.Sprint(rec) {
+		t.Fatalf("expected %v, got %v", rec, records[0])
+	}
+
+	// flip one bit of every byte in turn.
+	data := buf.Bytes()
+	for i := range data {
+		corrupted := append([]byte(nil), data...)
+		corrupted[i] ^= 0x01
+		if _, _, err = decodeRecords(bytes.NewReader(corrupted)); err == nil {
+			t.Fatalf("corruption at byte %d not detected", i)
+		}
+	}
+
+	if _, _, err = decodeRecords(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Fatal("truncated database not detected")
+	}
+}
+
+func TestNewMediaRepositoryFile(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 3; i++ {
+		testimage.Write(t, filepath.Join(dir, fmt.Sprintf("img-%d.png", i)), testimage.Pattern(i))
+	}
+	dbPath := filepath.Join(t.TempDir(), "reference.db")
+	hashTypes := hash.Types()
+
+	if _, err := NewMediaRepositoryFile(dbPath, "", hashTypes); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+
+	built, err := NewMediaRepositoryFile(dbPath, dir, hashTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the images are no longer needed.
+	loaded, err := NewMediaRepositoryFile(dbPath, "", hashTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, repo := range []*mediaRepositoryMem{built.(*mediaRepositoryMem), loaded.(*mediaRepositoryMem)} {
+		if n := len(repo.hashTable[hash.SHA1]); n != 3 {
+			t.Fatalf("expected 3 SHA1 hashes, got %d", n)
+		}
+		for _, hashType := range []hash.Type{hash.AHash, hash.DHash, hash.DHashV, hash.PHash, hash.WHash} {
+			if repo.pHashTable[hashType] == nil || repo.pHashTable[hashType].Len() == 0 {
+				t.Fatalf("expected %s hashes", hashType)
+			}
+		}
+	}
+
+	for sha1, refs := range built.(*mediaRepositoryMem).hashTable[hash.SHA1] {
+		if src := loaded.FindByHash(hash.SHA1, sha1); src != refs[0].name {
+			t.Fatalf("expected %s, got %s", refs[0].name, src)
+		}
+	}
+}
+
+func TestNewMediaRepositoryFileSettings(t *testing.T) {
+	dir := t.TempDir()
+	testimage.Write(t, filepath.Join(dir, "img.png"), testimage.Pattern(1))
+	dbPath := filepath.Join(t.TempDir(), "reference.db")
+	hashTypes := []hash.Type{hash.SHA1, hash.DHash, hash.DHashExt}
+
+	if _, err := NewMediaRepositoryFile(dbPath, dir, hashTypes); err != nil {
+		t.Fatal(err)
+	}
+
+	// the database was built with the orientation applied and the default hash size.
+	unoriented := media.WithOrientation(false)
+	for _, opt := range []media.Option{unoriented, media.WithHashSize(32)} {
+		if _, err := NewMediaRepositoryFile(dbPath, "", hashTypes, opt); !errors.Is(err, ErrDatabaseSettings) {
+			t.Fatalf("expected ErrDatabaseSettings, got %v", err)
+		}
+	}
+
+	// with the images, it is built again with the settings of the search.
+	if _, err := NewMediaRepositoryFile(dbPath, dir, hashTypes, unoriented); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMediaRepositoryFile(dbPath, "", hashTypes, unoriented); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMediaRepositoryFile(dbPath, "", hashTypes); !errors.Is(err, ErrDatabaseSettings) {
+		t.Fatalf("expected ErrDatabaseSettings, got %v", err)
+	}
+
+	// a database built without a hash type searched does not match.
+	settings := media.SettingsOf()
+	if err := writeDatabase(dbPath, nil, settings, []hash.Type{hash.SHA1, hash.DHash}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMediaRepositoryFile(dbPath, "", hashTypes[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMediaRepositoryFile(dbPath, "", hashTypes); !errors.Is(err, ErrDatabaseSettings) {
+		t.Fatalf("expected ErrDatabaseSettings, got %v", err)
+	}
+}
+
+func TestNewMediaRepositoryFileHashSet(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "export.json")
+	if err := os.WriteFile(source, []byte(vicsExport), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(t.TempDir(), "reference.db")
+	hashTypes := []hash.Type{hash.SHA1, hash.DHash}
+
+	if _, err := NewMediaRepositoryFile(dbPath, source, hashTypes); err != nil {
+		t.Fatal(err)
+	}
+
+	// the database keeps the categories of the set and records the hash types it holds.
+	repo, err := NewMediaRepositoryFile(dbPath, "", hashTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches := repo.FindAllByHash(hash.MD5, "d41d8cd98f00b204e9800998ecf8427e")
+	if len(matches) != 1 || matches[0].Name != "MediaID:2" || matches[0].Category != "2" {
+		t.Fatalf("expected MediaID:2 of category 2, got %v", matches)
+	}
+	matches = repo.FindAllByPerceptualHash(hash.DHash, 0x0f0f0f0f0f0f0f0f, 0, 0)
+	if len(matches) != 1 || matches[0].Name != "fox.jpg" || matches[0].Category != "1" {
+		t.Fatalf("expected fox.jpg of category 1, got %v", matches)
+	}
+
+	if _, err = NewMediaRepositoryFile(dbPath, "", []hash.Type{hash.AHash}); !errors.Is(err, ErrDatabaseSettings) {
+		t.Fatalf("expected ErrDatabaseSettings, got %v", err)
+	}
+}
@@ -0,0 +1,536 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+)
+
+// HashSetFormat identifies the format of a hash set file.
+type HashSetFormat string
+
+const (
+	HashSetPlain      HashSetFormat = "plain"      // one hash per line, optionally followed by the file name
+	HashSetCSV        HashSetFormat = "csv"        // header with a column per hash type
+	HashSetHashKeeper HashSetFormat = "hashkeeper" // HashKeeper CSV, holding MD5 hashes
+	HashSetNDJSON     HashSetFormat = "ndjson"     // a JSON object per line, with a key per hash type
+	HashSetVICS       HashSetFormat = "vics"       // VICS (Project VIC) JSON
+)
+
+var (
+	ErrUnknownHashList = errors.New("unknown hash list format")
+	// ErrHashSetSettings is returned for a hash set whose perceptual hashes were exported with
+	// other settings than the search.
+	ErrHashSetSettings = errors.New("hash set computed with other settings")
+	// ErrAmbiguousHash is returned for a 32-digit hash of a plain list without type, which may
+	// be either MD5 or ED2K.
+	ErrAmbiguousHash = errors.New("32-digit hash without type, prefix it with md5: or ed2k: or name the list *.md5 or *.ed2k")
+)
+
+// settingsKey names the settings of the perceptual hashes recorded by ExportHashSet, formatted
+// by media.Settings.String: in a "# chasam.settings: ..." comment at the top of a CSV, in an
+// NDJSON object of its own and as a key of a VICS document.
+const settingsKey = "chasam.settings"
+
+// nameColumns and categoryColumns are the header names, in lower case, accepted for the file
+// name and the category of a CSV hash list.
+var (
+	nameColumns     = []string{"name", "file_name", "filename", "file"}
+	categoryColumns = []string{"category", "categoria"}
+)
+
+// NewMediaRepositoryHashSet loads the hash set stored in path, detecting its format: a plain
+// list with one hash per line, a CSV with typed columns (sha1, ed2k, md5, d-hash, p-hash...),
+// a HashKeeper CSV, NDJSON or a VICS JSON export. No image is needed. The d-hash-ext and
+// p-hash-ext of the set must have the hash size of opts, and a set that records the settings
+// of its perceptual hashes must have the ones of opts.
+func NewMediaRepositoryHashSet(path string, opts ...media.Option) (media.Repository, error) {
+	records, err := readHashSet(path, media.SettingsOf(opts...))
+	if err != nil {
+		return nil, err
+	}
+
+	repository := newMediaRepositoryMem()
+	for _, rec := range records {
+		repository.appendRecord(rec)
+	}
+
+	return repository, nil
+}
+
+// readHashSet reads the records of the hash set stored in path, whose perceptual hashes must
+// have been computed with the settings.
+func readHashSet(path string, settings media.Settings) ([]*record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	format, err := detectHashListFormat(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var records []*record
+	var recorded *media.Settings
+	switch format {
+	case HashSetPlain:
+		records, err = readPlainList(f, filepath.Base(path))
+	case HashSetNDJSON:
+		records, recorded, err = readNDJSONList(f)
+	case HashSetVICS:
+		records, recorded, err = readVICS(f)
+	default:
+		records, recorded, err = readCSVList(f, format == HashSetHashKeeper)
+	}
+	if err == nil {
+		err = checkSettings(recorded, settings)
+	}
+	if err == nil {
+		err = checkHashSize(records, settings.HashSize)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return records, nil
+}
+
+// checkSettings returns ErrHashSetSettings if the settings recorded by a hash set are not the
+// ones of the search. Without them, only the hash size is checked, by checkHashSize.
+func checkSettings(recorded *media.Settings, settings media.Settings) error {
+	if recorded != nil && *recorded != settings {
+		return fmt.Errorf("%w: exported with %s, searched with %s", ErrHashSetSettings, recorded, settings)
+	}
+	return nil
+}
+
+// checkHashSize returns an error if an extended hash of the records has another number of words
+// than the hashes of size, which would never match them.
+func checkHashSize(records []*record, size int) error {
+	for _, rec := range records {
+		for hashType, h := range rec.extHashes {
+			if words := hashType.Words(size); words > 0 && len(h) != words {
+				return fmt.Errorf("%s: %s of %d bits, searched with a hash size of %d (%d bits)",
+					rec.name, hashType, 64*len(h), size, 64*words)
+			}
+		}
+	}
+	return nil
+}
+
+// detectHashListFormat inspects the first line of r that is neither empty nor a comment.
+func detectHashListFormat(r io.Reader) (HashSetFormat, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for sc.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(sc.Text(), "\ufeff"))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '{' || line[0] == '[' {
+			if isNDJSONLine(line) {
+				return HashSetNDJSON, nil
+			}
+			return HashSetVICS, nil
+		}
+
+		header := strings.ToLower(line)
+		if strings.Contains(header, "hashset_id") && strings.Contains(header, "file_id") {
+			return HashSetHashKeeper, nil
+		}
+
+		for _, column := range splitHeader(line) {
+			if _, err := hash.ParseType(unquote(column)); err == nil {
+				return HashSetCSV, nil
+			}
+		}
+
+		// any type of list tells a 32-digit hash apart from text.
+		if _, _, err := plainHash(strings.Fields(line)[0], hash.MD5); err == nil {
+			return HashSetPlain, nil
+		}
+		break
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+
+	return "", ErrUnknownHashList
+}
+
+// isNDJSONLine reports whether line is a complete JSON object keyed by hash types, rather than
+// the start of a VICS document.
+func isNDJSONLine(line string) bool {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &obj); err != nil {
+		return false
+	}
+
+	for key := range obj {
+		if _, err := hash.ParseType(key); err == nil || key == settingsKey {
+			return true
+		}
+	}
+	return false
+}
+
+// plainHashLen is the number of hexadecimal digits of the hash types of a plain list.
+var plainHashLen = map[hash.Type]int{hash.SHA1: 40, hash.MD5: 32, hash.ED2K: 32}
+
+// plainListType returns the type of the 32-digit hashes of a plain list named after it, such as
+// hashes.md5 or hashes.ed2k, or -1.
+func plainListType(listName string) hash.Type {
+	switch strings.ToLower(filepath.Ext(listName)) {
+	case ".md5":
+		return hash.MD5
+	case ".ed2k":
+		return hash.ED2K
+	default:
+		return -1
+	}
+}
+
+// plainHash returns the type and the value of a hash of a plain list. The type is prefixed to
+// the value, as in md5:<hash>, or told by its length: 40 digits for SHA1. MD5 and ED2K have
+// the same length, so a 32-digit value without prefix takes the listType and is
+// ErrAmbiguousHash if it is -1.
+func plainHash(value string, listType hash.Type) (hash.Type, string, error) {
+	hashType, digits := hash.Type(-1), value
+	if i := strings.IndexByte(value, ':'); i > 0 {
+		t, err := hash.ParseType(value[:i])
+		if err != nil {
+			return -1, "", err
+		}
+		hashType, digits = t, value[i+1:]
+	}
+
+	for _, c := range digits {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return -1, "", fmt.Errorf("invalid hash %q", value)
+		}
+	}
+
+	switch {
+	case hashType != -1:
+	case len(digits) == 40:
+		hashType = hash.SHA1
+	case len(digits) == 32 && listType == -1:
+		return -1, "", fmt.Errorf("%w: %s", ErrAmbiguousHash, value)
+	case len(digits) == 32:
+		hashType = listType
+	}
+
+	if n := plainHashLen[hashType]; n == 0 || len(digits) != n {
+		return -1, "", fmt.Errorf("invalid hash %q", value)
+	}
+	return hashType, strings.ToLower(digits), nil
+}
+
+// readPlainList reads lines formatted as "hash" or "hash  file name", as written by sha1sum
+// and md5sum, whose hashes are typed as told by plainHash. Entries without a name are named
+// after the list and the line number.
+func readPlainList(r io.Reader, listName string) ([]*record, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var records []*record
+	listType := plainListType(listName)
+	line := 0
+
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(strings.TrimPrefix(sc.Text(), "\ufeff"))
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		value, name := text, ""
+		if i := strings.IndexAny(text, " \t"); i > 0 {
+			value = text[:i]
+			name = strings.TrimPrefix(strings.TrimSpace(text[i:]), "*") // binary mode marker
+		}
+
+		hashType, value, err := plainHash(value, listType)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if name == "" {
+			name = fmt.Sprintf("%s:%d", listName, line)
+		}
+
+		rec := newRecord(name)
+		rec.hashes[hashType] = value
+		records = append(records, rec)
+	}
+
+	return records, sc.Err()
+}
+
+// readCSVList reads a CSV hash list whose header names the columns, and the settings recorded
+// in a comment line before the header, if any. In a HashKeeper list the hash column holds MD5
+// values and the name is made of the directory and file_name columns.
+func readCSVList(r io.Reader, hashKeeper bool) ([]*record, *media.Settings, error) {
+	br := bufio.NewReader(r)
+	settings, err := readCSVComments(br)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	first, err := br.Peek(4096)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, nil, err
+	}
+
+	cr := csv.NewReader(br)
+	cr.Comment = '#'
+	cr.Comma = detectDelimiter(first)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nameCol, dirCol, categoryCol := -1, -1, -1
+	hashCols := make(map[int]hash.Type)
+
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+
+		switch {
+		case hashKeeper && column == "hash":
+			hashCols[i] = hash.MD5
+		case hashKeeper && column == "directory":
+			dirCol = i
+		case contains(nameColumns, column):
+			nameCol = i
+		case contains(categoryColumns, column):
+			categoryCol = i
+		default:
+			if hashType, err := hash.ParseType(column); err == nil {
+				hashCols[i] = hashType
+			}
+		}
+	}
+	if len(hashCols) == 0 {
+		return nil, nil, ErrUnknownHashList
+	}
+
+	var records []*record
+
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		line, _ := cr.FieldPos(0)
+		name := field(row, nameCol)
+		if dir := field(row, dirCol); dir != "" && name != "" {
+			name = strings.TrimRight(dir, `\/`) + "/" + name
+		}
+		if name == "" {
+			name = fmt.Sprintf("line:%d", line)
+		}
+
+		rec := newRecord(name)
+		rec.category = field(row, categoryCol)
+
+		for col, hashType := range hashCols {
+			value := field(row, col)
+			if value == "" {
+				continue
+			}
+
+			if err := rec.setHash(hashType, value); err != nil {
+				return nil, nil, fmt.Errorf("line %d: invalid %s %q", line, hashType, value)
+			}
+		}
+
+		records = append(records, rec)
+	}
+
+	return records, settings, nil
+}
+
+// readCSVComments consumes the comment lines at the top of a CSV hash list and returns the
+// settings recorded by one of them.
+func readCSVComments(br *bufio.Reader) (*media.Settings, error) {
+	var settings *media.Settings
+	for {
+		b, _ := br.Peek(len("\ufeff"))
+		if bytes.HasPrefix(b, []byte("\ufeff")) {
+			br.Discard(len(b))
+			continue
+		}
+		if len(b) == 0 || b[0] != '#' {
+			return settings, nil
+		}
+
+		line, err := br.ReadString('\n')
+		text := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+		if value, ok := strings.CutPrefix(text, settingsKey+":"); ok {
+			s, perr := media.ParseSettings(value)
+			if perr != nil {
+				return nil, perr
+			}
+			settings = &s
+		}
+		if err != nil {
+			return settings, nil
+		}
+	}
+}
+
+// readNDJSONList reads a JSON object per line, such as
+// {"name": "a.jpg", "category": 1, "sha1": "...", "d-hash": "0f0f0f0f0f0f0f0f"}, and the
+// settings recorded by an object of their own. The name, the category and the hashes are
+// strings or numbers, and the other keys are ignored.
+func readNDJSONList(r io.Reader) ([]*record, *media.Settings, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var records []*record
+	var settings *media.Settings
+	line := 0
+
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(strings.TrimPrefix(sc.Text(), "\ufeff"))
+		if text == "" {
+			continue
+		}
+
+		var obj map[string]any
+		dec := json.NewDecoder(strings.NewReader(text))
+		dec.UseNumber()
+		if err := dec.Decode(&obj); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		if v, ok := obj[settingsKey]; ok {
+			value, _ := v.(string)
+			s, err := media.ParseSettings(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			settings = &s
+			continue
+		}
+
+		name, category := "", ""
+		rec := newRecord("")
+
+		for key, v := range obj {
+			key = strings.ToLower(key)
+			isName, isCategory := contains(nameColumns, key), contains(categoryColumns, key)
+			hashType, err := hash.ParseType(key)
+			if err != nil && !isName && !isCategory {
+				continue
+			}
+
+			value, ok := ndjsonValue(v)
+			switch {
+			case !ok:
+				return nil, nil, fmt.Errorf("line %d: invalid %s %v", line, key, v)
+			case value == "":
+			case isName:
+				name = value
+			case isCategory:
+				category = value
+			default:
+				if err = rec.setHash(hashType, value); err != nil {
+					return nil, nil, fmt.Errorf("line %d: invalid %s %q", line, hashType, value)
+				}
+			}
+		}
+
+		if name == "" {
+			name = fmt.Sprintf("line:%d", line)
+		}
+		rec.name = name
+		rec.category = category
+		records = append(records, rec)
+	}
+
+	return records, settings, sc.Err()
+}
+
+// ndjsonValue returns the text of a string or number of an NDJSON object, and false for the
+// other values.
+func ndjsonValue(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v), true
+	case json.Number:
+		return v.String(), true
+	case nil:
+		return "", true
+	default:
+		return "", false
+	}
+}
+
+// detectDelimiter returns the most frequent delimiter of the first line of data.
+func detectDelimiter(data []byte) rune {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[:i]
+	}
+
+	delimiter, count := ',', bytes.Count(data, []byte{','})
+	for _, d := range []rune{';', '\t', '|'} {
+		if n := bytes.Count(data, []byte(string(d))); n > count {
+			delimiter, count = d, n
+		}
+	}
+	return delimiter
+}
+
+func splitHeader(line string) []string {
+	return strings.FieldsFunc(line, func(r rune) bool {
+		return r == ',' || r == ';' || r == '\t' || r == '|'
+	})
+}
+
+func unquote(s string) string {
+	return strings.Trim(strings.TrimSpace(s), `"'`)
+}
+
+func field(row []string, col int) string {
+	if col < 0 || col >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[col])
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
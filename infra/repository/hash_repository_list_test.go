@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+)
+
+func writeList(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewMediaRepositoryHashSetPlain(t *testing.T) {
+	path := writeList(t, "list.txt", "\ufeff# reference set\n"+
+		"2FD4E1C67A2D28FCED849EE1BB76E7391B93EB12\n"+
+		"\n"+
+		"md5:9e107d9d372bb6826bd81d3542a419d6 *fox.jpg\n"+
+		"ED2K:d41d8cd98f00b204e9800998ecf8427e empty.txt\n")
+
+	repo, err := NewMediaRepositoryHashSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if src := repo.FindByHash(hash.SHA1, "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12"); src != "list.txt:2" {
+		t.Errorf("SHA1: expected list.txt:2, got %s", src)
+	}
+	for _, tt := range []struct {
+		hashType hash.Type
+		value    string
+		want     string
+	}{
+		{hash.MD5, "9e107d9d372bb6826bd81d3542a419d6", "fox.jpg"},
+		{hash.ED2K, "9e107d9d372bb6826bd81d3542a419d6", "-1"},
+		{hash.ED2K, "d41d8cd98f00b204e9800998ecf8427e", "empty.txt"},
+		{hash.MD5, "d41d8cd98f00b204e9800998ecf8427e", "-1"},
+	} {
+		if src := repo.FindByHash(tt.hashType, tt.value); src != tt.want {
+			t.Errorf("%s %s: expected %s, got %s", tt.hashType, tt.value, tt.want, src)
+		}
+	}
+}
+
+func TestNewMediaRepositoryHashSetPlainAmbiguous(t *testing.T) {
+	// a 32-digit hash may be MD5 or ED2K.
+	content := "9e107d9d372bb6826bd81d3542a419d6  fox.jpg\n"
+	if _, err := NewMediaRepositoryHashSet(writeList(t, "list.txt", content)); !errors.Is(err, ErrAmbiguousHash) {
+		t.Fatalf("expected ErrAmbiguousHash, got %v", err)
+	}
+
+	// the list named after the type, as written by md5sum.
+	for name, hashType := range map[string]hash.Type{"list.md5": hash.MD5, "list.ed2k": hash.ED2K} {
+		repo, err := NewMediaRepositoryHashSet(writeList(t, name, content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src := repo.FindByHash(hashType, "9e107d9d372bb6826bd81d3542a419d6"); src != "fox.jpg" {
+			t.Errorf("%s: expected fox.jpg, got %s", name, src)
+		}
+	}
+}
+
+func TestNewMediaRepositoryHashSetNDJSON(t *testing.T) {
+	path := writeList(t, "list.ndjson",
+		`{"name": "a.jpg", "category": 1, "sha1": "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12", "extra": [1, 2]}`+"\n"+
+			`{"name": "b.jpg", "category": "2", "d-hash": "0f0f0f0f0f0f0f0f"}`+"\n")
+
+	repo, err := NewMediaRepositoryHashSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if matches := repo.FindAllByHash(hash.SHA1, "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12"); len(matches) != 1 ||
+		matches[0].Name != "a.jpg" || matches[0].Category != "1" {
+		t.Errorf("SHA1: expected a.jpg of category 1, got %v", matches)
+	}
+	if matches := repo.FindAllByPerceptualHash(hash.DHash, 0x0f0f0f0f0f0f0f0f, 0, 0); len(matches) != 1 ||
+		matches[0].Name != "b.jpg" || matches[0].Category != "2" {
+		t.Errorf("DHash: expected b.jpg of category 2, got %v", matches)
+	}
+}
+
+func TestNewMediaRepositoryHashSetCSV(t *testing.T) {
+	path := writeList(t, "list.csv", "name;category;sha1;d-hash;PHash;unknown\n"+
+		"a.jpg;1;2fd4e1c67a2d28fced849ee1bb76e7391b93eb12;0f0f0f0f0f0f0f0f;;x\n"+
+		"\"b;c.jpg\";2;;;ffff0000ffff0000;y\n")
+
+	repo, err := NewMediaRepositoryHashSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if src := repo.FindByHash(hash.SHA1, "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12"); src != "a.jpg" {
+		t.Errorf("SHA1: expected a.jpg, got %s", src)
+	}
+	if dist, src := repo.FindByPerceptualHash(hash.DHash, 0x0f0f0f0f0f0f0f0f, 0); dist != 0 || src != "a.jpg" {
+		t.Errorf("DHash: expected a.jpg, got %s (%d)", src, dist)
+	}
+	if dist, src := repo.FindByPerceptualHash(hash.PHash, 0xffff0000ffff0001, 1); dist != 1 || src != "b;c.jpg" {
+		t.Errorf("PHash: expected b;c.jpg, got %s (%d)", src, dist)
+	}
+	if matches := repo.FindAllByPerceptualHash(hash.PHash, 0xffff0000ffff0000, 0, 0); len(matches) != 1 ||
+		matches[0].Category != "2" {
+		t.Errorf("expected category 2, got %v", matches)
+	}
+}
+
+func TestNewMediaRepositoryHashSetHashKeeper(t *testing.T) {
+	path := writeList(t, "hashkeeper.hke", `"file_id","hashset_id","file_name","directory","hash","file_size","date_modified","time_modified","time_zone","comments","date_accessed","time_accessed"`+"\r\n"+
+		`1,42,"fox.jpg","C:\images\","9E107D9D372BB6826BD81D3542A419D6",43,,,,,,`+"\r\n")
+
+	repo, err := NewMediaRepositoryHashSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if src := repo.FindByHash(hash.MD5, "9e107d9d372bb6826bd81d3542a419d6"); src != `C:\images/fox.jpg` {
+		t.Errorf("MD5: expected C:\\images/fox.jpg, got %s", src)
+	}
+}
+
+func TestNewMediaRepositoryHashSetVICS(t *testing.T) {
+	repo, err := NewMediaRepositoryHashSet(writeList(t, "export.json", vicsExport))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if src := repo.FindByHash(hash.MD5, "9e107d9d372bb6826bd81d3542a419d6"); src != "fox.jpg" {
+		t.Errorf("MD5: expected fox.jpg, got %s", src)
+	}
+}
+
+func TestNewMediaRepositoryHashSetHashSize(t *testing.T) {
+	// a d-hash-ext of 256 bits, the default hash size of 16.
+	path := writeList(t, "list.csv", "name,d-hash-ext\n"+
+		"a.jpg,"+strings.Repeat("0f", 32)+"\n")
+
+	if _, err := NewMediaRepositoryHashSet(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMediaRepositoryHashSet(path, media.WithHashSize(8)); err == nil {
+		t.Error("expected an error for a hash size of 8")
+	}
+}
+
+func TestNewMediaRepositoryHashSetInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown.txt": "hello world\n",
+		"empty.txt":   "",
+		"mixed.txt":   "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12\nnot a hash\n",
+		"bad.csv":     "name,d-hash\na.jpg,xyz\n",
+	} {
+		_, err := NewMediaRepositoryHashSet(writeList(t, name, content))
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+		if (name == "unknown.txt" || name == "empty.txt") && !errors.Is(err, ErrUnknownHashList) {
+			t.Errorf("%s: expected ErrUnknownHashList, got %v", name, err)
+		}
+	}
+}
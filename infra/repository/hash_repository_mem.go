@@ -2,127 +2,444 @@ package repository
 
 import (
 	"errors"
+	"io/fs"
 	"os"
-	"path/filepath"
+	"sort"
 
 	"github.com/tsmweb/chasam/app/hash"
 	"github.com/tsmweb/chasam/app/media"
+	"github.com/tsmweb/chasam/pkg/mih"
 )
 
+// mediaRepositoryMem keeps the hashes in memory. Perceptual hashes are indexed by multi-index
+// hashing, so a search only compares the hashes that may be within the hamming distance, and so
+// are the extended hashes. The segments of the segment hashes are indexed one by one, and
+// segmentCounts holds the number of segments of each segment hash of a reference. Each key of
+// an index holds the references that share the hash, and stored tells the hashes already
+// stored for a reference, so a reference appended twice is stored once.
 type mediaRepositoryMem struct {
-	hashTable  map[hash.Type]map[string]string
-	pHashTable map[hash.Type]map[uint64]string
+	hashTable     map[hash.Type]map[string][]reference
+	pHashTable    map[hash.Type]*mih.Index[[]reference]
+	extTable      map[hash.Type]*mih.Index[[]reference]
+	segmentTable  *mih.Index[[]segmentRef]
+	segmentCounts map[reference][]int
+	stored        map[storedKey]bool
+}
+
+// storedKey identifies a hash of a reference, the hexadecimal value of its words for the
+// perceptual hashes.
+type storedKey struct {
+	hashType hash.Type
+	value    string
+	ref      reference
+}
+
+// store reports whether the hash of the reference was not stored yet, and marks it stored.
+func (r *mediaRepositoryMem) store(hashType hash.Type, value string, ref reference) bool {
+	key := storedKey{hashType, value, ref}
+	if r.stored[key] {
+		return false
+	}
+	r.stored[key] = true
+	return true
+}
+
+// addReference appends the reference to the ones stored under key.
+func addReference[T any](idx *mih.Index[[]T], key []uint64, ref T) {
+	refs, _ := idx.Get(key)
+	idx.Add(key, append(refs, ref))
+}
+
+// itemMatches returns a match of every reference of the items.
+func itemMatches(hashType hash.Type, items []mih.Item[[]reference]) []media.Match {
+	var matches []media.Match
+	for _, it := range items {
+		for _, ref := range it.Value {
+			matches = append(matches, ref.match(hashType, it.Distance))
+		}
+	}
+	return matches
+}
+
+// reference is a file of the reference set and the category the set assigns to it. A set may
+// hold several files of the same name, such as the image.jpg of many VICS entries, each with
+// its own hashes and category.
+type reference struct {
+	name     string
+	category string
+}
+
+// segmentRef is a segment hash of a reference, numbered by set, since the files of a set that
+// share a name and a category each have their own.
+type segmentRef struct {
+	reference
+	set int
+}
+
+func (ref reference) match(hashType hash.Type, distance int) media.Match {
+	return media.Match{
+		Name:     ref.name,
+		Category: ref.category,
+		HashType: hashType.String(),
+		Distance: distance,
+	}
 }
 
 func (r *mediaRepositoryMem) AppendHash(hashType hash.Type, hashValue string, fileName string) {
+	r.appendHash(hashType, hashValue, reference{name: fileName})
+}
+
+func (r *mediaRepositoryMem) appendHash(hashType hash.Type, hashValue string, ref reference) {
+	if !r.store(hashType, hashValue, ref) {
+		return
+	}
 	hashMedia, ok := r.hashTable[hashType]
 	if !ok {
-		hashMedia = make(map[string]string)
+		hashMedia = make(map[string][]reference)
 		r.hashTable[hashType] = hashMedia
 	}
-	hashMedia[hashValue] = fileName
+	hashMedia[hashValue] = append(hashMedia[hashValue], ref)
 }
 
 func (r *mediaRepositoryMem) FindByHash(hashType hash.Type, hashValue string) string {
 	v, ok := r.hashTable[hashType][hashValue]
 	if ok {
-		return v
+		return v[0].name
 	}
 	return "-1"
 }
 
+func (r *mediaRepositoryMem) FindAllByHash(hashType hash.Type, hashValue string) []media.Match {
+	refs := r.hashTable[hashType][hashValue]
+	matches := make([]media.Match, 0, len(refs))
+	for _, ref := range refs {
+		matches = append(matches, ref.match(hashType, 0))
+	}
+	return sortMatches(matches, 0)
+}
+
 func (r *mediaRepositoryMem) AppendPerceptualHash(hashType hash.Type, hashValue uint64, fileName string) {
+	r.appendPerceptualHash(hashType, hashValue, reference{name: fileName})
+}
+
+func (r *mediaRepositoryMem) appendPerceptualHash(hashType hash.Type, hashValue uint64, ref reference) {
+	if !r.store(hashType, hash.FormatToHex(hashValue), ref) {
+		return
+	}
 	hashMedia, ok := r.pHashTable[hashType]
 	if !ok {
-		hashMedia = make(map[uint64]string)
+		hashMedia = mih.New[[]reference](1)
 		r.pHashTable[hashType] = hashMedia
 	}
-	hashMedia[hashValue] = fileName
+	addReference(hashMedia, []uint64{hashValue}, ref)
 }
 
 func (r *mediaRepositoryMem) FindByPerceptualHash(hashType hash.Type, hashValue uint64, distance int) (int, string) {
-	for lHash, fName := range r.pHashTable[hashType] {
-		dist, err := hash.Distance(lHash, hashValue)
-		if err != nil {
-			return -1, ""
+	matches := r.FindAllByPerceptualHash(hashType, hashValue, distance, 1)
+	if len(matches) == 0 {
+		return -1, ""
+	}
+
+	return matches[0].Distance, matches[0].Name
+}
+
+func (r *mediaRepositoryMem) FindAllByPerceptualHash(
+	hashType hash.Type,
+	hashValue uint64,
+	distance int,
+	limit int,
+) []media.Match {
+	hashMedia, ok := r.pHashTable[hashType]
+	if !ok {
+		return nil
+	}
+
+	matches := itemMatches(hashType, hashMedia.Search([]uint64{hashValue}, distance))
+	return sortMatches(matches, limit)
+}
+
+// AppendExtHash stores the extended hash. The words of the first hash of a type set the size of
+// its index, and the hashes of another size are ignored.
+func (r *mediaRepositoryMem) AppendExtHash(hashType hash.Type, hashValue []uint64, fileName string) {
+	r.appendExtHash(hashType, hashValue, reference{name: fileName})
+}
+
+func (r *mediaRepositoryMem) appendExtHash(hashType hash.Type, hashValue []uint64, ref reference) {
+	if len(hashValue) == 0 || !r.store(hashType, hash.ExtFormatToHex(hashValue), ref) {
+		return
+	}
+	hashMedia, ok := r.extTable[hashType]
+	if !ok {
+		hashMedia = mih.New[[]reference](len(hashValue))
+		r.extTable[hashType] = hashMedia
+	}
+	addReference(hashMedia, hashValue, ref)
+}
+
+func (r *mediaRepositoryMem) FindAllByExtHash(
+	hashType hash.Type,
+	hashValue []uint64,
+	distance int,
+	limit int,
+) []media.Match {
+	hashMedia, ok := r.extTable[hashType]
+	if !ok {
+		return nil
+	}
+
+	matches := itemMatches(hashType, hashMedia.Search(hashValue, distance))
+	return sortMatches(matches, limit)
+}
+
+func (r *mediaRepositoryMem) AppendSegmentHash(hashValue []uint64, fileName string) {
+	r.appendSegmentHash(hashValue, reference{name: fileName})
+}
+
+func (r *mediaRepositoryMem) appendSegmentHash(hashValue []uint64, ref reference) {
+	if len(hashValue) == 0 || !r.store(hash.SegmentHash, hash.ExtFormatToHex(hashValue), ref) {
+		return
+	}
+	sref := segmentRef{reference: ref, set: len(r.segmentCounts[ref])}
+	added := make(map[uint64]bool)
+	for _, h := range hashValue {
+		if !added[h] {
+			added[h] = true
+			addReference(r.segmentTable, []uint64{h}, sref)
 		}
+	}
+	r.segmentCounts[ref] = append(r.segmentCounts[ref], len(hashValue))
+}
 
-		if dist <= distance {
-			return dist, fName
+func (r *mediaRepositoryMem) FindAllBySegmentHash(
+	hashValue []uint64,
+	distance int,
+	fraction float64,
+	limit int,
+) []media.Match {
+	// closest holds, for each segment hash, the distance of the closest segment to each segment
+	// of the query.
+	closest := make(map[segmentRef]map[int]int)
+	for i, h := range hashValue {
+		for _, it := range r.segmentTable.Search([]uint64{h}, distance) {
+			for _, ref := range it.Value {
+				segments, ok := closest[ref]
+				if !ok {
+					segments = make(map[int]int)
+					closest[ref] = segments
+				}
+				if d, ok := segments[i]; !ok || it.Distance < d {
+					segments[i] = it.Distance
+				}
+			}
 		}
 	}
 
-	return -1, ""
+	var matches []media.Match
+	for ref, segments := range closest {
+		n := r.segmentCounts[ref.reference][ref.set]
+		if len(hashValue) < n {
+			n = len(hashValue)
+		}
+		if float64(len(segments)) < fraction*float64(n) {
+			continue
+		}
+
+		total := 0
+		for _, d := range segments {
+			total += d
+		}
+		matches = append(matches, ref.match(hash.SegmentHash, (total+len(segments)/2)/len(segments)))
+	}
+
+	return sortMatches(matches, limit)
+}
+
+// sortMatches orders the matches by distance, file name and category and keeps the first limit
+// ones.
+func sortMatches(matches []media.Match, limit int) []media.Match {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		if matches[i].Name != matches[j].Name {
+			return matches[i].Name < matches[j].Name
+		}
+		return matches[i].Category < matches[j].Category
+	})
+
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
 }
 
-func NewMediaRepositoryMem(dir string, hashTypes []hash.Type) (media.Repository, error) {
-	f, err := os.Open(dir)
+func newMediaRepositoryMem() *mediaRepositoryMem {
+	return &mediaRepositoryMem{
+		hashTable:     make(map[hash.Type]map[string][]reference),
+		pHashTable:    make(map[hash.Type]*mih.Index[[]reference]),
+		extTable:      make(map[hash.Type]*mih.Index[[]reference]),
+		segmentTable:  mih.New[[]segmentRef](1),
+		segmentCounts: make(map[reference][]int),
+		stored:        make(map[storedKey]bool),
+	}
+}
+
+// appendRecord stores the hashes of the record under its name and category.
+func (r *mediaRepositoryMem) appendRecord(rec *record) {
+	ref := reference{name: rec.name, category: rec.category}
+	for hashType, h := range rec.hashes {
+		r.appendHash(hashType, h, ref)
+	}
+	for hashType, h := range rec.pHashes {
+		r.appendPerceptualHash(hashType, h, ref)
+	}
+	for hashType, h := range rec.extHashes {
+		switch hashType {
+		case hash.SegmentHash:
+			r.appendSegmentHash(h, ref)
+		default:
+			r.appendExtHash(hashType, h, ref)
+		}
+	}
+}
+
+func NewMediaRepositoryMem(dir string, hashTypes []hash.Type, opts ...media.Option) (media.Repository, error) {
+	return NewMediaRepositoryFS(os.DirFS(dir), hashTypes, opts...)
+}
+
+// NewMediaRepositoryFS computes the hashTypes of the files in the root directory of fsys, with
+// the options of NewMedia given, which should be the ones of the search.
+func NewMediaRepositoryFS(fsys fs.FS, hashTypes []hash.Type, opts ...media.Option) (media.Repository, error) {
+	records, err := readMediaFS(fsys, hashTypes, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	entries, _ := f.Readdir(-1)
+	repository := newMediaRepositoryMem()
+	for _, rec := range records {
+		repository.appendRecord(rec)
+	}
+
+	return repository, nil
+}
+
+// record holds the hashes of a reference file.
+type record struct {
+	name      string
+	category  string
+	hashes    map[hash.Type]string
+	pHashes   map[hash.Type]uint64
+	extHashes map[hash.Type][]uint64
+}
+
+func newRecord(name string) *record {
+	return &record{
+		name:      name,
+		hashes:    make(map[hash.Type]string),
+		pHashes:   make(map[hash.Type]uint64),
+		extHashes: make(map[hash.Type][]uint64),
+	}
+}
+
+// readMediaDir computes the hashes of every file in dir.
+func readMediaDir(dir string, hashTypes []hash.Type, opts ...media.Option) ([]*record, error) {
+	return readMediaFS(os.DirFS(dir), hashTypes, opts...)
+}
+
+// readMediaFS computes the hashes of every file in the root directory of fsys.
+func readMediaFS(fsys fs.FS, hashTypes []hash.Type, opts ...media.Option) ([]*record, error) {
+	entries, _ := fs.ReadDir(fsys, ".")
 	if len(entries) <= 0 {
 		return nil, errors.New("images/videos not found")
 	}
 
-	repository := &mediaRepositoryMem{
-		hashTable:  make(map[hash.Type]map[string]string),
-		pHashTable: make(map[hash.Type]map[uint64]string),
-	}
+	var records []*record
 
 	for _, entry := range entries {
 		if entry.IsDir() {
 			continue
 		}
 
-		path := filepath.Join(dir, entry.Name())
-		m, err := media.NewMedia(path, hashTypes)
+		m, err := media.NewMedia(fsys, entry.Name(), hashTypes, opts...)
 		if err != nil {
 			return nil, err
 		}
 
-		for _, typeHash := range hashTypes {
-			switch typeHash {
-			case hash.SHA1:
-				if h := m.SHA1(); h != "" {
-					repository.AppendHash(hash.SHA1, h, m.Name())
-				}
-			case hash.ED2K:
-				if h := m.ED2K(); h != "" {
-					repository.AppendHash(hash.ED2K, h, m.Name())
-				}
-			case hash.AHash:
-				if h := m.AHash(); h > 0 {
-					repository.AppendPerceptualHash(hash.AHash, h, m.Name())
-				}
-			case hash.DHash:
-				if h := m.DHash(); h > 0 {
-					repository.AppendPerceptualHash(hash.DHash, h, m.Name())
-				}
-			case hash.DHashV:
-				if h := m.DHashV(); h > 0 {
-					repository.AppendPerceptualHash(hash.DHashV, h, m.Name())
-				}
-			case hash.PHash:
-				if h := m.PHash(); h > 0 {
-					repository.AppendPerceptualHash(hash.PHash, h, m.Name())
-				}
-			case hash.DomiHash:
-				if h := m.DomiHash(); h > 0 {
-					repository.AppendPerceptualHash(hash.DomiHash, h, m.Name())
-				}
-			case hash.ChHash:
-				if h := m.ChHash(); h > 0 {
-					repository.AppendPerceptualHash(hash.ChHash, h, m.Name())
-				}
-			case hash.WHash:
-				return nil, errors.New("w-hash not implemented")
-			default:
-				return nil, errors.New("invalid hash")
+		rec, err := mediaRecord(m, hashTypes)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+
+	return records, nil
+}
+
+func mediaRecord(m *media.Media, hashTypes []hash.Type) (*record, error) {
+	rec := newRecord(m.Name())
+
+	for _, typeHash := range hashTypes {
+		switch typeHash {
+		case hash.SHA1:
+			if h := m.SHA1(); h != "" {
+				rec.hashes[hash.SHA1] = h
+			}
+		case hash.ED2K:
+			if h := m.ED2K(); h != "" {
+				rec.hashes[hash.ED2K] = h
+			}
+		case hash.MD5:
+			if h := m.MD5(); h != "" {
+				rec.hashes[hash.MD5] = h
+			}
+		case hash.AHash:
+			if m.Has(hash.AHash) {
+				rec.pHashes[hash.AHash] = m.AHash()
+			}
+		case hash.DHash:
+			if m.Has(hash.DHash) {
+				rec.pHashes[hash.DHash] = m.DHash()
+			}
+		case hash.DHashV:
+			if m.Has(hash.DHashV) {
+				rec.pHashes[hash.DHashV] = m.DHashV()
+			}
+		case hash.PHash:
+			if m.Has(hash.PHash) {
+				rec.pHashes[hash.PHash] = m.PHash()
+			}
+		case hash.DomiHash:
+			if m.Has(hash.DomiHash) {
+				rec.pHashes[hash.DomiHash] = m.DomiHash()
 			}
+		case hash.ChHash:
+			if m.Has(hash.ChHash) {
+				rec.pHashes[hash.ChHash] = m.ChHash()
+			}
+		case hash.WHash:
+			if m.Has(hash.WHash) {
+				rec.pHashes[hash.WHash] = m.WHash()
+			}
+		case hash.SegmentHash:
+			if h := m.SegmentHash(); len(h) > 0 {
+				rec.extHashes[hash.SegmentHash] = h
+			}
+		case hash.PDQ:
+			if h := m.PDQ(); len(h) > 0 {
+				rec.extHashes[hash.PDQ] = h
+			}
+		case hash.DHashExt:
+			if h := m.DHashExt(); len(h) > 0 {
+				rec.extHashes[hash.DHashExt] = h
+			}
+		case hash.PHashExt:
+			if h := m.PHashExt(); len(h) > 0 {
+				rec.extHashes[hash.PHashExt] = h
+			}
+		default:
+			return nil, errors.New("invalid hash")
 		}
 	}
 
-	return repository, nil
+	return rec, nil
 }
@@ -0,0 +1,302 @@
+package repository
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math/rand"
+	"testing"
+	"testing/fstest"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+	"github.com/tsmweb/chasam/internal/testimage"
+)
+
+// linearScan is the reference search: it compares the hash against every stored hash.
+func linearScan(table map[uint64]string, hashValue uint64, distance int) map[string]int {
+	found := make(map[string]int)
+	for lHash, fName := range table {
+		if dist, _ := hash.Distance(lHash, hashValue); dist <= distance {
+			found[fName] = dist
+		}
+	}
+	return found
+}
+
+func randomHashes(rnd *rand.Rand, n int) map[uint64]string {
+	table := make(map[uint64]string, n)
+	for i := 0; i < n; i++ {
+		table[rnd.Uint64()] = fmt.Sprintf("img-%06d.jpg", i)
+	}
+	return table
+}
+
+// nearHash flips n random bits of h.
+func nearHash(rnd *rand.Rand, h uint64, n int) uint64 {
+	for i := 0; i < n; i++ {
+		h ^= 1 << uint(rnd.Intn(64))
+	}
+	return h
+}
+
+func TestFindByPerceptualHashMatchesLinearScan(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	table := randomHashes(rnd, 5000)
+	keys := make([]uint64, 0, len(table))
+
+	repo := newMediaRepositoryMem()
+	for h, name := range table {
+		repo.AppendPerceptualHash(hash.DHash, h, name)
+		keys = append(keys, h)
+	}
+
+	for q := 0; q < 500; q++ {
+		query := rnd.Uint64()
+		if q%2 == 0 {
+			query = nearHash(rnd, keys[rnd.Intn(len(keys))], rnd.Intn(16))
+		}
+
+		for _, distance := range []int{0, 5, 10, 15} {
+			expected := linearScan(table, query, distance)
+
+			found := make(map[string]int)
+			for _, it := range repo.pHashTable[hash.DHash].Search([]uint64{query}, distance) {
+				for _, ref := range it.Value {
+					found[ref.name] = it.Distance
+				}
+			}
+			if len(found) != len(expected) {
+				t.Fatalf("distance %d: expected %v, got %v", distance, expected, found)
+			}
+			for name, dist := range expected {
+				if found[name] != dist {
+					t.Fatalf("distance %d: expected %v, got %v", distance, expected, found)
+				}
+			}
+
+			matches := repo.FindAllByPerceptualHash(hash.DHash, query, distance, 0)
+			if len(matches) != len(expected) {
+				t.Fatalf("distance %d: expected %v, got %v", distance, expected, matches)
+			}
+			for i, m := range matches {
+				if d, ok := expected[m.Name]; !ok || d != m.Distance {
+					t.Fatalf("distance %d: match %v not found by linear scan", distance, m)
+				}
+				if i > 0 && (matches[i-1].Distance > m.Distance ||
+					matches[i-1].Distance == m.Distance && matches[i-1].Name > m.Name) {
+					t.Fatalf("distance %d: matches out of order: %v", distance, matches)
+				}
+			}
+
+			if top := repo.FindAllByPerceptualHash(hash.DHash, query, distance, 2); len(matches) > 2 &&
+				fmt.Sprint(top) != fmt.Sprint(matches[:2]) {
+				t.Fatalf("distance %d: expected top 2 of %v, got %v", distance, matches, top)
+			}
+
+			dist, name := repo.FindByPerceptualHash(hash.DHash, query, distance)
+			if len(expected) == 0 {
+				if dist != -1 {
+					t.Fatalf("distance %d: unexpected match %s (%d)", distance, name, dist)
+				}
+				continue
+			}
+			if dist != matches[0].Distance || name != matches[0].Name {
+				t.Fatalf("distance %d: expected closest match %v, got %s (%d)",
+					distance, matches[0], name, dist)
+			}
+		}
+	}
+
+	if dist, _ := repo.FindByPerceptualHash(hash.PHash, keys[0], 64); dist != -1 {
+		t.Fatal("expected no match for an empty hash type")
+	}
+}
+
+func TestFindAllByPerceptualHashSharedHash(t *testing.T) {
+	repo := newMediaRepositoryMem()
+	repo.AppendPerceptualHash(hash.DHash, 0xff, "b.jpg")
+	repo.AppendPerceptualHash(hash.DHash, 0xff, "a.jpg")
+	repo.AppendPerceptualHash(hash.DHash, 0xff, "a.jpg")
+
+	matches := repo.FindAllByPerceptualHash(hash.DHash, 0xff, 0, 0)
+	if len(matches) != 2 || matches[0].Name != "a.jpg" || matches[1].Name != "b.jpg" {
+		t.Fatalf("expected a.jpg and b.jpg, got %v", matches)
+	}
+
+	// the references sharing a hash are kept under a single key of the index.
+	for i := 0; i < 1000; i++ {
+		repo.AppendPerceptualHash(hash.DHash, 0xff, fmt.Sprintf("img-%04d.jpg", i))
+	}
+	if n := repo.pHashTable[hash.DHash].Len(); n != 1 {
+		t.Fatalf("expected 1 key, got %d", n)
+	}
+	if matches = repo.FindAllByPerceptualHash(hash.DHash, 0xfe, 1, 0); len(matches) != 1002 {
+		t.Fatalf("expected 1002 matches, got %d", len(matches))
+	}
+}
+
+func TestFindAllByExtHash(t *testing.T) {
+	repo := newMediaRepositoryMem()
+	a := []uint64{0xff, 0, 0, 0xf0}
+	repo.AppendExtHash(hash.PDQ, a, "a.jpg")
+	repo.AppendExtHash(hash.PDQ, a, "a.jpg")
+	repo.AppendExtHash(hash.PDQ, []uint64{0xff, 0, 0, 0xff}, "b.jpg")
+	// a hash of another size is ignored.
+	repo.AppendExtHash(hash.PDQ, []uint64{0xff}, "c.jpg")
+
+	got := fmt.Sprint(repo.FindAllByExtHash(hash.PDQ, []uint64{0xff, 0, 0, 0xf1}, 4, 0))
+	if want := "[{a.jpg  PDQ 1 0 map[] 0} {b.jpg  PDQ 3 0 map[] 0}]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if matches := repo.FindAllByExtHash(hash.PDQ, []uint64{0xff}, 64, 0); len(matches) != 0 {
+		t.Errorf("expected no match for a hash of another size, got %v", matches)
+	}
+}
+
+func TestFindAllBySegmentHash(t *testing.T) {
+	repo := newMediaRepositoryMem()
+	repo.AppendSegmentHash([]uint64{0x00ff, 0xff00, 0xf0f0, 0x0f0f}, "a.jpg")
+	repo.AppendSegmentHash([]uint64{0x00ff, 0x1234}, "b.jpg")
+	repo.AppendSegmentHash([]uint64{0x00ff, 0x1234}, "b.jpg")
+
+	tests := []struct {
+		query    []uint64
+		fraction float64
+		want     string
+	}{
+		// half of the segments of the query match a.jpg, and one of the two of b.jpg.
+		{[]uint64{0x00ff, 0xff01, 0xaaaa, 0x5555}, 0.5, "[{b.jpg  SegmentHash 0 0 map[] 0} {a.jpg  SegmentHash 1 0 map[] 0}]"},
+		{[]uint64{0x00ff, 0xff01, 0xaaaa, 0x5555}, 0.75, "[]"},
+		// the fraction is taken of the reference when it has fewer segments.
+		{[]uint64{0x00ff, 0x1235, 0xaaaa, 0x5555}, 1, "[{b.jpg  SegmentHash 1 0 map[] 0}]"},
+		{[]uint64{0x7777}, 0.1, "[]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(repo.FindAllBySegmentHash(tt.query, 1, tt.fraction, 0)); got != tt.want {
+			t.Errorf("%x with fraction %v: got %s, want %s", tt.query, tt.fraction, got, tt.want)
+		}
+	}
+}
+
+func TestFindAllBySegmentHashSameName(t *testing.T) {
+	// two files of a set share their name and category, each with its own segments.
+	repo := newMediaRepositoryMem()
+	repo.appendRecord(&record{name: "image.jpg", category: "1",
+		extHashes: map[hash.Type][]uint64{hash.SegmentHash: {0x00ff, 0xff00}}})
+	repo.appendRecord(&record{name: "image.jpg", category: "1",
+		extHashes: map[hash.Type][]uint64{hash.SegmentHash: {0x1234, 0x4321, 0xabcd}}})
+
+	want := "[{image.jpg 1 SegmentHash 0 0 map[] 0}]"
+	for _, query := range [][]uint64{{0x00ff, 0xff00}, {0x1234, 0x4321, 0xabcd}} {
+		if got := fmt.Sprint(repo.FindAllBySegmentHash(query, 0, 1, 0)); got != want {
+			t.Errorf("%x: got %s, want %s", query, got, want)
+		}
+	}
+}
+
+func TestSegmentHashCropAndBorder(t *testing.T) {
+	reference := testimage.Shapes(0)
+	crop := image.NewRGBA(image.Rect(0, 0, 270, 200))
+	draw.Draw(crop, crop.Bounds(), reference, image.Pt(25, 20), draw.Src)
+	border := image.NewRGBA(image.Rect(0, 0, 380, 300))
+	draw.Draw(border, border.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(border, image.Rect(30, 30, 350, 270), reference, image.Point{}, draw.Src)
+
+	hashTypes := []hash.Type{hash.DHash, hash.SegmentHash}
+	repo, err := NewMediaRepositoryFS(fstest.MapFS{
+		"reference.png": &fstest.MapFile{Data: testimage.Encode(t, reference, "png")},
+		"other.png":     &fstest.MapFile{Data: testimage.Encode(t, testimage.Shapes(1), "png")},
+	}, hashTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := fstest.MapFS{
+		"crop.png":   &fstest.MapFile{Data: testimage.Encode(t, crop, "png")},
+		"border.png": &fstest.MapFile{Data: testimage.Encode(t, border, "png")},
+		"other.png":  &fstest.MapFile{Data: testimage.Encode(t, testimage.Shapes(3), "png")},
+	}
+	for name, want := range map[string]string{"crop.png": "reference.png", "border.png": "reference.png", "other.png": ""} {
+		m, err := media.NewMedia(targets, name, hashTypes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the difference hash of the whole image does not survive the crop nor the border.
+		if want != "" {
+			if dist, _ := repo.FindByPerceptualHash(hash.DHash, m.DHash(), 10); dist != -1 {
+				t.Errorf("%s: unexpected DHash match at distance %d", name, dist)
+			}
+		}
+
+		matches := repo.FindAllBySegmentHash(m.SegmentHash(), 10, 0.5, 0)
+		switch {
+		case want == "" && len(matches) > 0:
+			t.Errorf("%s: expected no match, got %v", name, matches)
+		case want != "" && (len(matches) != 1 || matches[0].Name != want):
+			t.Errorf("%s: expected %s, got %v", name, want, matches)
+		}
+	}
+}
+
+func benchmarkQueries(rnd *rand.Rand, keys []uint64, n int) []uint64 {
+	queries := make([]uint64, n)
+	for i := range queries {
+		if i%10 == 0 {
+			queries[i] = nearHash(rnd, keys[rnd.Intn(len(keys))], 4)
+		} else {
+			queries[i] = rnd.Uint64()
+		}
+	}
+	return queries
+}
+
+func BenchmarkFindByPerceptualHash(b *testing.B) {
+	for _, size := range []int{10000, 100000} {
+		rnd := rand.New(rand.NewSource(7))
+		table := randomHashes(rnd, size)
+		keys := make([]uint64, 0, len(table))
+
+		repo := newMediaRepositoryMem()
+		for h, name := range table {
+			repo.AppendPerceptualHash(hash.DHash, h, name)
+			keys = append(keys, h)
+		}
+		queries := benchmarkQueries(rnd, keys, 1000)
+
+		for _, distance := range []int{5, 10} {
+			b.Run(fmt.Sprintf("MapScan/n=%d/d=%d", size, distance), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					query := queries[i%len(queries)]
+					for lHash := range table {
+						if dist, _ := hash.Distance(lHash, query); dist <= distance {
+							break
+						}
+					}
+				}
+			})
+
+			b.Run(fmt.Sprintf("MultiIndex/n=%d/d=%d", size, distance), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					repo.FindByPerceptualHash(hash.DHash, queries[i%len(queries)], distance)
+				}
+			})
+		}
+	}
+}
+
+func TestNewMediaRepositoryFSZeroHash(t *testing.T) {
+	// the difference hash of a plain image is 0, which is a hash like any other.
+	plain := image.NewGray(image.Rect(0, 0, 64, 48))
+	repo, err := NewMediaRepositoryFS(fstest.MapFS{
+		"plain.png": &fstest.MapFile{Data: testimage.Encode(t, plain, "png")},
+	}, []hash.Type{hash.DHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dist, name := repo.FindByPerceptualHash(hash.DHash, 0, 0); dist != 0 || name != "plain.png" {
+		t.Errorf("expected plain.png at distance 0, got %s (%d)", name, dist)
+	}
+}
@@ -0,0 +1,217 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tsmweb/chasam/app/hash"
+	"github.com/tsmweb/chasam/app/media"
+)
+
+// vicsMedia is a Media entry of a VICS (Project VIC) JSON export. Perceptual hashes, other
+// than PhotoDNA, are read from AlternativeHashes, where HashName is a hash type accepted by
+// hash.ParseType and HashValue is formatted by hash.FormatToHex.
+type vicsMedia struct {
+	MediaID    interface{}
+	Category   interface{} `json:",omitempty"`
+	MD5        string      `json:",omitempty"`
+	SHA1       string      `json:",omitempty"`
+	Name       string      `json:",omitempty"`
+	MediaFiles []struct {
+		FileName string
+	} `json:",omitempty"`
+	AlternativeHashes []vicsHash `json:",omitempty"`
+}
+
+// vicsEntry is an element of the value array of an export: a Media entry, or a Case holding
+// its Media entries.
+type vicsEntry struct {
+	vicsMedia
+	Media []vicsMedia
+}
+
+type vicsHash struct {
+	HashName  string
+	HashValue string
+}
+
+// NewMediaRepositoryVICS loads the Media entries of a VICS JSON export, keeping the category,
+// SHA1, MD5 and the perceptual hashes of each entry, whose d-hash-ext and p-hash-ext must have
+// the hash size of opts. An export that records the settings of its perceptual hashes must
+// have the ones of opts.
+func NewMediaRepositoryVICS(path string, opts ...media.Option) (media.Repository, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	repository := newMediaRepositoryMem()
+	settings := media.SettingsOf(opts...)
+
+	recorded, err := decodeVICS(f, func(vm *vicsMedia) error {
+		rec, err := vicsRecord(vm)
+		if err == nil {
+			err = checkHashSize([]*record{rec}, settings.HashSize)
+		}
+		if err != nil {
+			return err
+		}
+		repository.appendRecord(rec)
+		return nil
+	})
+	if err == nil {
+		err = checkSettings(recorded, settings)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return repository, nil
+}
+
+// readVICS returns the records of the Media entries of a VICS JSON export and the settings it
+// records, if any.
+func readVICS(r io.Reader) ([]*record, *media.Settings, error) {
+	var records []*record
+	settings, err := decodeVICS(r, func(vm *vicsMedia) error {
+		rec, err := vicsRecord(vm)
+		if err == nil {
+			records = append(records, rec)
+		}
+		return err
+	})
+	return records, settings, err
+}
+
+// decodeVICS calls fn for every Media entry of the export. The entries are decoded one at a
+// time, or one Case at a time, so large exports are never fully loaded in memory. Besides the
+// OData document {"value": [...]}, a bare array of entries is accepted, and the elements of
+// the array are either Media entries or Cases holding them in Media. The settings recorded by
+// ExportHashSet are returned, or nil.
+func decodeVICS(r io.Reader, fn func(vm *vicsMedia) error) (*media.Settings, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('['):
+		return nil, decodeVICSArray(dec, fn)
+	case json.Delim('{'):
+	default:
+		return nil, errors.New("invalid VICS document")
+	}
+
+	var settings *media.Settings
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		key, _ := tok.(string)
+		switch {
+		case key == settingsKey:
+			var value string
+			if err = dec.Decode(&value); err != nil {
+				return nil, err
+			}
+			s, err := media.ParseSettings(value)
+			if err != nil {
+				return nil, err
+			}
+			settings = &s
+			continue
+		case !strings.EqualFold(key, "value"):
+			var skip json.RawMessage
+			if err = dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if tok, err = dec.Token(); err != nil {
+			return nil, err
+		}
+		if tok != json.Delim('[') {
+			return nil, errors.New("invalid VICS document: value is not an array")
+		}
+		if err = decodeVICSArray(dec, fn); err != nil {
+			return nil, err
+		}
+	}
+
+	return settings, nil
+}
+
+func decodeVICSArray(dec *json.Decoder, fn func(vm *vicsMedia) error) error {
+	for dec.More() {
+		entry := new(vicsEntry)
+		if err := dec.Decode(entry); err != nil {
+			return err
+		}
+
+		if entry.Media == nil {
+			if err := fn(&entry.vicsMedia); err != nil {
+				return err
+			}
+			continue
+		}
+		for i := range entry.Media {
+			if err := fn(&entry.Media[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	// closing bracket.
+	_, err := dec.Token()
+	return err
+}
+
+func vicsRecord(vm *vicsMedia) (*record, error) {
+	name := vm.Name
+	if name == "" && len(vm.MediaFiles) > 0 {
+		name = vm.MediaFiles[0].FileName
+	}
+	if name == "" && vm.MediaID != nil {
+		name = fmt.Sprintf("MediaID:%v", vm.MediaID)
+	}
+	if name == "" {
+		return nil, errors.New("VICS media without name or MediaID")
+	}
+
+	rec := newRecord(name)
+	if vm.Category != nil {
+		rec.category = fmt.Sprint(vm.Category)
+	}
+
+	if h := strings.ToLower(strings.TrimSpace(vm.SHA1)); h != "" {
+		rec.hashes[hash.SHA1] = h
+	}
+	if h := strings.ToLower(strings.TrimSpace(vm.MD5)); h != "" {
+		rec.hashes[hash.MD5] = h
+	}
+
+	for _, ah := range vm.AlternativeHashes {
+		hashType, err := hash.ParseType(ah.HashName)
+		if err != nil {
+			// other vendors' hashes, such as PhotoDNA, are ignored.
+			continue
+		}
+
+		if err = rec.setHash(hashType, ah.HashValue); err != nil {
+			return nil, fmt.Errorf("VICS media %s: invalid %s %q", name, ah.HashName, ah.HashValue)
+		}
+	}
+
+	return rec, nil
+}
@@ -0,0 +1,210 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tsmweb/chasam/app/hash"
+)
+
+const vicsExport = `{
+	"odata.metadata": "http://github.com/ICMEC/ProjectVic/DataModels/1.3.xml#Media",
+	"value": [
+		{
+			"odata.id": "http://localhost/Media(1)",
+			"MediaID": 1,
+			"Category": 1,
+			"MD5": "9E107D9D372BB6826BD81D3542A419D6",
+			"SHA1": "2FD4E1C67A2D28FCED849EE1BB76E7391B93EB12",
+			"MediaFiles": [{"FileName": "fox.jpg"}],
+			"AlternativeHashes": [
+				{"HashName": "PhotoDNA", "HashValue": "AAAA"},
+				{"HashName": "d-hash", "HashValue": "0f0f0f0f0f0f0f0f"},
+				{"HashName": "PHash", "HashValue": "ffff0000ffff0000"}
+			]
+		},
+		{
+			"MediaID": 2,
+			"Category": 2,
+			"MD5": "d41d8cd98f00b204e9800998ecf8427e"
+		}
+	]
+}`
+
+// vicsCaseExport holds the Media entries in Case objects.
+const vicsCaseExport = `{
+	"odata.metadata": "http://github.com/ICMEC/ProjectVic/DataModels/1.3.xml#Cases",
+	"value": [
+		{
+			"CaseID": 10,
+			"CaseNumber": "2023/001",
+			"Media": [
+				{
+					"MediaID": 1,
+					"Category": 1,
+					"SHA1": "2FD4E1C67A2D28FCED849EE1BB76E7391B93EB12",
+					"MediaFiles": [{"FileName": "fox.jpg"}],
+					"AlternativeHashes": [{"HashName": "d-hash", "HashValue": "0f0f0f0f0f0f0f0f"}]
+				},
+				{
+					"MediaID": 2,
+					"Category": 2,
+					"MD5": "d41d8cd98f00b204e9800998ecf8427e"
+				}
+			]
+		},
+		{
+			"CaseID": 11,
+			"Media": [{"MediaID": 3, "Category": 3, "MD5": "9e107d9d372bb6826bd81d3542a419d6"}]
+		}
+	]
+}`
+
+func TestNewMediaRepositoryVICS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.json")
+	if err := os.WriteFile(path, []byte(vicsExport), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := NewMediaRepositoryVICS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if src := repo.FindByHash(hash.SHA1, "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12"); src != "fox.jpg" {
+		t.Errorf("SHA1: expected fox.jpg, got %s", src)
+	}
+	if src := repo.FindByHash(hash.MD5, "9e107d9d372bb6826bd81d3542a419d6"); src != "fox.jpg" {
+		t.Errorf("MD5: expected fox.jpg, got %s", src)
+	}
+	if src := repo.FindByHash(hash.MD5, "d41d8cd98f00b204e9800998ecf8427e"); src != "MediaID:2" {
+		t.Errorf("MD5: expected MediaID:2, got %s", src)
+	}
+	if dist, src := repo.FindByPerceptualHash(hash.DHash, 0x0f0f0f0f0f0f0f0e, 2); dist != 1 || src != "fox.jpg" {
+		t.Errorf("DHash: expected fox.jpg (1), got %s (%d)", src, dist)
+	}
+	if dist, _ := repo.FindByPerceptualHash(hash.PHash, 0xffff0000ffff0000, 0); dist != 0 {
+		t.Errorf("PHash: expected a match")
+	}
+
+	if matches := repo.FindAllByHash(hash.SHA1, "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12"); len(matches) != 1 ||
+		matches[0].Category != "1" {
+		t.Errorf("expected category 1, got %v", matches)
+	}
+	if matches := repo.FindAllByHash(hash.MD5, "d41d8cd98f00b204e9800998ecf8427e"); len(matches) != 1 ||
+		matches[0].Category != "2" {
+		t.Errorf("expected category 2, got %v", matches)
+	}
+}
+
+func TestNewMediaRepositoryVICSSharedName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.json")
+	doc := `{"value": [
+		{"Category": 1, "MD5": "9e107d9d372bb6826bd81d3542a419d6", "MediaFiles": [{"FileName": "image.jpg"}],
+			"AlternativeHashes": [{"HashName": "DHash", "HashValue": "0f0f0f0f0f0f0f0f"}]},
+		{"Category": 3, "MD5": "d41d8cd98f00b204e9800998ecf8427e", "MediaFiles": [{"FileName": "image.jpg"}],
+			"AlternativeHashes": [{"HashName": "DHash", "HashValue": "f0f0f0f0f0f0f0f0"}]}
+	]}`
+	if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := NewMediaRepositoryVICS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the entries share the file name but each keeps its own category.
+	for _, tt := range []struct {
+		md5      string
+		dHash    uint64
+		category string
+	}{
+		{"9e107d9d372bb6826bd81d3542a419d6", 0x0f0f0f0f0f0f0f0f, "1"},
+		{"d41d8cd98f00b204e9800998ecf8427e", 0xf0f0f0f0f0f0f0f0, "3"},
+	} {
+		matches := repo.FindAllByHash(hash.MD5, tt.md5)
+		if len(matches) != 1 || matches[0].Name != "image.jpg" || matches[0].Category != tt.category {
+			t.Errorf("MD5 %s: expected image.jpg of category %s, got %v", tt.md5, tt.category, matches)
+		}
+		matches = repo.FindAllByPerceptualHash(hash.DHash, tt.dHash, 0, 0)
+		if len(matches) != 1 || matches[0].Category != tt.category {
+			t.Errorf("DHash %x: expected category %s, got %v", tt.dHash, tt.category, matches)
+		}
+	}
+}
+
+func TestNewMediaRepositoryVICSCases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.json")
+	if err := os.WriteFile(path, []byte(vicsCaseExport), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := NewMediaRepositoryHashSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if matches := repo.FindAllByHash(hash.SHA1, "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12"); len(matches) != 1 ||
+		matches[0].Name != "fox.jpg" || matches[0].Category != "1" {
+		t.Errorf("SHA1: expected fox.jpg of category 1, got %v", matches)
+	}
+	if dist, src := repo.FindByPerceptualHash(hash.DHash, 0x0f0f0f0f0f0f0f0f, 0); dist != 0 || src != "fox.jpg" {
+		t.Errorf("DHash: expected fox.jpg (0), got %s (%d)", src, dist)
+	}
+	for md5, want := range map[string]string{
+		"d41d8cd98f00b204e9800998ecf8427e": "MediaID:2",
+		"9e107d9d372bb6826bd81d3542a419d6": "MediaID:3",
+	} {
+		if src := repo.FindByHash(hash.MD5, md5); src != want {
+			t.Errorf("MD5 %s: expected %s, got %s", md5, want, src)
+		}
+	}
+}
+
+func TestWriteVICSCategory(t *testing.T) {
+	numeric, text := newRecord("a.jpg"), newRecord("b.jpg")
+	numeric.category, text.category = "2", "CSAM"
+
+	var buf bytes.Buffer
+	if err := writeVICS(&buf, []hash.Type{hash.SHA1}, []*record{numeric, text}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Value []map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Value) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(doc.Value))
+	}
+	// VICS categories are integers; other categories are kept as text.
+	if got := string(doc.Value[0]["Category"]); got != "2" {
+		t.Errorf("expected the category 2, got %s", got)
+	}
+	if got := string(doc.Value[1]["Category"]); got != `"CSAM"` {
+		t.Errorf(`expected the category "CSAM", got %s`, got)
+	}
+}
+
+func TestNewMediaRepositoryVICSInvalid(t *testing.T) {
+	for _, doc := range []string{
+		`"media"`,
+		`{"value": {}}`,
+		`{"value": [{"Category": 1}]}`,
+		`{"value": [{"Name": "a.jpg", "AlternativeHashes": [{"HashName": "DHash", "HashValue": "xyz"}]}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "export.json")
+		if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewMediaRepositoryVICS(path); err == nil {
+			t.Errorf("expected error for %s", doc)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Package testimage provides the synthetic images and the encoding helpers shared by the tests.
+package testimage
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Gradient returns a horizontal gradient over a checkerboard, lightened by offset.
+func Gradient(w, h int, offset uint8) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*180)/w) + offset
+			if (x/16+y/16)%2 == 0 {
+				v /= 2
+			}
+			img.Set(x, y, color.RGBA{R: v, G: v, B: uint8(y), A: 255})
+		}
+	}
+	return img
+}
+
+// Pattern returns a 96x64 striped image whose pattern depends on seed.
+func Pattern(seed int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			v := uint8((x*(seed+2)*3 + y*(seed+1)*7) % 256)
+			if (x/(8+seed)+y/12)%2 == 0 {
+				v = 255 - v
+			}
+			img.Set(x, y, color.RGBA{R: v, G: uint8(x * 2), B: uint8(y * 3), A: 255})
+		}
+	}
+	return img
+}
+
+// Waves returns a w x h image of overlapping sine waves whose frequencies depend on seed.
+func Waves(w, h, seed int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			fx, fy := float64(x), float64(y)
+			v := 128 + 60*math.Sin(fx/(17+float64(seed)*5)+fy/23) + 60*math.Cos(fy/(11+float64(seed)*3)-fx/31)
+			img.Set(x, y, color.RGBA{R: uint8(v), G: uint8(255 - v), B: uint8(v / 2), A: 255})
+		}
+	}
+	return img
+}
+
+// Shapes returns 320x240 bright textured shapes, placed by seed, over a dark textured background.
+func Shapes(seed int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	for y := 0; y < 240; y++ {
+		for x := 0; x < 320; x++ {
+			v := 50 + 30*math.Sin(float64(x*(seed+1))/9)*math.Cos(float64(y)/(5+float64(seed)))
+			for i := 0; i < 4; i++ {
+				cx, cy := float64(70+(i%2)*170+seed*9), float64(65+(i/2)*105+seed*4)
+				r := float64(28 + (i*7+seed*11)%17)
+				dx, dy := float64(x)-cx, float64(y)-cy
+				circle := i%2 == seed%2 && dx*dx+dy*dy < r*r
+				square := i%2 != seed%2 && math.Abs(dx) < r && math.Abs(dy) < r*0.7
+				if circle || square {
+					v = 200 + 40*math.Sin(float64(x*(i+2)+y*(seed+3))/11)
+				}
+			}
+			img.Set(x, y, color.RGBA{R: uint8(v), G: uint8(v * 0.8), B: uint8(255 - v), A: 255})
+		}
+	}
+	return img
+}
+
+// Checker returns a 64x96 gray checkerboard, unlike the other patterns.
+func Checker() image.Image {
+	img := image.NewGray(image.Rect(0, 0, 64, 96))
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 64; x++ {
+			if (x/16+y/24)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 230})
+			} else {
+				img.SetGray(x, y, color.Gray{Y: 20})
+			}
+		}
+	}
+	return img
+}
+
+// Invert returns the negative of img.
+func Invert(img image.Image) image.Image {
+	bounds := img.Bounds()
+	inv := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			inv.Set(x, y, color.RGBA{R: 255 - uint8(r>>8), G: 255 - uint8(g>>8), B: 255 - uint8(b>>8), A: 255})
+		}
+	}
+	return inv
+}
+
+// Encode encodes img as png, jpeg or gif.
+func Encode(t testing.TB, img image.Image, format string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Write saves img in path, encoded by the path extension.
+func Write(t testing.TB, path string, img image.Image) {
+	t.Helper()
+
+	format := "png"
+	switch filepath.Ext(path) {
+	case ".jpg", ".jpeg":
+		format = "jpeg"
+	case ".gif":
+		format = "gif"
+	}
+	if err := os.WriteFile(path, Encode(t, img, format), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,237 @@
+// Package archive walks the members of zip, tar and gzip archives, descending into the archives
+// nested in them.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Format identifies the kind of an archive.
+type Format int
+
+const (
+	None Format = iota
+	Zip
+	Tar
+	Gzip
+)
+
+func (f Format) String() string {
+	switch f {
+	case Zip:
+		return "zip"
+	case Tar:
+		return "tar"
+	case Gzip:
+		return "gzip"
+	default:
+		return "none"
+	}
+}
+
+// Separator separates the path of an archive from the name of a member in a virtual path, as
+// in evidence.zip!/dir/img.jpg.
+const Separator = "!/"
+
+// HeaderSize is the number of bytes needed by Detect and held by Member.Header.
+const HeaderSize = 512
+
+// MaxMemberSize is the largest member read to memory, as a nested archive or by ReadAll.
+var MaxMemberSize int64 = 512 << 20
+
+var ErrMemberTooLarge = errors.New("archive member too large")
+
+// Detect returns the format of the archive whose first bytes are header.
+func Detect(header []byte) Format {
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return Zip
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return Gzip
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return Tar
+	default:
+		return None
+	}
+}
+
+// Member is a file stored in an archive. Its content is read from the Member itself.
+type Member struct {
+	Path    string // virtual path of the member
+	Size    int64  // size of the content, or -1 if unknown
+	ModTime time.Time
+	Header  []byte // first bytes of the content, up to HeaderSize
+
+	r io.Reader
+}
+
+func (m *Member) Read(p []byte) (int, error) {
+	return m.r.Read(p)
+}
+
+// ReadAll reads the content of the member, up to MaxMemberSize.
+func (m *Member) ReadAll() ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(m.r, MaxMemberSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > MaxMemberSize {
+		return nil, fmt.Errorf("%s: %w", m.Path, ErrMemberTooLarge)
+	}
+	return data, nil
+}
+
+// WalkFunc is called for every member that is not a directory nor a walked archive. The member
+// can only be read until WalkFunc returns. An error stops the walk.
+type WalkFunc func(m *Member) error
+
+// Walk calls fn for every member of the archive stored in r, whose path is name. The archives
+// nested in it are walked as well, up to depth levels of archives counting the outer one, and
+// the deeper ones are passed to fn as regular members.
+func Walk(name string, r io.ReaderAt, size int64, depth int, fn WalkFunc) error {
+	header := make([]byte, HeaderSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	w := &walker{fn: fn}
+	return w.walk(name, Detect(header[:n]), r, size, depth)
+}
+
+type walker struct {
+	fn WalkFunc
+}
+
+func (w *walker) walk(name string, format Format, r io.ReaderAt, size int64, depth int) error {
+	var err error
+	switch format {
+	case Zip:
+		err = w.walkZip(name, r, size, depth)
+	case Tar:
+		err = w.walkTar(name, io.NewSectionReader(r, 0, size), depth)
+	case Gzip:
+		err = w.walkGzip(name, io.NewSectionReader(r, 0, size), depth)
+	default:
+		return fmt.Errorf("%s: not an archive", name)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func (w *walker) walkZip(name string, r io.ReaderAt, size int64, depth int) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = w.member(memberPath(name, f.Name), int64(f.UncompressedSize64), f.Modified, rc, depth)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *walker) walkTar(name string, r io.Reader, depth int) error {
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err = w.member(memberPath(name, hdr.Name), hdr.Size, hdr.ModTime, tr, depth); err != nil {
+			return err
+		}
+	}
+}
+
+// walkGzip walks a compressed tar or, if the content is not a tar, the single compressed file.
+func (w *walker) walkGzip(name string, r io.Reader, depth int) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	br := bufio.NewReaderSize(zr, HeaderSize)
+	header, err := br.Peek(HeaderSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if Detect(header) == Tar {
+		return w.walkTar(name, br, depth)
+	}
+
+	member := zr.Name
+	if member == "" {
+		member = strings.TrimSuffix(path.Base(name), path.Ext(name))
+	}
+	return w.member(memberPath(name, member), -1, zr.ModTime, br, depth)
+}
+
+// member walks a nested archive or calls fn.
+func (w *walker) member(name string, size int64, modTime time.Time, r io.Reader, depth int) error {
+	br := bufio.NewReaderSize(r, HeaderSize)
+	header, err := br.Peek(HeaderSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	m := &Member{
+		Path:    name,
+		Size:    size,
+		ModTime: modTime,
+		Header:  header,
+		r:       br,
+	}
+
+	format := Detect(header)
+	if format == None || depth <= 1 {
+		return w.fn(m)
+	}
+
+	data, err := m.ReadAll()
+	if err != nil {
+		return err
+	}
+	return w.walk(name, format, bytes.NewReader(data), int64(len(data)), depth-1)
+}
+
+// memberPath joins the path of an archive and the name of a member, which is cleaned so that
+// it cannot point outside the archive.
+func memberPath(archive, member string) string {
+	member = strings.ReplaceAll(member, `\`, "/")
+	return archive + Separator + strings.TrimPrefix(path.Clean("/"+member), "/")
+}
@@ -0,0 +1,154 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+	"time"
+)
+
+func zipArchive(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarArchive(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, data := range files {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: time.Unix(1700000000, 0)}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipData(t *testing.T, name string, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Name = name
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func walkAll(t *testing.T, name string, data []byte, depth int) map[string]string {
+	t.Helper()
+
+	members := make(map[string]string)
+	err := Walk(name, bytes.NewReader(data), int64(len(data)), depth, func(m *Member) error {
+		content, err := io.ReadAll(m)
+		if err != nil {
+			return err
+		}
+		members[m.Path] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return members
+}
+
+func keys(m map[string]string) string {
+	var k []string
+	for key := range m {
+		k = append(k, key)
+	}
+	sort.Strings(k)
+	return fmt.Sprint(k)
+}
+
+func TestWalkNested(t *testing.T) {
+	inner := gzipData(t, "", tarArchive(t, map[string][]byte{
+		"photos/b.jpg": []byte("b"),
+	}))
+	outer := zipArchive(t, map[string][]byte{
+		"dir/a.jpg":         []byte("a"),
+		"inner.tar.gz":      inner,
+		"single.txt.gz":     gzipData(t, "notes.txt", []byte("notes")),
+		"../../etc/evil.sh": []byte("evil"),
+	})
+
+	members := walkAll(t, "evidence.zip", outer, 3)
+	expected := map[string]string{
+		"evidence.zip!/dir/a.jpg":                  "a",
+		"evidence.zip!/inner.tar.gz!/photos/b.jpg": "b",
+		"evidence.zip!/single.txt.gz!/notes.txt":   "notes",
+		"evidence.zip!/etc/evil.sh":                "evil",
+	}
+	if fmt.Sprint(members) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, members)
+	}
+
+	// at depth 1 the nested archives are regular members.
+	members = walkAll(t, "evidence.zip", outer, 1)
+	if keys(members) != "[evidence.zip!/dir/a.jpg evidence.zip!/etc/evil.sh evidence.zip!/inner.tar.gz evidence.zip!/single.txt.gz]" {
+		t.Fatalf("unexpected members %v", keys(members))
+	}
+	if members["evidence.zip!/inner.tar.gz"] != string(inner) {
+		t.Fatal("nested archive content not passed through")
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		data   []byte
+		format Format
+	}{
+		{zipArchive(t, nil), Zip},
+		{tarArchive(t, map[string][]byte{"a": []byte("a")}), Tar},
+		{gzipData(t, "a", []byte("a")), Gzip},
+		{[]byte("\x89PNG\r\n\x1a\n"), None},
+	}
+
+	for _, tt := range tests {
+		if f := Detect(tt.data); f != tt.format {
+			t.Errorf("expected %s, got %s", tt.format, f)
+		}
+	}
+}
+
+func TestWalkMemberTooLarge(t *testing.T) {
+	defer func(size int64) { MaxMemberSize = size }(MaxMemberSize)
+	MaxMemberSize = 4
+
+	data := zipArchive(t, map[string][]byte{"big.bin": []byte("0123456789")})
+	err := Walk("a.zip", bytes.NewReader(data), int64(len(data)), 1, func(m *Member) error {
+		_, err := m.ReadAll()
+		return err
+	})
+	if !errors.Is(err, ErrMemberTooLarge) {
+		t.Fatalf("expected ErrMemberTooLarge, got %v", err)
+	}
+}
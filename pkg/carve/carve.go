@@ -0,0 +1,438 @@
+// Package carve recovers the JPEG, PNG, GIF and BMP files stored in a raw byte source, such as
+// the unallocated space of a disk image, by their headers and their structure, without the help
+// of a file system.
+package carve
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/tsmweb/chasam/common/mediautil"
+	"github.com/tsmweb/chasam/pkg/disk/vfs"
+)
+
+// DirName is the name of the directory of the carved files.
+const DirName = "$Carved"
+
+// MaxSize is the largest file carved. A header whose structure goes on past it is skipped.
+var MaxSize int64 = 32 << 20
+
+// errInvalid is returned by the parsers for a header that does not start a valid file.
+var errInvalid = errors.New("carve: invalid file")
+
+// File is a file carved from the byte source.
+type File struct {
+	Offset int64
+	Size   int64
+	Ext    string // jpg, png, gif or bmp
+}
+
+// Name returns the name of the carved file, made of its offset in the byte source, as in
+// 1048576.jpg.
+func (f File) Name() string {
+	return fmt.Sprintf("%d.%s", f.Offset, f.Ext)
+}
+
+type format struct {
+	ext   string
+	magic []byte
+	parse func(br *bufio.Reader) (int64, error)
+}
+
+// formats holds a format for each signature that mediautil sniffs for the carved types.
+var formats = makeFormats()
+
+func makeFormats() []format {
+	parsers := []struct {
+		ext         string
+		contentType string
+		parse       func(br *bufio.Reader) (int64, error)
+	}{
+		{"jpg", "image/jpeg", parseJPEG},
+		{"png", "image/png", parsePNG},
+		{"gif", "image/gif", parseGIF},
+		{"bmp", "image/bmp", parseBMP},
+	}
+
+	var formats []format
+	for _, p := range parsers {
+		for _, magic := range mediautil.Signatures(p.contentType) {
+			formats = append(formats, format{p.ext, magic, p.parse})
+		}
+	}
+	return formats
+}
+
+// blockSize is the number of bytes scanned for headers at once.
+const blockSize = 1 << 20
+
+// Scan calls fn for each file carved from the size bytes of r, in the order of their offsets.
+// The scan goes on after the end of each file carved, so the thumbnails embedded in a JPEG are
+// not carved again. The headers inside the allocated runs, sorted by offset as returned by
+// vfs.FS.Allocated, are skipped, as their files are already read from the file system.
+func Scan(r io.ReaderAt, size int64, allocated []vfs.Run, fn func(File) error) error {
+	block := make([]byte, blockSize+16)
+	next := 0 // the first allocated run that does not end before the scan position.
+
+	for pos := int64(0); pos < size; {
+		n, err := r.ReadAt(block, pos)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+
+		// the last bytes of a block are scanned with the next one, unless it is the end.
+		scan := n
+		if pos+int64(n) < size && scan > blockSize {
+			scan = blockSize
+		}
+
+		end := pos + int64(scan)
+		for i := 0; i < scan; i++ {
+			off := pos + int64(i)
+			for next < len(allocated) && allocated[next].Physical+allocated[next].Length <= off {
+				next++
+			}
+			if next < len(allocated) && allocated[next].Physical <= off {
+				runEnd := allocated[next].Physical + allocated[next].Length
+				if runEnd < end {
+					i = int(runEnd-pos) - 1
+					continue
+				}
+				end = runEnd
+				break
+			}
+
+			f, ok := carveAt(r, size, off, block[i:n])
+			if !ok {
+				continue
+			}
+			if err = fn(f); err != nil {
+				return err
+			}
+			end = f.Offset + f.Size
+			break
+		}
+		pos = end
+	}
+	return nil
+}
+
+// carveAt carves the file whose header starts at off, given the bytes read from off.
+func carveAt(r io.ReaderAt, size, off int64, head []byte) (File, bool) {
+	for _, ft := range formats {
+		if !bytes.HasPrefix(head, ft.magic) {
+			continue
+		}
+
+		limit := size - off
+		if limit > MaxSize {
+			limit = MaxSize
+		}
+		br := bufio.NewReader(io.NewSectionReader(r, off, limit))
+		length, err := ft.parse(br)
+		if err != nil || length <= 0 || length > limit {
+			continue
+		}
+		return File{Offset: off, Size: length, Ext: ft.ext}, true
+	}
+	return File{}, false
+}
+
+// NewDir returns the directory DirName holding the files carved from the size bytes of r
+// outside the allocated runs.
+func NewDir(r io.ReaderAt, size int64, allocated []vfs.Run) (*vfs.Node, error) {
+	dir := vfs.NewDir(DirName, time.Time{}, false)
+	err := Scan(r, size, allocated, func(f File) error {
+		dir.Add(vfs.NewFile(f.Name(), f.Size, time.Time{}, false, io.NewSectionReader(r, f.Offset, f.Size)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dir, nil
+}
+
+// counter counts the bytes read by the parsers.
+type counter struct {
+	br *bufio.Reader
+	n  int64
+}
+
+func (c *counter) byte() (byte, error) {
+	b, err := c.br.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+func (c *counter) read(p []byte) error {
+	n, err := io.ReadFull(c.br, p)
+	c.n += int64(n)
+	return err
+}
+
+func (c *counter) skip(n int64) error {
+	m, err := c.br.Discard(int(n))
+	c.n += int64(m)
+	return err
+}
+
+// parseJPEG follows the markers from SOI to EOI, scanning the entropy coded data after each
+// SOS for the next marker.
+func parseJPEG(br *bufio.Reader) (int64, error) {
+	c := &counter{br: br}
+	if err := c.skip(2); err != nil {
+		return 0, err
+	}
+
+	var frame bool
+	for {
+		b, err := c.byte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0xFF {
+			return 0, errInvalid
+		}
+		marker, err := c.byte()
+		for err == nil && marker == 0xFF {
+			marker, err = c.byte()
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case marker == 0xD9:
+			if !frame {
+				return 0, errInvalid
+			}
+			return c.n, nil
+		case marker >= 0xD0 && marker <= 0xD7, marker == 0x01:
+			continue
+		case marker == 0x00 || marker == 0xD8:
+			return 0, errInvalid
+		}
+
+		var l [2]byte
+		if err = c.read(l[:]); err != nil {
+			return 0, err
+		}
+		length := int64(binary.BigEndian.Uint16(l[:]))
+		if length < 2 {
+			return 0, errInvalid
+		}
+		if err = c.skip(length - 2); err != nil {
+			return 0, err
+		}
+
+		switch marker {
+		case 0xC0, 0xC1, 0xC2, 0xC3, 0xC5, 0xC6, 0xC7, 0xC9, 0xCA, 0xCB, 0xCD, 0xCE, 0xCF:
+			frame = true
+		case 0xDA:
+			if !frame {
+				return 0, errInvalid
+			}
+			if err = skipEntropyData(c); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// skipEntropyData reads up to the next marker, which is not a stuffed 0xFF00 nor a restart
+// marker, leaving it unread.
+func skipEntropyData(c *counter) error {
+	for {
+		b, err := c.br.Peek(2)
+		if err != nil {
+			return err
+		}
+		if b[0] == 0xFF && b[1] != 0x00 && b[1] != 0xFF && (b[1] < 0xD0 || b[1] > 0xD7) {
+			return nil
+		}
+		if err = c.skip(1); err != nil {
+			return err
+		}
+	}
+}
+
+// parsePNG follows the chunks from IHDR to IEND, checking the CRC of IHDR.
+func parsePNG(br *bufio.Reader) (int64, error) {
+	c := &counter{br: br}
+	if err := c.skip(8); err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, 8)
+	for first := true; ; first = false {
+		if err := c.read(header); err != nil {
+			return 0, err
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		typ := header[4:]
+		if length > 1<<31-1 || !isChunkType(typ) {
+			return 0, errInvalid
+		}
+
+		switch {
+		case first:
+			if string(typ) != "IHDR" || length != 13 {
+				return 0, errInvalid
+			}
+			data := make([]byte, length+4)
+			if err := c.read(data); err != nil {
+				return 0, err
+			}
+			crc := crc32.Update(crc32.ChecksumIEEE(typ), crc32.IEEETable, data[:length])
+			if crc != binary.BigEndian.Uint32(data[length:]) {
+				return 0, errInvalid
+			}
+		default:
+			if err := c.skip(length + 4); err != nil {
+				return 0, err
+			}
+			if string(typ) == "IEND" {
+				return c.n, nil
+			}
+		}
+	}
+}
+
+func isChunkType(typ []byte) bool {
+	for _, b := range typ {
+		if !(b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseGIF follows the extensions and the images up to the trailer.
+func parseGIF(br *bufio.Reader) (int64, error) {
+	c := &counter{br: br}
+	screen := make([]byte, 13)
+	if err := c.read(screen); err != nil {
+		return 0, err
+	}
+	if flags := screen[10]; flags&0x80 != 0 {
+		if err := c.skip(3 << (flags&0x07 + 1)); err != nil {
+			return 0, err
+		}
+	}
+
+	var images int
+	for {
+		b, err := c.byte()
+		if err != nil {
+			return 0, err
+		}
+
+		switch b {
+		case 0x3B:
+			if images == 0 {
+				return 0, errInvalid
+			}
+			return c.n, nil
+		case 0x21:
+			if _, err = c.byte(); err != nil {
+				return 0, err
+			}
+		case 0x2C:
+			desc := make([]byte, 9)
+			if err = c.read(desc); err != nil {
+				return 0, err
+			}
+			if flags := desc[8]; flags&0x80 != 0 {
+				if err = c.skip(3 << (flags&0x07 + 1)); err != nil {
+					return 0, err
+				}
+			}
+			// LZW minimum code size.
+			if b, err = c.byte(); err != nil {
+				return 0, err
+			}
+			if b < 2 || b > 11 {
+				return 0, errInvalid
+			}
+			images++
+		default:
+			return 0, errInvalid
+		}
+
+		if err = skipSubBlocks(c); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// skipSubBlocks skips the data sub-blocks of a GIF up to the block terminator.
+func skipSubBlocks(c *counter) error {
+	for {
+		n, err := c.byte()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if err = c.skip(int64(n)); err != nil {
+			return err
+		}
+	}
+}
+
+// parseBMP takes the size of the file from its header, once the header looks sound.
+func parseBMP(br *bufio.Reader) (int64, error) {
+	header, err := br.Peek(30)
+	if err != nil {
+		return 0, err
+	}
+
+	size := int64(binary.LittleEndian.Uint32(header[2:]))
+	dataOffset := int64(binary.LittleEndian.Uint32(header[10:]))
+	dibSize := binary.LittleEndian.Uint32(header[14:])
+	if binary.LittleEndian.Uint32(header[6:]) != 0 || dataOffset < 14+int64(dibSize) || dataOffset >= size {
+		return 0, errInvalid
+	}
+
+	var width, height int64
+	var planes, bits uint16
+	switch dibSize {
+	case 12:
+		width = int64(binary.LittleEndian.Uint16(header[18:]))
+		height = int64(binary.LittleEndian.Uint16(header[20:]))
+		planes = binary.LittleEndian.Uint16(header[22:])
+		bits = binary.LittleEndian.Uint16(header[24:])
+	case 40, 52, 56, 108, 124:
+		width = int64(int32(binary.LittleEndian.Uint32(header[18:])))
+		height = int64(int32(binary.LittleEndian.Uint32(header[22:])))
+		planes = binary.LittleEndian.Uint16(header[26:])
+		bits = binary.LittleEndian.Uint16(header[28:])
+	default:
+		return 0, errInvalid
+	}
+	if height < 0 {
+		height = -height
+	}
+	if width <= 0 || height == 0 || planes != 1 {
+		return 0, errInvalid
+	}
+
+	switch bits {
+	case 1, 4, 8, 16, 24, 32:
+	default:
+		return 0, errInvalid
+	}
+	return size, nil
+}
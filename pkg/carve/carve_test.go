@@ -0,0 +1,175 @@
+package carve
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"math/rand"
+	"testing"
+	"testing/fstest"
+
+	"github.com/tsmweb/chasam/internal/testimage"
+	"github.com/tsmweb/chasam/pkg/disk/vfs"
+)
+
+func encodeJPEG(t *testing.T) []byte {
+	return testimage.Encode(t, testimage.Gradient(64, 48, 0), "jpeg")
+}
+
+// jpegWithThumbnail returns a JPEG holding a JPEG thumbnail in an APP1 segment.
+func jpegWithThumbnail(t *testing.T) []byte {
+	outer := encodeJPEG(t)
+	thumb := encodeJPEG(t)
+
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	app1 = append(app1, "Exif\x00\x00"...)
+	app1 = append(app1, thumb...)
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(app1)-2))
+
+	return append(append(append([]byte(nil), outer[:2]...), app1...), outer[2:]...)
+}
+
+func encodePNG(t *testing.T) []byte {
+	return testimage.Encode(t, testimage.Gradient(64, 48, 0), "png")
+}
+
+func encodeGIF(t *testing.T) []byte {
+	return testimage.Encode(t, testimage.Gradient(64, 48, 0), "gif")
+}
+
+// encodeBMP returns a 24 bits BMP of 4x2 pixels.
+func encodeBMP() []byte {
+	const rowSize, height = 12, 2
+	b := make([]byte, 54+rowSize*height)
+	copy(b, "BM")
+	binary.LittleEndian.PutUint32(b[2:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[10:], 54)
+	binary.LittleEndian.PutUint32(b[14:], 40)
+	binary.LittleEndian.PutUint32(b[18:], 4)
+	binary.LittleEndian.PutUint32(b[22:], height)
+	binary.LittleEndian.PutUint16(b[26:], 1)
+	binary.LittleEndian.PutUint16(b[28:], 24)
+	for i := 54; i < len(b); i++ {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func junk(rnd *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	rnd.Read(b)
+	return b
+}
+
+func TestScan(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	var blob bytes.Buffer
+	var want []File
+	add := func(data []byte, ext string) {
+		want = append(want, File{Offset: int64(blob.Len()), Size: int64(len(data)), Ext: ext})
+		blob.Write(data)
+	}
+
+	blob.Write(junk(rnd, 1000))
+	add(jpegWithThumbnail(t), "jpg")
+	blob.Write(junk(rnd, 333))
+	// a JPEG header without a frame and a truncated PNG are not carved.
+	blob.Write([]byte("\xFF\xD8\xFF\xE0\x00\x04ab\xFF\xD9"))
+	blob.Write(encodePNG(t)[:200])
+	blob.Write(junk(rnd, 17))
+	add(encodePNG(t), "png")
+	blob.Write([]byte("BM some text, not a bitmap"))
+	add(encodeGIF(t), "gif")
+	add(encodeBMP(), "bmp")
+	// a file across the blocks of the scan.
+	blob.Write(junk(rnd, blockSize-blob.Len()-100))
+	add(encodeJPEG(t), "jpg")
+	blob.Write(junk(rnd, 5000))
+
+	data := blob.Bytes()
+	var got []File
+	err := Scan(bytes.NewReader(data), int64(len(data)), nil, func(f File) error {
+		got = append(got, f)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d files %v, want %d %v", len(got), got, len(want), want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("file %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestScanAllocated(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	jpg, png, gif := encodeJPEG(t), encodePNG(t), encodeGIF(t)
+
+	// a file inside an allocated run is skipped, as is a run across the blocks of the scan.
+	data := append(junk(rnd, 512), png...)
+	data = append(data, junk(rnd, blockSize)...)
+	jpgOffset := len(data)
+	data = append(data, jpg...)
+	data = append(data, junk(rnd, 100)...)
+	pngOffset := len(data)
+	data = append(data, png...)
+	data = append(data, junk(rnd, 50)...)
+	gifOffset := len(data)
+	data = append(data, gif...)
+
+	allocated := []vfs.Run{
+		{Physical: 100, Length: int64(jpgOffset) - 200},
+		{Physical: int64(pngOffset) - 10, Length: int64(len(png)) + 20},
+	}
+	var got []File
+	err := Scan(bytes.NewReader(data), int64(len(data)), allocated, func(f File) error {
+		got = append(got, f)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []File{
+		{Offset: int64(jpgOffset), Size: int64(len(jpg)), Ext: "jpg"},
+		{Offset: int64(gifOffset), Size: int64(len(gif)), Ext: "gif"},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestNewDir(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	jpg, bmp := encodeJPEG(t), encodeBMP()
+
+	data := append(junk(rnd, 512), jpg...)
+	data = append(data, junk(rnd, 100)...)
+	bmpOffset := len(data)
+	data = append(data, bmp...)
+
+	dir, err := NewDir(bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := vfs.NewDir(".", dir.ModTime(), false)
+	root.Add(dir)
+	fsys := vfs.New(root)
+
+	if err = fstest.TestFS(fsys, DirName+"/512.jpg", DirName+"/"+File{Offset: int64(bmpOffset), Ext: "bmp"}.Name()); err != nil {
+		t.Fatal(err)
+	}
+	content, err := fs.ReadFile(fsys, DirName+"/512.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, jpg) {
+		t.Error("carved JPEG content mismatch")
+	}
+}
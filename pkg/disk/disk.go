@@ -0,0 +1,241 @@
+// Package disk opens raw disk images (dd) read-only, finds their MBR or GPT partitions and
+// exposes the FAT, exFAT, NTFS and ext2/3/4 file systems found in them as an fs.FS.
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tsmweb/chasam/pkg/disk/exfat"
+	"github.com/tsmweb/chasam/pkg/disk/ext4"
+	"github.com/tsmweb/chasam/pkg/disk/fat"
+	"github.com/tsmweb/chasam/pkg/disk/ntfs"
+	"github.com/tsmweb/chasam/pkg/disk/vfs"
+)
+
+var ErrUnsupported = errors.New("disk: no supported file system found")
+
+const sectorSize = 512
+
+// Partition is an entry of the partition table of a disk.
+type Partition struct {
+	Number int
+	Offset int64  // in bytes
+	Size   int64  // in bytes
+	Type   string // the MBR type, as in 0x07, or the GPT type GUID
+}
+
+// Partitions returns the partitions of the disk image r of size bytes, read from its GPT or
+// from its MBR, including the logical partitions of an extended partition.
+func Partitions(r io.ReaderAt, size int64) ([]Partition, error) {
+	mbr := make([]byte, sectorSize)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, nil
+	}
+
+	var parts []Partition
+	for i := 0; i < 4; i++ {
+		e := mbr[446+i*16:]
+		typ := e[4]
+		start := int64(binary.LittleEndian.Uint32(e[8:])) * sectorSize
+		length := int64(binary.LittleEndian.Uint32(e[12:])) * sectorSize
+
+		switch {
+		case typ == 0:
+		case typ == 0xee:
+			return gptPartitions(r, size)
+		case isExtended(typ):
+			logical, err := ebrPartitions(r, size, start)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, logical...)
+		default:
+			if start > 0 && start < size {
+				parts = append(parts, Partition{
+					Number: i + 1,
+					Offset: start,
+					Size:   limit(length, size-start),
+					Type:   fmt.Sprintf("0x%02x", typ),
+				})
+			}
+		}
+	}
+	return parts, nil
+}
+
+func isExtended(typ byte) bool {
+	return typ == 0x05 || typ == 0x0f || typ == 0x85
+}
+
+func limit(n, bound int64) int64 {
+	if n > bound {
+		return bound
+	}
+	return n
+}
+
+// ebrPartitions follows the chain of extended boot records from the extended partition at
+// offset. The logical partitions are numbered from 5, as Linux does.
+func ebrPartitions(r io.ReaderAt, size, offset int64) ([]Partition, error) {
+	var parts []Partition
+	ebr := make([]byte, sectorSize)
+	visited := make(map[int64]bool)
+
+	for next := offset; next > 0 && next < size && !visited[next]; {
+		visited[next] = true
+		if _, err := r.ReadAt(ebr, next); err != nil {
+			return nil, err
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xaa {
+			break
+		}
+
+		e := ebr[446:]
+		if typ := e[4]; typ != 0 {
+			start := next + int64(binary.LittleEndian.Uint32(e[8:]))*sectorSize
+			if start < size {
+				parts = append(parts, Partition{
+					Number: 5 + len(parts),
+					Offset: start,
+					Size:   limit(int64(binary.LittleEndian.Uint32(e[12:]))*sectorSize, size-start),
+					Type:   fmt.Sprintf("0x%02x", typ),
+				})
+			}
+		}
+
+		e = ebr[462:]
+		if !isExtended(e[4]) {
+			break
+		}
+		next = offset + int64(binary.LittleEndian.Uint32(e[8:]))*sectorSize
+	}
+	return parts, nil
+}
+
+func gptPartitions(r io.ReaderAt, size int64) ([]Partition, error) {
+	header := make([]byte, 92)
+	if _, err := r.ReadAt(header, sectorSize); err != nil {
+		return nil, err
+	}
+	if string(header[:8]) != "EFI PART" {
+		return nil, errors.New("disk: invalid GPT header")
+	}
+
+	tableOffset := int64(binary.LittleEndian.Uint64(header[72:])) * sectorSize
+	count := int64(binary.LittleEndian.Uint32(header[80:]))
+	entrySize := int64(binary.LittleEndian.Uint32(header[84:]))
+	if entrySize < 128 || count > 1024 {
+		return nil, errors.New("disk: invalid GPT header")
+	}
+
+	table := make([]byte, count*entrySize)
+	if _, err := r.ReadAt(table, tableOffset); err != nil {
+		return nil, err
+	}
+
+	var parts []Partition
+	for i := int64(0); i < count; i++ {
+		e := table[i*entrySize:]
+		if bytes.Equal(e[:16], make([]byte, 16)) {
+			continue
+		}
+		first := int64(binary.LittleEndian.Uint64(e[32:])) * sectorSize
+		last := int64(binary.LittleEndian.Uint64(e[40:])) * sectorSize
+		if first <= 0 || first >= size || last < first {
+			continue
+		}
+		parts = append(parts, Partition{
+			Number: int(i) + 1,
+			Offset: first,
+			Size:   limit(last-first+sectorSize, size-first),
+			Type:   guid(e[:16]),
+		})
+	}
+	return parts, nil
+}
+
+// guid formats a GUID stored in the mixed endian layout of GPT.
+func guid(b []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(b[0:]),
+		binary.LittleEndian.Uint16(b[4:]),
+		binary.LittleEndian.Uint16(b[6:]),
+		b[8:10], b[10:16])
+}
+
+// Open returns the file system of the disk image r of size bytes. An image of a single file
+// system is returned as is, while the file systems of a partitioned disk are placed in the
+// directories p1, p2... named after the partition numbers. The partitions without a supported
+// file system are left out.
+func Open(r io.ReaderAt, size int64) (*vfs.FS, error) {
+	// the boot code of an MBR can pass for a FAT boot sector, so the partitions are looked up
+	// when the image does not open as a single file system.
+	fsys, volumeErr := openVolume(vfs.NewSection(r, 0, size))
+	if volumeErr == nil {
+		return fsys, nil
+	}
+
+	parts, err := Partitions(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := make(map[string]*vfs.FS)
+	var errs []error
+	if !errors.Is(volumeErr, ErrUnsupported) {
+		errs = append(errs, volumeErr)
+	}
+	for _, p := range parts {
+		fsys, err := openVolume(vfs.NewSection(r, p.Offset, p.Size))
+		if errors.Is(err, ErrUnsupported) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("p%d: %w", p.Number, err))
+			continue
+		}
+		volumes[fmt.Sprintf("p%d", p.Number)] = fsys
+	}
+
+	if len(volumes) == 0 {
+		if len(errs) > 0 {
+			return nil, errs[0]
+		}
+		return nil, ErrUnsupported
+	}
+	return vfs.Mount(volumes), nil
+}
+
+// openVolume opens the file system that starts at the beginning of r, detected by the
+// signatures of its boot sector or superblock.
+func openVolume(r io.ReaderAt) (*vfs.FS, error) {
+	boot := make([]byte, 2048)
+	n, err := r.ReadAt(boot, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	boot = boot[:n]
+	if n < sectorSize {
+		return nil, ErrUnsupported
+	}
+
+	switch {
+	case ntfs.Detect(boot):
+		return ntfs.Open(r)
+	case exfat.Detect(boot):
+		return exfat.Open(r)
+	case n == 2048 && ext4.Detect(boot[1024:]):
+		return ext4.Open(r)
+	case fat.Detect(boot):
+		return fat.Open(r)
+	default:
+		return nil, ErrUnsupported
+	}
+}
@@ -0,0 +1,202 @@
+package disk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+// readImage reads a gzipped file system image of the ext4 tests.
+func readImage(t *testing.T, name string) []byte {
+	t.Helper()
+
+	f, err := os.Open("ext4/testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func putEntry(e []byte, typ byte, start, sectors int64) {
+	e[4] = typ
+	binary.LittleEndian.PutUint32(e[8:], uint32(start))
+	binary.LittleEndian.PutUint32(e[12:], uint32(sectors))
+}
+
+// mbrDisk returns a disk with ext4 in the primary partition 1 and ext2 in the logical
+// partition 5.
+func mbrDisk(t *testing.T) []byte {
+	ext4 := readImage(t, "ext4.img.gz")
+	ext2 := readImage(t, "ext2.img.gz")
+
+	const p1, extended = 2048, 8192
+	logical := int64(extended + 2048)
+	disk := make([]byte, (logical+int64(len(ext2)/sectorSize)+64)*sectorSize)
+
+	mbr := disk[:sectorSize]
+	mbr[0] = 0xeb // boot code
+	putEntry(mbr[446:], 0x83, p1, int64(len(ext4)/sectorSize))
+	putEntry(mbr[462:], 0x0f, extended, int64(len(disk)/sectorSize)-extended)
+	mbr[510], mbr[511] = 0x55, 0xaa
+	copy(disk[p1*sectorSize:], ext4)
+
+	ebr := disk[extended*sectorSize:]
+	putEntry(ebr[446:], 0x83, logical-extended, int64(len(ext2)/sectorSize))
+	ebr[510], ebr[511] = 0x55, 0xaa
+	copy(disk[logical*sectorSize:], ext2)
+
+	return disk
+}
+
+// gptDisk returns a disk with ext4 in the partition 2 of its GPT.
+func gptDisk(t *testing.T) []byte {
+	ext4 := readImage(t, "ext4.img.gz")
+
+	const start = 2048
+	disk := make([]byte, (start+int64(len(ext4)/sectorSize)+64)*sectorSize)
+
+	mbr := disk[:sectorSize]
+	putEntry(mbr[446:], 0xee, 1, int64(len(disk)/sectorSize)-1)
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	header := disk[sectorSize:]
+	copy(header, "EFI PART")
+	binary.LittleEndian.PutUint64(header[72:], 2)
+	binary.LittleEndian.PutUint32(header[80:], 128)
+	binary.LittleEndian.PutUint32(header[84:], 128)
+
+	entry := disk[2*sectorSize+128:]
+	copy(entry, []byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4})
+	binary.LittleEndian.PutUint64(entry[32:], start)
+	binary.LittleEndian.PutUint64(entry[40:], start+uint64(len(ext4)/sectorSize)-1)
+	copy(disk[start*sectorSize:], ext4)
+
+	return disk
+}
+
+func TestPartitions(t *testing.T) {
+	disk := mbrDisk(t)
+	parts, err := Partitions(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 || parts[0].Number != 1 || parts[0].Offset != 2048*sectorSize ||
+		parts[1].Number != 5 || parts[1].Offset != (8192+2048)*sectorSize || parts[1].Type != "0x83" {
+		t.Fatalf("MBR partitions: %+v", parts)
+	}
+
+	disk = gptDisk(t)
+	parts, err = Partitions(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 || parts[0].Number != 2 || parts[0].Offset != 2048*sectorSize ||
+		parts[0].Type != "0FC63DAF-8483-4772-8E79-3D69D8477DE4" {
+		t.Fatalf("GPT partitions: %+v", parts)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		name  string
+		disk  []byte
+		files []string
+	}{
+		{"volume", readImage(t, "ext2.img.gz"), []string{"keep.jpg", "gone.jpg"}},
+		{"mbr", mbrDisk(t), []string{"p1/photo.jpg", "p1/dir/deep/note.txt", "p5/keep.jpg", "p5/gone.jpg"}},
+		{"gpt", gptDisk(t), []string{"p2/photo.jpg", "p2/tiny.txt"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys, err := Open(bytes.NewReader(tt.disk), int64(len(tt.disk)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = fstest.TestFS(fsys, tt.files...); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	if _, err := Open(bytes.NewReader(make([]byte, 4096)), 4096); err != ErrUnsupported {
+		t.Errorf("empty disk: got %v, want %v", err, ErrUnsupported)
+	}
+}
+
+func TestOpenWalk(t *testing.T) {
+	disk := mbrDisk(t)
+	fsys, err := Open(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files int
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 6 {
+		t.Errorf("got %d files, want 6", files)
+	}
+}
+
+func TestAllocated(t *testing.T) {
+	disk := mbrDisk(t)
+	fsys, err := Open(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocated := fsys.Allocated()
+
+	covered := func(off int64) bool {
+		for _, run := range allocated {
+			if off >= run.Physical && off < run.Physical+run.Length {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 1; i < len(allocated); i++ {
+		if allocated[i].Physical <= allocated[i-1].Physical+allocated[i-1].Length {
+			t.Fatalf("runs %d and %d are not merged and sorted: %+v", i-1, i, allocated)
+		}
+	}
+
+	// the files of the partitions are placed in the disk, while the deleted one is left out.
+	for name, want := range map[string]bool{"p1/photo.jpg": true, "p5/keep.jpg": true, "p5/gone.jpg": false} {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the first block of the file, as it can be fragmented.
+		off := bytes.Index(disk, data[:1024])
+		if off < 0 {
+			t.Fatalf("%s: content not found in the disk", name)
+		}
+		if got := covered(int64(off)); got != want {
+			t.Errorf("%s: got allocated %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Package exfat reads exFAT file systems, including the deleted entry sets whose clusters were
+// not reused.
+package exfat
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+	"unicode/utf16"
+
+	"github.com/tsmweb/chasam/pkg/disk/vfs"
+)
+
+var ErrNotExFAT = errors.New("exfat: not an exFAT file system")
+
+const (
+	entrySize = 32
+
+	typeBitmap = 0x81
+	typeFile   = 0x85
+	typeStream = 0xc0
+	typeName   = 0xc1
+	typeInUse  = 0x80
+
+	attrDirectory = 0x10
+
+	flagNoFatChain = 0x02
+
+	maxDirSize = 256 << 20
+)
+
+type volume struct {
+	r           io.ReaderAt
+	clusterSize int64
+	heapOffset  int64
+	clusters    uint32
+	fatOffset   int64
+	bitmap      []byte
+
+	visited map[uint32]bool
+}
+
+// Detect reports whether boot is the boot sector of an exFAT volume.
+func Detect(boot []byte) bool {
+	return len(boot) >= 512 && string(boot[3:11]) == "EXFAT   "
+}
+
+// Open reads the exFAT file system stored in r.
+func Open(r io.ReaderAt) (*vfs.FS, error) {
+	boot := make([]byte, 512)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	if !Detect(boot) {
+		return nil, ErrNotExFAT
+	}
+
+	sectorShift := boot[108]
+	clusterShift := boot[109]
+	if sectorShift < 9 || sectorShift > 12 || clusterShift > 25-sectorShift {
+		return nil, ErrNotExFAT
+	}
+	sectorSize := int64(1) << sectorShift
+
+	v := &volume{
+		r:           r,
+		clusterSize: sectorSize << clusterShift,
+		fatOffset:   int64(binary.LittleEndian.Uint32(boot[80:])) * sectorSize,
+		heapOffset:  int64(binary.LittleEndian.Uint32(boot[88:])) * sectorSize,
+		clusters:    binary.LittleEndian.Uint32(boot[92:]),
+		visited:     make(map[uint32]bool),
+	}
+	// the clusters past the end of the image cannot be read, so they are left out, which bounds
+	// every chain and run by the size of the image.
+	size := vfs.Size(r)
+	if v.heapOffset >= size {
+		return nil, ErrNotExFAT
+	}
+	if n := (size - v.heapOffset) / v.clusterSize; int64(v.clusters) > n {
+		v.clusters = uint32(n)
+	}
+
+	rootCluster := binary.LittleEndian.Uint32(boot[96:])
+	if !v.valid(rootCluster) {
+		return nil, ErrNotExFAT
+	}
+
+	rootRuns := v.chain(rootCluster)
+	if err := v.readBitmap(rootRuns); err != nil {
+		return nil, err
+	}
+
+	root := vfs.NewDir(".", time.Time{}, false)
+	v.visited[rootCluster] = true
+	v.readDir(root, rootRuns, false)
+
+	return vfs.New(root), nil
+}
+
+func (v *volume) valid(cluster uint32) bool {
+	return cluster >= 2 && int64(cluster) < int64(v.clusters)+2
+}
+
+func (v *volume) clusterOffset(cluster uint32) int64 {
+	return v.heapOffset + int64(cluster-2)*v.clusterSize
+}
+
+func (v *volume) next(cluster uint32) uint32 {
+	var b [4]byte
+	if _, err := v.r.ReadAt(b[:], v.fatOffset+int64(cluster)*4); err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b[:])
+}
+
+// chain returns the runs of the cluster chain starting at cluster, stopping at a loop.
+func (v *volume) chain(cluster uint32) []vfs.Run {
+	var runs []vfs.Run
+	var logical int64
+
+	for n := int64(0); v.valid(cluster) && n <= int64(v.clusters); n++ {
+		if last := len(runs) - 1; last >= 0 && runs[last].Physical+runs[last].Length == v.clusterOffset(cluster) {
+			runs[last].Length += v.clusterSize
+		} else {
+			runs = append(runs, vfs.Run{Logical: logical, Physical: v.clusterOffset(cluster), Length: v.clusterSize})
+		}
+		logical += v.clusterSize
+		cluster = v.next(cluster)
+	}
+	return runs
+}
+
+// clusterCount returns the number of clusters of size bytes, without overflowing.
+func (v *volume) clusterCount(size int64) int64 {
+	count := size / v.clusterSize
+	if size%v.clusterSize != 0 {
+		count++
+	}
+	return count
+}
+
+// contiguous returns the runs of size bytes stored from cluster, if they are inside the heap.
+func (v *volume) contiguous(cluster uint32, size int64) ([]vfs.Run, bool) {
+	if size < 0 {
+		return nil, false
+	}
+	count := v.clusterCount(size)
+	if count == 0 {
+		return nil, true
+	}
+	if !v.valid(cluster) || count > int64(v.clusters)-(int64(cluster)-2) {
+		return nil, false
+	}
+	return vfs.Contiguous(v.clusterOffset(cluster), count*v.clusterSize), true
+}
+
+// free reports whether the count clusters from cluster are unallocated in the bitmap.
+func (v *volume) free(cluster uint32, count int64) bool {
+	for c := int64(cluster) - 2; c < int64(cluster)-2+count; c++ {
+		if c < 0 || c/8 >= int64(len(v.bitmap)) || v.bitmap[c/8]&(1<<(c%8)) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readBitmap loads the allocation bitmap described in the root directory.
+func (v *volume) readBitmap(rootRuns []vfs.Run) error {
+	data := v.readRuns(rootRuns)
+	for off := 0; off+entrySize <= len(data); off += entrySize {
+		e := data[off : off+entrySize]
+		if e[0] == 0 {
+			break
+		}
+		if e[0] != typeBitmap {
+			continue
+		}
+
+		size := int64(binary.LittleEndian.Uint64(e[24:]))
+		runs, ok := v.contiguous(binary.LittleEndian.Uint32(e[20:]), size)
+		if !ok || size < (int64(v.clusters)+7)/8 {
+			return ErrNotExFAT
+		}
+		v.bitmap = make([]byte, size)
+		_, err := vfs.NewRunReader(v.r, runs, size).ReadAt(v.bitmap, 0)
+		return err
+	}
+	return ErrNotExFAT
+}
+
+// readRuns reads the directory stored in runs, up to the largest size of an exFAT directory.
+func (v *volume) readRuns(runs []vfs.Run) []byte {
+	var size int64
+	for _, run := range runs {
+		size += run.Length
+	}
+	if size > maxDirSize {
+		size = maxDirSize
+	}
+	data := make([]byte, size)
+	n, _ := vfs.NewRunReader(v.r, runs, size).ReadAt(data, 0)
+	return data[:n-n%entrySize]
+}
+
+// readDir adds the entry sets of the directory stored in runs to dir. A deleted set has the
+// in-use bit of its entry types cleared.
+func (v *volume) readDir(dir *vfs.Node, runs []vfs.Run, deleted bool) {
+	data := v.readRuns(runs)
+
+	for off := 0; off+entrySize <= len(data); off += entrySize {
+		e := data[off : off+entrySize]
+		if e[0] == 0 {
+			break
+		}
+		if e[0]&^typeInUse != typeFile&^typeInUse {
+			continue
+		}
+
+		erased := e[0]&typeInUse == 0
+		count := int(e[1])
+		if count < 2 || off+(count+1)*entrySize > len(data) {
+			continue
+		}
+		set := data[off : off+(count+1)*entrySize]
+		if n, ok := v.readSet(dir, set, deleted || erased); ok {
+			off += n * entrySize
+		}
+	}
+}
+
+// readSet adds the file or directory of the entry set to dir and returns the number of its
+// secondary entries.
+func (v *volume) readSet(dir *vfs.Node, set []byte, deleted bool) (int, bool) {
+	inUse := set[0] & typeInUse
+	stream := set[entrySize : 2*entrySize]
+	if stream[0] != typeStream&^typeInUse|inUse {
+		return 0, false
+	}
+
+	nameLength := int(stream[3])
+	var chars []uint16
+	for i := 2 * entrySize; i+entrySize <= len(set) && len(chars) < nameLength; i += entrySize {
+		if set[i] != typeName&^typeInUse|inUse {
+			break
+		}
+		for j := 2; j < entrySize && len(chars) < nameLength; j += 2 {
+			chars = append(chars, binary.LittleEndian.Uint16(set[i+j:]))
+		}
+	}
+	if len(chars) == 0 {
+		return 0, false
+	}
+	name := string(utf16.Decode(chars))
+
+	attr := binary.LittleEndian.Uint16(set[4:])
+	modTime := timestamp(binary.LittleEndian.Uint32(set[12:]))
+	flags := stream[1]
+	cluster := binary.LittleEndian.Uint32(stream[20:])
+	size := int64(binary.LittleEndian.Uint64(stream[24:]))
+	validSize := int64(binary.LittleEndian.Uint64(stream[8:]))
+	if size < 0 {
+		return len(set)/entrySize - 1, true
+	}
+	if validSize < 0 {
+		validSize = 0
+	}
+
+	var runs []vfs.Run
+	switch {
+	case deleted:
+		// the chain of a deleted file is not trusted, so only a contiguous file whose clusters
+		// are still free is recovered.
+		var ok bool
+		runs, ok = v.contiguous(cluster, size)
+		if !ok || !v.free(cluster, v.clusterCount(size)) {
+			return len(set)/entrySize - 1, true
+		}
+	case flags&flagNoFatChain != 0:
+		runs, _ = v.contiguous(cluster, size)
+	case size > 0:
+		runs = v.chain(cluster)
+	}
+
+	if attr&attrDirectory != 0 {
+		if !v.valid(cluster) || v.visited[cluster] {
+			return len(set)/entrySize - 1, true
+		}
+		v.visited[cluster] = true
+
+		sub := vfs.NewDir(name, modTime, deleted)
+		v.readDir(sub, runs, deleted)
+		dir.Add(sub)
+		return len(set)/entrySize - 1, true
+	}
+
+	// the bytes past the valid data length were never written and read as zeros.
+	if validSize < size {
+		for i := range runs {
+			if end := runs[i].Logical + runs[i].Length; end > validSize {
+				runs[i].Length -= end - validSize
+				if runs[i].Length < 0 {
+					runs[i].Length = 0
+				}
+			}
+		}
+	}
+	dir.Add(vfs.NewFile(name, size, modTime, deleted, vfs.NewRunReader(v.r, runs, size)))
+	return len(set)/entrySize - 1, true
+}
+
+// timestamp converts an exFAT timestamp, in local time, as if it were UTC.
+func timestamp(ts uint32) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Date(
+		1980+int(ts>>25), time.Month(ts>>21&0x0f), int(ts>>16&0x1f),
+		int(ts>>11&0x1f), int(ts>>5&0x3f), int(ts&0x1f)*2, 0, time.UTC)
+}
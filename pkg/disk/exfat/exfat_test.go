@@ -0,0 +1,196 @@
+package exfat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"unicode/utf16"
+
+	"github.com/tsmweb/chasam/pkg/disk/vfs"
+)
+
+// image builds an exFAT file system of 512-byte sectors and clusters, with the allocation
+// bitmap in cluster 2 and the root directory in cluster 3.
+type image struct {
+	data []byte
+}
+
+const (
+	testClusters   = 1000
+	testFATOffset  = 24 * 512
+	testHeapOffset = 64 * 512
+)
+
+func newImage() *image {
+	img := &image{data: make([]byte, testHeapOffset+testClusters*512)}
+	b := img.data
+	b[0], b[1], b[2] = 0xeb, 0x76, 0x90
+	copy(b[3:], "EXFAT   ")
+	binary.LittleEndian.PutUint64(b[72:], uint64(len(b)/512))
+	binary.LittleEndian.PutUint32(b[80:], testFATOffset/512)
+	binary.LittleEndian.PutUint32(b[84:], 8)
+	binary.LittleEndian.PutUint32(b[88:], testHeapOffset/512)
+	binary.LittleEndian.PutUint32(b[92:], testClusters)
+	binary.LittleEndian.PutUint32(b[96:], 3)
+	b[108], b[109], b[110] = 9, 0, 1
+	b[510], b[511] = 0x55, 0xaa
+
+	img.allocate(2, 0xffffffff)
+	img.allocate(3, 0xffffffff)
+	return img
+}
+
+// allocate marks cluster as used and sets its FAT entry to next, unless next is zero.
+func (img *image) allocate(cluster, next uint32) {
+	bitmap := img.cluster(2)
+	bitmap[(cluster-2)/8] |= 1 << ((cluster - 2) % 8)
+	if next != 0 {
+		binary.LittleEndian.PutUint32(img.data[testFATOffset+cluster*4:], next)
+	}
+}
+
+func (img *image) cluster(c uint32) []byte {
+	off := testHeapOffset + (int(c)-2)*512
+	return img.data[off : off+512]
+}
+
+// entrySet returns the entries of a file. A deleted set has the in-use bits cleared.
+func entrySet(name string, attr uint16, cluster uint32, size int64, noFatChain, deleted bool) []byte {
+	chars := utf16.Encode([]rune(name))
+	names := (len(chars) + 14) / 15
+	set := make([]byte, (2+names)*entrySize)
+
+	set[0] = typeFile
+	set[1] = byte(1 + names)
+	binary.LittleEndian.PutUint16(set[4:], attr)
+	binary.LittleEndian.PutUint32(set[12:], 45<<25|1<<21|1<<16) // 2025-01-01
+
+	stream := set[entrySize:]
+	stream[0] = typeStream
+	stream[1] = 0x01
+	if noFatChain {
+		stream[1] |= flagNoFatChain
+	}
+	stream[3] = byte(len(chars))
+	binary.LittleEndian.PutUint64(stream[8:], uint64(size))
+	binary.LittleEndian.PutUint32(stream[20:], cluster)
+	binary.LittleEndian.PutUint64(stream[24:], uint64(size))
+
+	for i, c := range chars {
+		e := set[(2+i/15)*entrySize:]
+		e[0] = typeName
+		binary.LittleEndian.PutUint16(e[2+(i%15)*2:], c)
+	}
+
+	if deleted {
+		for off := 0; off < len(set); off += entrySize {
+			set[off] &^= typeInUse
+		}
+	}
+	return set
+}
+
+func buildImage() (*image, map[string][]byte) {
+	img := newImage()
+	files := map[string][]byte{
+		"a rather long picture name.jpg": bytes.Repeat([]byte("jpeg"), 300), // 3 clusters
+		"dir/inner.png":                  []byte("png data"),
+		"erased.gif":                     bytes.Repeat([]byte("gif"), 250),
+	}
+
+	long := files["a rather long picture name.jpg"]
+	copy(img.cluster(10), long)
+	copy(img.cluster(12), long[512:])
+	copy(img.cluster(13), long[1024:])
+	img.allocate(10, 12)
+	img.allocate(12, 13)
+	img.allocate(13, 0xffffffff)
+
+	copy(img.cluster(20), files["dir/inner.png"])
+	img.allocate(20, 0)
+
+	// the deleted file keeps its free clusters 30-31.
+	copy(img.cluster(30), files["erased.gif"])
+	copy(img.cluster(31), files["erased.gif"][512:])
+
+	sub := entrySet("inner.png", 0, 20, 8, true, false)
+	copy(img.cluster(5), sub)
+	img.allocate(5, 0)
+
+	root := make([]byte, entrySize)
+	root[0] = typeBitmap
+	binary.LittleEndian.PutUint32(root[20:], 2)
+	binary.LittleEndian.PutUint64(root[24:], (testClusters+7)/8)
+	root = append(root, entrySet("a rather long picture name.jpg", 0, 10, int64(len(long)), false, false)...)
+	root = append(root, entrySet("dir", attrDirectory, 5, 512, true, false)...)
+	root = append(root, entrySet("erased.gif", 0, 30, int64(len(files["erased.gif"])), true, true)...)
+	// the cluster of this deleted file was reused by dir/inner.png.
+	root = append(root, entrySet("lost.jpg", 0, 20, 100, true, true)...)
+	copy(img.cluster(3), root)
+
+	return img, files
+}
+
+func TestOpen(t *testing.T) {
+	img, files := buildImage()
+
+	fsys, err := Open(bytes.NewReader(img.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fstest.TestFS(fsys, "a rather long picture name.jpg", "dir/inner.png", "erased.gif"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range files {
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: content mismatch", name)
+		}
+	}
+
+	info, err := fs.Stat(fsys, "erased.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Sys().(*vfs.Node).Deleted {
+		t.Error("erased.gif: want deleted")
+	}
+	if info.ModTime().Year() != 2025 {
+		t.Errorf("erased.gif: mod time %v", info.ModTime())
+	}
+
+	if _, err = fs.Stat(fsys, "lost.jpg"); err == nil {
+		t.Error("lost.jpg: the clusters of the deleted file were reused")
+	}
+}
+
+// FuzzOpen checks that a damaged image either fails to open or opens into a file system whose
+// files can be read, without a panic or an allocation of the sizes it declares.
+func FuzzOpen(f *testing.F) {
+	img, _ := buildImage()
+	f.Add(img.data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fsys, err := Open(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if file, err := fsys.Open(name); err == nil {
+				io.CopyN(io.Discard, file, 1<<16)
+				file.Close()
+			}
+			return nil
+		})
+	})
+}
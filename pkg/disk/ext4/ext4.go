@@ -0,0 +1,498 @@
+// Package ext4 reads ext2, ext3 and ext4 file systems. The deleted directory entries left in
+// the slack of a directory block are recovered when their inode still maps free blocks, which
+// ext2 keeps but ext3 and ext4 clear.
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tsmweb/chasam/pkg/disk/vfs"
+)
+
+var ErrNotExt = errors.New("ext4: not an ext2/3/4 file system")
+
+const (
+	superblockOffset = 1024
+	magic            = 0xef53
+
+	incompatFileType   = 0x0002
+	incompat64Bit      = 0x0080
+	incompatMetaBG     = 0x0010
+	incompatInlineData = 0x8000
+
+	flagIndex      = 0x1000
+	flagExtents    = 0x80000
+	flagInlineData = 0x10000000
+
+	modeMask = 0xf000
+	modeDir  = 0x4000
+	modeFile = 0x8000
+
+	extentMagic = 0xf30a
+
+	blockUninit = 0x0002
+
+	rootInode = 2
+
+	maxDirSize = 64 << 20
+)
+
+// Detect reports whether sb, the bytes read from offset 1024, is an ext superblock.
+func Detect(sb []byte) bool {
+	return len(sb) >= 58 && binary.LittleEndian.Uint16(sb[56:]) == magic
+}
+
+type group struct {
+	blockBitmap int64
+	inodeTable  int64
+	flags       uint16
+}
+
+type volume struct {
+	r              io.ReaderAt
+	blockSize      int64
+	blocks         int64
+	firstDataBlock int64
+	blocksPerGroup int64
+	inodesPerGroup int64
+	inodes         int64
+	inodeSize      int64
+	fileType       bool
+	groups         []group
+	bitmaps        map[int][]byte
+
+	visited map[uint32]bool
+}
+
+type inode struct {
+	mode   uint16
+	size   int64
+	mtime  time.Time
+	dtime  uint32
+	links  uint16
+	blocks uint32
+	flags  uint32
+	block  []byte // i_block, 60 bytes
+}
+
+// Open reads the ext2, ext3 or ext4 file system stored in r.
+func Open(r io.ReaderAt) (*vfs.FS, error) {
+	sb := make([]byte, 1024)
+	if _, err := r.ReadAt(sb, superblockOffset); err != nil {
+		return nil, err
+	}
+	if !Detect(sb) {
+		return nil, ErrNotExt
+	}
+
+	logBlockSize := binary.LittleEndian.Uint32(sb[24:])
+	incompat := binary.LittleEndian.Uint32(sb[96:])
+	if logBlockSize > 6 || incompat&incompatMetaBG != 0 {
+		return nil, ErrNotExt
+	}
+
+	v := &volume{
+		r:              r,
+		blockSize:      1024 << logBlockSize,
+		blocks:         int64(binary.LittleEndian.Uint32(sb[4:])),
+		firstDataBlock: int64(binary.LittleEndian.Uint32(sb[20:])),
+		blocksPerGroup: int64(binary.LittleEndian.Uint32(sb[32:])),
+		inodesPerGroup: int64(binary.LittleEndian.Uint32(sb[40:])),
+		inodes:         int64(binary.LittleEndian.Uint32(sb[0:])),
+		inodeSize:      128,
+		fileType:       incompat&incompatFileType != 0,
+		bitmaps:        make(map[int][]byte),
+		visited:        make(map[uint32]bool),
+	}
+	if binary.LittleEndian.Uint32(sb[76:]) >= 1 {
+		v.inodeSize = int64(binary.LittleEndian.Uint16(sb[88:]))
+	}
+	descSize := int64(32)
+	if incompat&incompat64Bit != 0 {
+		v.blocks |= int64(binary.LittleEndian.Uint32(sb[0x150:])) << 32
+		if ds := int64(binary.LittleEndian.Uint16(sb[254:])); ds >= 64 {
+			descSize = ds
+		}
+	}
+	// the bitmap of a group takes a single block.
+	if v.blocksPerGroup == 0 || v.blocksPerGroup > 8*v.blockSize || v.inodesPerGroup == 0 ||
+		v.inodesPerGroup > 8*v.blockSize || v.inodeSize < 128 || v.inodeSize > v.blockSize {
+		return nil, ErrNotExt
+	}
+
+	// the blocks past the end of the image cannot be read, so they are left out, which bounds
+	// the group descriptors and every block number by the size of the image.
+	size := vfs.Size(r)
+	if n := size / v.blockSize; v.blocks < 0 || v.blocks > n {
+		v.blocks = n
+	}
+	if v.firstDataBlock >= v.blocks {
+		return nil, ErrNotExt
+	}
+
+	count := (v.blocks - v.firstDataBlock + v.blocksPerGroup - 1) / v.blocksPerGroup
+	tableOffset := (v.firstDataBlock + 1) * v.blockSize
+	if tableOffset >= size || count > (size-tableOffset)/descSize {
+		return nil, ErrNotExt
+	}
+	table := make([]byte, count*descSize)
+	if _, err := r.ReadAt(table, tableOffset); err != nil {
+		return nil, fmt.Errorf("ext4: group descriptors: %v", err)
+	}
+	v.groups = make([]group, count)
+	for i := range v.groups {
+		d := table[int64(i)*descSize:]
+		g := group{
+			blockBitmap: int64(binary.LittleEndian.Uint32(d[0:])),
+			inodeTable:  int64(binary.LittleEndian.Uint32(d[8:])),
+			flags:       binary.LittleEndian.Uint16(d[18:]),
+		}
+		if descSize >= 64 {
+			g.blockBitmap |= int64(binary.LittleEndian.Uint32(d[0x20:])) << 32
+			g.inodeTable |= int64(binary.LittleEndian.Uint32(d[0x28:])) << 32
+		}
+		v.groups[i] = g
+	}
+
+	ino, err := v.inode(rootInode)
+	if err != nil {
+		return nil, err
+	}
+	if ino.mode&modeMask != modeDir {
+		return nil, ErrNotExt
+	}
+
+	root := vfs.NewDir(".", ino.mtime, false)
+	v.visited[rootInode] = true
+	v.readDir(root, ino)
+
+	return vfs.New(root), nil
+}
+
+func (v *volume) inode(num uint32) (*inode, error) {
+	if num == 0 || int64(num) > v.inodes {
+		return nil, fmt.Errorf("ext4: bad inode %d", num)
+	}
+	g := int64(num-1) / v.inodesPerGroup
+	if g >= int64(len(v.groups)) {
+		return nil, fmt.Errorf("ext4: bad inode %d", num)
+	}
+
+	if t := v.groups[g].inodeTable; t <= 0 || t >= v.blocks {
+		return nil, fmt.Errorf("ext4: bad inode table of group %d", g)
+	}
+
+	b := make([]byte, 128)
+	off := v.groups[g].inodeTable*v.blockSize + (int64(num-1)%v.inodesPerGroup)*v.inodeSize
+	if _, err := v.r.ReadAt(b, off); err != nil {
+		return nil, fmt.Errorf("ext4: inode %d: %v", num, err)
+	}
+
+	size := int64(binary.LittleEndian.Uint32(b[4:])) | int64(binary.LittleEndian.Uint32(b[108:]))<<32
+	if size < 0 {
+		return nil, fmt.Errorf("ext4: inode %d: bad size", num)
+	}
+
+	return &inode{
+		mode:   binary.LittleEndian.Uint16(b[0:]),
+		size:   size,
+		mtime:  time.Unix(int64(binary.LittleEndian.Uint32(b[16:])), 0).UTC(),
+		dtime:  binary.LittleEndian.Uint32(b[20:]),
+		links:  binary.LittleEndian.Uint16(b[26:]),
+		blocks: binary.LittleEndian.Uint32(b[28:]),
+		flags:  binary.LittleEndian.Uint32(b[32:]),
+		block:  b[40:100],
+	}, nil
+}
+
+// runs maps the blocks of ino through its extent tree or its block map. The blocks of the tree
+// or of the indirect blocks are read once, so that a damaged inode that points to the same
+// block again cannot make the walk loop.
+func (v *volume) runs(ino *inode) ([]vfs.Run, error) {
+	var runs []vfs.Run
+	var err error
+	seen := make(map[int64]bool)
+	if ino.flags&flagExtents != 0 {
+		err = v.extents(ino.block, 0, &runs, seen)
+	} else {
+		err = v.blockMap(ino.block, &runs, seen)
+	}
+	return runs, err
+}
+
+// extents walks the extent tree node b. An uninitialized extent is read as zeros.
+func (v *volume) extents(b []byte, level int, runs *[]vfs.Run, seen map[int64]bool) error {
+	if len(b) < 12 || binary.LittleEndian.Uint16(b) != extentMagic || level > 5 {
+		return errors.New("ext4: bad extent header")
+	}
+	entries := int(binary.LittleEndian.Uint16(b[2:]))
+	depth := binary.LittleEndian.Uint16(b[6:])
+	if 12+entries*12 > len(b) {
+		return errors.New("ext4: bad extent header")
+	}
+
+	for i := 0; i < entries; i++ {
+		e := b[12+i*12:]
+		if depth == 0 {
+			length := int64(binary.LittleEndian.Uint16(e[4:]))
+			sparse := length > 32768
+			if sparse {
+				length -= 32768
+			}
+			start := int64(binary.LittleEndian.Uint16(e[6:]))<<32 | int64(binary.LittleEndian.Uint32(e[8:]))
+			if !sparse && start+length > v.blocks {
+				return fmt.Errorf("ext4: bad extent at block %d", start)
+			}
+			*runs = append(*runs, vfs.Run{
+				Logical:  int64(binary.LittleEndian.Uint32(e[0:])) * v.blockSize,
+				Physical: start * v.blockSize,
+				Length:   length * v.blockSize,
+				Sparse:   sparse,
+			})
+			continue
+		}
+
+		leaf := int64(binary.LittleEndian.Uint16(e[8:]))<<32 | int64(binary.LittleEndian.Uint32(e[4:]))
+		if leaf >= v.blocks || seen[leaf] {
+			return fmt.Errorf("ext4: bad extent node %d", leaf)
+		}
+		seen[leaf] = true
+
+		node := make([]byte, v.blockSize)
+		if _, err := v.r.ReadAt(node, leaf*v.blockSize); err != nil {
+			return err
+		}
+		if err := v.extents(node, level+1, runs, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockMap walks the 12 direct blocks and the indirect, double and triple indirect blocks of an
+// ext2/3 inode.
+func (v *volume) blockMap(b []byte, runs *[]vfs.Run, seen map[int64]bool) error {
+	var logical int64
+	for i := 0; i < 15; i++ {
+		block := int64(binary.LittleEndian.Uint32(b[i*4:]))
+		level := 0
+		if i >= 12 {
+			level = i - 11
+		}
+		if err := v.mapBlock(block, level, &logical, runs, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *volume) mapBlock(block int64, level int, logical *int64, runs *[]vfs.Run, seen map[int64]bool) error {
+	if level == 0 {
+		if block >= v.blocks {
+			return fmt.Errorf("ext4: bad block %d", block)
+		}
+		if block != 0 {
+			v.addBlock(block, *logical, runs)
+		}
+		*logical += v.blockSize
+		return nil
+	}
+
+	if block == 0 {
+		// a hole as large as the blocks mapped through this indirect block.
+		span := v.blockSize
+		for i := 0; i < level; i++ {
+			span *= v.blockSize / 4
+		}
+		*logical += span
+		return nil
+	}
+	if block >= v.blocks || seen[block] {
+		return fmt.Errorf("ext4: bad block %d", block)
+	}
+	seen[block] = true
+
+	data := make([]byte, v.blockSize)
+	if _, err := v.r.ReadAt(data, block*v.blockSize); err != nil {
+		return err
+	}
+	for i := int64(0); i < v.blockSize; i += 4 {
+		if err := v.mapBlock(int64(binary.LittleEndian.Uint32(data[i:])), level-1, logical, runs, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *volume) addBlock(block, logical int64, runs *[]vfs.Run) {
+	physical := block * v.blockSize
+	if last := len(*runs) - 1; last >= 0 {
+		r := &(*runs)[last]
+		if r.Logical+r.Length == logical && r.Physical+r.Length == physical {
+			r.Length += v.blockSize
+			return
+		}
+	}
+	*runs = append(*runs, vfs.Run{Logical: logical, Physical: physical, Length: v.blockSize})
+}
+
+// free reports whether all the blocks of runs are unallocated in the block bitmaps.
+func (v *volume) free(runs []vfs.Run) bool {
+	for _, run := range runs {
+		if run.Sparse {
+			continue
+		}
+		for b := run.Physical / v.blockSize; b < (run.Physical+run.Length)/v.blockSize; b++ {
+			if b < v.firstDataBlock || b >= v.blocks {
+				return false
+			}
+			g := int((b - v.firstDataBlock) / v.blocksPerGroup)
+			bit := (b - v.firstDataBlock) % v.blocksPerGroup
+
+			bitmap, ok := v.bitmaps[g]
+			if !ok {
+				if v.groups[g].flags&blockUninit == 0 {
+					if t := v.groups[g].blockBitmap; t <= 0 || t >= v.blocks {
+						return false
+					}
+					bitmap = make([]byte, v.blockSize)
+					if _, err := v.r.ReadAt(bitmap, v.groups[g].blockBitmap*v.blockSize); err != nil {
+						return false
+					}
+				}
+				v.bitmaps[g] = bitmap
+			}
+			if bitmap != nil && bitmap[bit/8]&(1<<(bit%8)) != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// readDir adds the entries of the directory ino to dir.
+func (v *volume) readDir(dir *vfs.Node, ino *inode) {
+	if ino.flags&flagInlineData != 0 {
+		// the first 4 bytes hold the inode of the parent directory.
+		v.readEntries(dir, ino.block[4:], false)
+		return
+	}
+
+	runs, err := v.runs(ino)
+	if err != nil || ino.size > maxDirSize {
+		return
+	}
+	data := make([]byte, ino.size)
+	if _, err = vfs.NewRunReader(v.r, runs, ino.size).ReadAt(data, 0); err != nil && !errors.Is(err, io.EOF) {
+		return
+	}
+
+	// the blocks of a hashed directory start with index nodes, so their slack is not scanned.
+	slack := ino.flags&flagIndex == 0
+	for off := int64(0); off < int64(len(data)); off += v.blockSize {
+		end := off + v.blockSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		v.readEntries(dir, data[off:end], slack)
+	}
+}
+
+// readEntries adds the entries of a directory block to dir and, if slack is set, the deleted
+// entries left in the space that a live entry took over.
+func (v *volume) readEntries(dir *vfs.Node, b []byte, slack bool) {
+	for off := 0; off+8 <= len(b); {
+		num, recLen, nameLen, ok := v.entry(b[off:])
+		if !ok {
+			return
+		}
+		if num != 0 {
+			v.add(dir, num, string(b[off+8:off+8+nameLen]), false)
+		}
+
+		if slack {
+			// a deleted entry merged into the previous one keeps its own record.
+			for pos := off + (8+nameLen+3)&^3; pos+8 <= off+recLen; {
+				dnum, _, dnameLen, ok := v.entry(b[pos : off+recLen])
+				if !ok || dnum == 0 {
+					pos += 4
+					continue
+				}
+				v.add(dir, dnum, string(b[pos+8:pos+8+dnameLen]), true)
+				pos += (8 + dnameLen + 3) &^ 3
+			}
+		}
+		off += recLen
+	}
+}
+
+// entry parses the directory entry at the start of b.
+func (v *volume) entry(b []byte) (num uint32, recLen, nameLen int, ok bool) {
+	if len(b) < 8 {
+		return 0, 0, 0, false
+	}
+	num = binary.LittleEndian.Uint32(b)
+	recLen = int(binary.LittleEndian.Uint16(b[4:]))
+	nameLen = int(b[6])
+	if !v.fileType {
+		nameLen |= int(b[7]) << 8
+	}
+	if recLen < 8 || recLen%4 != 0 || recLen > len(b) || 8+nameLen > recLen || int64(num) > v.inodes {
+		return 0, 0, 0, false
+	}
+	return num, recLen, nameLen, true
+}
+
+func (v *volume) add(dir *vfs.Node, num uint32, name string, deleted bool) {
+	if name == "" || name == "." || name == ".." {
+		return
+	}
+	ino, err := v.inode(num)
+	if err != nil {
+		return
+	}
+
+	if deleted {
+		// only a regular file whose inode was released but still maps free blocks.
+		if ino.mode&modeMask != modeFile || ino.links != 0 || ino.dtime == 0 || ino.blocks == 0 ||
+			ino.flags&(flagExtents|flagInlineData) != 0 {
+			return
+		}
+	} else if ino.links == 0 {
+		return
+	}
+
+	switch ino.mode & modeMask {
+	case modeDir:
+		if v.visited[num] {
+			return
+		}
+		v.visited[num] = true
+
+		sub := vfs.NewDir(name, ino.mtime, false)
+		v.readDir(sub, ino)
+		dir.Add(sub)
+
+	case modeFile:
+		var data io.ReaderAt
+		if ino.flags&flagInlineData != 0 {
+			if ino.size > int64(len(ino.block)) {
+				// the rest of the data is in an extended attribute.
+				return
+			}
+			data = bytes.NewReader(ino.block[:ino.size])
+		} else {
+			runs, err := v.runs(ino)
+			if err != nil || (deleted && (len(runs) == 0 || !v.free(runs))) {
+				return
+			}
+			data = vfs.NewRunReader(v.r, runs, ino.size)
+		}
+		dir.Add(vfs.NewFile(name, ino.size, ino.mtime, deleted, data))
+	}
+}
@@ -0,0 +1,139 @@
+package ext4
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/tsmweb/chasam/pkg/disk/vfs"
+)
+
+var testTime = time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// openImage opens a gzipped image of testdata, described in testdata/README.
+func openImage(t *testing.T, name string) fs.FS {
+	t.Helper()
+
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func checkFiles(t *testing.T, fsys fs.FS, files map[string]string) {
+	t.Helper()
+
+	for name, want := range files {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); got != want && string(data) != want {
+			t.Errorf("%s: content mismatch", name)
+		}
+
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(testTime) {
+			t.Errorf("%s: mod time %v", name, info.ModTime())
+		}
+	}
+}
+
+func TestOpenExt4(t *testing.T) {
+	fsys := openImage(t, "ext4.img.gz")
+
+	if err := fstest.TestFS(fsys, "photo.jpg", "tiny.txt", "dir/deep/note.txt"); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, fsys, map[string]string{
+		"photo.jpg":         "8d014ee2028a71ef0bf344c646483f03a68709800b938b3adca3fcc2fa26ccf5",
+		"tiny.txt":          "inline\n",
+		"dir/deep/note.txt": "deep note\n",
+	})
+}
+
+func TestOpenExt2Deleted(t *testing.T) {
+	fsys := openImage(t, "ext2.img.gz")
+
+	if err := fstest.TestFS(fsys, "big.bin", "keep.jpg", "gone.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, fsys, map[string]string{
+		"big.bin":  "338128d21e6c77a33e7d831be3924acb7736915d7488ca041a40d776fcd71bcf",
+		"keep.jpg": "cb632b576fbe14723f36b563f700ce2f8d730f721e34b83173f0f3dc99ab6784",
+		"gone.jpg": "9b5835aa4bf4492532632c83f96184fd89bd545aa9b2caa369bea2dedc50ac07",
+	})
+
+	for name, deleted := range map[string]bool{"gone.jpg": true, "keep.jpg": false} {
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Sys().(*vfs.Node).Deleted != deleted {
+			t.Errorf("%s: deleted = %v", name, !deleted)
+		}
+	}
+}
+
+// FuzzOpen checks that a damaged image either fails to open or opens into a file system whose
+// files can be read, without a panic or an allocation of the sizes it declares.
+func FuzzOpen(f *testing.F) {
+	for _, name := range []string{"ext2.img.gz", "ext4.img.gz"} {
+		gz, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(gz))
+		if err != nil {
+			f.Fatal(err)
+		}
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fsys, err := Open(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if file, err := fsys.Open(name); err == nil {
+				io.CopyN(io.Discard, file, 1<<16)
+				file.Close()
+			}
+			return nil
+		})
+	})
+}
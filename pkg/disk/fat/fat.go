@@ -0,0 +1,423 @@
+// Package fat reads FAT12, FAT16 and FAT32 file systems, including the deleted entries whose
+// clusters were not reused.
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/tsmweb/chasam/pkg/disk/vfs"
+)
+
+var ErrNotFAT = errors.New("fat: not a FAT file system")
+
+const (
+	attrReadOnly  = 0x01
+	attrHidden    = 0x02
+	attrSystem    = 0x04
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrLongName  = attrReadOnly | attrHidden | attrSystem | attrVolumeID
+
+	entrySize   = 32
+	deletedMark = 0xe5
+
+	maxDirSize = 65536 * entrySize
+)
+
+type volume struct {
+	r           io.ReaderAt
+	bits        int // 12, 16 or 32
+	clusterSize int64
+	dataOffset  int64
+	clusters    uint32 // number of data clusters
+	fat         []byte
+
+	rootOffset  int64 // FAT12/16 fixed root directory
+	rootSize    int64
+	rootCluster uint32 // FAT32
+
+	visited map[uint32]bool
+}
+
+// Detect reports whether the boot sector holds a FAT BIOS parameter block.
+func Detect(boot []byte) bool {
+	if len(boot) < 512 || boot[510] != 0x55 || boot[511] != 0xaa {
+		return false
+	}
+	if string(boot[82:87]) == "FAT32" || string(boot[54:59]) == "FAT12" || string(boot[54:59]) == "FAT16" {
+		return true
+	}
+	_, err := parseBoot(boot)
+	return err == nil && (boot[0] == 0xeb || boot[0] == 0xe9)
+}
+
+type bootSector struct {
+	bytesPerSector    int64
+	sectorsPerCluster int64
+	reservedSectors   int64
+	numFATs           int64
+	rootEntries       int64
+	totalSectors      int64
+	fatSectors        int64
+	rootCluster       uint32
+}
+
+func parseBoot(b []byte) (*bootSector, error) {
+	bs := &bootSector{
+		bytesPerSector:    int64(binary.LittleEndian.Uint16(b[11:])),
+		sectorsPerCluster: int64(b[13]),
+		reservedSectors:   int64(binary.LittleEndian.Uint16(b[14:])),
+		numFATs:           int64(b[16]),
+		rootEntries:       int64(binary.LittleEndian.Uint16(b[17:])),
+		totalSectors:      int64(binary.LittleEndian.Uint16(b[19:])),
+		fatSectors:        int64(binary.LittleEndian.Uint16(b[22:])),
+	}
+	if bs.totalSectors == 0 {
+		bs.totalSectors = int64(binary.LittleEndian.Uint32(b[32:]))
+	}
+	if bs.fatSectors == 0 {
+		bs.fatSectors = int64(binary.LittleEndian.Uint32(b[36:]))
+		bs.rootCluster = binary.LittleEndian.Uint32(b[44:])
+	}
+
+	switch bs.bytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, ErrNotFAT
+	}
+	if bs.sectorsPerCluster == 0 || bs.sectorsPerCluster&(bs.sectorsPerCluster-1) != 0 ||
+		bs.reservedSectors == 0 || bs.numFATs == 0 || bs.fatSectors == 0 || bs.totalSectors == 0 {
+		return nil, ErrNotFAT
+	}
+	return bs, nil
+}
+
+// Open reads the FAT file system stored in r.
+func Open(r io.ReaderAt) (*vfs.FS, error) {
+	boot := make([]byte, 512)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	bs, err := parseBoot(boot)
+	if err != nil {
+		return nil, err
+	}
+
+	rootSectors := (bs.rootEntries*entrySize + bs.bytesPerSector - 1) / bs.bytesPerSector
+	firstDataSector := bs.reservedSectors + bs.numFATs*bs.fatSectors + rootSectors
+	if firstDataSector >= bs.totalSectors {
+		return nil, ErrNotFAT
+	}
+
+	v := &volume{
+		r:           r,
+		clusterSize: bs.sectorsPerCluster * bs.bytesPerSector,
+		dataOffset:  firstDataSector * bs.bytesPerSector,
+		clusters:    uint32((bs.totalSectors - firstDataSector) / bs.sectorsPerCluster),
+		rootOffset:  (bs.reservedSectors + bs.numFATs*bs.fatSectors) * bs.bytesPerSector,
+		rootSize:    rootSectors * bs.bytesPerSector,
+		rootCluster: bs.rootCluster,
+		visited:     make(map[uint32]bool),
+	}
+
+	switch {
+	case v.clusters < 4085:
+		v.bits = 12
+	case v.clusters < 65525:
+		v.bits = 16
+	default:
+		v.bits = 32
+	}
+	if (v.bits == 32) != (bs.rootEntries == 0) {
+		return nil, ErrNotFAT
+	}
+
+	// the clusters past the end of the image cannot be read, so they are left out, and only the
+	// part of the FAT that maps the remaining clusters is read.
+	size := vfs.Size(r)
+	if n := (size - v.dataOffset) / v.clusterSize; int64(v.clusters) > n {
+		if n < 0 {
+			n = 0
+		}
+		v.clusters = uint32(n)
+	}
+	fatSize := bs.fatSectors * bs.bytesPerSector
+	if n := (int64(v.clusters)+2)*int64(v.bits)/8 + 1; fatSize > n {
+		fatSize = n
+	}
+	v.fat = make([]byte, fatSize)
+	if _, err = r.ReadAt(v.fat, bs.reservedSectors*bs.bytesPerSector); err != nil {
+		return nil, err
+	}
+
+	root := vfs.NewDir(".", time.Time{}, false)
+	if v.bits == 32 {
+		v.readDir(root, v.chain(v.rootCluster), false)
+	} else {
+		v.readDir(root, vfs.Contiguous(v.rootOffset, v.rootSize), false)
+	}
+
+	return vfs.New(root), nil
+}
+
+// next returns the FAT entry of cluster.
+func (v *volume) next(cluster uint32) uint32 {
+	switch v.bits {
+	case 12:
+		off := int(cluster + cluster/2)
+		if off+1 >= len(v.fat) {
+			return 0
+		}
+		e := uint32(binary.LittleEndian.Uint16(v.fat[off:]))
+		if cluster&1 == 1 {
+			return e >> 4
+		}
+		return e & 0xfff
+	case 16:
+		off := int(cluster) * 2
+		if off+1 >= len(v.fat) {
+			return 0
+		}
+		return uint32(binary.LittleEndian.Uint16(v.fat[off:]))
+	default:
+		off := int(cluster) * 4
+		if off+3 >= len(v.fat) {
+			return 0
+		}
+		return binary.LittleEndian.Uint32(v.fat[off:]) & 0x0fffffff
+	}
+}
+
+func (v *volume) valid(cluster uint32) bool {
+	return cluster >= 2 && int64(cluster) < int64(v.clusters)+2
+}
+
+func (v *volume) clusterOffset(cluster uint32) int64 {
+	return v.dataOffset + int64(cluster-2)*v.clusterSize
+}
+
+// chain returns the runs of the cluster chain starting at cluster, stopping at a loop.
+func (v *volume) chain(cluster uint32) []vfs.Run {
+	var runs []vfs.Run
+	var logical int64
+
+	for n := int64(0); v.valid(cluster) && n <= int64(v.clusters); n++ {
+		if last := len(runs) - 1; last >= 0 && runs[last].Physical+runs[last].Length == v.clusterOffset(cluster) {
+			runs[last].Length += v.clusterSize
+		} else {
+			runs = append(runs, vfs.Run{Logical: logical, Physical: v.clusterOffset(cluster), Length: v.clusterSize})
+		}
+		logical += v.clusterSize
+		cluster = v.next(cluster)
+	}
+	return runs
+}
+
+// freeRun returns the run of count clusters from cluster, if all of them are free, which is how
+// the content of a deleted entry is recovered: its chain was cleared, so the file is assumed to
+// be contiguous.
+func (v *volume) freeRun(cluster uint32, count int64) ([]vfs.Run, bool) {
+	if count == 0 {
+		return nil, true
+	}
+	if !v.valid(cluster) || count > int64(v.clusters)-(int64(cluster)-2) {
+		return nil, false
+	}
+	for c := cluster; c < cluster+uint32(count); c++ {
+		if v.next(c) != 0 {
+			return nil, false
+		}
+	}
+	return vfs.Contiguous(v.clusterOffset(cluster), count*v.clusterSize), true
+}
+
+// readDir adds the entries of the directory stored in runs to dir, up to the largest size of a
+// FAT directory.
+func (v *volume) readDir(dir *vfs.Node, runs []vfs.Run, deleted bool) {
+	var size int64
+	for _, run := range runs {
+		size += run.Length
+	}
+	if size > maxDirSize {
+		size = maxDirSize
+	}
+	data := make([]byte, size)
+	if n, _ := vfs.NewRunReader(v.r, runs, size).ReadAt(data, 0); int64(n) < size {
+		data = data[:n-n%entrySize]
+	}
+
+	var lfn longName
+
+	for off := 0; off+entrySize <= len(data); off += entrySize {
+		e := data[off : off+entrySize]
+		if e[0] == 0 {
+			break
+		}
+
+		erased := e[0] == deletedMark
+		attr := e[11]
+
+		if attr&0x3f == attrLongName {
+			lfn.add(e, erased)
+			continue
+		}
+		name, ok := lfn.name(e, erased)
+		lfn = longName{}
+
+		if attr&attrVolumeID != 0 || e[0] == '.' {
+			continue
+		}
+		if !ok {
+			name = shortName(e)
+		}
+
+		entryDeleted := deleted || erased
+		cluster := uint32(binary.LittleEndian.Uint16(e[26:]))
+		if v.bits == 32 {
+			cluster |= uint32(binary.LittleEndian.Uint16(e[20:])) << 16
+		}
+		modTime := dosTime(binary.LittleEndian.Uint16(e[24:]), binary.LittleEndian.Uint16(e[22:]))
+
+		if attr&attrDirectory != 0 {
+			if !v.valid(cluster) || v.visited[cluster] {
+				continue
+			}
+			v.visited[cluster] = true
+
+			sub := vfs.NewDir(name, modTime, entryDeleted)
+			if entryDeleted {
+				// only the first cluster of a deleted directory can be located.
+				runs, ok := v.freeRun(cluster, 1)
+				if !ok {
+					continue
+				}
+				v.readDir(sub, runs, true)
+			} else {
+				v.readDir(sub, v.chain(cluster), false)
+			}
+			dir.Add(sub)
+			continue
+		}
+
+		size := int64(binary.LittleEndian.Uint32(e[28:]))
+		var fileRuns []vfs.Run
+		if entryDeleted {
+			var ok bool
+			if fileRuns, ok = v.freeRun(cluster, (size+v.clusterSize-1)/v.clusterSize); !ok {
+				continue
+			}
+		} else if size > 0 {
+			fileRuns = v.chain(cluster)
+		}
+
+		dir.Add(vfs.NewFile(name, size, modTime, entryDeleted, vfs.NewRunReader(v.r, fileRuns, size)))
+	}
+}
+
+// longName collects the long file name entries that precede a short entry. They are stored
+// from the last part to the first.
+type longName struct {
+	parts    [][]uint16
+	checksum byte
+	erased   bool
+}
+
+func (l *longName) add(e []byte, erased bool) {
+	if len(l.parts) > 0 && (e[13] != l.checksum || erased != l.erased) {
+		l.parts = nil
+	}
+	if !erased && e[0]&0x40 != 0 {
+		l.parts = nil
+	}
+
+	part := make([]uint16, 0, 13)
+	for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+		for i := r[0]; i < r[1]; i += 2 {
+			part = append(part, binary.LittleEndian.Uint16(e[i:]))
+		}
+	}
+	l.parts = append(l.parts, part)
+	l.checksum = e[13]
+	l.erased = erased
+}
+
+// name returns the long name of the short entry e, if its checksum matches. The first byte of
+// an erased short name is lost, so it is taken from the long name.
+func (l *longName) name(e []byte, erased bool) (string, bool) {
+	if len(l.parts) == 0 || l.erased != erased {
+		return "", false
+	}
+
+	var chars []uint16
+	for i := len(l.parts) - 1; i >= 0; i-- {
+		chars = append(chars, l.parts[i]...)
+	}
+	for i, c := range chars {
+		if c == 0 {
+			chars = chars[:i]
+			break
+		}
+	}
+	name := string(utf16.Decode(chars))
+	name = strings.TrimRight(name, "￿")
+	if name == "" {
+		return "", false
+	}
+
+	short := append([]byte(nil), e[:11]...)
+	if erased {
+		short[0] = strings.ToUpper(name)[0]
+	}
+	if shortChecksum(short) != l.checksum {
+		return "", false
+	}
+	return name, true
+}
+
+func shortChecksum(name []byte) byte {
+	var sum byte
+	for _, c := range name[:11] {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// shortName formats an 8.3 name, applying the lower case flags set by Windows NT. The first
+// character of an erased name is replaced by an underscore.
+func shortName(e []byte) string {
+	base := strings.TrimRight(string(e[0:8]), " ")
+	ext := strings.TrimRight(string(e[8:11]), " ")
+
+	switch {
+	case e[0] == deletedMark:
+		base = "_" + base[1:]
+	case e[0] == 0x05:
+		base = "\xe5" + base[1:]
+	}
+	if e[12]&0x08 != 0 {
+		base = strings.ToLower(base)
+	}
+	if e[12]&0x10 != 0 {
+		ext = strings.ToLower(ext)
+	}
+
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// dosTime converts a FAT date and time, which are in local time, as if they were UTC.
+func dosTime(date, tm uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(
+		1980+int(date>>9), time.Month(date>>5&0x0f), int(date&0x1f),
+		int(tm>>11), int(tm>>5&0x3f), int(tm&0x1f)*2, 0, time.UTC)
+}
@@ -0,0 +1,231 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"unicode/utf16"
+
+	"github.com/tsmweb/chasam/pkg/disk/vfs"
+)
+
+// image builds a FAT16 file system of 512-byte sectors and clusters.
+type image struct {
+	data []byte
+}
+
+const (
+	testSectors     = 8192
+	testFATSectors  = 32
+	testRootEntries = 512
+	testRootOffset  = (1 + 2*testFATSectors) * 512
+	testDataOffset  = testRootOffset + testRootEntries*entrySize
+)
+
+func newImage() *image {
+	img := &image{data: make([]byte, testSectors*512)}
+	b := img.data
+	b[0], b[1], b[2] = 0xeb, 0x3c, 0x90
+	copy(b[3:], "MSDOS5.0")
+	binary.LittleEndian.PutUint16(b[11:], 512)
+	b[13] = 1
+	binary.LittleEndian.PutUint16(b[14:], 1)
+	b[16] = 2
+	binary.LittleEndian.PutUint16(b[17:], testRootEntries)
+	binary.LittleEndian.PutUint16(b[19:], testSectors)
+	b[21] = 0xf8
+	binary.LittleEndian.PutUint16(b[22:], testFATSectors)
+	copy(b[54:], "FAT16   ")
+	b[510], b[511] = 0x55, 0xaa
+
+	img.setFAT(0, 0xfff8)
+	img.setFAT(1, 0xffff)
+	return img
+}
+
+func (img *image) setFAT(cluster, value uint16) {
+	binary.LittleEndian.PutUint16(img.data[512+int(cluster)*2:], value)
+}
+
+func (img *image) cluster(c uint16) []byte {
+	off := testDataOffset + (int(c)-2)*512
+	return img.data[off : off+512]
+}
+
+// writeFile stores data in the clusters given and chains them in the FAT.
+func (img *image) writeFile(data []byte, clusters ...uint16) {
+	for i, c := range clusters {
+		end := (i + 1) * 512
+		if end > len(data) {
+			end = len(data)
+		}
+		copy(img.cluster(c), data[i*512:end])
+		if i+1 < len(clusters) {
+			img.setFAT(c, clusters[i+1])
+		} else {
+			img.setFAT(c, 0xffff)
+		}
+	}
+}
+
+// entries returns the directory entries of a long name followed by its short entry.
+func entries(long string, short string, attr byte, cluster uint16, size uint32, deleted bool) []byte {
+	var se [entrySize]byte
+	copy(se[:], "           ")
+	base, ext, _ := strings.Cut(short, ".")
+	copy(se[0:8], base)
+	copy(se[8:11], ext)
+	se[11] = attr
+	binary.LittleEndian.PutUint16(se[24:], 0x5a21) // 2025-01-01
+	binary.LittleEndian.PutUint16(se[26:], cluster)
+	binary.LittleEndian.PutUint32(se[28:], size)
+	sum := shortChecksum(se[:])
+	if deleted {
+		se[0] = deletedMark
+	}
+
+	var out []byte
+	if long != "" {
+		chars := utf16.Encode([]rune(long))
+		chars = append(chars, 0)
+		for len(chars)%13 != 0 {
+			chars = append(chars, 0xffff)
+		}
+		parts := len(chars) / 13
+		for p := parts; p >= 1; p-- {
+			var le [entrySize]byte
+			le[0] = byte(p)
+			if p == parts {
+				le[0] |= 0x40
+			}
+			if deleted {
+				le[0] = deletedMark
+			}
+			le[11] = attrLongName
+			le[13] = sum
+			part := chars[(p-1)*13 : p*13]
+			i := 0
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for off := r[0]; off < r[1]; off += 2 {
+					binary.LittleEndian.PutUint16(le[off:], part[i])
+					i++
+				}
+			}
+			out = append(out, le[:]...)
+		}
+	}
+	return append(out, se[:]...)
+}
+
+func buildImage(t testing.TB) (*image, map[string][]byte) {
+	t.Helper()
+
+	img := newImage()
+	files := map[string][]byte{
+		"Photo of the beach.jpg": bytes.Repeat([]byte("beach"), 300), // 3 clusters
+		"README.TXT":             []byte("hello"),
+		"Sub/nested.bin":         bytes.Repeat([]byte{7}, 700),
+		"recovered.jpg":          bytes.Repeat([]byte("gone"), 200),
+	}
+
+	img.writeFile(files["Photo of the beach.jpg"], 2, 3, 9) // fragmented
+	img.writeFile(files["README.TXT"], 4)
+	img.writeFile(nil, 5) // Sub
+	img.writeFile(files["Sub/nested.bin"], 6, 7)
+
+	// the deleted file keeps its clusters 20-21, which are free.
+	copy(img.cluster(20), files["recovered.jpg"])
+	copy(img.cluster(21), files["recovered.jpg"][512:])
+
+	var root []byte
+	root = append(root, entries("", "VOLUME", attrVolumeID, 0, 0, false)...)
+	root = append(root, entries("Photo of the beach.jpg", "PHOTOO~1.JPG", 0, 2, uint32(len(files["Photo of the beach.jpg"])), false)...)
+	root = append(root, entries("", "README.TXT", 0, 4, 5, false)...)
+	root = append(root, entries("Sub", "SUB", attrDirectory, 5, 0, false)...)
+	root = append(root, entries("recovered.jpg", "RECOVE~1.JPG", 0, 20, uint32(len(files["recovered.jpg"])), true)...)
+	// the cluster of this deleted file was reused by README.TXT.
+	root = append(root, entries("", "LOST.JPG", 0, 4, 100, true)...)
+	copy(img.data[testRootOffset:], root)
+
+	sub := entries("", ".", attrDirectory, 5, 0, false)
+	sub = append(sub, entries("", "..", attrDirectory, 0, 0, false)...)
+	sub = append(sub, entries("nested.bin", "NESTED.BIN", 0, 6, 700, false)...)
+	copy(img.cluster(5), sub)
+
+	return img, files
+}
+
+func TestOpen(t *testing.T) {
+	img, files := buildImage(t)
+
+	fsys, err := Open(bytes.NewReader(img.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fstest.TestFS(fsys, "Photo of the beach.jpg", "README.TXT", "Sub/nested.bin", "recovered.jpg"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range files {
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: content mismatch", name)
+		}
+	}
+
+	info, err := fs.Stat(fsys, "recovered.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Sys().(*vfs.Node).Deleted {
+		t.Error("recovered.jpg: want deleted")
+	}
+	if info.ModTime().Year() != 2025 {
+		t.Errorf("recovered.jpg: mod time %v", info.ModTime())
+	}
+
+	if _, err = fs.Stat(fsys, "_OST.JPG"); err == nil {
+		t.Error("_OST.JPG: the clusters of the deleted file were reused")
+	}
+}
+
+func TestDetect(t *testing.T) {
+	img, _ := buildImage(t)
+	if !Detect(img.data[:512]) {
+		t.Error("Detect: want true")
+	}
+	if Detect(make([]byte, 512)) {
+		t.Error("Detect: want false")
+	}
+}
+
+// FuzzOpen checks that a damaged image either fails to open or opens into a file system whose
+// files can be read, without a panic or an allocation of the sizes it declares.
+func FuzzOpen(f *testing.F) {
+	img, _ := buildImage(f)
+	f.Add(img.data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fsys, err := Open(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if file, err := fsys.Open(name); err == nil {
+				io.CopyN(io.Discard, file, 1<<16)
+				file.Close()
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,509 @@
+// Package ntfs reads NTFS file systems by scanning the master file table, which also finds the
+// deleted records whose clusters were not reused.
+package ntfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+	"unicode/utf16"
+
+	"github.com/tsmweb/chasam/pkg/disk/vfs"
+)
+
+var (
+	ErrNotNTFS     = errors.New("ntfs: not an NTFS file system")
+	ErrUnsupported = errors.New("ntfs: compressed or encrypted data is not supported")
+)
+
+// OrphanDir holds the records whose parent directory cannot be found.
+const OrphanDir = "$OrphanFiles"
+
+const (
+	attrStandardInfo = 0x10
+	attrFileName     = 0x30
+	attrData         = 0x80
+	attrEnd          = 0xffffffff
+
+	flagCompressed = 0x0001
+	flagEncrypted  = 0x4000
+
+	recordInUse     = 0x01
+	recordDirectory = 0x02
+
+	namespaceDOS = 2
+
+	recordRoot   = 5
+	recordBitmap = 6
+	recordExtend = 11
+	firstUser    = 16
+)
+
+// Detect reports whether boot is the boot sector of an NTFS volume.
+func Detect(boot []byte) bool {
+	return len(boot) >= 512 && string(boot[3:11]) == "NTFS    "
+}
+
+type volume struct {
+	r           io.ReaderAt
+	size        int64 // of the image
+	clusterSize int64
+	recordSize  int64
+	bitmap      []byte
+}
+
+// record holds the attributes of an MFT record, merged with the ones of its extension records.
+type record struct {
+	flags     uint16
+	seq       uint16
+	name      string
+	parent    uint64
+	parentSeq uint16
+	dosName   bool
+	modTime   time.Time
+
+	hasData  bool
+	resident []byte
+	runs     []vfs.Run
+	size     int64
+	valid    int64
+	dataFlag uint16
+}
+
+func (rec *record) deleted() bool { return rec.flags&recordInUse == 0 }
+func (rec *record) dir() bool     { return rec.flags&recordDirectory != 0 }
+
+// Open reads the NTFS file system stored in r.
+func Open(r io.ReaderAt) (*vfs.FS, error) {
+	boot := make([]byte, 512)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	if !Detect(boot) {
+		return nil, ErrNotNTFS
+	}
+
+	sectorSize := int64(binary.LittleEndian.Uint16(boot[11:]))
+	spc := int64(boot[13])
+	if spc > 0x80 {
+		spc = 1 << (256 - spc)
+	}
+	if sectorSize < 256 || sectorSize > 4096 || spc == 0 {
+		return nil, ErrNotNTFS
+	}
+
+	v := &volume{r: r, size: vfs.Size(r), clusterSize: sectorSize * spc}
+	if c := int8(boot[64]); c > 0 {
+		v.recordSize = int64(c) * v.clusterSize
+	} else if c > -31 {
+		v.recordSize = 1 << uint(-c)
+	}
+	if v.recordSize < 512 || v.recordSize > 1<<16 {
+		return nil, ErrNotNTFS
+	}
+
+	// the MFT is described by its own first record.
+	mftCluster := binary.LittleEndian.Uint64(boot[48:])
+	if mftCluster >= uint64(v.size/v.clusterSize) {
+		return nil, ErrNotNTFS
+	}
+	mftOffset := int64(mftCluster) * v.clusterSize
+	buf := make([]byte, v.recordSize)
+	if _, err := r.ReadAt(buf, mftOffset); err != nil {
+		return nil, err
+	}
+	mft := &record{}
+	if err := v.parseRecord(buf, mft); err != nil {
+		return nil, fmt.Errorf("ntfs: $MFT: %v", err)
+	}
+	if !mft.hasData || mft.resident != nil {
+		return nil, ErrNotNTFS
+	}
+
+	// the records past the runs of the MFT would be read as zeros, so a damaged size is bounded
+	// by the length of the runs, which are inside the image.
+	count := mft.size
+	if n := mappedLength(mft.runs); count > n {
+		count = n
+	}
+	records, err := v.readMFT(vfs.NewRunReader(r, mft.runs, mft.size), count/v.recordSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// the bitmap holds a bit for each cluster of the volume, which is inside the image.
+	if bm := records[recordBitmap]; bm != nil && bm.hasData && bm.size > 0 {
+		size := bm.size
+		if n := (v.size/v.clusterSize + 7) / 8; size > n {
+			size = n
+		}
+		v.bitmap = make([]byte, size)
+		if _, err = v.reader(bm).ReadAt(v.bitmap, 0); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("ntfs: $Bitmap: %v", err)
+		}
+	}
+
+	return vfs.New(v.tree(records)), nil
+}
+
+// mappedLength returns the logical end of the last run of runs that is not sparse.
+func mappedLength(runs []vfs.Run) int64 {
+	var n int64
+	for _, run := range runs {
+		if end := run.Logical + run.Length; !run.Sparse && end > n {
+			n = end
+		}
+	}
+	return n
+}
+
+// readMFT parses count records, merging the extension records into their base records.
+func (v *volume) readMFT(r io.ReaderAt, count int64) (map[uint64]*record, error) {
+	records := make(map[uint64]*record)
+	buf := make([]byte, v.recordSize)
+
+	for i := int64(0); i < count; i++ {
+		if _, err := r.ReadAt(buf, i*v.recordSize); err != nil {
+			return nil, fmt.Errorf("ntfs: MFT record %d: %v", i, err)
+		}
+		if string(buf[:4]) != "FILE" {
+			continue
+		}
+
+		num := uint64(i)
+		if base := binary.LittleEndian.Uint64(buf[32:]) & 0xffffffffffff; base != 0 {
+			num = base
+		}
+		rec := records[num]
+		if rec == nil {
+			rec = &record{}
+			records[num] = rec
+		}
+		if num == uint64(i) {
+			rec.flags = binary.LittleEndian.Uint16(buf[22:])
+			rec.seq = binary.LittleEndian.Uint16(buf[16:])
+		}
+		// a damaged record is left out, as the scan goes on.
+		_ = v.parseRecord(buf, rec)
+	}
+
+	return records, nil
+}
+
+// parseRecord applies the update sequence fixups of buf and adds its attributes to rec.
+func (v *volume) parseRecord(buf []byte, rec *record) error {
+	if string(buf[:4]) != "FILE" {
+		return errors.New("bad record signature")
+	}
+
+	usaOffset := int(binary.LittleEndian.Uint16(buf[4:]))
+	usaCount := int(binary.LittleEndian.Uint16(buf[6:]))
+	if usaCount == 0 || usaOffset+usaCount*2 > len(buf) || (usaCount-1)*512 > len(buf) {
+		return errors.New("bad update sequence")
+	}
+	usn := buf[usaOffset : usaOffset+2]
+	for i := 1; i < usaCount; i++ {
+		end := i*512 - 2
+		if !bytes.Equal(buf[end:end+2], usn) {
+			return errors.New("torn record")
+		}
+		copy(buf[end:end+2], buf[usaOffset+i*2:usaOffset+i*2+2])
+	}
+
+	for off := int(binary.LittleEndian.Uint16(buf[20:])); off+16 <= len(buf); {
+		typ := binary.LittleEndian.Uint32(buf[off:])
+		length := int(binary.LittleEndian.Uint32(buf[off+4:]))
+		if typ == attrEnd || length < 16 || off+length > len(buf) {
+			break
+		}
+		v.parseAttribute(buf[off:off+length], typ, rec)
+		off += length
+	}
+	return nil
+}
+
+func (v *volume) parseAttribute(a []byte, typ uint32, rec *record) {
+	nonResident := a[8] != 0
+	nameLength := a[9]
+	flags := binary.LittleEndian.Uint16(a[12:])
+
+	var value []byte
+	if !nonResident {
+		if len(a) < 24 {
+			return
+		}
+		length := int(binary.LittleEndian.Uint32(a[16:]))
+		offset := int(binary.LittleEndian.Uint16(a[20:]))
+		if offset+length > len(a) {
+			return
+		}
+		value = a[offset : offset+length]
+	} else if len(a) < 64 {
+		return
+	}
+
+	switch typ {
+	case attrStandardInfo:
+		if len(value) >= 16 {
+			rec.modTime = fileTime(binary.LittleEndian.Uint64(value[8:]))
+		}
+
+	case attrFileName:
+		if len(value) < 66 || len(value) < 66+int(value[64])*2 {
+			return
+		}
+		dos := value[65] == namespaceDOS
+		if rec.name != "" && (dos || !rec.dosName) {
+			return
+		}
+		chars := make([]uint16, value[64])
+		for i := range chars {
+			chars[i] = binary.LittleEndian.Uint16(value[66+i*2:])
+		}
+		ref := binary.LittleEndian.Uint64(value)
+		rec.name = string(utf16.Decode(chars))
+		rec.parent = ref & 0xffffffffffff
+		rec.parentSeq = uint16(ref >> 48)
+		rec.dosName = dos
+
+	case attrData:
+		if nameLength != 0 {
+			return
+		}
+		rec.hasData = true
+		rec.dataFlag |= flags
+		if !nonResident {
+			rec.resident = append([]byte(nil), value...)
+			rec.size = int64(len(value))
+			rec.valid = rec.size
+			return
+		}
+
+		startVCN := int64(binary.LittleEndian.Uint64(a[16:]))
+		if startVCN < 0 || startVCN > math.MaxInt64/v.clusterSize {
+			return
+		}
+		if startVCN == 0 {
+			rec.size = int64(binary.LittleEndian.Uint64(a[48:]))
+			rec.valid = int64(binary.LittleEndian.Uint64(a[56:]))
+		}
+		runs := int(binary.LittleEndian.Uint16(a[32:]))
+		if runs < len(a) {
+			rec.runs = append(rec.runs, v.decodeRuns(a[runs:], startVCN)...)
+		}
+	}
+}
+
+// decodeRuns decodes a run list whose first cluster is startVCN. The list stops at a run that
+// is not inside the image or whose offsets would overflow.
+func (v *volume) decodeRuns(b []byte, startVCN int64) []vfs.Run {
+	maxVCN := math.MaxInt64 / v.clusterSize
+	clusters := v.size / v.clusterSize
+
+	var runs []vfs.Run
+	vcn := startVCN
+	var lcn int64
+
+	for i := 0; i < len(b) && b[i] != 0; {
+		lengthSize := int(b[i] & 0x0f)
+		offsetSize := int(b[i] >> 4)
+		i++
+		if lengthSize == 0 || lengthSize > 8 || offsetSize > 8 || i+lengthSize+offsetSize > len(b) {
+			break
+		}
+
+		length := int64(readUint(b[i : i+lengthSize]))
+		i += lengthSize
+		if length <= 0 || length > maxVCN-vcn {
+			break
+		}
+
+		run := vfs.Run{Logical: vcn * v.clusterSize, Length: length * v.clusterSize}
+		if offsetSize == 0 {
+			run.Sparse = true
+		} else {
+			delta := readInt(b[i : i+offsetSize])
+			i += offsetSize
+			if delta < -lcn || delta > clusters-lcn {
+				break
+			}
+			lcn += delta
+			run.Physical = lcn * v.clusterSize
+		}
+		if !run.Sparse && (lcn < 0 || lcn > clusters || length > clusters-lcn) {
+			break
+		}
+
+		runs = append(runs, run)
+		vcn += length
+	}
+	return runs
+}
+
+func readUint(b []byte) uint64 {
+	var n uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		n = n<<8 | uint64(b[i])
+	}
+	return n
+}
+
+func readInt(b []byte) int64 {
+	n := int64(readUint(b))
+	shift := uint(64 - 8*len(b))
+	return n << shift >> shift
+}
+
+// reader returns the content of the unnamed data attribute of rec. The bytes past the
+// initialized size were never written and read as zeros.
+func (v *volume) reader(rec *record) io.ReaderAt {
+	if rec.dataFlag&(flagCompressed|flagEncrypted) != 0 {
+		return errReader{ErrUnsupported}
+	}
+	if rec.resident != nil {
+		return bytes.NewReader(rec.resident)
+	}
+
+	valid := rec.valid
+	if valid < 0 || valid > rec.size {
+		valid = rec.size
+	}
+	runs := make([]vfs.Run, 0, len(rec.runs))
+	for _, run := range rec.runs {
+		if end := run.Logical + run.Length; end > valid {
+			run.Length -= end - valid
+		}
+		if run.Length > 0 {
+			runs = append(runs, run)
+		}
+	}
+	return vfs.NewRunReader(v.r, runs, rec.size)
+}
+
+// free reports whether the clusters of rec are unallocated, so that the data of a deleted
+// record is still intact.
+func (v *volume) free(rec *record) bool {
+	if rec.resident != nil {
+		return true
+	}
+	if v.bitmap == nil {
+		return false
+	}
+	for _, run := range rec.runs {
+		if run.Sparse {
+			continue
+		}
+		for c := run.Physical / v.clusterSize; c < (run.Physical+run.Length)/v.clusterSize; c++ {
+			if c/8 >= int64(len(v.bitmap)) || v.bitmap[c/8]&(1<<(c%8)) != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// tree builds the directory tree of the records with a name.
+func (v *volume) tree(records map[uint64]*record) *vfs.Node {
+	root := vfs.NewDir(".", time.Time{}, false)
+	if rec := records[recordRoot]; rec != nil {
+		root = vfs.NewDir(".", rec.modTime, false)
+	}
+
+	t := &treeBuilder{
+		v:       v,
+		records: records,
+		nodes:   map[uint64]*vfs.Node{recordRoot: root},
+		state:   map[uint64]int{recordRoot: placed},
+		root:    root,
+	}
+	for num, rec := range records {
+		if num < firstUser || rec.name == "" || rec.parent == recordExtend {
+			continue
+		}
+		if rec.size < 0 || (rec.deleted() && !rec.dir() && rec.hasData && !v.free(rec)) {
+			continue
+		}
+
+		if rec.dir() {
+			t.nodes[num] = vfs.NewDir(rec.name, rec.modTime, rec.deleted())
+		} else {
+			t.nodes[num] = vfs.NewFile(rec.name, rec.size, rec.modTime, rec.deleted(), v.reader(rec))
+		}
+	}
+
+	for num := range t.nodes {
+		t.place(num)
+	}
+	return root
+}
+
+const (
+	unplaced = iota
+	visiting
+	placed
+)
+
+type treeBuilder struct {
+	v       *volume
+	records map[uint64]*record
+	nodes   map[uint64]*vfs.Node
+	state   map[uint64]int
+	root    *vfs.Node
+	orphans *vfs.Node
+}
+
+// place adds the node of num to its parent, placing the parent first. The nodes whose parent is
+// missing, was reused or is part of a loop go to the orphan directory.
+func (t *treeBuilder) place(num uint64) bool {
+	switch t.state[num] {
+	case placed:
+		return true
+	case visiting:
+		return false
+	}
+	t.state[num] = visiting
+
+	rec := t.records[num]
+	parent := t.nodes[rec.parent]
+	if prec := t.records[rec.parent]; parent == nil || prec == nil || !prec.dir() ||
+		!sameSeq(prec, rec.parentSeq) || (rec.parent != recordRoot && !t.place(rec.parent)) {
+		parent = t.orphanDir()
+	}
+
+	parent.Add(t.nodes[num])
+	t.state[num] = placed
+	return true
+}
+
+// sameSeq reports whether seq refers to the current use of prec. The sequence number of a
+// record is incremented when it is deleted.
+func sameSeq(prec *record, seq uint16) bool {
+	return seq == 0 || prec.seq == seq || (prec.deleted() && prec.seq == seq+1)
+}
+
+func (t *treeBuilder) orphanDir() *vfs.Node {
+	if t.orphans == nil {
+		t.orphans = vfs.NewDir(OrphanDir, time.Time{}, false)
+		t.root.Add(t.orphans)
+	}
+	return t.orphans
+}
+
+// fileTime converts the number of 100-nanosecond intervals since 1601.
+func fileTime(ft uint64) time.Time {
+	if ft == 0 {
+		return time.Time{}
+	}
+	const epochDelta = 116444736000000000 // 1601 to 1970
+	return time.Unix(0, (int64(ft)-epochDelta)*100).UTC()
+}
+
+type errReader struct {
+	err error
+}
+
+func (e errReader) ReadAt([]byte, int64) (int, error) { return 0, e.err }
@@ -0,0 +1,326 @@
+package ntfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf16"
+
+	"github.com/tsmweb/chasam/pkg/disk/vfs"
+)
+
+// image builds an NTFS file system of 512-byte clusters and 1 KiB records, whose MFT of 64
+// records starts at cluster 16.
+type image struct {
+	data   []byte
+	bitmap []byte
+}
+
+const (
+	testClusters = 2000
+	testMFT      = 16
+	testRecords  = 64
+	testBitmap   = 150
+)
+
+var testTime = time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func newImage() *image {
+	img := &image{
+		data:   make([]byte, testClusters*512),
+		bitmap: make([]byte, testClusters/8),
+	}
+	b := img.data
+	b[0], b[1], b[2] = 0xeb, 0x52, 0x90
+	copy(b[3:], "NTFS    ")
+	binary.LittleEndian.PutUint16(b[11:], 512)
+	b[13] = 1
+	binary.LittleEndian.PutUint64(b[40:], testClusters-1)
+	binary.LittleEndian.PutUint64(b[48:], testMFT)
+	b[64] = 0xf6 // 1 KiB records
+	b[510], b[511] = 0x55, 0xaa
+
+	img.allocate(0, testMFT+testRecords*2)
+	img.allocate(testBitmap, 1)
+	img.record(0, 1, recordInUse, 0,
+		stdInfo(),
+		fileName(recordRoot, 5, "$MFT", 3),
+		nonResident(attrData, 0, 0, testRecords*1024, testRecords*1024, [][2]int64{{testMFT, testRecords * 2}}))
+	img.record(recordRoot, 5, recordInUse|recordDirectory, 0,
+		stdInfo(),
+		fileName(recordRoot, 5, ".", 3))
+	img.record(recordBitmap, 6, recordInUse, 0,
+		stdInfo(),
+		fileName(recordRoot, 5, "$Bitmap", 3),
+		nonResident(attrData, 0, 0, testClusters/8, testClusters/8, [][2]int64{{testBitmap, 1}}))
+	return img
+}
+
+func (img *image) allocate(cluster, count int64) {
+	for c := cluster; c < cluster+count; c++ {
+		img.bitmap[c/8] |= 1 << (c % 8)
+	}
+}
+
+func (img *image) cluster(c int64) []byte {
+	return img.data[c*512 : (c+1)*512]
+}
+
+// finish writes the cluster bitmap.
+func (img *image) finish() []byte {
+	copy(img.cluster(testBitmap), img.bitmap)
+	return img.data
+}
+
+// record writes the MFT record num, protected by an update sequence array.
+func (img *image) record(num int64, seq, flags uint16, base uint64, attrs ...[]byte) {
+	buf := img.data[testMFT*512+num*1024 : testMFT*512+(num+1)*1024]
+	copy(buf, "FILE")
+	binary.LittleEndian.PutUint16(buf[4:], 48)
+	binary.LittleEndian.PutUint16(buf[6:], 3)
+	binary.LittleEndian.PutUint16(buf[16:], seq)
+	binary.LittleEndian.PutUint16(buf[20:], 56)
+	binary.LittleEndian.PutUint16(buf[22:], flags)
+	binary.LittleEndian.PutUint64(buf[32:], base)
+
+	off := 56
+	for _, a := range attrs {
+		off += copy(buf[off:], a)
+	}
+	binary.LittleEndian.PutUint32(buf[off:], attrEnd)
+	binary.LittleEndian.PutUint32(buf[24:], uint32(off+8))
+
+	binary.LittleEndian.PutUint16(buf[48:], 1)
+	for i := 1; i <= 2; i++ {
+		end := i*512 - 2
+		copy(buf[48+i*2:], buf[end:end+2])
+		binary.LittleEndian.PutUint16(buf[end:], 1)
+	}
+}
+
+func align8(b []byte) []byte {
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func resident(typ uint32, flags uint16, value []byte) []byte {
+	a := make([]byte, 24)
+	binary.LittleEndian.PutUint32(a, typ)
+	binary.LittleEndian.PutUint16(a[12:], flags)
+	binary.LittleEndian.PutUint32(a[16:], uint32(len(value)))
+	binary.LittleEndian.PutUint16(a[20:], 24)
+	a = align8(append(a, value...))
+	binary.LittleEndian.PutUint32(a[4:], uint32(len(a)))
+	return a
+}
+
+// nonResident returns a data attribute mapped by runs of {lcn, length}; a negative lcn is a
+// sparse run.
+func nonResident(typ uint32, flags uint16, startVCN, size, valid int64, runs [][2]int64) []byte {
+	a := make([]byte, 64)
+	binary.LittleEndian.PutUint32(a, typ)
+	a[8] = 1
+	binary.LittleEndian.PutUint16(a[12:], flags)
+	binary.LittleEndian.PutUint64(a[16:], uint64(startVCN))
+	binary.LittleEndian.PutUint16(a[32:], 64)
+	binary.LittleEndian.PutUint64(a[48:], uint64(size))
+	binary.LittleEndian.PutUint64(a[56:], uint64(valid))
+
+	var lcn, vcn int64
+	for _, run := range runs {
+		if run[0] < 0 {
+			a = append(a, 0x02, byte(run[1]), byte(run[1]>>8))
+		} else {
+			delta := run[0] - lcn
+			a = append(a, 0x42, byte(run[1]), byte(run[1]>>8),
+				byte(delta), byte(delta>>8), byte(delta>>16), byte(delta>>24))
+			lcn = run[0]
+		}
+		vcn += run[1]
+	}
+	binary.LittleEndian.PutUint64(a[24:], uint64(startVCN+vcn-1))
+	binary.LittleEndian.PutUint64(a[40:], uint64(vcn*512))
+	a = align8(append(a, 0))
+	binary.LittleEndian.PutUint32(a[4:], uint32(len(a)))
+	return a
+}
+
+func stdInfo() []byte {
+	value := make([]byte, 48)
+	ft := uint64(testTime.UnixNano()/100 + 116444736000000000)
+	binary.LittleEndian.PutUint64(value[8:], ft)
+	return resident(attrStandardInfo, 0, value)
+}
+
+func fileName(parent uint64, parentSeq uint16, name string, namespace byte) []byte {
+	chars := utf16.Encode([]rune(name))
+	value := make([]byte, 66+len(chars)*2)
+	binary.LittleEndian.PutUint64(value, parent|uint64(parentSeq)<<48)
+	value[64] = byte(len(chars))
+	value[65] = namespace
+	for i, c := range chars {
+		binary.LittleEndian.PutUint16(value[66+i*2:], c)
+	}
+	return resident(attrFileName, 0, value)
+}
+
+func buildImage() ([]byte, map[string][]byte) {
+	img := newImage()
+	files := map[string][]byte{
+		"small.txt":               []byte("hello"),
+		"photo.jpg":               bytes.Repeat([]byte("jpeg"), 300),
+		"pics/in pics.png":        append(make([]byte, 512), bytes.Repeat([]byte{9}, 400)...),
+		"gone.jpg":                bytes.Repeat([]byte("gone"), 250),
+		"small (deleted).txt":     []byte("old hello"),
+		"olddir/old.gif":          []byte("GIF89a"),
+		OrphanDir + "/orphan.bmp": []byte("BM"),
+	}
+
+	img.record(recordExtend, 11, recordInUse|recordDirectory, 0, stdInfo(), fileName(recordRoot, 5, "$Extend", 3))
+	img.record(24, 1, recordInUse, 0, stdInfo(), fileName(recordExtend, 11, "$ObjId", 3), resident(attrData, 0, []byte("x")))
+
+	img.record(16, 1, recordInUse, 0, stdInfo(), fileName(recordRoot, 5, "small.txt", 3), resident(attrData, 0, files["small.txt"]))
+
+	photo := files["photo.jpg"]
+	copy(img.cluster(200), photo)
+	copy(img.cluster(201), photo[512:])
+	copy(img.cluster(300), photo[1024:])
+	img.allocate(200, 2)
+	img.allocate(300, 1)
+	img.record(17, 1, recordInUse, 0, stdInfo(),
+		fileName(recordRoot, 5, "PHOTO~1.JPG", namespaceDOS),
+		fileName(recordRoot, 5, "photo.jpg", 1),
+		nonResident(attrData, 0, 0, int64(len(photo)), int64(len(photo)), [][2]int64{{200, 2}, {300, 1}}))
+
+	img.record(18, 1, recordInUse|recordDirectory, 0, stdInfo(), fileName(recordRoot, 5, "pics", 1))
+
+	// the data of this file is in an extension record and starts with a sparse cluster.
+	copy(img.cluster(401), files["pics/in pics.png"][512:])
+	img.allocate(401, 1)
+	img.record(19, 1, recordInUse, 0, stdInfo(), fileName(18, 1, "in pics.png", 1))
+	img.record(20, 1, recordInUse, 19, nonResident(attrData, 0, 0, 912, 912, [][2]int64{{-1, 1}, {401, 1}}))
+
+	gone := files["gone.jpg"]
+	copy(img.cluster(500), gone)
+	copy(img.cluster(501), gone[512:])
+	img.record(21, 2, 0, 0, stdInfo(), fileName(recordRoot, 5, "gone.jpg", 1),
+		nonResident(attrData, 0, 0, int64(len(gone)), int64(len(gone)), [][2]int64{{500, 2}}))
+
+	// the cluster of this deleted file was reused by photo.jpg.
+	img.record(22, 2, 0, 0, stdInfo(), fileName(recordRoot, 5, "reused.jpg", 1),
+		nonResident(attrData, 0, 0, 100, 100, [][2]int64{{200, 1}}))
+
+	img.record(23, 1, recordInUse, 0, stdInfo(), fileName(40, 1, "orphan.bmp", 1), resident(attrData, 0, files[OrphanDir+"/orphan.bmp"]))
+
+	img.record(25, 8, recordDirectory, 0, stdInfo(), fileName(recordRoot, 5, "olddir", 1))
+	img.record(26, 2, 0, 0, stdInfo(), fileName(25, 7, "old.gif", 1), resident(attrData, 0, files["olddir/old.gif"]))
+
+	img.record(27, 2, 0, 0, stdInfo(), fileName(recordRoot, 5, "small.txt", 1), resident(attrData, 0, files["small (deleted).txt"]))
+
+	img.record(28, 1, recordInUse, 0, stdInfo(), fileName(recordRoot, 5, "packed.jpg", 1),
+		nonResident(attrData, flagCompressed, 0, 512, 512, [][2]int64{{600, 1}}))
+	img.allocate(600, 1)
+
+	return img.finish(), files
+}
+
+func TestOpen(t *testing.T) {
+	data, files := buildImage()
+
+	fsys, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range files {
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: content mismatch", name)
+		}
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{OrphanDir, "gone.jpg", "olddir", "packed.jpg", "photo.jpg", "pics", "small (deleted).txt", "small.txt"}
+	if len(names) != len(want) {
+		t.Fatalf("root: got %q, want %q", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("root: got %q, want %q", names, want)
+		}
+	}
+
+	for name, deleted := range map[string]bool{"gone.jpg": true, "olddir/old.gif": true, "photo.jpg": false} {
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Sys().(*vfs.Node).Deleted != deleted {
+			t.Errorf("%s: deleted = %v", name, !deleted)
+		}
+		if !info.ModTime().Equal(testTime) {
+			t.Errorf("%s: mod time %v", name, info.ModTime())
+		}
+	}
+
+	if _, err = fs.ReadFile(fsys, "packed.jpg"); err == nil {
+		t.Error("packed.jpg: want an error reading compressed data")
+	}
+}
+
+func TestFS(t *testing.T) {
+	data, _ := buildImage()
+
+	fsys, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the compressed file cannot be read by TestFS.
+	sub, err := fs.Sub(fsys, "pics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fstest.TestFS(sub, "in pics.png"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// FuzzOpen checks that a damaged image either fails to open or opens into a file system whose
+// files can be read, without a panic or an allocation of the sizes it declares.
+func FuzzOpen(f *testing.F) {
+	data, _ := buildImage()
+	f.Add(data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fsys, err := Open(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if file, err := fsys.Open(name); err == nil {
+				io.CopyN(io.Discard, file, 1<<16)
+				file.Close()
+			}
+			return nil
+		})
+	})
+}
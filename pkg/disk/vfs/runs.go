@@ -0,0 +1,185 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"sort"
+)
+
+// Run maps Length bytes of a file, starting at its offset Logical, to the offset Physical of the
+// disk image. A sparse run is read as zeros.
+type Run struct {
+	Logical  int64
+	Physical int64
+	Length   int64
+	Sparse   bool
+}
+
+// RunReader reads a file made of runs, such as the cluster chain of a FAT file, the data runs
+// of an NTFS attribute or the extents of an ext4 inode.
+type RunReader struct {
+	r    io.ReaderAt
+	runs []Run
+	size int64
+}
+
+// NewRunReader returns a reader of size bytes mapped by runs. The bytes not mapped by any run
+// are read as zeros. The runs of a damaged file system may overlap, so the bytes already mapped
+// by a previous run are cut from the next one, and the empty runs are left out.
+func NewRunReader(r io.ReaderAt, runs []Run, size int64) *RunReader {
+	sorted := make([]Run, 0, len(runs))
+	for _, run := range runs {
+		if run.Logical >= 0 && run.Length > 0 {
+			sorted = append(sorted, run)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Logical < sorted[j].Logical })
+
+	runs = sorted[:0]
+	var end int64
+	for _, run := range sorted {
+		if cut := end - run.Logical; cut > 0 {
+			if cut >= run.Length {
+				continue
+			}
+			run.Logical += cut
+			run.Physical += cut
+			run.Length -= cut
+		}
+		runs = append(runs, run)
+		end = run.Logical + run.Length
+	}
+	return &RunReader{r: r, runs: runs, size: size}
+}
+
+// Section is an io.SectionReader that keeps its offset in the reader it reads, such as the
+// offset of a partition in a disk image, so that the runs read through it can be placed in the
+// image.
+type Section struct {
+	*io.SectionReader
+	Offset int64
+}
+
+// NewSection returns a Section that reads n bytes of r from off.
+func NewSection(r io.ReaderAt, off, n int64) *Section {
+	return &Section{SectionReader: io.NewSectionReader(r, off, n), Offset: off}
+}
+
+// Contiguous returns the runs of a file stored in length bytes from the offset physical.
+func Contiguous(physical, length int64) []Run {
+	return []Run{{Physical: physical, Length: length}}
+}
+
+// Size returns the size of the disk image r, as reported by its Size method, such as the one of
+// an io.SectionReader, or else found by reading single bytes. The sizes and counts read from a
+// file system are checked against it before anything is allocated or read in a loop.
+func Size(r io.ReaderAt) int64 {
+	if s, ok := r.(interface{ Size() int64 }); ok {
+		return s.Size()
+	}
+
+	var b [1]byte
+	readable := func(off int64) bool {
+		n, _ := r.ReadAt(b[:], off)
+		return n == 1
+	}
+	lo, hi := int64(0), int64(1)
+	for readable(hi - 1) {
+		if hi > 1<<61 {
+			return hi
+		}
+		lo, hi = hi, hi*2
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if readable(mid - 1) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// imageRuns returns the runs of the file that are read from the image, placed in the reader
+// under the Section that rr reads, if any.
+func (rr *RunReader) imageRuns() []Run {
+	var base int64
+	if s, ok := rr.r.(*Section); ok {
+		base = s.Offset
+	}
+
+	var runs []Run
+	for _, run := range rr.runs {
+		if run.Sparse || run.Length <= 0 || run.Logical >= rr.size {
+			continue
+		}
+		run.Physical += base
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+func (rr *RunReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vfs: negative offset")
+	}
+	if off >= rr.size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if remaining := rr.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		err = io.EOF
+	}
+
+	// first run that ends after off.
+	i := sort.Search(len(rr.runs), func(i int) bool {
+		return rr.runs[i].Logical+rr.runs[i].Length > off
+	})
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if i >= len(rr.runs) || rr.runs[i].Logical > pos {
+			// a hole up to the next run.
+			end := int64(len(p))
+			if i < len(rr.runs) && rr.runs[i].Logical-off < end {
+				end = rr.runs[i].Logical - off
+			}
+			zero(p[n:end])
+			n = int(end)
+			continue
+		}
+
+		run := rr.runs[i]
+		chunk := p[n:]
+		if limit := run.Logical + run.Length - pos; int64(len(chunk)) > limit {
+			chunk = chunk[:limit]
+		}
+
+		if run.Sparse {
+			zero(chunk)
+		} else {
+			m, readErr := rr.r.ReadAt(chunk, run.Physical+pos-run.Logical)
+			if m < len(chunk) {
+				if readErr == nil || errors.Is(readErr, io.EOF) {
+					readErr = io.ErrUnexpectedEOF
+				}
+				return n + m, readErr
+			}
+		}
+
+		n += len(chunk)
+		i++
+	}
+
+	return n, err
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
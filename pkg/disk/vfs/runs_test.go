@@ -0,0 +1,27 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRunReaderOverlap(t *testing.T) {
+	image := bytes.NewReader([]byte("0123456789abcdefghij"))
+
+	// the runs of a damaged file system overlap, and one of them is empty or negative.
+	runs := []Run{
+		{Logical: 0, Physical: 0, Length: 8},
+		{Logical: 4, Physical: 10, Length: 2},
+		{Logical: 6, Physical: 10, Length: 6},
+		{Logical: 12, Physical: 0, Length: -4},
+	}
+	data := make([]byte, 14)
+	n, err := NewRunReader(image, runs, 14).ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if want := "01234567cdef\x00\x00"; n != 14 || string(data) != want {
+		t.Fatalf("expected %q, got %q", want, data[:n])
+	}
+}
@@ -0,0 +1,270 @@
+// Package vfs implements the read-only fs.FS shared by the file systems of pkg/disk, which build
+// a tree of nodes whose content is read from a disk image.
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Node is a file or a directory. It implements fs.FileInfo and is returned by its Sys method, so
+// that the callers can tell the deleted entries.
+type Node struct {
+	name    string
+	dir     bool
+	size    int64
+	modTime time.Time
+	data    io.ReaderAt
+
+	// Deleted is set for the entries recovered from unallocated directory entries or records.
+	Deleted bool
+
+	children []*Node
+	index    map[string]*Node
+}
+
+// NewDir returns a directory node.
+func NewDir(name string, modTime time.Time, deleted bool) *Node {
+	return &Node{
+		name:    name,
+		dir:     true,
+		modTime: modTime,
+		Deleted: deleted,
+		index:   make(map[string]*Node),
+	}
+}
+
+// NewFile returns a file node of size bytes read from data.
+func NewFile(name string, size int64, modTime time.Time, deleted bool, data io.ReaderAt) *Node {
+	return &Node{
+		name:    name,
+		size:    size,
+		modTime: modTime,
+		data:    data,
+		Deleted: deleted,
+	}
+}
+
+// Add adds child to the directory n. A deleted entry whose name is already used is renamed to
+// "name (deleted)", followed by a counter if needed, while an allocated entry replaces a
+// deleted one of the same name.
+func (n *Node) Add(child *Node) {
+	if !n.dir || child.name == "" || child.name == "." || child.name == ".." || strings.Contains(child.name, "/") {
+		return
+	}
+
+	if other, ok := n.index[child.name]; ok {
+		if !child.Deleted && other.Deleted {
+			n.rename(other)
+		} else {
+			n.rename(child)
+		}
+	}
+
+	n.children = append(n.children, child)
+	n.index[child.name] = child
+}
+
+func (n *Node) rename(child *Node) {
+	ext := path.Ext(child.name)
+	base := strings.TrimSuffix(child.name, ext)
+
+	name := fmt.Sprintf("%s (deleted)%s", base, ext)
+	for i := 2; n.index[name] != nil; i++ {
+		name = fmt.Sprintf("%s (deleted %d)%s", base, i, ext)
+	}
+
+	if n.index[child.name] == child {
+		delete(n.index, child.name)
+		n.index[name] = child
+	}
+	child.name = name
+}
+
+// Child returns the entry name of the directory n.
+func (n *Node) Child(name string) *Node {
+	return n.index[name]
+}
+
+func (n *Node) Name() string       { return n.name }
+func (n *Node) Size() int64        { return n.size }
+func (n *Node) ModTime() time.Time { return n.modTime }
+func (n *Node) IsDir() bool        { return n.dir }
+func (n *Node) Sys() any           { return n }
+
+func (n *Node) Mode() fs.FileMode {
+	if n.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// FS is a read-only file system whose files implement io.ReaderAt and io.Seeker.
+type FS struct {
+	root *Node
+}
+
+// New returns the file system whose root directory is root.
+func New(root *Node) *FS {
+	return &FS{root: root}
+}
+
+// Root returns the root directory, to which more entries can be added.
+func (f *FS) Root() *Node {
+	return f.root
+}
+
+func (f *FS) lookup(op, name string) (*Node, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	n := f.root
+	if name == "." {
+		return n, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !n.dir {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if n = n.index[elem]; n == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return n, nil
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	n, err := f.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.dir {
+		return &dir{node: n, entries: n.sortedChildren()}, nil
+	}
+	data := n.data
+	if data == nil {
+		data = eofReader{}
+	}
+	return &file{node: n, SectionReader: io.NewSectionReader(data, 0, n.size)}, nil
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := f.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	children := n.sortedChildren()
+	entries := make([]fs.DirEntry, len(children))
+	for i, c := range children {
+		entries[i] = fs.FileInfoToDirEntry(c)
+	}
+	return entries, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	return f.lookup("stat", name)
+}
+
+func (n *Node) sortedChildren() []*Node {
+	children := append([]*Node(nil), n.children...)
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+	return children
+}
+
+type file struct {
+	node *Node
+	*io.SectionReader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.node, nil }
+func (f *file) Close() error               { return nil }
+
+type dir struct {
+	node    *Node
+	entries []*Node
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.node, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.node.name, Err: errors.New("is a directory")}
+}
+
+func (d *dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	n := len(d.entries) - d.offset
+	if n == 0 && count > 0 {
+		return nil, io.EOF
+	}
+	if count > 0 && n > count {
+		n = count
+	}
+
+	entries := make([]fs.DirEntry, n)
+	for i := range entries {
+		entries[i] = fs.FileInfoToDirEntry(d.entries[d.offset+i])
+	}
+	d.offset += n
+	return entries, nil
+}
+
+type eofReader struct{}
+
+func (eofReader) ReadAt([]byte, int64) (int, error) { return 0, io.EOF }
+
+// Allocated returns the ranges of the disk image that hold the content of the files that are
+// not deleted, as runs whose Physical offset and Length are merged and sorted by offset. The
+// files read through a Section are placed by its offset, and the content that is not read from
+// runs, such as the one stored in an NTFS record, is left out.
+func (f *FS) Allocated() []Run {
+	var runs []Run
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		for _, child := range n.children {
+			if child.dir {
+				walk(child)
+			} else if rr, ok := child.data.(*RunReader); ok && !child.Deleted {
+				runs = append(runs, rr.imageRuns()...)
+			}
+		}
+	}
+	walk(f.root)
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Physical < runs[j].Physical })
+	var merged []Run
+	for _, run := range runs {
+		if last := len(merged) - 1; last >= 0 && run.Physical <= merged[last].Physical+merged[last].Length {
+			if end := run.Physical + run.Length; end > merged[last].Physical+merged[last].Length {
+				merged[last].Length = end - merged[last].Physical
+			}
+			continue
+		}
+		merged = append(merged, Run{Physical: run.Physical, Length: run.Length})
+	}
+	return merged
+}
+
+// Mount returns a file system whose root holds the root directory of each of fss, under the
+// name it is mapped to.
+func Mount(fss map[string]*FS) *FS {
+	root := NewDir(".", time.Time{}, false)
+	for name, f := range fss {
+		dir := *f.root
+		dir.name = name
+		root.Add(&dir)
+	}
+	return New(root)
+}
@@ -0,0 +1,412 @@
+// Package ewf reads the media acquired in EnCase evidence files (EWF-E01), split in segments
+// named E01, E02... E99, EAA... EZZ.
+package ewf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNotEWF   = errors.New("ewf: not an EWF segment")
+	ErrCorrupt  = errors.New("ewf: corrupt evidence file")
+	ErrNoHash   = errors.New("ewf: no MD5 stored in the evidence file")
+	ErrMismatch = errors.New("ewf: MD5 mismatch")
+)
+
+var signature = []byte("EVF\x09\x0d\x0a\xff\x00")
+
+const (
+	fileHeaderSize = 13
+	descriptorSize = 76
+
+	compressedFlag = 0x80000000
+
+	// cacheSize is the number of decompressed chunks kept in memory.
+	cacheSize = 8
+)
+
+type chunk struct {
+	segment    int
+	offset     int64
+	end        int64 // bound of the stored chunk, used for the compressed chunks
+	compressed bool
+}
+
+// Reader reads the acquired media. It is safe for concurrent use.
+type Reader struct {
+	segments  []io.ReaderAt
+	closers   []io.Closer
+	chunks    []chunk
+	chunkSize int64
+	size      int64
+	md5       []byte
+
+	mu    sync.Mutex
+	cache map[int][]byte
+	order []int
+}
+
+// Open opens the evidence file whose first segment is path, such as image.E01, together with
+// the next segments found in the same directory.
+func Open(path string) (*Reader, error) {
+	var files []io.ReaderAt
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+
+	for n := 1; ; n++ {
+		name := path
+		if n > 1 {
+			var ok bool
+			if name, ok = segmentPath(path, n); !ok {
+				break
+			}
+		}
+
+		f, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) && n > 1 {
+			break
+		}
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, f)
+		closers = append(closers, f)
+	}
+
+	r, err := NewReader(files...)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	r.closers = closers
+	return r, nil
+}
+
+// segmentPath returns the path of the segment n, whose extension follows E01...E99, EAA...EZZ,
+// keeping the case of the first segment.
+func segmentPath(first string, n int) (string, bool) {
+	ext := filepath.Ext(first)
+	if len(ext) != 4 {
+		return "", false
+	}
+
+	var suffix string
+	switch {
+	case n <= 99:
+		suffix = fmt.Sprintf("%02d", n)
+	case n-100 < 26*26:
+		suffix = string([]byte{byte('A' + (n-100)/26), byte('A' + (n-100)%26)})
+	default:
+		return "", false
+	}
+	if ext[1] >= 'a' && ext[1] <= 'z' {
+		suffix = strings.ToLower(suffix)
+	}
+	return strings.TrimSuffix(first, ext) + ext[:2] + suffix, true
+}
+
+// IsEWF reports whether header, the first bytes of a file, is the header of an EWF segment.
+func IsEWF(header []byte) bool {
+	return bytes.HasPrefix(header, signature)
+}
+
+// NewReader reads the evidence file made of segments, in order.
+func NewReader(segments ...io.ReaderAt) (*Reader, error) {
+	r := &Reader{
+		segments: segments,
+		cache:    make(map[int][]byte),
+	}
+
+	var done bool
+	for i, seg := range segments {
+		last, err := r.readSegment(i, seg)
+		if err != nil {
+			return nil, fmt.Errorf("ewf: segment %d: %w", i+1, err)
+		}
+		if last {
+			done = true
+			break
+		}
+	}
+	if !done {
+		return nil, fmt.Errorf("%w: missing segments after %d", ErrCorrupt, len(segments))
+	}
+	if r.chunkSize == 0 || int64(len(r.chunks))*r.chunkSize < r.size {
+		return nil, fmt.Errorf("%w: %d chunks for %d bytes", ErrCorrupt, len(r.chunks), r.size)
+	}
+	return r, nil
+}
+
+// readSegment walks the sections of a segment and reports whether it is the last one.
+func (r *Reader) readSegment(index int, seg io.ReaderAt) (bool, error) {
+	header := make([]byte, fileHeaderSize)
+	if _, err := seg.ReadAt(header, 0); err != nil {
+		return false, err
+	}
+	if !IsEWF(header) {
+		return false, ErrNotEWF
+	}
+	if n := int(binary.LittleEndian.Uint16(header[9:])); n != index+1 {
+		return false, fmt.Errorf("%w: segment number %d", ErrCorrupt, n)
+	}
+
+	var sectorsEnd int64
+	desc := make([]byte, descriptorSize)
+
+	for off := int64(fileHeaderSize); ; {
+		if _, err := seg.ReadAt(desc, off); err != nil {
+			return false, err
+		}
+		if adler32.Checksum(desc[:72]) != binary.LittleEndian.Uint32(desc[72:]) {
+			return false, fmt.Errorf("%w: section at %d", ErrCorrupt, off)
+		}
+
+		typ := string(bytes.TrimRight(desc[:16], "\x00"))
+		next := int64(binary.LittleEndian.Uint64(desc[16:]))
+		size := int64(binary.LittleEndian.Uint64(desc[24:]))
+		data := off + descriptorSize
+
+		switch typ {
+		case "done":
+			return true, nil
+		case "next":
+			return false, nil
+		case "volume", "disk", "data":
+			if err := r.readVolume(seg, data, size-descriptorSize); err != nil {
+				return false, err
+			}
+		case "sectors":
+			sectorsEnd = off + size
+		case "table":
+			if err := r.readTable(index, seg, data, sectorsEnd); err != nil {
+				return false, err
+			}
+		case "hash", "digest":
+			sum := make([]byte, md5.Size)
+			if _, err := seg.ReadAt(sum, data); err != nil {
+				return false, err
+			}
+			if !bytes.Equal(sum, make([]byte, md5.Size)) {
+				r.md5 = sum
+			}
+		}
+
+		if next <= off {
+			return false, fmt.Errorf("%w: section %q at %d", ErrCorrupt, typ, off)
+		}
+		off = next
+	}
+}
+
+func (r *Reader) readVolume(seg io.ReaderAt, off, size int64) error {
+	if size < 24 {
+		return fmt.Errorf("%w: volume section", ErrCorrupt)
+	}
+	b := make([]byte, 24)
+	if _, err := seg.ReadAt(b, off); err != nil {
+		return err
+	}
+
+	sectorsPerChunk := int64(binary.LittleEndian.Uint32(b[8:]))
+	bytesPerSector := int64(binary.LittleEndian.Uint32(b[12:]))
+	sectors := int64(binary.LittleEndian.Uint64(b[16:]))
+	chunkSize := sectorsPerChunk * bytesPerSector
+	if chunkSize <= 0 || chunkSize > 64<<20 || sectors < 0 {
+		return fmt.Errorf("%w: volume section", ErrCorrupt)
+	}
+	if r.chunkSize != 0 && r.chunkSize != chunkSize {
+		return fmt.Errorf("%w: chunk size changed", ErrCorrupt)
+	}
+
+	r.chunkSize = chunkSize
+	r.size = sectors * bytesPerSector
+	return nil
+}
+
+// readTable adds the chunks of a table section. The chunk offsets are relative to the base
+// offset of the table, and the last chunk ends with the sectors section before it.
+func (r *Reader) readTable(index int, seg io.ReaderAt, off, sectorsEnd int64) error {
+	header := make([]byte, 24)
+	if _, err := seg.ReadAt(header, off); err != nil {
+		return err
+	}
+	if adler32.Checksum(header[:20]) != binary.LittleEndian.Uint32(header[20:]) {
+		return fmt.Errorf("%w: table header", ErrCorrupt)
+	}
+
+	count := int64(binary.LittleEndian.Uint32(header[0:]))
+	base := int64(binary.LittleEndian.Uint64(header[8:]))
+	if count > 1<<20 {
+		return fmt.Errorf("%w: table of %d entries", ErrCorrupt, count)
+	}
+
+	entries := make([]byte, count*4)
+	if _, err := seg.ReadAt(entries, off+24); err != nil {
+		return err
+	}
+
+	first := len(r.chunks)
+	for i := int64(0); i < count; i++ {
+		e := binary.LittleEndian.Uint32(entries[i*4:])
+		c := chunk{
+			segment:    index,
+			offset:     base + int64(e&^compressedFlag),
+			compressed: e&compressedFlag != 0,
+			end:        sectorsEnd,
+		}
+		if len(r.chunks) > first {
+			r.chunks[len(r.chunks)-1].end = c.offset
+		}
+		r.chunks = append(r.chunks, c)
+	}
+	return nil
+}
+
+// Size returns the size of the acquired media.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// MD5 returns the hash of the media stored at the acquisition, or nil if there is none.
+func (r *Reader) MD5() []byte {
+	return r.md5
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("ewf: negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if remaining := r.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		err = io.EOF
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		data, cerr := r.readChunk(int(pos / r.chunkSize))
+		if cerr != nil {
+			return n, cerr
+		}
+		n += copy(p[n:], data[pos%r.chunkSize:])
+	}
+	return n, err
+}
+
+// readChunk returns the content of the chunk i, decompressed or checked against its checksum.
+func (r *Reader) readChunk(i int) ([]byte, error) {
+	r.mu.Lock()
+	data, ok := r.cache[i]
+	r.mu.Unlock()
+	if ok {
+		return data, nil
+	}
+
+	length := r.chunkSize
+	if rest := r.size - int64(i)*r.chunkSize; rest < length {
+		length = rest
+	}
+
+	c := r.chunks[i]
+	seg := r.segments[c.segment]
+	if c.compressed {
+		if c.end <= c.offset {
+			return nil, fmt.Errorf("%w: chunk %d", ErrCorrupt, i)
+		}
+		zr, err := zlib.NewReader(io.NewSectionReader(seg, c.offset, c.end-c.offset))
+		if err != nil {
+			return nil, fmt.Errorf("ewf: chunk %d: %v", i, err)
+		}
+		data, err = io.ReadAll(io.LimitReader(zr, r.chunkSize))
+		if err == nil {
+			// reading to the end checks the Adler-32 of the stream.
+			var n int
+			n, err = zr.Read(make([]byte, 1))
+			if n > 0 {
+				err = errors.New("chunk too large")
+			} else if errors.Is(err, io.EOF) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ewf: chunk %d: %v", i, err)
+		}
+	} else {
+		data = make([]byte, length+4)
+		if _, err := seg.ReadAt(data, c.offset); err != nil {
+			return nil, fmt.Errorf("ewf: chunk %d: %v", i, err)
+		}
+		sum := binary.LittleEndian.Uint32(data[length:])
+		data = data[:length]
+		if adler32.Checksum(data) != sum {
+			return nil, fmt.Errorf("%w: chunk %d checksum", ErrCorrupt, i)
+		}
+	}
+	if int64(len(data)) < length {
+		return nil, fmt.Errorf("%w: chunk %d is short", ErrCorrupt, i)
+	}
+	data = data[:length]
+
+	r.mu.Lock()
+	if _, ok := r.cache[i]; ok {
+		r.mu.Unlock()
+		return data, nil
+	}
+	if len(r.order) == cacheSize {
+		delete(r.cache, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.cache[i] = data
+	r.order = append(r.order, i)
+	r.mu.Unlock()
+
+	return data, nil
+}
+
+// Verify reads the whole media and compares its MD5 with the one stored at the acquisition.
+func (r *Reader) Verify() error {
+	if r.md5 == nil {
+		return ErrNoHash
+	}
+
+	h := md5.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, r.size)); err != nil {
+		return err
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, r.md5) {
+		return fmt.Errorf("%w: got %x, want %x", ErrMismatch, sum, r.md5)
+	}
+	return nil
+}
+
+// Close closes the segment files opened by Open.
+func (r *Reader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,289 @@
+package ewf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"hash/adler32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writer builds the segments of an evidence file.
+type writer struct {
+	chunkSize    int
+	chunksPerSeg int
+	compressed   func(i int) bool
+	withHash     bool
+	corruptChunk int // index of a chunk whose content is altered, or -1
+	segments     [][]byte
+}
+
+func section(buf *bytes.Buffer, typ string, data []byte) {
+	off := buf.Len()
+	desc := make([]byte, descriptorSize)
+	copy(desc, typ)
+	size := descriptorSize + len(data)
+	next := off + size
+	if typ == "done" || typ == "next" {
+		next = off
+	}
+	binary.LittleEndian.PutUint64(desc[16:], uint64(next))
+	binary.LittleEndian.PutUint64(desc[24:], uint64(size))
+	binary.LittleEndian.PutUint32(desc[72:], adler32.Checksum(desc[:72]))
+	buf.Write(desc)
+	buf.Write(data)
+}
+
+func (w *writer) write(media []byte) [][]byte {
+	sectorSize := 512
+	chunks := (len(media) + w.chunkSize - 1) / w.chunkSize
+
+	volume := make([]byte, 1052)
+	volume[0] = 0x01
+	binary.LittleEndian.PutUint32(volume[4:], uint32(chunks))
+	binary.LittleEndian.PutUint32(volume[8:], uint32(w.chunkSize/sectorSize))
+	binary.LittleEndian.PutUint32(volume[12:], uint32(sectorSize))
+	binary.LittleEndian.PutUint64(volume[16:], uint64(len(media)/sectorSize))
+
+	var segments [][]byte
+	for first, n := 0, 1; first < chunks; n++ {
+		last := first + w.chunksPerSeg
+		if last > chunks {
+			last = chunks
+		}
+
+		var buf bytes.Buffer
+		buf.Write(signature)
+		buf.WriteByte(1)
+		binary.Write(&buf, binary.LittleEndian, uint16(n))
+		buf.Write([]byte{0, 0})
+
+		if n == 1 {
+			var header bytes.Buffer
+			zw := zlib.NewWriter(&header)
+			zw.Write([]byte("1\nmain\nc\tn\ta\te\tt\n1\t1\ttest\texaminer\tnotes\n\n"))
+			zw.Close()
+			section(&buf, "header", header.Bytes())
+			section(&buf, "volume", volume)
+		} else {
+			section(&buf, "data", volume)
+		}
+
+		// the chunks are stored after the descriptor of the sectors section.
+		sectorsOff := buf.Len()
+		var data bytes.Buffer
+		var offsets []uint32
+		for i := first; i < last; i++ {
+			end := (i + 1) * w.chunkSize
+			if end > len(media) {
+				end = len(media)
+			}
+			content := append([]byte(nil), media[i*w.chunkSize:end]...)
+
+			offset := uint32(sectorsOff + descriptorSize + data.Len())
+			if w.compressed(i) {
+				offset |= compressedFlag
+				zw := zlib.NewWriter(&data)
+				if i == w.corruptChunk {
+					content[0] ^= 0xff
+				}
+				zw.Write(content)
+				zw.Close()
+			} else {
+				sum := adler32.Checksum(content)
+				if i == w.corruptChunk {
+					content[0] ^= 0xff
+					sum = adler32.Checksum(content)
+				}
+				data.Write(content)
+				binary.Write(&data, binary.LittleEndian, sum)
+			}
+			offsets = append(offsets, offset)
+		}
+		section(&buf, "sectors", data.Bytes())
+
+		table := make([]byte, 24, 24+len(offsets)*4+4)
+		binary.LittleEndian.PutUint32(table[0:], uint32(len(offsets)))
+		binary.LittleEndian.PutUint32(table[20:], adler32.Checksum(table[:20]))
+		for _, o := range offsets {
+			table = binary.LittleEndian.AppendUint32(table, o)
+		}
+		table = binary.LittleEndian.AppendUint32(table, adler32.Checksum(table[24:]))
+		section(&buf, "table", table)
+		section(&buf, "table2", table)
+
+		if last == chunks {
+			if w.withHash {
+				sum := md5.Sum(media)
+				hash := make([]byte, 36)
+				copy(hash, sum[:])
+				section(&buf, "hash", hash)
+			}
+			section(&buf, "done", nil)
+		} else {
+			section(&buf, "next", nil)
+		}
+
+		segments = append(segments, buf.Bytes())
+		first = last
+	}
+	return segments
+}
+
+func testMedia(size int) []byte {
+	media := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(media[:size/2])
+	// the second half compresses well.
+	for i := size / 2; i < size; i++ {
+		media[i] = byte(i / 1000)
+	}
+	return media
+}
+
+func readers(segments [][]byte) []io.ReaderAt {
+	rs := make([]io.ReaderAt, len(segments))
+	for i, s := range segments {
+		rs[i] = bytes.NewReader(s)
+	}
+	return rs
+}
+
+func TestReader(t *testing.T) {
+	media := testMedia(40 * 4096)
+	tests := []struct {
+		name         string
+		chunksPerSeg int
+		compressed   func(int) bool
+	}{
+		{"compressed", 100, func(int) bool { return true }},
+		{"uncompressed", 100, func(int) bool { return false }},
+		{"mixed segments", 7, func(i int) bool { return i%3 != 0 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &writer{chunkSize: 4096, chunksPerSeg: tt.chunksPerSeg, compressed: tt.compressed, withHash: true, corruptChunk: -1}
+			r, err := NewReader(readers(w.write(media))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Size() != int64(len(media)) {
+				t.Fatalf("size %d, want %d", r.Size(), len(media))
+			}
+
+			// reads that cross the chunk boundaries.
+			for _, off := range []int64{0, 4000, 4096*7 - 10, int64(len(media)) - 100} {
+				p := make([]byte, 5000)
+				n, err := r.ReadAt(p, off)
+				if err != nil && !errors.Is(err, io.EOF) {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(p[:n], media[off:off+int64(n)]) {
+					t.Errorf("ReadAt(%d): content mismatch", off)
+				}
+			}
+
+			if err = r.Verify(); err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	media := testMedia(16 * 4096)
+
+	w := &writer{chunkSize: 4096, chunksPerSeg: 100, compressed: func(i int) bool { return i%2 == 0 }, withHash: true, corruptChunk: 5}
+	r, err := NewReader(readers(w.write(media))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Verify(); !errors.Is(err, ErrMismatch) {
+		t.Errorf("Verify: got %v, want %v", err, ErrMismatch)
+	}
+
+	w = &writer{chunkSize: 4096, chunksPerSeg: 100, compressed: func(int) bool { return true }, corruptChunk: -1}
+	r, err = NewReader(readers(w.write(media))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Verify(); !errors.Is(err, ErrNoHash) {
+		t.Errorf("Verify: got %v, want %v", err, ErrNoHash)
+	}
+}
+
+func TestReaderChecksum(t *testing.T) {
+	media := testMedia(8 * 4096)
+	w := &writer{chunkSize: 4096, chunksPerSeg: 100, compressed: func(int) bool { return false }, corruptChunk: -1}
+	segments := w.write(media)
+
+	// a bit flipped in the third chunk, after its checksum was computed.
+	segments[0][bytes.Index(segments[0], media[2*4096:2*4096+64])] ^= 1
+
+	r, err := NewReader(readers(segments)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.ReadAt(make([]byte, 10), 2*4096); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("ReadAt: got %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	media := testMedia(30 * 4096)
+	w := &writer{chunkSize: 4096, chunksPerSeg: 8, compressed: func(int) bool { return true }, withHash: true, corruptChunk: -1}
+	segments := w.write(media)
+
+	dir := t.TempDir()
+	for i, s := range segments {
+		name, _ := segmentPath(filepath.Join(dir, "evidence.E01"), i+1)
+		if err := os.WriteFile(name, s, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := Open(filepath.Join(dir, "evidence.E01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err = r.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// without its last segment the evidence file is incomplete.
+	name, _ := segmentPath(filepath.Join(dir, "evidence.E01"), len(segments))
+	os.Remove(name)
+	if _, err = Open(filepath.Join(dir, "evidence.E01")); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Open: got %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestSegmentPath(t *testing.T) {
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{1, "img.E01"},
+		{2, "img.E02"},
+		{99, "img.E99"},
+		{100, "img.EAA"},
+		{101, "img.EAB"},
+		{126, "img.EBA"},
+	}
+	for _, tt := range tests {
+		if got, _ := segmentPath("img.E01", tt.n); got != tt.want {
+			t.Errorf("segmentPath(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+	if got, _ := segmentPath("img.e01", 2); got != "img.e02" {
+		t.Errorf("segmentPath(lower case) = %s", got)
+	}
+}
@@ -0,0 +1,237 @@
+/*
+Package mih implements multi-index hashing, an index that answers hamming distance range
+queries over binary codes without comparing the code against every stored item.
+
+Each code of n 64-bit words is split into 4n substrings of 16 bits, and every substring is
+indexed in its own table. By the pigeonhole principle, if two codes are at most r bits apart,
+at least one pair of their substrings is at most r/4n bits apart, so only the buckets close to
+the substrings of the searched code must be checked.
+
+	idx := mih.New[string](1)
+	idx.Add([]uint64{0xf0f0f0f0f0f0f0f0}, "img.jpg")
+	for _, it := range idx.Search([]uint64{0xf0f0f0f0f0f0f0f1}, 10) {
+		fmt.Println(it.Value, it.Distance)
+	}
+*/
+package mih
+
+import (
+	"math/bits"
+	"sort"
+)
+
+const (
+	substringBits  = 16
+	substringsWord = 64 / substringBits
+)
+
+// Item represents a code/value pair found by a search and its distance to the searched code.
+type Item[V any] struct {
+	Key      []uint64
+	Value    V
+	Distance int
+}
+
+// Index stores values indexed by a binary code with a fixed number of 64-bit words.
+type Index[V any] struct {
+	words  int
+	keys   []uint64 // flattened codes, words per entry
+	values []V
+	tables []map[uint16][]int32
+}
+
+// New creates an Index instance for codes of the given number of 64-bit words.
+func New[V any](words int) *Index[V] {
+	if words < 1 {
+		words = 1
+	}
+
+	tables := make([]map[uint16][]int32, words*substringsWord)
+	for i := range tables {
+		tables[i] = make(map[uint16][]int32)
+	}
+
+	return &Index[V]{
+		words:  words,
+		tables: tables,
+	}
+}
+
+// Words returns the number of 64-bit words of the indexed codes.
+func (idx *Index[V]) Words() int {
+	return idx.words
+}
+
+// Len returns the number of codes stored in the index.
+func (idx *Index[V]) Len() int {
+	return len(idx.values)
+}
+
+// Add stores value under key. If the key is already present, its value is replaced.
+// Keys with a different number of words are ignored.
+func (idx *Index[V]) Add(key []uint64, value V) {
+	if len(key) != idx.words {
+		return
+	}
+
+	if i, ok := idx.find(key); ok {
+		idx.values[i] = value
+		return
+	}
+
+	entry := int32(len(idx.values))
+	idx.keys = append(idx.keys, key...)
+	idx.values = append(idx.values, value)
+
+	for t := range idx.tables {
+		sub := substring(key, t)
+		idx.tables[t][sub] = append(idx.tables[t][sub], entry)
+	}
+}
+
+// Get returns the value stored under key.
+func (idx *Index[V]) Get(key []uint64) (V, bool) {
+	if i, ok := idx.find(key); ok {
+		return idx.values[i], true
+	}
+
+	var zero V
+	return zero, false
+}
+
+// Search returns every item whose key is at most radius bits away from key, in the order they
+// were added to the index.
+func (idx *Index[V]) Search(key []uint64, radius int) []Item[V] {
+	if len(key) != idx.words || radius < 0 || len(idx.values) == 0 {
+		return nil
+	}
+
+	subRadius := radius / len(idx.tables)
+	probes := masksWithin(subRadius)
+
+	// probing the buckets costs more than scanning everything when the radius is large.
+	if len(probes)*len(idx.tables) >= len(idx.values) {
+		return idx.scan(key, radius)
+	}
+
+	var found []int32
+	for t, table := range idx.tables {
+		sub := substring(key, t)
+
+		for _, mask := range probes {
+			for _, entry := range table[sub^mask] {
+				// an entry close enough in an earlier table was already checked.
+				if idx.seenBefore(entry, key, t, subRadius) {
+					continue
+				}
+				if d := idx.distance(entry, key); d <= radius {
+					found = append(found, entry)
+				}
+			}
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i] < found[j] })
+
+	items := make([]Item[V], 0, len(found))
+	for _, entry := range found {
+		items = append(items, idx.item(entry, key))
+	}
+	return items
+}
+
+// Range calls fn for every key/value pair stored in the index, in the order they were added,
+// stopping as soon as fn returns false.
+func (idx *Index[V]) Range(fn func(key []uint64, value V) bool) {
+	for i := range idx.values {
+		if !fn(idx.key(int32(i)), idx.values[i]) {
+			return
+		}
+	}
+}
+
+func (idx *Index[V]) scan(key []uint64, radius int) []Item[V] {
+	var items []Item[V]
+	for i := range idx.values {
+		if d := idx.distance(int32(i), key); d <= radius {
+			items = append(items, idx.item(int32(i), key))
+		}
+	}
+	return items
+}
+
+func (idx *Index[V]) find(key []uint64) (int32, bool) {
+	if len(key) != idx.words {
+		return -1, false
+	}
+
+	for _, entry := range idx.tables[0][substring(key, 0)] {
+		if idx.distance(entry, key) == 0 {
+			return entry, true
+		}
+	}
+	return -1, false
+}
+
+func (idx *Index[V]) seenBefore(entry int32, key []uint64, table int, subRadius int) bool {
+	stored := idx.key(entry)
+	for t := 0; t < table; t++ {
+		if bits.OnesCount16(substring(stored, t)^substring(key, t)) <= subRadius {
+			return true
+		}
+	}
+	return false
+}
+
+func (idx *Index[V]) key(entry int32) []uint64 {
+	start := int(entry) * idx.words
+	return idx.keys[start : start+idx.words : start+idx.words]
+}
+
+func (idx *Index[V]) item(entry int32, key []uint64) Item[V] {
+	return Item[V]{
+		Key:      idx.key(entry),
+		Value:    idx.values[entry],
+		Distance: idx.distance(entry, key),
+	}
+}
+
+func (idx *Index[V]) distance(entry int32, key []uint64) int {
+	d := 0
+	for i, w := range idx.key(entry) {
+		d += bits.OnesCount64(w ^ key[i])
+	}
+	return d
+}
+
+// masks holds every 16-bit mask sorted by the number of bits set, and maskCount[r] is the
+// number of masks with at most r bits set.
+var masks, maskCount = func() ([]uint16, []int) {
+	masks := make([]uint16, 0, 1<<substringBits)
+	count := make([]int, substringBits+1)
+
+	for r := 0; r <= substringBits; r++ {
+		for m := 0; m < 1<<substringBits; m++ {
+			if bits.OnesCount16(uint16(m)) == r {
+				masks = append(masks, uint16(m))
+			}
+		}
+		count[r] = len(masks)
+	}
+	return masks, count
+}()
+
+// masksWithin returns every 16-bit mask with at most radius bits set.
+func masksWithin(radius int) []uint16 {
+	if radius > substringBits {
+		radius = substringBits
+	}
+	return masks[:maskCount[radius]]
+}
+
+// substring returns the t-th 16-bit substring of key, starting from the most significant bits.
+func substring(key []uint64, t int) uint16 {
+	word := key[t/substringsWord]
+	shift := uint(64 - substringBits*(t%substringsWord+1))
+	return uint16(word >> shift)
+}
@@ -0,0 +1,92 @@
+package mih
+
+import (
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+func distance(a, b []uint64) int {
+	d := 0
+	for i := range a {
+		d += bits.OnesCount64(a[i] ^ b[i])
+	}
+	return d
+}
+
+func randomKey(rnd *rand.Rand, words int) []uint64 {
+	key := make([]uint64, words)
+	for i := range key {
+		key[i] = rnd.Uint64()
+	}
+	return key
+}
+
+func flipBits(rnd *rand.Rand, key []uint64, n int) []uint64 {
+	near := append([]uint64(nil), key...)
+	for i := 0; i < n; i++ {
+		b := rnd.Intn(len(near) * 64)
+		near[b/64] ^= 1 << uint(b%64)
+	}
+	return near
+}
+
+func TestSearch(t *testing.T) {
+	for _, words := range []int{1, 4} {
+		rnd := rand.New(rand.NewSource(1))
+		idx := New[int](words)
+		keys := make([][]uint64, 3000)
+
+		for i := range keys {
+			keys[i] = randomKey(rnd, words)
+			idx.Add(keys[i], i)
+		}
+
+		if idx.Len() != len(keys) {
+			t.Fatalf("expected %d keys, got %d", len(keys), idx.Len())
+		}
+
+		for q := 0; q < 200; q++ {
+			key := randomKey(rnd, words)
+			if q%2 == 0 {
+				key = flipBits(rnd, keys[rnd.Intn(len(keys))], rnd.Intn(24))
+			}
+
+			for _, radius := range []int{0, 3, 10, 20, 40} {
+				var expected []int
+				for i, k := range keys {
+					if distance(k, key) <= radius {
+						expected = append(expected, i)
+					}
+				}
+
+				items := idx.Search(key, radius)
+				if len(items) != len(expected) {
+					t.Fatalf("words %d, radius %d: expected %v, got %v", words, radius, expected, items)
+				}
+				for i, it := range items {
+					if it.Value != expected[i] || it.Distance != distance(it.Key, key) {
+						t.Fatalf("words %d, radius %d: expected %v, got %v", words, radius, expected, items)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestAddReplace(t *testing.T) {
+	idx := New[string](1)
+	idx.Add([]uint64{0xff}, "a")
+	idx.Add([]uint64{0xff}, "b")
+	idx.Add([]uint64{0xff, 0x00}, "c")
+
+	if idx.Len() != 1 {
+		t.Fatalf("expected 1 key, got %d", idx.Len())
+	}
+	if v, ok := idx.Get([]uint64{0xff}); !ok || v != "b" {
+		t.Fatalf("expected b, got %q", v)
+	}
+	if _, ok := idx.Get([]uint64{0xfe}); ok {
+		t.Fatal("unexpected key 0xfe")
+	}
+}